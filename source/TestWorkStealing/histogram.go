@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"proj3/constants"
+	"proj3/png"
+	ws "proj3/WorkStealing"
+)
+
+// rows of an image counted by each histogram task
+const histogramRows = 64
+
+// histogramTask implements `ws.Mapper`: counts the luminance (8-bit scale, mean of the channels)
+// of the pixels in rows [yStart, yEnd) of an image into its own histogram.
+type histogramTask struct {
+	pixels 	*image.RGBA64
+	yStart 	int
+	yEnd 	int
+	taskID 	int
+	counts 	[256]int
+}
+
+func (ht *histogramTask) Execute(wID int) {
+	bounds := ht.pixels.Bounds()
+	for y := ht.yStart; y < ht.yEnd; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ht.counts[luminance(ht.pixels, x, y)]++
+		}
+	}
+}
+
+func (ht *histogramTask) GetTaskID() int {
+	return ht.taskID
+}
+
+func (ht *histogramTask) Result() ws.Result {
+	return &ht.counts
+}
+
+// combineHistograms adds the counts of histogram 'b' to 'a' and returns 'a'
+func combineHistograms(a, b ws.Result) ws.Result {
+	histA, histB := a.(*[256]int), b.(*[256]int)
+	for i := range histA {
+		histA[i] += histB[i]
+	}
+	return histA
+}
+
+// luminance returns the luminance of pixel (x, y) in 8-bit scale
+func luminance(pixels *image.RGBA64, x, y int) int {
+	c := pixels.RGBA64At(x, y)
+	return (int(c.R) + int(c.G) + int(c.B)) / 3 >> 8
+}
+
+// runHistogram computes the luminance histogram of all images in 'dataDir' with `ws.Pool.MapReduce`,
+// one task per block of `histogramRows` rows, and checks it against a sequential reference.
+// Usage: go run ./TestWorkStealing histogram [data_dir] [workers]
+func runHistogram(dataDir string, nWorkers int) {
+	paths, _ := filepath.Glob(filepath.Join(constants.InDir, dataDir, "*.png"))
+	if len(paths) == 0 {
+		fmt.Printf("No images found in %s\n", filepath.Join(constants.InDir, dataDir))
+		os.Exit(1)
+	}
+
+	var tasks []ws.Runnable
+	var reference [256]int
+	for _, path := range paths {
+		img, err := png.Load(path)
+		if err != nil {
+			fmt.Printf("Error loading image %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		pixels, _ := img.GetInputOutputPixels()
+		bounds := pixels.Bounds()
+
+		// sequential reference
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				reference[luminance(pixels, x, y)]++
+			}
+		}
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y += histogramRows {
+			yEnd := y + histogramRows
+			if yEnd > bounds.Max.Y {
+				yEnd = bounds.Max.Y
+			}
+			tasks = append(tasks, &histogramTask{pixels: pixels, yStart: y, yEnd: yEnd, taskID: len(tasks)})
+		}
+	}
+
+	histogram := ws.NewPool(nWorkers).MapReduce(tasks, combineHistograms).(*[256]int)
+	total := 0
+	for _, count := range histogram {
+		total += count
+	}
+	fmt.Printf("Images: %d\nTasks: %d\nPixels: %d\n", len(paths), len(tasks), total)
+	if *histogram != reference {
+		fmt.Println("Histogram differs from the sequential reference")
+		os.Exit(1)
+	}
+	fmt.Println("Histogram matches the sequential reference")
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"strconv"
 	ws "proj3/WorkStealing"
+	"proj3/utils"
 	"sync"
 	"time"
 )
@@ -50,8 +52,106 @@ func (st *SleepTask) GetTaskID() int {
 }
 
 
+// runStealTest checks no task runs twice (or never) with each steal policy when all tasks start in one queue,
+// and that stealing half of the victim's queue needs fewer steal attempts than stealing one task.
+// Usage: go run -race ./TestWorkStealing steal
+func runStealTest() {
+	numTasks := 100000
+	numWorkers := 8
+
+	attempts := make(map[string]int64)
+	for _, policy := range []string{ws.StealOne, ws.StealHalf} {
+		duplicates, lost, policyAttempts := ws.StealTest(numTasks, numWorkers, policy)
+		attempts[policy] = policyAttempts
+		fmt.Printf("Policy %s: %d duplicates, %d lost, %d steal attempts\n", policy, duplicates, lost, policyAttempts)
+		if duplicates > 0 || lost > 0 {
+			os.Exit(1)
+		}
+	}
+	if attempts[ws.StealHalf] >= attempts[ws.StealOne] {
+		fmt.Println("Stealing half did not reduce the steal attempts")
+		os.Exit(1)
+	}
+}
+
+// runEmptyPopTest checks popping from an empty queue, as workers without tasks do, leaves it consistent.
+// Usage: go run -race ./TestWorkStealing empty
+func runEmptyPopTest() {
+	numPops := 1000000
+	numThieves := 8
+
+	inconsistencies := ws.EmptyPopTest(numPops, numThieves)
+	fmt.Printf("Pops on the empty queue: %d\nInconsistencies: %d\n", numPops, inconsistencies)
+	if inconsistencies > 0 {
+		os.Exit(1)
+	}
+}
+
+// runCapacityTest checks the max capacity reported by a queue matches its capacity after several resizes.
+// Usage: go run -race ./TestWorkStealing capacity
+func runCapacityTest() {
+	numTasks := 100000
+	numReaders := 4
+	logCapacity := 4 // 16 => resized 13 times to hold all tasks
+
+	maxCapacity, capacity, inconsistencies := ws.CapacityTest(numTasks, numReaders, logCapacity)
+	fmt.Printf("Initial capacity: %d\nMax capacity reached: %d\nFinal capacity: %d\nInconsistencies: %d\n",
+		1<<logCapacity, maxCapacity, capacity, inconsistencies)
+	if inconsistencies > 0 {
+		os.Exit(1)
+	}
+}
+
+// runQueueTest checks every task enqueued to the lock-free queue of the parfiles workers is dequeued exactly once
+// and in order, with many producers and consumers.
+// Usage: go run -race ./TestWorkStealing queue
+func runQueueTest() {
+	numTasks := 1000000
+	numProducers := 4
+	numConsumers := 8
+
+	duplicates, lost, outOfOrder := utils.QueueStressTest(numTasks, numProducers, numConsumers)
+	fmt.Printf("Total tasks: %d\nTotal duplicates: %d\nTotal lost: %d\nTotal out of order: %d\n",
+		numTasks, duplicates, lost, outOfOrder)
+	if duplicates > 0 || lost > 0 || outOfOrder > 0 {
+		os.Exit(1)
+	}
+}
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "steal" {
+		runStealTest()
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "empty" {
+		runEmptyPopTest()
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "capacity" {
+		runCapacityTest()
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "queue" {
+		runQueueTest()
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "histogram" {
+		dataDir, nWorkers := "small", 4
+		if len(os.Args) > 2 {
+			dataDir = os.Args[2]
+		}
+		if len(os.Args) > 3 {
+			nWorkers, _ = strconv.Atoi(os.Args[3])
+		}
+		runHistogram(dataDir, nWorkers)
+		return
+	}
+
 	file, err := os.Create("log.txt")
 	if err != nil {
 		panic(err)
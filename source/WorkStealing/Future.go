@@ -0,0 +1,98 @@
+package workstealing
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrPoolShutdown is the error of the futures whose function was not executed because the pool was shut down
+var ErrPoolShutdown = errors.New("pool shut down before the task was executed")
+
+// `PanicError` is the error of a future whose function panicked (see `Future.Wait`).
+type PanicError struct {
+	Value interface{}	// value passed to panic
+	Stack []byte		// stack of the goroutine when it panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panicked: %v", e.Value)
+}
+
+// `Future` is a `Runnable` executing a function and holding its result, so tasks of a `Pool` can report
+// results and errors back to the caller (see `Pool.Submit`).
+// A panic of the function is recovered and reported as a `*PanicError`, so it doesn't bring the worker down.
+type Future struct {
+	id 		int
+	fn 		func() (Result, error)
+	result 	Result
+	err 	error
+	done 	chan struct{}	// closed once the result is set
+}
+
+// NewFuture returns a `Future` executing 'fn', with 'id' as task id.
+func NewFuture(id int, fn func() (Result, error)) *Future {
+	return &Future{id: id, fn: fn, done: make(chan struct{})}
+}
+
+// Execute executes the function of the future and sets its result.
+// Obs: must be executed once; the pool executes each task once.
+func (f *Future) Execute(wID int) {
+	defer close(f.done)
+	defer func() {
+		if value := recover(); value != nil {
+			f.result, f.err = nil, &PanicError{Value: value, Stack: debug.Stack()}
+		}
+	}()
+	f.result, f.err = f.fn()
+}
+
+func (f *Future) GetTaskID() int { return f.id }
+
+// Done returns a channel closed once the result of the future is set.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the future and returns the result and error of its function;
+// a `*PanicError` if it panicked, or `ErrPoolShutdown` if it was never executed.
+func (f *Future) Wait() (Result, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+// cancel sets `ErrPoolShutdown` as the result of the future if it was not executed.
+// Obs: must only be called once no worker can execute the future anymore.
+func (f *Future) cancel() {
+	select {
+	case <-f.done:
+	default:
+		f.err = ErrPoolShutdown
+		close(f.done)
+	}
+}
+
+// Submit executes 'fn' in the pool in the background and returns its future (see `SubmitAll`).
+func (p *Pool) Submit(fn func() (Result, error)) *Future {
+	return p.SubmitAll([]func() (Result, error){fn})[0]
+}
+
+// SubmitAll executes 'fns' as a batch of the pool in the background and returns a future for each one, in order.
+// The id of each future is its index. Returns immediately; the caller awaits the futures (see `Future.Wait`).
+// Obs: the futures not executed because the pool was shut down (see `Shutdown`) give `ErrPoolShutdown`.
+func (p *Pool) SubmitAll(fns []func() (Result, error)) []*Future {
+	futures := make([]*Future, len(fns))
+	tasks := make([]Runnable, len(fns))
+	for i, fn := range fns {
+		futures[i] = NewFuture(i, fn)
+		tasks[i] = futures[i]
+	}
+	go func() {
+		// obs: once `Run` returns, no worker of the batch executes tasks anymore
+		p.Run(tasks)
+		for _, future := range futures {
+			future.cancel()
+		}
+	}()
+	return futures
+}
@@ -0,0 +1,187 @@
+package workstealing
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// `Result` is the partial result of a task in a `MapReduce`. eg: the histogram of a region of an image.
+type Result interface{}
+
+// `Mapper` is a `Runnable` producing a partial result once executed.
+type Mapper interface {
+	Runnable
+	Result() Result		// called after `Execute`, by the same worker
+}
+
+// `Pool` runs batches of tasks on 'nWorkers' work stealing `Worker`s, one goroutine per worker.
+// Workers live for the duration of a batch: they are started by `Run`/`MapReduce` and stopped once all tasks are done.
+// The pool is stopped by `Shutdown`; batches may run concurrently.
+type Pool struct {
+	nWorkers 	int		// number of workers executing the tasks
+	logCapacity int		// initial capacity (log2) of the queue of each worker
+	mu 			sync.Mutex
+	shutdown 	bool					// true once `Shutdown` is called; no more batches are started
+	batches 	map[*poolBatch]bool		// batches running
+}
+
+// poolBatch is a batch of tasks running in the pool
+type poolBatch struct {
+	workers 	[]*Worker
+	remaining 	atomic.Int64	// tasks of the batch not executed yet
+	done 		chan struct{}	// closed once all tasks are executed, to stop the workers
+	doneOnce 	sync.Once
+	finished 	chan struct{}	// closed once all workers returned
+}
+
+// NewPool returns a new `Pool` with 'nWorkers' workers (at least one).
+func NewPool(nWorkers int) *Pool {
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	return &Pool{nWorkers: nWorkers, logCapacity: 8, batches: make(map[*poolBatch]bool)}
+}
+
+// poolTask wraps a task of a batch to signal its completion and, in a `MapReduce`, to combine its result.
+type poolTask struct {
+	task 	Runnable
+	batch 	*poolBatch
+	partial []Result					// partial result of each worker; nil for `Run`
+	combine func(a, b Result) Result
+}
+
+// Execute executes the task and combines its result into the partial result of worker 'wID'.
+// Obs: each worker only writes its own entry of 'partial', so no lock is needed.
+func (pt *poolTask) Execute(wID int) {
+	pt.task.Execute(wID)
+	if mapper, ok := pt.task.(Mapper); ok && pt.partial != nil {
+		if pt.partial[wID] == nil {
+			pt.partial[wID] = mapper.Result()
+		} else {
+			pt.partial[wID] = pt.combine(pt.partial[wID], mapper.Result())
+		}
+	}
+	pt.batch.taskDone()
+}
+
+func (pt *poolTask) GetTaskID() int { return pt.task.GetTaskID() }
+
+// Run executes 'tasks' in the pool and returns when all of them are done, or the pool is shut down (see `Shutdown`).
+// Tasks are divided in blocks among the workers; idle workers steal from the others.
+// Obs: once the pool is shut down, returns without executing any task.
+func (p *Pool) Run(tasks []Runnable) {
+	p.run(tasks, nil, nil)
+}
+
+// MapReduce executes 'tasks' in the pool and returns their results merged with 'combine',
+// or nil if no task produced a result. Tasks must implement `Mapper`; others are executed but contribute nothing.
+// Each worker merges the results of the tasks it executes into its own partial result, avoiding a global lock;
+// the partial results of the workers are merged at the end.
+// Obs: 'combine' must be associative and commutative, since the order tasks are executed in is not deterministic.
+// It may modify and return 'a', but not 'b'.
+// Obs: if the pool is shut down without draining, only the results of the tasks executed are merged.
+func (p *Pool) MapReduce(tasks []Runnable, combine func(a, b Result) Result) Result {
+	partial := make([]Result, p.nWorkers)
+	p.run(tasks, partial, combine)
+
+	var result Result
+	for _, workerResult := range partial {
+		if workerResult == nil {
+			continue
+		}
+		if result == nil {
+			result = workerResult
+		} else {
+			result = combine(result, workerResult)
+		}
+	}
+	return result
+}
+
+// Shutdown stops the pool and returns once the workers of all batches running returned; later batches execute nothing.
+// - drain = true: the tasks of the batches running are executed first, i.e., it waits for `Run`/`MapReduce` to complete.
+// - drain = false: each worker returns once its current task is done (see `Worker.Stop`); tasks not started are
+//   discarded, and `Run`/`MapReduce` return with the tasks executed so far.
+// In both cases no task is executing when Shutdown returns. Safe to call more than once.
+// Obs: must not be called by a task of the pool; it would wait for itself.
+func (p *Pool) Shutdown(drain bool) {
+	p.mu.Lock()
+	p.shutdown = true
+	batches := make([]*poolBatch, 0, len(p.batches))
+	for batch := range p.batches {
+		batches = append(batches, batch)
+	}
+	p.mu.Unlock()
+
+	for _, batch := range batches {
+		if !drain {
+			// signal all workers first, so none keeps stealing the tasks of those being waited for
+			for _, worker := range batch.workers {
+				worker.signalStop()
+			}
+			for _, worker := range batch.workers {
+				worker.Stop()
+			}
+		}
+		<-batch.finished
+	}
+}
+
+// taskDone signals a task of the batch is done; the last one stops the workers of the batch
+func (b *poolBatch) taskDone() {
+	if b.remaining.Add(-1) == 0 {
+		b.stop()
+	}
+}
+
+// stop signals the workers of the batch to stop stealing and return
+func (b *poolBatch) stop() {
+	b.doneOnce.Do(func() { close(b.done) })
+}
+
+// run executes 'tasks' in the pool and waits for all of them (see `poolTask`), or for the workers to be stopped.
+func (p *Pool) run(tasks []Runnable, partial []Result, combine func(a, b Result) Result) {
+	queues := make([]*UDEqueue, p.nWorkers)
+	workers := make([]*Worker, p.nWorkers)
+	for i := range workers {
+		queues[i] = NewUDEqueue(p.logCapacity)
+		workers[i] = NewWorker(i, queues)
+	}
+	batch := &poolBatch{workers: workers, done: make(chan struct{}), finished: make(chan struct{})}
+	batch.remaining.Store(int64(len(tasks)))
+	if len(tasks) == 0 {
+		batch.stop()
+	}
+
+	// register the batch, so `Shutdown` can stop it
+	p.mu.Lock()
+	if p.shutdown {
+		p.mu.Unlock()
+		return
+	}
+	p.batches[batch] = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.batches, batch)
+		p.mu.Unlock()
+		close(batch.finished)
+	}()
+
+	// divide the tasks in blocks among the workers
+	blockSize := (len(tasks) + p.nWorkers - 1) / p.nWorkers
+	for i, task := range tasks {
+		workers[i/blockSize].AddTask(&poolTask{task: task, batch: batch, partial: partial, combine: combine})
+	}
+
+	// workers return once all tasks are done (`done`) or they are stopped by `Shutdown`
+	var wgWorkers sync.WaitGroup
+	wgWorkers.Add(p.nWorkers)
+	for _, worker := range workers {
+		go func(w *Worker) {
+			defer wgWorkers.Done()
+			w.Run(batch.done)
+		}(worker)
+	}
+	wgWorkers.Wait()
+}
@@ -0,0 +1,210 @@
+package workstealing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFutures(t *testing.T) {
+	pool := NewPool(4)
+	fns := make([]func() (Result, error), 50)
+	for i := range fns {
+		i := i
+		fns[i] = func() (Result, error) {
+			switch {
+			case i == 7:
+				panic(fmt.Sprintf("task %d failed", i))
+			case i%10 == 3:
+				return nil, fmt.Errorf("error of task %d", i)
+			}
+			return i * i, nil
+		}
+	}
+	futures := pool.SubmitAll(fns)
+	for i, future := range futures {
+		if future.GetTaskID() != i {
+			t.Errorf("future %d has id %d", i, future.GetTaskID())
+		}
+		result, err := future.Wait()
+		switch {
+		case i == 7:
+			var panicErr *PanicError
+			if !errors.As(err, &panicErr) || panicErr.Value != "task 7 failed" || !strings.Contains(string(panicErr.Stack), "TestFutures") {
+				t.Errorf("future 7: got %v, want the captured panic with its stack", err)
+			}
+		case i%10 == 3:
+			if err == nil || err.Error() != fmt.Sprintf("error of task %d", i) {
+				t.Errorf("future %d: got error %v", i, err)
+			}
+		default:
+			if err != nil || result != i*i {
+				t.Errorf("future %d: got %v, %v, want %d", i, result, err, i*i)
+			}
+		}
+		select {
+		case <-future.Done():
+		default:
+			t.Errorf("future %d waited but not done", i)
+		}
+	}
+
+	// the pool keeps working after a panic
+	if result, err := pool.Submit(func() (Result, error) { return "ok", nil }).Wait(); result != "ok" || err != nil {
+		t.Errorf("got %v, %v after a panic, want ok", result, err)
+	}
+
+	// futures submitted once the pool is shut down are never executed
+	pool.Shutdown(true)
+	executed := false
+	if _, err := pool.Submit(func() (Result, error) { executed = true; return nil, nil }).Wait(); !errors.Is(err, ErrPoolShutdown) || executed {
+		t.Errorf("future of a shut down pool: got %v, executed %v, want %v", err, executed, ErrPoolShutdown)
+	}
+}
+
+// histogramTask implements `Mapper`: counts the values of data[start:end]
+type histogramTask struct {
+	data       []uint8
+	start, end int
+	counts     [256]int
+}
+
+func (ht *histogramTask) Execute(wID int) {
+	for _, v := range ht.data[ht.start:ht.end] {
+		ht.counts[v]++
+	}
+}
+
+func (ht *histogramTask) GetTaskID() int { return ht.start }
+func (ht *histogramTask) Result() Result { return &ht.counts }
+
+// combineHistograms adds the counts of 'b' to 'a' and returns 'a'
+func combineHistograms(a, b Result) Result {
+	histA, histB := a.(*[256]int), b.(*[256]int)
+	for i := range histA {
+		histA[i] += histB[i]
+	}
+	return histA
+}
+
+func TestMapReduceHistogram(t *testing.T) {
+	// pseudo random values, skewed towards the low ones
+	data := make([]uint8, 100003)
+	rng := newXorshift(1)
+	for i := range data {
+		data[i] = uint8(rng.Intn(256) * rng.Intn(256) / 255)
+	}
+	var reference [256]int
+	for _, v := range data {
+		reference[v]++
+	}
+
+	for _, nWorkers := range []int{1, 3, 8} {
+		for _, blockSize := range []int{1000, 7919, len(data)} {
+			var tasks []Runnable
+			for start := 0; start < len(data); start += blockSize {
+				end := start + blockSize
+				if end > len(data) {
+					end = len(data)
+				}
+				tasks = append(tasks, &histogramTask{data: data, start: start, end: end})
+			}
+			histogram, ok := NewPool(nWorkers).MapReduce(tasks, combineHistograms).(*[256]int)
+			if !ok || *histogram != reference {
+				t.Errorf("%d workers, %d tasks: histogram differs from the sequential reference", nWorkers, len(tasks))
+			}
+		}
+	}
+
+	// no tasks, or tasks without results: nothing to merge
+	if result := NewPool(4).MapReduce(nil, combineHistograms); result != nil {
+		t.Errorf("no tasks: got %v, want nil", result)
+	}
+	if result := NewPool(4).MapReduce([]Runnable{&countTask{counts: make([]int32, 1)}}, combineHistograms); result != nil {
+		t.Errorf("a task that is not a Mapper: got %v, want nil", result)
+	}
+}
+
+// submitSleeping submits 'n' functions sleeping for 'sleep' to 'pool'; 'executed' counts the functions executed.
+// Returns once the first function started, i.e., once the batch of the futures runs in the pool.
+func submitSleeping(pool *Pool, n int, sleep time.Duration, executed *atomic.Int64) []*Future {
+	started := make(chan struct{})
+	var startOnce sync.Once
+	fns := make([]func() (Result, error), n)
+	for i := range fns {
+		i := i
+		fns[i] = func() (Result, error) {
+			startOnce.Do(func() { close(started) })
+			time.Sleep(sleep)
+			executed.Add(1)
+			return i, nil
+		}
+	}
+	futures := pool.SubmitAll(fns)
+	<-started
+	return futures
+}
+
+// waitAll waits for 'futures' for at most 'timeout'; returns the number of futures with a result,
+// the number with `ErrPoolShutdown`, and false if some future is still pending.
+func waitAll(t *testing.T, futures []*Future, timeout time.Duration) (results int, cancelled int, ok bool) {
+	deadline := time.After(timeout)
+	for i, future := range futures {
+		select {
+		case <-future.Done():
+		case <-deadline:
+			return results, cancelled, false
+		}
+		result, err := future.Wait()
+		switch {
+		case err == nil && result == i:
+			results++
+		case errors.Is(err, ErrPoolShutdown):
+			cancelled++
+		default:
+			t.Errorf("future %d: got %v, %v", i, result, err)
+		}
+	}
+	return results, cancelled, true
+}
+
+func TestShutdownDrain(t *testing.T) {
+	pool := NewPool(4)
+	var executed atomic.Int64
+	futures := submitSleeping(pool, 64, time.Millisecond, &executed)
+	pool.Shutdown(true)
+
+	// draining: every future of the running batch completes, and was complete when Shutdown returned
+	if n := executed.Load(); n != int64(len(futures)) {
+		t.Errorf("%d of %d functions executed when Shutdown(true) returned", n, len(futures))
+	}
+	results, cancelled, ok := waitAll(t, futures, 5*time.Second)
+	if !ok || results != len(futures) || cancelled != 0 {
+		t.Errorf("Shutdown(true): %d results and %d cancelled of %d futures (all done: %v)", results, cancelled, len(futures), ok)
+	}
+}
+
+func TestShutdownNoDrain(t *testing.T) {
+	pool := NewPool(4)
+	var executed atomic.Int64
+	futures := submitSleeping(pool, 400, time.Millisecond, &executed)
+	pool.Shutdown(false)
+
+	// no task executes once Shutdown returns
+	executedAtShutdown := executed.Load()
+	results, cancelled, ok := waitAll(t, futures, 5*time.Second)
+	if !ok {
+		t.Fatalf("Shutdown(false): futures still pending after %d results and %d cancelled", results, cancelled)
+	}
+	if executed.Load() != executedAtShutdown || int64(results) != executedAtShutdown {
+		t.Errorf("%d functions executed at Shutdown, %d after, %d results", executedAtShutdown, executed.Load(), results)
+	}
+	// the unexecuted futures fail instead of hanging
+	if cancelled == 0 || results+cancelled != len(futures) {
+		t.Errorf("Shutdown(false): %d results and %d cancelled of %d futures", results, cancelled, len(futures))
+	}
+}
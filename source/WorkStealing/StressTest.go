@@ -0,0 +1,178 @@
+package workstealing
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// countTask is a `Runnable` that counts how many times it was returned by the queue
+type countTask struct {
+	taskID int
+	counts []int32
+}
+
+func (ct *countTask) Execute(wID int) {
+	atomic.AddInt32(&ct.counts[ct.taskID], 1)
+}
+
+func (ct *countTask) GetTaskID() int {
+	return ct.taskID
+}
+
+// spinTask is a `countTask` that also spins for a while, so workers finish their queues at different times
+// and steal from each other
+type spinTask struct {
+	countTask
+	spins int
+	sink  *int64
+}
+
+func (st *spinTask) Execute(wID int) {
+	sum := 0
+	for i := 0; i < st.spins; i++ {
+		sum += i
+	}
+	atomic.AddInt64(st.sink, int64(sum&1))
+	st.countTask.Execute(wID)
+}
+
+// StealTest puts 'numTasks' tasks in the queue of the first of 'numWorkers' workers, so all other workers
+// must steal, and runs them with the steal 'policy' (see `Worker.SetStealPolicy`).
+// Returns the number of tasks executed more than once, the number never executed,
+// and the total number of steal attempts of all workers (see `Worker.StealAttempts`).
+func StealTest(numTasks int, numWorkers int, policy string) (duplicates int, lost int, attempts int64) {
+	counts := make([]int32, numTasks)
+	queues := make([]*UDEqueue, numWorkers)
+	workers := make([]*Worker, numWorkers)
+	for i := range workers {
+		queues[i] = NewUDEqueue(4)
+		workers[i] = NewWorker(i, queues)
+		workers[i].SetStealPolicy(policy)
+	}
+
+	// tasks signal their completion through the counts; done is closed once all tasks ran at least once
+	var sink int64
+	for i := 0; i < numTasks; i++ {
+		workers[0].AddTask(&spinTask{countTask: countTask{taskID: i, counts: counts}, spins: 2000, sink: &sink})
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(w *Worker) {
+			defer wg.Done()
+			w.Run(done)
+		}(worker)
+	}
+	for i := 0; i < numTasks; i++ {
+		for atomic.LoadInt32(&counts[i]) == 0 {
+			runtime.Gosched()
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	for _, count := range counts {
+		if count > 1 {
+			duplicates++
+		} else if count == 0 {
+			lost++
+		}
+	}
+	for _, worker := range workers {
+		attempts += worker.StealAttempts()
+	}
+	return duplicates, lost, attempts
+}
+
+// EmptyPopTest pops 'numPops' times from the bottom of an empty queue while 'numThieves' thieves check it and try
+// to steal from its top, then pushes and pops a task. The pops on the empty queue must leave it as it was.
+// Returns the number of inconsistencies: tasks popped or stolen from the empty queue, `bottom` seen below `top`,
+// and the task pushed afterwards not popped back.
+func EmptyPopTest(numPops int, numThieves int) (inconsistencies int) {
+	queue := NewUDEqueue(4)
+	var errs atomic.Int64
+	var done atomic.Bool
+	var wg sync.WaitGroup
+
+	for i := 0; i < numThieves; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				// obs: `top` first, as in `IsEmpty`; it never increases here
+				top := atomic.LoadInt64(&queue.top)
+				if atomic.LoadInt64(&queue.bottom) < top || queue.Size() != 0 || queue.PopTop() != nil {
+					errs.Add(1)
+				}
+			}
+		}()
+	}
+	for i := 0; i < numPops; i++ {
+		if queue.popBottom() != nil {
+			errs.Add(1)
+		}
+	}
+	done.Store(true)
+	wg.Wait()
+
+	if atomic.LoadInt64(&queue.bottom) != atomic.LoadInt64(&queue.top) {
+		errs.Add(1)
+	}
+	queue.pushBottom(&countTask{taskID: 0, counts: make([]int32, 1)})
+	if queue.popBottom() == nil || !queue.IsEmpty() {
+		errs.Add(1)
+	}
+	return int(errs.Load())
+}
+
+// CapacityTest pushes 'numTasks' tasks to a queue with initial capacity 2^'logCapacity', forcing it to resize
+// while 'numReaders' threads read its max capacity, then pops them all back.
+// Returns the max capacity reached (see `UDEqueue.MaxCapacityReached`), the final capacity of the queue and the
+// number of inconsistencies: a max read below the initial capacity or below a previous read, a max different from
+// the final capacity, and a final capacity too small for the tasks pushed.
+func CapacityTest(numTasks int, numReaders int, logCapacity int) (maxCapacity int, capacity int, inconsistencies int) {
+	queue := NewUDEqueue(logCapacity)
+	initial := queue.GetCapacity()
+	var errs atomic.Int64
+	var done atomic.Bool
+	var wg sync.WaitGroup
+
+	// readers: the max only grows, from the initial capacity
+	for i := 0; i < numReaders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := initial
+			for !done.Load() {
+				max := queue.MaxCapacityReached()
+				if max < last {
+					errs.Add(1)
+				}
+				last = max
+			}
+		}()
+	}
+
+	// owner: no pops while pushing, so the queue holds all tasks at the end
+	counts := make([]int32, numTasks)
+	for i := 0; i < numTasks; i++ {
+		queue.pushBottom(&countTask{taskID: i, counts: counts})
+	}
+	done.Store(true)
+	wg.Wait()
+
+	maxCapacity, capacity = queue.MaxCapacityReached(), queue.GetCapacity()
+	if maxCapacity != capacity || capacity <= numTasks {
+		errs.Add(1)
+	}
+	for queue.popBottom() != nil {
+	}
+	// the max is kept after the tasks are popped
+	if queue.MaxCapacityReached() != maxCapacity {
+		errs.Add(1)
+	}
+	return maxCapacity, capacity, int(errs.Load())
+}
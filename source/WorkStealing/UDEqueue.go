@@ -14,6 +14,7 @@ type UDEqueue struct {
 	tasks 			   	unsafe.Pointer // `CircularArray` of `Task`s; unsafe.Pointer is used to allow atomic operations
 	bottom 	   			int64  		   // Points to the entry after the bottomost element of the queue.
 	top 	   			int64		   // Points to the topmost element of the queue. Always increases.
+	maxCapacity 		int64		   // Largest capacity the queue reached; see `MaxCapacityReached`
 }
 
 // Examples of states and operations: 
@@ -32,7 +33,7 @@ type UDEqueue struct {
 // NewUDEqueue returns a new UDEqueue
 func NewUDEqueue(initialLogCapacity int) *UDEqueue {
 	circArray := NewCircularArray(initialLogCapacity)
-	return &UDEqueue{unsafe.Pointer(circArray), 0, 0}
+	return &UDEqueue{unsafe.Pointer(circArray), 0, 0, int64(circArray.GetCapacity())}
 }
 
 
@@ -46,10 +47,10 @@ func (u *UDEqueue) IsEmpty() bool {
 	// because if `bottom` <= `oldTop`, necessarily `bottom` <= any value for `top`.
 	oldTop := atomic.LoadInt64(&u.top)
 	
-	return u.bottom <= oldTop
-	// NOTE: Does not need a atomic to load `bottom` above; only consequence is 
-	// more false positives (i.e., queue is not empty but thieves think it is). 
-	// But notice that Go's race detector will throw a data race.
+	return atomic.LoadInt64(&u.bottom) <= oldTop
+	// NOTE: Strictly, the atomic to load `bottom` above is not needed; only consequence would be
+	// more false positives (i.e., queue is not empty but thieves think it is).
+	// It is used so that the queue is clean under Go's race detector.
 }
 
 // PushBottom pushes a task to the bottom of the queue. Only the owner of the queue calls this method.
@@ -65,7 +66,9 @@ func (u *UDEqueue) pushBottom(task Runnable) {
 	// if there is no space, resize the queue
 	if (int(size) >= tasks.GetCapacity() -1) {
 		// an atomic store needs to be used to communicate to all threads of the new queue
-		atomic.StorePointer(&u.tasks, unsafe.Pointer(tasks.Resize(int(oldTop), int(u.bottom))))
+		newTasks := tasks.Resize(int(u.bottom), int(oldTop))
+		atomic.StorePointer(&u.tasks, unsafe.Pointer(newTasks))
+		u.recordCapacity(newTasks.GetCapacity())
 	}
 	// Obs: this might resize when there is still space, because thieves might have 
 	// stolen tasks in between. Could change to a retry strategy if memory becomes a concern.
@@ -95,14 +98,15 @@ func (u *UDEqueue) PopTop() Runnable {
 	oldTop := atomic.LoadInt64(&u.top)
 	
 	// If the queue is empty, return nil.
-	if (u.bottom <= oldTop) {
+	if (atomic.LoadInt64(&u.bottom) <= oldTop) {
 		return nil
 	}
-	// NOTE: can use an atomic for `bottom`, above but not necessary; consequence is more `nil` returns. 
-	// But notice that Go will throw a data race.
+	// NOTE: the atomic load of `bottom` above also guarantees the thief sees the task
+	// the owner put in the queue before incrementing `bottom`.
 
 	// Not empty -> try to get a task. 
-	task := (*CircularArray)(u.tasks).GetTask(int(oldTop))
+	// Obs: the owner might be resizing the queue; atomic load to get the most recent array.
+	task := (*CircularArray)(atomic.LoadPointer(&u.tasks)).GetTask(int(oldTop))
 
 	// CAS re-confirms the entry being pointed to is still the same. 
 	// If `oldTop` is still the queue's top, then return the task.
@@ -118,8 +122,42 @@ func (u *UDEqueue) PopTop() Runnable {
 	return nil
 }
 
+// Size returns an estimate of the number of tasks in the queue. Both thieves and the owner can call this method.
+// Obs: the estimate might be stale by the time it is used, since the owner and thieves keep popping and pushing.
+// Reads `top` first for the same reason as `IsEmpty`; never negative.
+func (u *UDEqueue) Size() int {
+	oldTop := atomic.LoadInt64(&u.top)
+	size := atomic.LoadInt64(&u.bottom) - oldTop
+	if size < 0 {
+		return 0
+	}
+	return int(size)
+}
+
+// PopTopN pops up to 'n' tasks from the top of the queue. Only thieves call this method.
+// Each task is claimed with its own `PopTop`, so a batch is as safe as single steals against the owner and
+// other thieves. Stops at the first failed `PopTop`; i.e., might return fewer than 'n' tasks (or none).
+func (u *UDEqueue) PopTopN(n int) []Runnable {
+	var tasks []Runnable
+	for len(tasks) < n {
+		task := u.PopTop()
+		if task == nil {
+			break
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
 // PopBottom pops a task from the bottom of the queue. Only the owner calls this method.
+// Obs: workers call it on their queue even if they got no tasks (see `Worker.Run`).
 func (u *UDEqueue) popBottom() Runnable {
+	// Empty queue: nothing to pop, and it can't be filled meanwhile, since only the owner pushes.
+	// Return before decrementing `bottom`, so thieves never see it below `top` (see the reset below).
+	if u.IsEmpty() {
+		return nil
+	}
+
 	// Update the bottom of the queue.
 	// Atomic is used here to communicate to all threads that the bottom of the queue was updated;
 	// this is relevant in the case the queue becomes empty, so that a thief does not steal from an empty queue
@@ -149,25 +187,39 @@ func (u *UDEqueue) popBottom() Runnable {
 
 	// If size == 0, owner of the queue and thieves competing for the last element.
 	// CAS operator will resolve the conflict giving the task to the fastest thread.
-	// If someone else got the task, the owner resets the queue to empty and return nil.
+	// If someone else got the task, the owner returns nil.
 	if !atomic.CompareAndSwapInt64(&u.top, oldTop, oldTop + 1) {
 		// task to return is nil
 		task = nil
-		
-		// Reset the queue
-		// Obs:oldTop + 1 -> bottom because if a thief won the race, it will have
-		// incremented the top, to reset the queue needs to increment the bottom.
-		// eg: bottom = 8, top = 7; thief wins => newTop = 8; reset making oldTop + 1 = 7 + 1 = new top = 8
-		atomic.SwapInt64(&u.bottom, oldTop + 1)
-
-		// REVIEW: I believe an atomic is needed above, so that other thieves know the 
-		// queue was reset. But I'm not sure. It is possible it is not needed because 
-		//at this point it is known the queue is empty (bottom <= top) in the branches 
-		// before, so thieves will not try to steal from it anyway.
 	}
+
+	// Reset the queue in both cases: whoever won the race incremented the top to oldTop + 1.
+	// eg: bottom = 8, top = 7 => bottom updated to 7 above; winner makes top = 8; reset making bottom = 7 + 1 = 8
+	// Obs: before, the queue was only reset if a thief won. If the owner won, bottom stayed one behind top
+	// and the next `pushBottom` wrote its task to an index considered empty (i.e., the task was lost).
+	atomic.StoreInt64(&u.bottom, oldTop + 1)
+	// Obs: the atomic is needed so that thieves see the reset bottom.
 	return task
 }
 
+// recordCapacity updates the largest capacity reached by the queue with 'capacity', if larger.
+// Obs: only the owner resizes, but the max is updated with a CAS loop so it can be read by any thread meanwhile.
+func (u *UDEqueue) recordCapacity(capacity int) {
+	for {
+		oldMax := atomic.LoadInt64(&u.maxCapacity)
+		if int64(capacity) <= oldMax || atomic.CompareAndSwapInt64(&u.maxCapacity, oldMax, int64(capacity)) {
+			return
+		}
+	}
+}
+
+// MaxCapacityReached returns the largest capacity the queue reached, i.e., its initial capacity if it never resized.
+// Any thread can call this method. A max above the initial capacity means pushes outgrew the queue (see `pushBottom`);
+// eg: to tune the initial capacity of the queues of the workers.
+func (u *UDEqueue) MaxCapacityReached() int {
+	return int(atomic.LoadInt64(&u.maxCapacity))
+}
+
 func (u *UDEqueue) GetCapacity() int {
 	return (*CircularArray)(u.tasks).GetCapacity()
 }
\ No newline at end of file
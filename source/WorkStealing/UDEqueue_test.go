@@ -0,0 +1,110 @@
+package workstealing
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// duplicatesAndLost returns the number of tasks counted more than once and the number never counted
+func duplicatesAndLost(counts []int32) (duplicates int, lost int) {
+	for _, count := range counts {
+		if count > 1 {
+			duplicates++
+		} else if count == 0 {
+			lost++
+		}
+	}
+	return duplicates, lost
+}
+
+// TestUDEqueueStress has one owner pushing and popping while many thieves steal from the top at high contention.
+// Every task must be returned exactly once; run with -race to also check the atomics of the queue.
+func TestUDEqueueStress(t *testing.T) {
+	const numTasks, numThieves = 200000, 8
+	// small capacity to also exercise the queue resizes
+	queue := NewUDEqueue(4)
+	counts := make([]int32, numTasks)
+
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	// thieves: steal until the owner is done and the queue is empty
+	for i := 0; i < numThieves; i++ {
+		wg.Add(1)
+		go func(wID int) {
+			defer wg.Done()
+			for !done.Load() || !queue.IsEmpty() {
+				if task := queue.PopTop(); task != nil {
+					task.Execute(wID)
+				}
+			}
+		}(i + 1)
+	}
+
+	// owner: pops one task for every two pushed, competing with thieves for the last elements
+	for i := 0; i < numTasks; i++ {
+		queue.pushBottom(&countTask{taskID: i, counts: counts})
+		if i%2 == 1 {
+			if task := queue.popBottom(); task != nil {
+				task.Execute(0)
+			}
+		}
+	}
+	for !queue.IsEmpty() {
+		if task := queue.popBottom(); task != nil {
+			task.Execute(0)
+		}
+	}
+	done.Store(true)
+	wg.Wait()
+
+	if duplicates, lost := duplicatesAndLost(counts); duplicates > 0 || lost > 0 {
+		t.Errorf("%d tasks returned more than once and %d never returned out of %d", duplicates, lost, numTasks)
+	}
+}
+
+func TestPopTopN(t *testing.T) {
+	queue := NewUDEqueue(2)
+	counts := make([]int32, 5)
+	for i := range counts {
+		queue.pushBottom(&countTask{taskID: i, counts: counts})
+	}
+	// oldest tasks first, up to n
+	var ids []int
+	for _, task := range queue.PopTopN(3) {
+		ids = append(ids, task.GetTaskID())
+	}
+	if !reflect.DeepEqual(ids, []int{0, 1, 2}) {
+		t.Errorf("PopTopN(3): got tasks %v, want [0 1 2]", ids)
+	}
+	// fewer tasks left than asked
+	if tasks := queue.PopTopN(10); len(tasks) != 2 || tasks[0].GetTaskID() != 3 || tasks[1].GetTaskID() != 4 {
+		t.Errorf("PopTopN(10) with 2 tasks left: got %d tasks", len(tasks))
+	}
+	if tasks := queue.PopTopN(1); len(tasks) != 0 || !queue.IsEmpty() {
+		t.Errorf("PopTopN on an empty queue: got %d tasks", len(tasks))
+	}
+}
+
+func TestMaxCapacityAfterResizes(t *testing.T) {
+	// initial capacity 4, doubled to 8, 16, 32, 64 and 128 to hold 100 tasks
+	maxCapacity, capacity, inconsistencies := CapacityTest(100, 4, 2)
+	if inconsistencies > 0 {
+		t.Errorf("%d inconsistencies reading the max capacity", inconsistencies)
+	}
+	if maxCapacity != 128 || capacity != 128 {
+		t.Errorf("got max capacity %d and capacity %d, want 128", maxCapacity, capacity)
+	}
+	// a queue that never resized reports its initial capacity
+	if max := NewUDEqueue(3).MaxCapacityReached(); max != 8 {
+		t.Errorf("max capacity of a new queue: got %d, want 8", max)
+	}
+}
+
+func TestEmptyPopBottom(t *testing.T) {
+	// repeated pops on an empty queue, as idle workers do, while thieves check it stays empty
+	if inconsistencies := EmptyPopTest(10000, 4); inconsistencies > 0 {
+		t.Errorf("%d inconsistencies popping from an empty queue", inconsistencies)
+	}
+}
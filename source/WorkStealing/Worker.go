@@ -1,8 +1,6 @@
 package workstealing
 
-import (
-	"math/rand"
-)
+import "sync"
 
 // OBS: This worker does not `push` elements to the queue because it was not
 // necessary for my use implementation. For an example of how one could look
@@ -11,24 +9,162 @@ import (
 // `Worker` is a struct that represents a thread in the work stealing scheduler.
 // Each `Worker` access it's own queue among the `queues` slice and steal tasks
 // from other threads by randomly selecting a queue and trying to `popTop` a task from it.
+// Order of execution: the owner pushes and pops tasks at the `bottom` of its queue, i.e., LIFO: the last task
+// added is the next one it executes. Thieves pop from the `top`, i.e., FIFO: they take the oldest tasks.
+// eg: tasks added in order 1..5 => the owner executes 5, 4, ... while thieves take 1, 2, ...
+// So tasks added while the worker runs (eg: by the tasks it executes) are executed before its older backlog,
+// which is drained from the other end by idle workers.
 type Worker struct {
 	queues 		[]*UDEqueue   // queues of `Runnable`s (one for each worker)
 	tasksAdd 	[]Runnable	  // tasks to be added to the queue
 	id 	  		int			  // id of the worker
+	rng 		xorshift	  // generator to select victims; seeded from `id`
+	stealHalf 	bool		  // steal policy; see `SetStealPolicy`
+	attempts 	int64		  // number of steal attempts; see `StealAttempts`
+	stop 		chan struct{} // closed by `Stop` to signal the worker to return after its current task
+	stopOnce 	sync.Once
+	mu 			sync.Mutex	  // protects `running`
+	running 	chan struct{} // closed when the current call to `Run`/`RunNoWs` returns; nil if never run
+	onEvent 	func(id int, event string) // optional; see `SetEventHook`
 }
 
+// Events of a `Worker` reported to its event hook (see `SetEventHook`)
+const (
+	EventRun   = "run"   // the worker started running
+	EventSteal = "steal" // the worker stole a task to execute
+	EventExit  = "exit"  // the worker returned from `Run`/`RunNoWs`
+)
+
+// Steal policies of a `Worker` (see `SetStealPolicy`)
+const (
+	StealOne  = "one"	// steal one task from the victim (default)
+	StealHalf = "half"	// steal half of the tasks of the victim, as estimated by `UDEqueue.Size`
+)
+
 // NewWorker returns a new `Worker` with the given id and queues.
 func NewWorker(id int, queues []*UDEqueue) *Worker {
-	worker := &Worker{queues: queues, id: id,  tasksAdd: nil}
+	worker := &Worker{queues: queues, id: id,  tasksAdd: nil, rng: newXorshift(uint64(id)), stop: make(chan struct{})}
 	return worker
 }
 
+// SetStealPolicy sets how many tasks the worker steals from a victim: `StealOne` or `StealHalf`.
+// Stealing half of the victim's queue makes fewer steals needed to balance the work. The size of the victim's
+// queue is an estimate and other thieves race for the same tasks, so the worker might get fewer tasks than half.
+// Must be called before `Run`.
+func (w *Worker) SetStealPolicy(policy string) {
+	w.stealHalf = policy == StealHalf
+}
+
+// SetEventHook sets a function called by the worker with its id on each of its events (eg: `EventSteal`),
+// from the goroutine running the worker. The hook must be fast; it runs between the tasks of the worker.
+// Must be called before `Run`.
+func (w *Worker) SetEventHook(hook func(id int, event string)) {
+	w.onEvent = hook
+}
+
+// event reports 'event' to the event hook of the worker, if any
+func (w *Worker) event(event string) {
+	if w.onEvent != nil {
+		w.onEvent(w.id, event)
+	}
+}
+
+// StealAttempts returns the number of times the worker tried to steal from a victim whose queue was not empty.
+// Must only be called after the worker returned from `Run`.
+func (w *Worker) StealAttempts() int64 {
+	return w.attempts
+}
+
+// MaxCapacityReached returns the largest capacity the worker's own queue reached (see `UDEqueue.MaxCapacityReached`).
+// Safe to call while the worker runs.
+func (w *Worker) MaxCapacityReached() int {
+	return w.queues[w.id].MaxCapacityReached()
+}
+
+// QueueSize returns an estimate of the number of tasks in the worker's own queue (see `UDEqueue.Size`).
+// Safe to call while the worker runs.
+func (w *Worker) QueueSize() int {
+	return w.queues[w.id].Size()
+}
+
+// steal tries to steal tasks from 'victim' following the steal policy of the worker.
+// Returns a task to execute or nil; with `StealHalf`, the other stolen tasks are pushed to the worker's own queue.
+func (w *Worker) steal(victim int) Runnable {
+	w.attempts++
+	if !w.stealHalf {
+		return w.queues[victim].PopTop()
+	}
+	n := w.queues[victim].Size() / 2
+	if n < 1 {
+		n = 1
+	}
+	tasks := w.queues[victim].PopTopN(n)
+	if len(tasks) == 0 {
+		return nil
+	}
+	for _, task := range tasks[1:] {
+		w.queues[w.id].pushBottom(task)
+	}
+	return tasks[0]
+}
+
+// Stop signals the worker to return from `Run`/`RunNoWs` once its current task is done, and waits for it.
+// When Stop returns, the worker executes no more tasks: tasks left in its queue, including one it popped or stole
+// but did not start (see `putBack`), are not executed by it, but may still be stolen by other running workers. A worker is stopped for good; later calls to `Run` return at once.
+// Safe to call from any goroutine and more than once; must not be called by a task executed by the worker itself.
+func (w *Worker) Stop() {
+	w.signalStop()
+	w.mu.Lock()
+	running := w.running
+	w.mu.Unlock()
+	if running != nil {
+		<-running
+	}
+}
+
+// signalStop signals the worker to stop, without waiting for it (see `Stop`)
+func (w *Worker) signalStop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// stopped returns true once `Stop` was called
+func (w *Worker) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// started records a call to `Run`/`RunNoWs`, so that `Stop` waits for it. Returns the function to call when it returns.
+func (w *Worker) started() func() {
+	running := make(chan struct{})
+	w.mu.Lock()
+	w.running = running
+	w.mu.Unlock()
+	return func() { close(running) }
+}
+
+// putBack pushes 'task', popped or stolen but not executed, back to the worker's own queue, so it is not lost
+// when the worker returns (eg: stopped right after stealing it); other running workers may still steal it.
+// Obs: called by the worker itself before it returns, i.e., by the owner of the queue.
+func (w *Worker) putBack(task Runnable) {
+	if task != nil {
+		w.queues[w.id].pushBottom(task)
+	}
+}
+
 // `Run` in loop executing tasks from it's own queue or by stealing tasks from other threads.
-// Will run in loop until a `done` signal is received.
+// Will run in loop until a `done` signal is received or the worker is stopped (see `Stop`).
 func (w *Worker) Run(done <- chan struct{}) {
+	defer w.started()()
+	w.event(EventRun)
+	defer w.event(EventExit)
 	var victim int
 	// initialize `task` by popping an element from it's own queue
 	task := w.queues[w.id].popBottom()
+	defer func() { w.putBack(task) }()
 
 	// Loop: execute tasks (own or stolen) until a `done` signal is received
 	for{
@@ -37,26 +173,50 @@ func (w *Worker) Run(done <- chan struct{}) {
 		// If `done` signal is received, stop working/stealing and return
 		case <- done:
 			return
+		case <- w.stop:
+			return
 		
 		// Execute owned/stolen tasks
 		default:
 			// pop a task from it's own queue and execute it. 
-			// Keep popping until queue is empty.
+			// Keep popping until queue is empty or the worker is stopped.
 			for task != nil {
 				// execute the task
 				task.Execute(w.id)
 				task = nil
+				if w.stopped() {
+					return
+				}
 				if !w.queues[w.id].IsEmpty() {
 					task = w.queues[w.id].popBottom()
 				}
 			}
 
 			// if own queue is empty, steal tasks from other threads
+			// obs: `done` is also checked while stealing; otherwise a worker finding no tasks would never return
+			if len(w.queues) == 1 {
+				// no other workers to steal from
+				select {
+				case <- done:
+				case <- w.stop:
+				}
+				return
+			}
 			for task == nil {
+				select {
+				case <- done:
+					return
+				case <- w.stop:
+					return
+				default:
+				}
 				victim = w.SelectRandomVictim()
-				// if victim's queue is not empty, steal a task; otherwise, go to next victim
+				// if victim's queue is not empty, steal (see `SetStealPolicy`); otherwise, go to next victim
 				if !w.queues[victim].IsEmpty() {
-					task = w.queues[victim].PopTop()
+					task = w.steal(victim)
+					if task != nil {
+						w.event(EventSteal)
+					}
 				}
 			}
 		}
@@ -65,16 +225,18 @@ func (w *Worker) Run(done <- chan struct{}) {
 
 
 // SelectRandomVictim returns a random index representing another worker.
+// OBS: draws from the worker's own generator (see `xorshift`); must only be called by the worker itself.
 func (w *Worker) SelectRandomVictim() int{
 	// select a random victim. Keep drawing until it is not itself
-	victim := rand.Intn(len(w.queues))
+	victim := w.rng.Intn(len(w.queues))
 	for victim == w.id {
-		victim = rand.Intn(len(w.queues))
+		victim = w.rng.Intn(len(w.queues))
 	}
 	return victim
 }
 
-// AddTask adds a task to the worker's queue.
+// AddTask adds a task to the bottom of the worker's queue: it is the next task the worker executes (LIFO; see `Worker`).
+// Must be called by the owner, i.e., before `Run` or by a task executed by the worker.
 func (w *Worker) AddTask(task Runnable) {
 	w.queues[w.id].pushBottom(task)
 }
@@ -97,11 +259,15 @@ func (w *Worker) GetTask(index int) (Runnable, bool) {
 //==============================================================================
 
 
-// `Run` in loop executing tasks from it's own queue or by stealing tasks from other threads.
-// Will run in loop until a `done` signal is received.
+// `RunNoWs` in loop executing tasks from it's own queue only.
+// Returns once its queue is empty, a `done` signal is received or the worker is stopped (see `Stop`).
 func (w *Worker) RunNoWs(done <- chan struct{}) {
+	defer w.started()()
+	w.event(EventRun)
+	defer w.event(EventExit)
 	// initialize `task` by popping an element from it's own queue
 	task := w.queues[w.id].popBottom()
+	defer func() { w.putBack(task) }()
 	// Loop: execute tasks (own) until a `done` signal is received or tasks are done
 	for{
 		select{
@@ -109,15 +275,20 @@ func (w *Worker) RunNoWs(done <- chan struct{}) {
 		// If `done` signal is received, stop working/stealing and return
 		case <- done:
 			return
+		case <- w.stop:
+			return
 		
 		// Execute owned/stolen tasks
 		default:
 			// pop a task from it's own queue and execute it. 
-			// Keep popping until queue is empty.
+			// Keep popping until queue is empty or the worker is stopped.
 			for task != nil {
 				// execute the task
 				task.Execute(w.id)
 				task = nil
+				if w.stopped() {
+					return
+				}
 				if !w.queues[w.id].IsEmpty() {
 					task = w.queues[w.id].popBottom()
 				}
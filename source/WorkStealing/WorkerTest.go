@@ -2,7 +2,6 @@ package workstealing
 
 import (
 	"fmt"
-	"math/rand"
 	"sync/atomic"
 	"time"
 )
@@ -16,10 +15,11 @@ type WorkerTest struct {
 	id 	  	int
 	Mode 	atomic.Int32
 	tasks 	[]Runnable
+	rng 	xorshift	// generator to select victims; seeded from `id`
 }
 
 func NewWorkerTest(id int, queues []*UDEqueue) *WorkerTest {
-	worker := &WorkerTest{queues: queues, id: id,  tasks: nil}
+	worker := &WorkerTest{queues: queues, id: id,  tasks: nil, rng: newXorshift(uint64(id))}
 	worker.Mode.Store(1)
 	return worker
 }
@@ -44,9 +44,9 @@ func (w *WorkerTest) Run() {
 		// if own queue is empty, steal tasks from other threads
 		for w.Mode.Load() == 1 && task == nil {
 			// select a random victim. Keep drawing until it is not itself
-			victim = rand.Intn(len(w.queues))
+			victim = w.rng.Intn(len(w.queues))
 			for victim == w.id {
-				victim = rand.Intn(len(w.queues))
+				victim = w.rng.Intn(len(w.queues))
 			}
 
 			// if victim's queue is not empty, steal a task from it; otherwise, select another victim
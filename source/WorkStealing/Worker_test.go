@@ -0,0 +1,174 @@
+package workstealing
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSelectRandomVictim(t *testing.T) {
+	const nWorkers = 8
+	queues := make([]*UDEqueue, nWorkers)
+	for i := range queues {
+		queues[i] = NewUDEqueue(4)
+	}
+	for id := 0; id < nWorkers; id++ {
+		worker := NewWorker(id, queues)
+		drawn := make(map[int]bool)
+		for i := 0; i < 1000; i++ {
+			victim := worker.SelectRandomVictim()
+			if victim == id || victim < 0 || victim >= nWorkers {
+				t.Fatalf("worker %d selected victim %d", id, victim)
+			}
+			drawn[victim] = true
+		}
+		// every other worker is selected at some point
+		if len(drawn) != nWorkers-1 {
+			t.Errorf("worker %d selected only %d of the %d other workers", id, len(drawn), nWorkers-1)
+		}
+	}
+}
+
+// lockedRand is a generator shared by all workers behind a lock, as the global source of `math/rand`
+// before it was seeded at random (Go 1.20)
+type lockedRand struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rand.Intn(n)
+}
+
+// benchmarkIdleSteal runs many idle workers that keep selecting a victim with 'selectVictim' and
+// trying to pop the top of its empty queue, as in the steal-search loop of `Worker.Run`.
+func benchmarkIdleSteal(b *testing.B, selectVictim func(w *Worker) int) {
+	const nWorkers = 64
+	queues := make([]*UDEqueue, nWorkers)
+	for i := range queues {
+		queues[i] = NewUDEqueue(4)
+	}
+	var nextID atomic.Int32
+	b.SetParallelism(nWorkers)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		w := NewWorker(int(nextID.Add(1)-1)%nWorkers, queues)
+		for pb.Next() {
+			queues[selectVictim(w)].PopTop()
+		}
+	})
+}
+
+func BenchmarkIdleStealXorshift(b *testing.B) {
+	benchmarkIdleSteal(b, (*Worker).SelectRandomVictim)
+}
+
+func BenchmarkIdleStealLockedRand(b *testing.B) {
+	shared := &lockedRand{rand: rand.New(rand.NewSource(1))}
+	benchmarkIdleSteal(b, func(w *Worker) int {
+		victim := shared.Intn(len(w.queues))
+		for victim == w.id {
+			victim = shared.Intn(len(w.queues))
+		}
+		return victim
+	})
+}
+
+// TestStealHalfFillingOwner runs thieves stealing half of the victims' queues while the owner of the first queue
+// keeps filling it and popping from it. Every task must be executed exactly once, and the steals of each thief
+// must be consistent with its attempts and with the tasks the thieves executed.
+func TestStealHalfFillingOwner(t *testing.T) {
+	const numTasks, numThieves = 50000, 6
+	queues := make([]*UDEqueue, numThieves+1)
+	for i := range queues {
+		queues[i] = NewUDEqueue(4)
+	}
+	counts := make([]int32, numTasks)
+	ownerCounts := make([]int32, numTasks)
+
+	steals := make([]int64, len(queues))
+	thieves := make([]*Worker, numThieves)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range thieves {
+		thieves[i] = NewWorker(i+1, queues)
+		thieves[i].SetStealPolicy(StealHalf)
+		thieves[i].SetEventHook(func(id int, event string) {
+			if event == EventSteal {
+				steals[id]++
+			}
+		})
+		wg.Add(1)
+		go func(w *Worker) {
+			defer wg.Done()
+			w.Run(done)
+		}(thieves[i])
+	}
+
+	// owner of queue 0: pushes all tasks, popping one for every four pushed
+	for i := 0; i < numTasks; i++ {
+		queues[0].pushBottom(&countTask{taskID: i, counts: counts})
+		if i%4 == 3 {
+			if task := queues[0].popBottom(); task != nil {
+				task.Execute(0)
+				atomic.AddInt32(&ownerCounts[task.GetTaskID()], 1)
+			}
+		}
+	}
+	for i := 0; i < numTasks; i++ {
+		for atomic.LoadInt32(&counts[i]) == 0 {
+			runtime.Gosched()
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if duplicates, lost := duplicatesAndLost(counts); duplicates > 0 || lost > 0 {
+		t.Fatalf("%d tasks executed more than once and %d never executed out of %d", duplicates, lost, numTasks)
+	}
+	executedByThieves := numTasks
+	for _, count := range ownerCounts {
+		executedByThieves -= int(count)
+	}
+	var totalSteals int64
+	for _, thief := range thieves {
+		if steals[thief.id] > thief.StealAttempts() {
+			t.Errorf("thief %d: %d steals out of %d attempts", thief.id, steals[thief.id], thief.StealAttempts())
+		}
+		totalSteals += steals[thief.id]
+	}
+	// each steal gives the thief at least one task to execute
+	if totalSteals == 0 || totalSteals > int64(executedByThieves) {
+		t.Errorf("%d steals for %d tasks executed by the thieves", totalSteals, executedByThieves)
+	}
+}
+
+// TestStealPolicies checks no task runs twice (or never) with each steal policy when all tasks start in one queue.
+func TestStealPolicies(t *testing.T) {
+	for _, policy := range []string{StealOne, StealHalf} {
+		duplicates, lost, attempts := StealTest(20000, 8, policy)
+		if duplicates > 0 || lost > 0 || attempts == 0 {
+			t.Errorf("policy %s: %d duplicates, %d lost, %d steal attempts", policy, duplicates, lost, attempts)
+		}
+	}
+}
+
+// TestStopKeepsPoppedTask stops a worker before it runs: it returns without executing the task it popped,
+// and leaves the task in its queue instead of dropping it.
+func TestStopKeepsPoppedTask(t *testing.T) {
+	for _, run := range []func(w *Worker, done <-chan struct{}){(*Worker).Run, (*Worker).RunNoWs} {
+		queues := []*UDEqueue{NewUDEqueue(4), NewUDEqueue(4)}
+		counts := make([]int32, 1)
+		worker := NewWorker(0, queues)
+		worker.AddTask(&countTask{taskID: 0, counts: counts})
+		worker.Stop()
+		run(worker, make(chan struct{}))
+		if counts[0] != 0 || worker.QueueSize() != 1 {
+			t.Errorf("stopped worker: task executed %d times, %d tasks left in its queue, want 0 and 1", counts[0], worker.QueueSize())
+		}
+	}
+}
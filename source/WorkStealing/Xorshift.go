@@ -0,0 +1,38 @@
+package workstealing
+
+// `xorshift` is a xorshift64* pseudo random number generator used by workers to select victims.
+// Each worker holds its own generator, so the steal-search loop never contends on the lock
+// protecting the global source of `math/rand`.
+// OBS: not thread safe; must only be used by the worker holding it.
+// reference: https://en.wikipedia.org/wiki/Xorshift#xorshift*
+type xorshift struct {
+	state uint64	// current state; never zero
+}
+
+// newXorshift returns a generator seeded from 'seed' (e.g. the id of the worker).
+// The seed is scrambled with a splitmix64 step, so consecutive ids give unrelated sequences
+// and the state is never zero (a zero state would only generate zeros).
+func newXorshift(seed uint64) xorshift {
+	z := seed + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	if z == 0 {
+		z = 1
+	}
+	return xorshift{state: z}
+}
+
+// next returns the next pseudo random 64-bit number of the sequence
+func (x *xorshift) next() uint64 {
+	x.state ^= x.state >> 12
+	x.state ^= x.state << 25
+	x.state ^= x.state >> 27
+	return x.state * 0x2545f4914f6cdd1d
+}
+
+// Intn returns a pseudo random number in [0, n). n must be positive.
+// obs: uses the high 32 bits, which are the best of xorshift64*; the modulo bias is negligible for numbers of workers.
+func (x *xorshift) Intn(n int) int {
+	return int((x.next() >> 32) % uint64(n))
+}
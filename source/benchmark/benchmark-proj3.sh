@@ -122,7 +122,7 @@ for experiment in "${experiments[@]}"; do
 
 
     # compute performance metrics and plot speedups
-    go run ./benchmark/benchmark.go "$experiment"
+    go run -tags plot ./benchmark "$experiment"
 
     # Cleanup for 'many' experiment
     # delete the images created
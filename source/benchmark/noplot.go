@@ -0,0 +1,14 @@
+//go:build !plot
+
+package main
+
+import "fmt"
+
+// plotSpeedups is a no-op without the 'plot' tag, so the benchmark builds without gonum (see plot.go)
+func plotSpeedups(speedups map[string]map[string]map[int]float64, imagesPartialPath string) {
+	fmt.Println("Speedup plots skipped: build with '-tags plot' to plot them")
+}
+
+// plotEfficiencies is a no-op without the 'plot' tag (see plot.go); skipping plots is reported by `plotSpeedups`
+func plotEfficiencies(efficiencies map[string]map[string]map[int]float64, imagesPartialPath string) {
+}
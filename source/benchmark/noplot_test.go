@@ -0,0 +1,38 @@
+//go:build !plot
+
+package main
+
+import (
+	"go/build"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestStatsWithoutGonum builds the benchmark without the 'plot' tag: it imports no gonum package,
+// and the statistics are computed and the plots skipped.
+func TestStatsWithoutGonum(t *testing.T) {
+	pkg, err := build.Default.ImportDir(".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range pkg.Imports {
+		if strings.HasPrefix(path, "gonum.org/") {
+			t.Errorf("imports %s without the plot tag", path)
+		}
+	}
+
+	dir := t.TempDir()
+	times := map[string]map[string]map[int]float64{
+		"s":        {"big": {1: 120}},
+		"parfiles": {"big": {2: 60, 4: 40}},
+	}
+	speedups := ComputeSpeedups(times, filepath.Join(dir, "speedups.txt"))
+	efficiencies := ComputeEfficiencies(speedups, filepath.Join(dir, "efficiencies.txt"))
+	if speedups["parfiles"]["big"][4] != 3 || math.Abs(efficiencies["parfiles"]["big"][4]-0.75) > 1e-9 {
+		t.Errorf("speedups %v, efficiencies %v", speedups, efficiencies)
+	}
+	plotSpeedups(speedups, dir)
+	plotEfficiencies(efficiencies, dir)
+}
@@ -0,0 +1,165 @@
+//go:build plot
+
+// Plots of the speedups and efficiencies of each mode. Requires gonum's plot packages; built only with the 'plot' tag:
+// go run -tags plot ./benchmark [experiment [baseline]]
+
+package main
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+//=============================================================================
+// Plotting methods
+//=============================================================================
+// Customized tick marks for the Y axis
+type CustomYTicks struct{}
+
+// forces plotter to show all valus in Y axis
+func (CustomYTicks) Ticks(min, max float64) []plot.Tick {
+	var newTicks []plot.Tick
+	defaultTicks := plot.DefaultTicks{}
+	ticks := defaultTicks.Ticks(min, max)
+	for _, t := range ticks {
+		t.Label = fmt.Sprintf("%.2f", t.Value)
+		newTicks = append(newTicks, t)
+	}
+	return newTicks
+}
+
+// customized tick marks for the X axis
+type CustomXTicks struct{
+	Threads []int
+}
+// forces plotter to show all number in X axis for which there are values
+func (t CustomXTicks) Ticks(min, max float64) []plot.Tick {
+	var ticks []plot.Tick
+	for _, thread := range t.Threads {
+		if float64(thread) >= min && float64(thread) <= max {
+			ticks = append(ticks, plot.Tick{Value: float64(thread), Label: fmt.Sprintf("%d", thread)})
+		}
+	}
+	return ticks
+}
+
+
+// plotSpeedups saves a graph of the speedups of each mode (see `ComputeSpeedups`) to '<imagesPartialPath>speedup-<mode>.png'
+func plotSpeedups(speedups map[string]map[string]map[int]float64, imagesPartialPath string) {
+	plotModes(speedups, imagesPartialPath, "speedup", "Speedup")
+}
+
+// plotEfficiencies saves a graph of the efficiencies of each mode (see `ComputeEfficiencies`)
+// to '<imagesPartialPath>efficiency-<mode>.png'
+func plotEfficiencies(efficiencies map[string]map[string]map[int]float64, imagesPartialPath string) {
+	plotModes(efficiencies, imagesPartialPath, "efficiency", "Efficiency")
+}
+
+// plotModes saves a graph of 'values' vs number of threads for each mode to '<imagesPartialPath><name>-<mode>.png',
+// with a line for each data directory. eg: name = "speedup" => speedup-parfiles.png
+// @label: name of the values in the title and Y axis. eg: "Speedup"
+func plotModes(values map[string]map[string]map[int]float64, imagesPartialPath string, name string, label string) {
+	// colors for the lines for each dataDir
+	dataDirColors := map[string]color.RGBA{
+		"small":   {R: 0, G: 255, B: 0, A: 255}, // green
+		"mixture": {R: 0, G: 0, B: 255, A: 255}, // blue
+		"big":     {R: 255, G: 0, B: 0, A: 255}, // red
+	}
+
+	for mode, data := range values {
+		// create a new plot
+		p := plot.New()
+		
+		// set the title and axis labels (obs: new lines and spaces for padding)
+		p.Title.Text = fmt.Sprintf("\nEditor %s graph (%s)", name, mode)
+		p.X.Label.Text = "Number of Threads \n "
+		p.Y.Label.Text = "\n" + label
+
+		// add space between the title and beginning of the plot
+		p.Title.Padding = vg.Points(20)
+		p.Title.TextStyle.Font.Size = vg.Points(15)
+
+		// add space between the axes and the plot
+		p.X.Label.Padding = vg.Points(5)
+		p.Y.Label.Padding = vg.Points(5)
+
+		// set grid lines
+		grid := plotter.NewGrid()
+		p.Add(grid)
+
+		// force Y axis to show numbers in every tick
+		p.Y.Tick.Marker = CustomYTicks{}
+
+		// background color gray
+		// p.BackgroundColor = color.RGBA{R: 225, G: 225, B: 225, A: 255}
+
+		colorIndex := 0
+		for dataDir, threadsData := range data {
+			// sort thread counts in ascending order to pass to the graph
+			keys := make([]int, 0, len(threadsData))
+			for k := range threadsData {
+				keys = append(keys, k)
+			}
+			// Sort the thread counts
+			sort.Ints(keys)
+
+			// Create the plotter.XYs struct using the sorted keys
+			pts := make(plotter.XYs, len(keys))
+			for i, k := range keys {
+				pts[i].X = float64(k)
+				pts[i].Y = threadsData[k]
+			}
+
+			// create a line for the dataDir
+			line, _ := plotter.NewLine(pts)
+			
+			// line width and color
+			line.LineStyle.Width = vg.Points(1)
+			line.LineStyle.Color = dataDirColors[dataDir]
+			
+			// create markers for the dataDir line
+			scatter, _ := plotter.NewScatter(pts)
+			scatter.GlyphStyle.Color = dataDirColors[dataDir]
+			scatter.GlyphStyle.Radius = vg.Points(2) // set the radius as per your requirement
+
+			// add the line and the scatter to the plot
+			p.Add(line, scatter) // adding scatter here
+
+			// add a legend for the line
+			p.Legend.Top = true
+			p.Legend.Left = true
+			p.Legend.Add(dataDir, line)
+
+			// add some padding to the borders of the plot
+			xmin, xmax := p.X.Min, p.X.Max
+			ymin, ymax := p.Y.Min, p.Y.Max
+
+			xpadding := (xmax - xmin) * 0.02 // 10% of range
+			ypadding := (ymax - ymin) * 0.02 // 10% of range
+
+			p.X.Min = xmin - xpadding
+			p.X.Max = xmax + xpadding
+
+			p.Y.Min = ymin - ypadding
+			p.Y.Max = ymax + ypadding
+
+			// force X axis to show all threads values
+			threads := make([]int, 0)
+			for k := range threadsData {
+				threads = append(threads, k)
+			}
+			p.X.Tick.Marker = CustomXTicks{Threads: threads}
+
+			// change the color for the next dataDir
+			colorIndex++
+		}
+
+		// save plot to a PNG file
+		if err := p.Save(6*vg.Inch, 6*vg.Inch, fmt.Sprintf("%s%s-%s.png", imagesPartialPath, name, mode)); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Statistics of the benchmark results: average and best times, speedups and comparison against a baseline.
+// Obs: no plotting dependencies, so the numeric results and data files are available without gonum (see plot.go).
+
+package main
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+//=============================================================================
+// Data struct and methods to compute average, best times and speedups
+//=============================================================================
+
+// Data struct to parse JSON results file
+type Data struct {
+	Mode		 string  `json:"mode"`
+	Threads      int     `json:"threads"`
+	TimeElapsed  float64 `json:"timeElapsed"`
+	TimeParallel float64 `json:"timeParallel"`
+	DataDir      string  `json:"datadir"`
+}
+
+
+// ParseResults parses the 'results.txt' file and returns a map of Data structs
+// Malformed lines are skipped and their number reported (see `ReadResults`).
+func ParseResults(pathToResultsFile string) map[string][]Data {
+	file, err := os.Open(pathToResultsFile)
+	if err != nil {
+		fmt.Println(err)
+		return map[string][]Data{}
+	}
+	defer file.Close()
+
+	dataSets, skipped, err := ReadResults(file)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if skipped > 0 {
+		fmt.Printf("Skipped %d malformed lines of %s\n", skipped, pathToResultsFile)
+	}
+	return dataSets
+}
+
+// `ReadResults` reads one result per line from 'reader' and returns them by mode, with the number of lines skipped.
+// Lines that are not a JSON result (eg: corrupt, truncated, or interleaved by concurrent appends) are skipped
+// instead of stopping the parsing, so the results of the lines after them are kept. Blank lines are ignored.
+// Obs: a JSON line without a mode is not a result; it is skipped too.
+// Returns an error only if reading fails; the results read until then are returned with it.
+func ReadResults(reader io.Reader) (map[string][]Data, int, error) {
+	dataSets := make(map[string][]Data)
+	skipped := 0
+
+	// obs: lines are read whole, whatever their length; a corrupt line may be arbitrarily long
+	lines := bufio.NewReader(reader)
+	for {
+		line, readErr := lines.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var data Data
+			if err := json.Unmarshal(line, &data); err != nil || data.Mode == "" {
+				skipped++
+			} else {
+				dataSets[data.Mode] = append(dataSets[data.Mode], data)
+			}
+		}
+		if readErr == io.EOF {
+			return dataSets, skipped, nil
+		}
+		if readErr != nil {
+			return dataSets, skipped, readErr
+		}
+	}
+}
+
+// `ComputeAverageTimes` computes the average times for each mode, data directory and number of threads.
+// @dataSets: map of Data structs
+// returns: map of average times for each mode, data directory and number of threads
+// e.g. map["parfiles"]["b"]["4"] = 100 (parfiles took on average 100 seconds to run on data directory "b" with 4 threads)
+func ComputeAverageTimes(dataSets map[string][]Data, averagesPath string) map[string]map[string]map[int]float64 {
+	averagesElapsed := make(map[string]map[string]map[int]float64, 0)
+	counters := make(map[string]map[string]map[int]int, 0)
+
+	// iterate over modes
+	for mode, dataSet := range dataSets {
+		averagesElapsed[mode] = make(map[string]map[int]float64)
+		counters[mode] = make(map[string]map[int]int)
+		
+		// iterate over datapoints for each mode
+		for _, data := range dataSet {
+
+			// initialize dataDir map to populate with averages
+			if averagesElapsed[mode][data.DataDir] == nil {
+				averagesElapsed[mode][data.DataDir] = make(map[int]float64)
+				counters[mode][data.DataDir] = make(map[int]int)
+			}
+			// accumulate sum and counter for each dataDir and number of threads
+			averagesElapsed[mode][data.DataDir][data.Threads] += data.TimeElapsed
+			counters[mode][data.DataDir][data.Threads]++
+		}
+
+		// compute averages for each dataDir and number of threads for a given mode
+		for dataDir, data := range averagesElapsed[mode] {
+			for threads, timeElapsed := range data {
+				averagesElapsed[mode][dataDir][threads] = timeElapsed / float64(counters[mode][dataDir][threads])
+			}
+		}		
+	}
+	// write best times to file
+	saveToFile(averagesElapsed, averagesPath)
+	return averagesElapsed
+}
+
+// `ComputeBestTimes` computes the best times for each mode, data directory and number of threads.
+// @dataSets: map of Data structs
+// returns: map of best times for each mode, data directory and number of threads
+// e.g. map["parfiles"]["b"]["4"] = 100 (parfiles took on 100 seconds to run on data directory "b" with 4 threads on its best run)
+func ComputeBestTimes(dataSets map[string][]Data, bestTotalTimesPath, bestParallTimesPath string) map[string]map[string]map[int]float64 {
+	bestTotalTimes := make(map[string]map[string]map[int]float64)
+	bestParallTimes := make(map[string]map[string]map[int]float64)
+
+	// iterate over modes
+	for mode, data := range dataSets {
+		// iterate over datapoints for each mode
+		for _, data := range data {
+			if bestTotalTimes[mode] == nil {
+				bestTotalTimes[mode] = make(map[string]map[int]float64)
+				bestParallTimes[mode] = make(map[string]map[int]float64)
+			}
+
+			if bestTotalTimes[mode][data.DataDir] == nil {
+				bestTotalTimes[mode][data.DataDir] = make(map[int]float64)
+				bestParallTimes[mode][data.DataDir] = make(map[int]float64)
+			}
+
+			// if total time elapsed is less than the current best time for a thread, update best time
+			if data.TimeElapsed < bestTotalTimes[mode][data.DataDir][data.Threads] || bestTotalTimes[mode][data.DataDir][data.Threads] == 0 {
+				bestTotalTimes[mode][data.DataDir][data.Threads] = data.TimeElapsed
+				bestParallTimes[mode][data.DataDir][data.Threads] = data.TimeParallel
+			}
+		}				
+	}
+
+	// Save the results to file
+	saveToFile(bestTotalTimes, bestTotalTimesPath)
+	saveToFile(bestParallTimes, bestParallTimesPath)
+
+	return bestTotalTimes
+}
+
+// `ComputeSpeedups` computes the speedups for each mode, data directory and number of threads.
+// @times: map of times for each mode, data directory and number of threads
+// returns: map of speedups for each mode, data directory and number of threads
+// e.g. map["parfiles"]["b"]["4"] = 2 (parfiles with 4 threads processed data directory "b" on average 2 times faster than sequential impl.)
+func ComputeSpeedups(times map[string]map[string]map[int]float64, speedUpsPath string) map[string]map[string]map[int]float64 {
+	speedups := make(map[string]map[string]map[int]float64, 0)
+	
+	// iterate over modes
+	for mode, data := range times {
+		baseline := baselineMode(mode)
+		if mode == baseline {
+			continue
+		}
+		// for each mode create a new map of average speedups per data directory and number of threads
+		// e.g. map["parfiles"]["b"]["4"], map["parfiles"]["b"]["8"], etc.
+		speedups[mode] = make(map[string]map[int]float64)
+		// iterate over data directories
+		for dataDir, data := range data {
+			// initialize dataDir map to populate with speedups
+			speedups[mode][dataDir] = make(map[int]float64)
+			for threads, timeElapsed := range data {
+				if threads != 1 {
+					// speedup = sequential time / parallel time
+					speedups[mode][dataDir][threads] = times[baseline][dataDir][1] / timeElapsed
+				}
+			}
+		}
+	}
+	// write speedups to file
+	file, _ := os.Create(speedUpsPath)
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	encoder.Encode(speedups)
+	return speedups
+}
+
+// `baselineMode` returns the sequential mode the speedups of 'mode' are relative to:
+// "compute_s" for compute-only modes, whose times exclude loading and saving (e.g. "compute_parslices"), and "s" otherwise.
+func baselineMode(mode string) string {
+	if strings.HasPrefix(mode, "compute_") {
+		return "compute_s"
+	}
+	return "s"
+}
+
+// `ComputeEfficiencies` computes the parallel efficiency for each mode, data directory and number of threads,
+// i.e., the speedup divided by the number of threads. 1 is perfect scaling; it drops as threads are added
+// with diminishing returns, which shows scaling losses more clearly than the speedups.
+// @speedups: map of speedups for each mode, data directory and number of threads (see `ComputeSpeedups`)
+// returns: map of efficiencies with the same keys as 'speedups'
+// e.g. map["parfiles"]["b"][4] = 0.5 (parfiles with 4 threads processed data directory "b" 2 times faster than sequential impl.)
+func ComputeEfficiencies(speedups map[string]map[string]map[int]float64, efficienciesPath string) map[string]map[string]map[int]float64 {
+	efficiencies := make(map[string]map[string]map[int]float64, len(speedups))
+	for mode, data := range speedups {
+		efficiencies[mode] = make(map[string]map[int]float64, len(data))
+		for dataDir, data := range data {
+			efficiencies[mode][dataDir] = make(map[int]float64, len(data))
+			for threads, speedup := range data {
+				efficiencies[mode][dataDir][threads] = speedup / float64(threads)
+			}
+		}
+	}
+	// write efficiencies to file
+	file, _ := os.Create(efficienciesPath)
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	encoder.Encode(efficiencies)
+	return efficiencies
+}
+
+//=============================================================================
+// Baseline comparison
+//=============================================================================
+
+// Regression is a mode, data directory and number of threads whose speedup dropped below the baseline
+type Regression struct {
+	Mode     string
+	DataDir  string
+	Threads  int
+	Baseline float64 // speedup in the baseline
+	Current  float64 // speedup in the current results
+}
+
+func (r Regression) String() string {
+	return fmt.Sprintf("%s %s %d threads: speedup %.2f -> %.2f (%.1f%%)", r.Mode, r.DataDir, r.Threads,
+		r.Baseline, r.Current, 100*(r.Current-r.Baseline)/r.Baseline)
+}
+
+// `LoadSpeedups` reads the speedups written by `ComputeSpeedups` at 'speedUpsPath' (eg: a baseline of a previous run)
+func LoadSpeedups(speedUpsPath string) (map[string]map[string]map[int]float64, error) {
+	file, err := os.Open(speedUpsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var speedups map[string]map[string]map[int]float64
+	if err := json.NewDecoder(file).Decode(&speedups); err != nil {
+		return nil, fmt.Errorf("reading speedups %s: %w", speedUpsPath, err)
+	}
+	return speedups, nil
+}
+
+// `CompareToBaseline` compares the 'current' speedups against the 'baseline' ones (see `ComputeSpeedups`).
+// Returns the mode/data directory/thread combinations whose speedup is below the baseline by more than 'tolerance',
+// relative to the baseline. eg: tolerance = 0.1 => speedup 4 in the baseline regresses below 3.6.
+// Combinations missing from either set are not compared. Regressions are sorted by mode, data directory and threads.
+func CompareToBaseline(current, baseline map[string]map[string]map[int]float64, tolerance float64) []Regression {
+	var regressions []Regression
+	for mode, dataDirs := range baseline {
+		for dataDir, threadsData := range dataDirs {
+			for threads, baselineSpeedup := range threadsData {
+				currentSpeedup, ok := current[mode][dataDir][threads]
+				if !ok {
+					continue
+				}
+				if currentSpeedup < baselineSpeedup*(1-tolerance) {
+					regressions = append(regressions, Regression{Mode: mode, DataDir: dataDir, Threads: threads,
+						Baseline: baselineSpeedup, Current: currentSpeedup})
+				}
+			}
+		}
+	}
+	sort.Slice(regressions, func(i, j int) bool {
+		a, b := regressions[i], regressions[j]
+		if a.Mode != b.Mode {
+			return a.Mode < b.Mode
+		}
+		if a.DataDir != b.DataDir {
+			return a.DataDir < b.DataDir
+		}
+		return a.Threads < b.Threads
+	})
+	return regressions
+}
+
+func saveToFile(data map[string]map[string]map[int]float64, path string) {
+    file, err := os.Create(path)
+    if err != nil {
+        panic(err)
+    }
+    defer file.Close()
+
+    encoder := json.NewEncoder(file)
+
+    for key, val := range data {
+        singleRecord := make(map[string]map[string]map[int]float64)
+        singleRecord[key] = val
+
+        err = encoder.Encode(singleRecord)
+        if err != nil {
+            panic(err)
+        }
+
+        _, err = file.WriteString("\n")
+        if err != nil {
+            panic(err)
+        }
+    }
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// speedupsOf returns the speedups of the times of parfiles on data directory "big", sequential time 100
+// eg: speedupsOf(map[int]float64{2: 50}) => map["parfiles"]["big"][2] = 2
+func speedupsOf(t *testing.T, parfiles map[int]float64) map[string]map[string]map[int]float64 {
+	t.Helper()
+	times := map[string]map[string]map[int]float64{
+		"s":        {"big": {1: 100}},
+		"parfiles": {"big": parfiles},
+	}
+	path := filepath.Join(t.TempDir(), "speedups.json")
+	speedups := ComputeSpeedups(times, path)
+	// the baseline is read back from the file written
+	loaded, err := LoadSpeedups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, speedups) {
+		t.Fatalf("loaded speedups %v, want %v", loaded, speedups)
+	}
+	return speedups
+}
+
+func TestCompareToBaseline(t *testing.T) {
+	baseline := speedupsOf(t, map[int]float64{2: 50, 4: 25, 8: 20})
+
+	// 4 threads: speedup 4 -> 3.2 (-20%); 8 threads: 5 -> 4.65 (-7%), within the tolerance; 2 threads improved
+	regressed := speedupsOf(t, map[int]float64{2: 40, 4: 31.25, 8: 21.5})
+	want := []Regression{{Mode: "parfiles", DataDir: "big", Threads: 4, Baseline: 4, Current: 3.2}}
+	if got := CompareToBaseline(regressed, baseline, 0.1); !reflect.DeepEqual(got, want) {
+		t.Errorf("got regressions %v, want %v", got, want)
+	}
+
+	improved := speedupsOf(t, map[int]float64{2: 30, 4: 20, 8: 10})
+	if got := CompareToBaseline(improved, baseline, 0.1); len(got) != 0 {
+		t.Errorf("improved speedups reported as regressions: %v", got)
+	}
+
+	// combinations missing from the current results are not compared
+	partial := speedupsOf(t, map[int]float64{2: 50})
+	if got := CompareToBaseline(partial, baseline, 0); len(got) != 0 {
+		t.Errorf("missing combinations reported as regressions: %v", got)
+	}
+}
+
+func TestComputeEfficiencies(t *testing.T) {
+	// compute-only modes are relative to "compute_s", the others to "s"; the sequential modes get no entries
+	times := map[string]map[string]map[int]float64{
+		"s":                 {"big": {1: 64}},
+		"compute_s":         {"big": {1: 32}},
+		"parfiles":          {"big": {1: 64, 2: 32, 4: 32}},
+		"compute_parslices": {"big": {2: 16, 8: 8}},
+	}
+	dir := t.TempDir()
+	speedups := ComputeSpeedups(times, filepath.Join(dir, "speedups.json"))
+	efficiencies := ComputeEfficiencies(speedups, filepath.Join(dir, "efficiencies.json"))
+
+	tests := []struct {
+		mode    string
+		threads int
+		speedup float64
+		eff     float64
+	}{
+		{"parfiles", 2, 2, 1},
+		{"parfiles", 4, 2, 0.5},
+		{"compute_parslices", 2, 2, 1},
+		{"compute_parslices", 8, 4, 0.5},
+	}
+	for _, tt := range tests {
+		if got := speedups[tt.mode]["big"][tt.threads]; got != tt.speedup {
+			t.Errorf("%s with %d threads: speedup %v, want %v", tt.mode, tt.threads, got, tt.speedup)
+		}
+		if got := efficiencies[tt.mode]["big"][tt.threads]; got != tt.eff {
+			t.Errorf("%s with %d threads: efficiency %v, want %v", tt.mode, tt.threads, got, tt.eff)
+		}
+	}
+	for _, mode := range []string{"s", "compute_s"} {
+		if _, ok := efficiencies[mode]; ok {
+			t.Errorf("baseline mode %s has efficiencies", mode)
+		}
+	}
+	// the single-threaded run of a parallel mode has no speedup
+	if _, ok := efficiencies["parfiles"]["big"][1]; ok {
+		t.Errorf("parfiles with 1 thread has an efficiency")
+	}
+}
+
+func TestReadResultsSkipsMalformedLines(t *testing.T) {
+	// as written by concurrent runs: a garbage line, two records interleaved on one line, a record without mode,
+	// blank lines and a record truncated at the end of the file
+	results := `{"mode":"s","threads":1,"timeElapsed":10,"timeParallel":8,"datadir":"small"}
+not json at all
+{"mode":"parfiles","threads":2,"timeElapsed":6,"timeParallel":4,"datadir":"small"}
+{"mode":"parfiles","threads":4,"timeEl{"mode":"s","threads":1,"timeElapsed":11,"timeParallel":9,"datadir":"small"}
+{"threads":8,"timeElapsed":3}
+
+
+{"mode":"parfiles","threads":4,"timeElapsed":4,"timeParallel":2,"datadir":"small"}
+{"mode":"parfiles","threads":8,"timeElap`
+	dataSets, skipped, err := ReadResults(strings.NewReader(results))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 4 {
+		t.Errorf("skipped %d lines, want 4", skipped)
+	}
+	want := map[string][]Data{
+		"s": {{Mode: "s", Threads: 1, TimeElapsed: 10, TimeParallel: 8, DataDir: "small"}},
+		"parfiles": {
+			{Mode: "parfiles", Threads: 2, TimeElapsed: 6, TimeParallel: 4, DataDir: "small"},
+			{Mode: "parfiles", Threads: 4, TimeElapsed: 4, TimeParallel: 2, DataDir: "small"},
+		},
+	}
+	if !reflect.DeepEqual(dataSets, want) {
+		t.Errorf("got %v, want %v", dataSets, want)
+	}
+}
@@ -1,5 +1,7 @@
 package constants
 
+import "time"
+
 var EffectsPathFile = "./data/effects.txt"
 
 var InDir = "./data/in"
@@ -9,4 +11,13 @@ var ResultsPath = "./benchmark/results.txt"
 
 var InitLogCapacity = 6
 
-var PipePhases = 3
\ No newline at end of file
+var PipePhases = 3
+
+var MinRowsPerSlice = 64
+
+var ThumbSize = 128
+
+var MemSampleInterval = 100 * time.Millisecond
+var EventLogBuffer = 4096
+
+var SnapshotInterval = 10 * time.Second
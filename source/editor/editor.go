@@ -1,10 +1,22 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"math"
 	"os"
+	"os/signal"
 	"proj3/scheduler"
+	"proj3/utils"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"proj3/png"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -13,13 +25,278 @@ const usage = "Usage: editor data_dir mode [number of threads]\n" +
 	"mode     = (s) run sequentially, (parfiles) process multiple files in parallel, (parslices) process slices of each image in parallel" +
 				"(pipebsp) run the pipeline version of the program, (pipebspws) run the pipeline version of the program with work stealing.\n" +
 	"[number of threads] = Runs the parallel version of the program with the specified number of threads." +
+	" Either a number (e.g. 4) or a fraction of the CPUs of the machine (e.g. 0.5x or 75%), at least 1.\n" +
 	"[number of sub-threads] = Only for PipeBSP modes. Number of sub-routines each thread can spawn for image processing in slices. Defaults to 1."+
-	"[Chunk size] = Only for PipeBSP modes. Number of images to be processed at the same time. Defaults to all images provided.\n]"
+	"[Chunk size] = Only for PipeBSP modes. Number of images to be processed at the same time. Defaults to all images provided.\n]" +
+	"Benchmark sweep: editor data_dir bench mode thread_counts [repetitions]\n" +
+	"thread_counts = Comma separated list of thread counts to run 'mode' with (e.g. 1,2,4,8 or 1,50%,100%). A sequential baseline is run in each repetition.\n" +
+	"Barrier comparison: editor data_dir barriers thread_counts [repetitions] = bench parslices with each barrier strategy (wg, cond, pool).\n" +
+	"Compute-only sweep: editor data_dir compute mode thread_counts [repetitions] = bench 'mode' (s, parfiles or parslices) timing only the effects,\n" +
+	"  with the images loaded once into memory and no outputs saved. Results are written as compute_<mode>.\n" +
+	"Archive: editor archive_path archive [number of threads] = process the images in a .zip, .tar.gz or .tar archive without unpacking it.\n" +
+	"Version: editor version = print the version, build info and supported modes and effects.\n" +
+	"Work estimate: editor data_dir estimate = print the pixel operations needed to process the images, without processing them.\n" +
+	"Round trip: editor data_dir roundtrip = apply the effects of each image followed by their inverse and check the original image is given back.\n" +
+	"Verify: editor data_dir verify manifest_file = process the images and check the hash of each output against 'manifest_file' (JSON object of output names to SHA-256),\n" +
+	"  without saving them. If 'manifest_file' does not exist, it is created with the hashes of this run.\n" +
+	"Batch: editor data_dir batch state_file number_of_threads = process the images as in parfiles, recording the completed outputs in 'state_file' (JSON).\n" +
+	"  Ctrl+C finishes the images in progress and stops; running the batch again with the same 'state_file' skips the completed outputs.\n" +
+	"Thumbnail grids: editor data_dir thumbgrid number_of_threads = save one grid of thumbnails of the processed images per data directory, e.g. data/out/small_grid.png.\n" +
+	"Replay: editor replay result = run again the run of 'result': a line number of benchmark/results.txt (from 1) or the JSON of a result.\n" +
+	"HTTP server: editor serve [address] [number of threads]\n" +
+	"address = Address to listen on (e.g. :8080). Images are processed with POST /process?effects=B,S.\n" +
+	"Profiling flags (before data_dir): -cpuprofile file = write a CPU profile to 'file', -memprofile file = write a heap profile to 'file'.\n" +
+	"-pinprocs = set GOMAXPROCS to the number of threads during the run.\n" +
+	"-roundrobin = interleave the images among workers instead of dividing them in blocks (PipeBSPWS modes only).\n" +
+	"-steal policy = steal one task (one, default) or half of the victim's queue (half) at a time (PipeBSPWS modes only).\n" +
+	"-peakmem = add the peak heap in use and number of goroutines during the run to the results.\n" +
+	"-phasetimes = add the aggregate time of each pipeline phase to the results (PipeBSP modes only).\n" +
+	"-backlog interval = sample the tasks waiting in each pipeline phase every 'interval' (e.g. 10ms) and print their max and average (PipeBSP modes only).\n" +
+	"-barrier name = synchronize the slices between effects with a WaitGroup (wg, default), a cond variable (cond),\n" +
+	"  or a WaitGroup with a persistent pool of goroutines instead of spawning them for each effect (pool) (parslices only).\n" +
+	"-resultcache mb = cache up to 'mb' megabytes of processed images, so repeated images skip the effects (s, parfiles and parslices only).\n" +
+	"-autosubthreads = process the first images with different sub-thread counts and use the fastest for the rest, up to 'number of sub-threads' or the number of procs if 1 (PipeBSPWS modes only).\n" +
+	"-semaphore = start a goroutine per image, with at most 'number of threads' running at a time (parfiles only).\n" +
+	"-lockfree = workers take the images from a lock-free queue instead of the TAS locked one (parfiles only, without -semaphore).\n" +
+	"-slices strategy = divide images into bands of rows (bands, default), interleaved rows (interleaved) or bands with their own buffers and halo exchange between effects (halo) (parslices and PipeBSP modes only).\n" +
+	"-eventlog file = write the start and finish of each pipeline task and the steals of the workers to 'file', one JSON per line (PipeBSP modes only).\n" +
+	"-loadthreads n, -processthreads n, -savethreads n = number of workers loading, processing and saving the images instead of 'number of threads' (PipeBSP modes only).\n" +
+	"-writers n = save the images with a dedicated pool of 'n' goroutines instead of the phase 3 workers (PipeBSP modes only).\n" +
+	"-sharedpool = the three pipeline phases share one pool of workers instead of one pool each (PipeBSPWS modes only).\n" +
+	"-lifo = each worker processes its most recently added images (last in the effects file) first (PipeBSPWS modes only).\n" +
+	"-shuffle = shuffle the order of the images before distributing them to workers. -seed n = seed of the shuffle (default 1).\n" +
+	"-sort = sort the images by input path before distributing them to workers (not with -shuffle).\n" +
+	"-sample n = process only every n-th image, to preview a large batch. -samplecount n = process only n images at random, chosen with -seed (not with -sample).\n" +
+	"-checkpoint file = record the completed images in 'file'. -resume = skip the images recorded in the checkpoint file.\n" +
+	"-effects chain = apply the effects of 'chain' (comma separated codes, e.g. B,B,S,GL709) to all images of the data directories instead of the entries of effects.txt.\n" +
+	"-direffects file = apply the effect chains in 'file' (JSON object, e.g. {\"small\": [\"G\"]}) to the images of each data directory instead of effects.txt.\n" +
+	"-outarchive file = write the outputs of the archive mode to the archive 'file' instead of the output directory.\n" +
+	"-thumbsize n = side of the thumbnails of the thumbgrid mode, in pixels (default 128).\n" +
+	"-maxpixels n = reject images with more than 'n' pixels (width x height) before decoding them. The server rejects images over 8192 x 8192 pixels if not given.\n" +
+	"-contenthash = embed a hash of the input image and effects in the output names, e.g. IMG_2029_Out.<hash>.png.\n" +
+	"-copyunchanged = copy the source file instead of re-encoding when the effects change no pixel (e.g. no effects).\n" +
+	"-grayout = save outputs whose pixels are all gray and opaque (e.g. after G) as single channel PNGs, 8 or 16 bits, instead of RGBA.\n" +
+	"-provenance = record the effect chain applied to each output in a tEXt chunk of the PNG (e.g. Effects=B,B,S).\n" +
+	"-intermediates = also save the image after each effect, e.g. IMG_Out.step0.png (s, parfiles and parslices only).\n" +
+	"-manifest file = write a JSON array describing each processed image to 'file'.\n" +
+	"-snapshot duration = time between snapshots of the state file of the batch mode, e.g. 30s (default 10s).\n" +
+	"-checkorder = warn about effect chains whose order changes the result.\n" +
+	"-normalize = scale custom kernels (K and KF effects) with a positive sum so they sum to 1; others are left as they are (s, parfiles, parslices and PipeBSP modes only).\n" +
+	"-optimize = merge consecutive blurs into single kernels, saving passes over the image (s, parfiles, parslices and PipeBSP modes only).\n" +
+	"-quality level = trade the precision of the outputs for speed or size: high (default, 16 bits), balanced (as -optimize; channels within 2 of high per merge,\n" +
+	"  amplified by sharpen and edge-detect after the blurs) or fast (as balanced, convolving and saving 8 bits per channel for faster runs and smaller files;\n" +
+	"  within 255 times the sum of the absolute values of each kernel, plus 130, more per convolution).\n" +
+	"-inplace = apply point effects (e.g. grayscale, invert) in place, so images whose effects are all point effects take one buffer instead of two (s, parfiles, parslices and PipeBSP modes only).\n" +
+	"-workerpools = each worker reuses the buffers of the images it already saved instead of allocating new ones (parfiles and batch modes only)."
+
+var cpuProfile = flag.String("cpuprofile", "", "write a CPU profile to this file")
+var memProfile = flag.String("memprofile", "", "write a heap profile to this file")
+var version = flag.Bool("version", false, "print the version, build info and supported modes and effects")
+var pinProcs = flag.Bool("pinprocs", false, "set GOMAXPROCS to the number of threads during the run")
+var roundRobin = flag.Bool("roundrobin", false, "interleave the images among workers instead of dividing them in blocks")
+var stealPolicy = flag.String("steal", "", "tasks stolen at a time: one or half (PipeBSPWS modes only)")
+var peakMem = flag.Bool("peakmem", false, "add the peak heap in use and number of goroutines during the run to the results")
+var phaseTimes = flag.Bool("phasetimes", false, "add the aggregate time of each pipeline phase to the results")
+var backlogInterval = flag.Duration("backlog", 0, "sample the backlog of each pipeline phase at this interval (0 = off)")
+var barrier = flag.String("barrier", "", "barrier strategy between effects: wg, cond or pool (parslices only)")
+var resultCache = flag.Int("resultcache", 0, "megabytes of processed images to cache; 0 disables the cache")
+var autoSubThreads = flag.Bool("autosubthreads", false, "tune the number of sub-threads on the first images (PipeBSPWS modes only)")
+var semaphore = flag.Bool("semaphore", false, "one goroutine per image, bounded by a semaphore (parfiles only)")
+var lockFree = flag.Bool("lockfree", false, "take images from a lock-free queue (parfiles only)")
+var sliceStrategy = flag.String("slices", "", "division of images into slices: bands, interleaved or halo (parslices and PipeBSP modes only)")
+var eventLog = flag.String("eventlog", "", "write the events of the pipeline to this JSONL file (PipeBSP modes only)")
+var loadThreads = flag.Int("loadthreads", 0, "number of phase 1 workers loading the images (PipeBSP modes only)")
+var processThreads = flag.Int("processthreads", 0, "number of phase 2 workers applying the effects (PipeBSP modes only)")
+var saveThreads = flag.Int("savethreads", 0, "number of phase 3 workers saving the images (PipeBSP modes only)")
+var writers = flag.Int("writers", 0, "number of dedicated goroutines saving the images (PipeBSP modes only)")
+var sharedPool = flag.Bool("sharedpool", false, "share one pool of workers among the pipeline phases (PipeBSPWS modes only)")
+var lifo = flag.Bool("lifo", false, "process the most recently added images first (PipeBSPWS modes only)")
+var contentHash = flag.Bool("contenthash", false, "embed a hash of the input image and effects in the output names")
+var shuffle = flag.Bool("shuffle", false, "shuffle the order of the images before distributing them to workers")
+var seed = flag.Int64("seed", 1, "seed of the shuffle")
+var sortTasks = flag.Bool("sort", false, "sort the images by input path before distributing them to workers")
+var sample = flag.Int("sample", 0, "process only every n-th image")
+var sampleCount = flag.Int("samplecount", 0, "process only n images at random, chosen with -seed")
+var checkpoint = flag.String("checkpoint", "", "record the completed images in this file")
+var resume = flag.Bool("resume", false, "skip the images recorded in the checkpoint file")
+var effectChain = flag.String("effects", "", "comma separated effects applied to all images of the data directories instead of effects.txt")
+var dirEffects = flag.String("direffects", "", "JSON file mapping data directories to effect chains")
+var outArchive = flag.String("outarchive", "", "write the outputs of the archive mode to this archive")
+var thumbSize = flag.Int("thumbsize", 0, "side of the thumbnails of the thumbgrid mode, in pixels (0 = default)")
+var maxPixels = flag.Int("maxpixels", 0, "reject images with more than this number of pixels (0 = no limit)")
+var copyUnchanged = flag.Bool("copyunchanged", false, "copy the source file instead of re-encoding when the effects change no pixel")
+var grayOut = flag.Bool("grayout", false, "save gray outputs as single channel PNGs")
+var provenance = flag.Bool("provenance", false, "record the effect chain of each output in a tEXt chunk")
+var intermediates = flag.Bool("intermediates", false, "also save the image after each effect (s, parfiles and parslices only)")
+var manifest = flag.String("manifest", "", "write a JSON array describing each processed image to this file")
+var snapshotInterval = flag.Duration("snapshot", 0, "time between snapshots of the state file of the batch mode (0 = default)")
+var checkOrder = flag.Bool("checkorder", false, "warn about effect chains whose order changes the result")
+var normalizeKernels = flag.Bool("normalize", false, "scale custom kernels with a positive sum to sum 1 (s, parfiles, parslices and PipeBSP modes only)")
+var quality = flag.String("quality", "", "precision of the outputs: high (default), balanced or fast")
+var optimizeChain = flag.Bool("optimize", false, "merge consecutive blurs into single kernels (s, parfiles, parslices and PipeBSP modes only)")
+var inPlace = flag.Bool("inplace", false, "apply point effects in place, with one buffer per image (s, parfiles, parslices and PipeBSP modes only)")
+var workerPools = flag.Bool("workerpools", false, "reuse the buffers of saved images within each worker (parfiles and batch modes only)")
+
+// parseThreadCount parses a thread count: a non-negative integer, or a fraction of `runtime.NumCPU` given as a factor
+// followed by 'x' or a percentage, rounded to the nearest integer and at least 1.
+// eg: 8 CPUs => "2" -> 2; "0.5x" -> 4; "75%" -> 6; "100%" -> 8
+// Returns an error for other values, instead of taking them as 0.
+func parseThreadCount(arg string) (int, error) {
+	factor, isFactor := strings.CutSuffix(arg, "x")
+	percent, isPercent := strings.CutSuffix(arg, "%")
+	if !isFactor && !isPercent {
+		threads, err := strconv.Atoi(arg)
+		if err != nil || threads < 0 {
+			return 0, fmt.Errorf("invalid number of threads %q: expected a number (e.g. 4) or a fraction of the CPUs (e.g. 0.5x or 75%%)", arg)
+		}
+		return threads, nil
+	}
+
+	var fraction float64
+	var err error
+	if isFactor {
+		fraction, err = strconv.ParseFloat(factor, 64)
+	} else {
+		fraction, err = strconv.ParseFloat(percent, 64)
+		fraction /= 100
+	}
+	if err != nil || !(fraction > 0) || math.IsInf(fraction, 0) {
+		return 0, fmt.Errorf("invalid fraction of the CPUs %q: expected a positive factor (e.g. 0.5x) or percentage (e.g. 75%%)", arg)
+	}
+	threads := int(math.Round(fraction * float64(runtime.NumCPU())))
+	if threads < 1 {
+		threads = 1
+	}
+	return threads, nil
+}
+
+// mustParseThreadCount parses a thread count (see `parseThreadCount`), exiting with the error if it is not valid
+func mustParseThreadCount(arg string) int {
+	threads, err := parseThreadCount(arg)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	return threads
+}
+
+// parseThreadCounts parses a comma separated list of thread counts (see `parseThreadCount`). eg: "1,2,4,8"; "1,50%,100%"
+func parseThreadCounts(arg string) []int {
+	var counts []int
+	for _, t := range strings.Split(arg, ",") {
+		counts = append(counts, mustParseThreadCount(t))
+	}
+	return counts
+}
+
+// parseRepetitions parses the number of repetitions of a sweep: a positive integer.
+// Returns an error for other values, instead of taking them as 0 repetitions.
+func parseRepetitions(arg string) (int, error) {
+	repetitions, err := strconv.Atoi(arg)
+	if err != nil || repetitions < 1 {
+		return 0, fmt.Errorf("invalid number of repetitions %q: expected a positive number (e.g. 3)", arg)
+	}
+	return repetitions, nil
+}
+
+// mustParseRepetitions parses the number of repetitions of a sweep (see `parseRepetitions`), exiting with the error
+// and the usage if it is not valid
+func mustParseRepetitions(arg string) int {
+	repetitions, err := parseRepetitions(arg)
+	if err != nil {
+		fmt.Println("Error:", err)
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	return repetitions
+}
+
+// printVersion prints the module version and build info, and the modes and effects supported.
+func printVersion() {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		fmt.Printf("editor %s %s\n", info.Main.Path, info.Main.Version)
+		fmt.Printf("go: %s\n", info.GoVersion)
+		for _, setting := range info.Settings {
+			// only the settings relevant for reproducibility: commit, platform
+			if strings.HasPrefix(setting.Key, "vcs.") || setting.Key == "GOOS" || setting.Key == "GOARCH" {
+				fmt.Printf("%s: %s\n", setting.Key, setting.Value)
+			}
+		}
+	} else {
+		fmt.Println("editor (build info not available)")
+	}
+	fmt.Printf("modes: %s\n", strings.Join(scheduler.Modes(), " "))
+	fmt.Printf("effects: %s\n", strings.Join(png.Effects(), " "))
+}
+
+// startProfiling starts the CPU profile (if requested) and returns a function that stops it
+// and writes the heap profile (if requested). The returned function is safe to call more than once,
+// so it can be used in every exit path (normal return, panic and signals).
+// reference: https://pkg.go.dev/runtime/pprof
+func startProfiling() func() {
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			fmt.Println("could not create CPU profile:", err)
+			os.Exit(1)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			fmt.Println("could not start CPU profile:", err)
+			os.Exit(1)
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if *cpuProfile != "" {
+				pprof.StopCPUProfile()
+			}
+			if *memProfile != "" {
+				f, err := os.Create(*memProfile)
+				if err != nil {
+					fmt.Println("could not create memory profile:", err)
+					return
+				}
+				defer f.Close()
+				// get up-to-date statistics
+				runtime.GC()
+				if err := pprof.WriteHeapProfile(f); err != nil {
+					fmt.Println("could not write memory profile:", err)
+				}
+			}
+		})
+	}
+}
 
 
 func main() {
 
-	// for debugging
+	// Parse profiling flags; the remaining (positional) arguments are parsed below as usual
+	flag.Parse()
+	os.Args = append(os.Args[:1], flag.Args()...)
+
+	// Flush the profiles on all exit paths: normal return, panics and interrupts
+	stopProfiling := startProfiling()
+	defer stopProfiling()
+	defer func() {
+		if r := recover(); r != nil {
+			stopProfiling()
+			panic(r)
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		stopProfiling()
+		os.Exit(1)
+	}()
+
+	if *version || (len(os.Args) > 1 && os.Args[1] == "version") {
+		printVersion()
+		return
+	}
 
 	if len(os.Args) < 2 {
 		fmt.Println(usage)
@@ -28,14 +305,171 @@ func main() {
 
 	config := scheduler.Config{DataDirs: "", Mode: "", ThreadCount: 0, SubThreadCount: 0}
 	config.DataDirs = os.Args[1]
+	config.PinProcs = *pinProcs
+	config.CheckOrder = *checkOrder
+	config.OptimizeChain = *optimizeChain
+	config.Quality = *quality
+	config.NormalizeKernels = *normalizeKernels
+	config.InPlace = *inPlace
+	config.WorkerPools = *workerPools
+	config.PhaseTimes = *phaseTimes
+	config.BacklogInterval = *backlogInterval
+	config.RoundRobin = *roundRobin
+	config.StealPolicy = *stealPolicy
+	config.PeakMem = *peakMem
+	config.CheckpointPath = *checkpoint
+	config.Resume = *resume
+	config.ManifestPath = *manifest
+	config.SaveIntermediates = *intermediates
+	config.CopyUnchanged = *copyUnchanged
+	config.EmbedProvenance = *provenance
+	config.GrayOutput = *grayOut
+	config.Barrier = *barrier
+	config.Writers = *writers
+	config.SharedPool = *sharedPool
+	config.LIFO = *lifo
+	config.ContentHash = *contentHash
+	config.Semaphore = *semaphore
+	config.LockFreeQueue = *lockFree
+	config.AutoSubThreads = *autoSubThreads
+	config.SliceStrategy = *sliceStrategy
+	config.EventLog = *eventLog
+	config.LoadThreads = *loadThreads
+	config.ProcessThreads = *processThreads
+	config.SaveThreads = *saveThreads
+	config.ResultCacheSize = *resultCache << 20
+	config.Shuffle = *shuffle
+	config.Seed = *seed
+	config.SortTasks = *sortTasks
+	config.Sample = *sample
+	config.SampleCount = *sampleCount
+	config.MaxPixels = *maxPixels
+	config.OutArchive = *outArchive
+	config.ThumbSize = *thumbSize
+	config.SnapshotInterval = *snapshotInterval
+	if *effectChain != "" {
+		effects, err := png.ParseEffectChain(*effectChain)
+		if err != nil {
+			fmt.Println("Error parsing effects:", err)
+			os.Exit(1)
+		}
+		config.Effects = effects
+	}
+	if *dirEffects != "" {
+		effects, err := utils.LoadDirEffects(*dirEffects)
+		if err != nil {
+			fmt.Println("Error loading per-directory effects:", err)
+			os.Exit(1)
+		}
+		config.DirEffects = effects
+	}
+
+	// HTTP server: parse the address and number of threads
+	if os.Args[1] == "serve" {
+		config.DataDirs = ""
+		config.Mode = "serve"
+		if len(os.Args) > 2 {
+			config.Addr = os.Args[2]
+		}
+		config.ThreadCount = 1
+		if len(os.Args) > 3 {
+			config.ThreadCount = mustParseThreadCount(os.Args[3])
+		}
+		scheduler.Schedule(config)
+		return
+	}
+
+	// Replay: the settings are those of the result; flags other than the profiling ones are ignored
+	if os.Args[1] == "replay" {
+		if len(os.Args) < 3 {
+			fmt.Println(usage)
+			return
+		}
+		result, err := scheduler.ReadResult(os.Args[2])
+		if err == nil {
+			config, err = scheduler.ConfigFromResult(result)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		start := time.Now()
+		scheduler.Schedule(config)
+		fmt.Printf("%.2f\n", time.Since(start).Seconds())
+		return
+	}
+
+	// Benchmark sweep: parse the mode to benchmark, thread counts and repetitions
+	// obs: the compute-only sweep takes the same arguments
+	if len(os.Args) > 4 && (os.Args[2] == "bench" || os.Args[2] == "compute") {
+		config.Mode = os.Args[2]
+		config.BenchMode = os.Args[3]
+		config.BenchThreads = parseThreadCounts(os.Args[4])
+		config.BenchRepeat = 1
+		if len(os.Args) > 5 {
+			config.BenchRepeat = mustParseRepetitions(os.Args[5])
+		}
+		config.SubThreadCount = 1
+
+		start := time.Now()
+		scheduler.Schedule(config)
+		fmt.Printf("%.2f\n", time.Since(start).Seconds())
+		return
+	}
+
+	// Barrier comparison: parse thread counts and repetitions as in the benchmark sweep
+	if len(os.Args) > 3 && os.Args[2] == "barriers" {
+		config.Mode = "barriers"
+		config.BenchThreads = parseThreadCounts(os.Args[3])
+		config.BenchRepeat = 1
+		if len(os.Args) > 4 {
+			config.BenchRepeat = mustParseRepetitions(os.Args[4])
+		}
+
+		start := time.Now()
+		scheduler.Schedule(config)
+		fmt.Printf("%.2f\n", time.Since(start).Seconds())
+		return
+	}
+
+	// Verification: path of the manifest of hashes
+	if len(os.Args) > 3 && os.Args[2] == "verify" {
+		config.Mode = os.Args[2]
+		config.HashManifest = os.Args[3]
+		scheduler.Schedule(config)
+		return
+	}
+
+	// Batch: path of the state file and number of threads
+	// obs: interrupts cancel the batch instead of exiting, so the images in progress are finished and snapshotted
+	if len(os.Args) > 4 && os.Args[2] == "batch" {
+		config.Mode = os.Args[2]
+		config.StatePath = os.Args[3]
+		config.ThreadCount = mustParseThreadCount(os.Args[4])
+		signal.Stop(signals)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		config.Context = ctx
+
+		start := time.Now()
+		scheduler.Schedule(config)
+		fmt.Printf("%.2f\n", time.Since(start).Seconds())
+		return
+	}
+
+	// Work estimate and round trip check: no other arguments
+	if len(os.Args) > 2 && (os.Args[2] == "estimate" || os.Args[2] == "roundtrip") {
+		config.Mode = os.Args[2]
+		scheduler.Schedule(config)
+		return
+	}
 
 	// Parse command line arguments
 	
 	// If # threads not specified, default to sequential mode
 	if len(os.Args) > 3 {
 		config.Mode = os.Args[2]
-		threads, _ := strconv.Atoi(os.Args[3])
-		config.ThreadCount = threads
+		config.ThreadCount = mustParseThreadCount(os.Args[3])
 	} else {
 		config.Mode = "s"
 	}
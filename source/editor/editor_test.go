@@ -0,0 +1,156 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"proj3/png"
+	"proj3/scheduler"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// readProfile returns the uncompressed contents of the profile at 'path' (pprof writes gzipped protobufs)
+func readProfile(t *testing.T, path string) []byte {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("%s is not a gzipped profile: %v", path, err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	return data
+}
+
+func TestProfiling(t *testing.T) {
+	dir := t.TempDir()
+	oldCPU, oldMem := *cpuProfile, *memProfile
+	defer func() { *cpuProfile, *memProfile = oldCPU, oldMem }()
+	*cpuProfile, *memProfile = filepath.Join(dir, "cpu.prof"), filepath.Join(dir, "mem.prof")
+
+	stopProfiling := startProfiling()
+	// a short run: a few blurs of a small image
+	img := png.NewImage(200, 200)
+	img.ApplyEffects(png.CreateKernels([]string{"B", "B", "B", "S"}))
+	stopProfiling()
+	// safe to call again on another exit path; the profiles are written once
+	stopProfiling()
+
+	for _, path := range []string{*cpuProfile, *memProfile} {
+		if data := readProfile(t, path); len(data) == 0 {
+			t.Errorf("%s is empty", path)
+		}
+	}
+}
+
+// captureStdout returns what 'f' prints to the standard output
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	f()
+	writer.Close()
+	out, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestPrintVersion(t *testing.T) {
+	out := captureStdout(t, printVersion)
+	lines := map[string][]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if key, value, found := strings.Cut(line, ": "); found {
+			lines[key] = strings.Fields(value)
+		}
+	}
+	if !reflect.DeepEqual(lines["modes"], scheduler.Modes()) {
+		t.Errorf("modes printed %v, want %v", lines["modes"], scheduler.Modes())
+	}
+	if !reflect.DeepEqual(lines["effects"], png.Effects()) {
+		t.Errorf("effects printed %v, want %v", lines["effects"], png.Effects())
+	}
+	// the modes and built-in effects documented in the usage
+	for _, mode := range []string{"s", "parfiles", "parslices", "pipebsp", "pipebspws"} {
+		if !contains(lines["modes"], mode) {
+			t.Errorf("mode %q not printed in %v", mode, lines["modes"])
+		}
+	}
+	for _, effect := range []string{"B", "S", "E", "G"} {
+		if !contains(lines["effects"], effect) {
+			t.Errorf("effect %q not printed in %v", effect, lines["effects"])
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestParseThreadCount(t *testing.T) {
+	nCPU := runtime.NumCPU()
+	atLeastOne := func(n int) int {
+		if n < 1 {
+			return 1
+		}
+		return n
+	}
+	tests := []struct {
+		arg  string
+		want int
+	}{
+		{"2", 2},
+		{"0", 0},
+		{"0.5x", atLeastOne(int(math.Round(0.5 * float64(nCPU))))},
+		{"2x", 2 * nCPU},
+		{"100%", nCPU},
+		{"75%", atLeastOne(int(math.Round(0.75 * float64(nCPU))))},
+		// tiny fractions still run one thread
+		{"0.001x", 1},
+	}
+	for _, test := range tests {
+		if got, err := parseThreadCount(test.arg); err != nil || got != test.want {
+			t.Errorf("parseThreadCount(%q) = %d, %v; want %d", test.arg, got, err, test.want)
+		}
+	}
+	for _, arg := range []string{"", "four", "-2", "1.5", "0x", "-50%", "x", "%", "NaNx", "Infx", "50%x"} {
+		if got, err := parseThreadCount(arg); err == nil {
+			t.Errorf("parseThreadCount(%q) = %d, want an error", arg, got)
+		}
+	}
+}
+
+func TestParseRepetitions(t *testing.T) {
+	for arg, want := range map[string]int{"1": 1, "3": 3, "10": 10} {
+		if got, err := parseRepetitions(arg); err != nil || got != want {
+			t.Errorf("parseRepetitions(%q) = %d, %v; want %d", arg, got, err, want)
+		}
+	}
+	for _, arg := range []string{"", "three", "0", "-1", "1.5", "3x", " 3"} {
+		if got, err := parseRepetitions(arg); err == nil {
+			t.Errorf("parseRepetitions(%q) = %d, want an error", arg, got)
+		}
+	}
+}
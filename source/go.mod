@@ -1,8 +1,12 @@
 module proj3
 
-go 1.19
+go 1.20
 
-require gonum.org/v1/plot v0.13.0
+require (
+	github.com/BurntSushi/toml v1.3.2
+	gonum.org/v1/plot v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	git.sr.ht/~sbinet/gg v0.4.1 // indirect
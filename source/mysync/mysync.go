@@ -1,6 +1,7 @@
 package mysync
 
 import (
+	"sync"
 	"sync/atomic"
 	"runtime"
 	"bytes"
@@ -42,9 +43,9 @@ func (aBool *atomicBoolean) GetAndSet(newVal bool) bool{
 	return intToBool(oldVal)
 }
 
-// Set sets the value of atomicBoolean. Obs: not thread safe
+// Set sets the value of atomicBoolean
 func (aBool *atomicBoolean) Set(newVal bool){
-	aBool.value = boolToInt(newVal)
+	atomic.StoreUint32(&aBool.value, boolToInt(newVal))
 }
 
 //==============================================================================
@@ -101,6 +102,68 @@ func ExecuteOne(counter *int, tLock *TASLock,  nThreads int, function func()) {
 	tLock.Unlock()
 }
 
+//==============================================================================
+// Semaphore struct and methods
+//==============================================================================
+
+// Semaphore bounds the number of goroutines holding it at the same time to its 'limit'.
+// The limit can be changed while the semaphore is in use (see `SetLimit`).
+// @held: number of goroutines holding the semaphore
+// @cond: signaled when the semaphore is released or the limit raised, to wake up goroutines waiting in `Acquire`
+type Semaphore struct{
+	mutex sync.Mutex
+	cond  *sync.Cond
+	limit int
+	held  int
+}
+
+// Creates a new Semaphore struct with the given 'limit' (at least 1) and returns a pointer to it
+func NewSemaphore(limit int) *Semaphore{
+	sem := &Semaphore{limit: 1}
+	sem.cond = sync.NewCond(&sem.mutex)
+	sem.SetLimit(limit)
+	return sem
+}
+
+// Acquire blocks until fewer than 'limit' goroutines hold the semaphore, then holds it.
+// Must be followed by a `Release`.
+func (sem *Semaphore) Acquire() {
+	sem.mutex.Lock()
+	for sem.held >= sem.limit {
+		sem.cond.Wait()
+	}
+	sem.held++
+	sem.mutex.Unlock()
+}
+
+// Release releases the semaphore held by the caller
+func (sem *Semaphore) Release() {
+	sem.mutex.Lock()
+	sem.held--
+	sem.mutex.Unlock()
+	sem.cond.Signal()
+}
+
+// SetLimit sets the number of goroutines that can hold the semaphore at the same time (at least 1).
+// Raising the limit wakes up waiting goroutines right away; lowering it takes effect as holders release it,
+// i.e., no holder is preempted.
+func (sem *Semaphore) SetLimit(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	sem.mutex.Lock()
+	sem.limit = limit
+	sem.mutex.Unlock()
+	sem.cond.Broadcast()
+}
+
+// Limit returns the current limit of the semaphore
+func (sem *Semaphore) Limit() int {
+	sem.mutex.Lock()
+	defer sem.mutex.Unlock()
+	return sem.limit
+}
+
 //==============================================================================
 // Methods for debugging
 //==============================================================================
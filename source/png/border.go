@@ -0,0 +1,76 @@
+package png
+
+import (
+	"image"
+	"image/color"
+)
+
+//=============================================================================
+// Borders and frames
+//=============================================================================
+
+// Border draws a solid border of color 'c', 'width' pixels wide, around the image (its last modified buffer),
+// eg: for contact sheets and galleries. The result becomes the last modified buffer, as after an effect.
+// If 'expand' is false, the border is drawn inside: the outer 'width' pixels of each side are replaced by 'c'
+// and the interior is copied, so the size is kept. Images narrower than twice 'width' are filled with 'c'.
+// If 'expand' is true, the image is framed instead: both buffers are reallocated 'width' pixels larger on each side,
+// with the image copied at the center, and 'Bounds' is updated. eg: 400x300, width 10 => 420x320
+// A 'width' below 1 leaves the image as is.
+// Obs: the border ignores the mask (see `SetMask`); expanding removes it, as it no longer has the bounds of the image.
+func Border(img *Image, width int, c color.RGBA64, expand bool) {
+	if width < 1 {
+		return
+	}
+	inputPixels, outputPixels := img.GetInputOutputPixels()
+	inPlace := img.InPlace()
+	bounds := img.Bounds
+	if expand {
+		// obs: the new buffers start at (0, 0); the image is placed at (width, width)
+		bounds = image.Rect(0, 0, img.Bounds.Dx()+2*width, img.Bounds.Dy()+2*width)
+		outputPixels = image.NewRGBA64(bounds)
+		for y := img.Bounds.Min.Y; y < img.Bounds.Max.Y; y++ {
+			start := inputPixels.PixOffset(img.Bounds.Min.X, y)
+			end := inputPixels.PixOffset(img.Bounds.Max.X, y)
+			copy(outputPixels.Pix[outputPixels.PixOffset(width, y-img.Bounds.Min.Y+width):], inputPixels.Pix[start:end])
+		}
+	} else if !inPlace {
+		// obs: in place, the interior is already in the buffer the frame is drawn on
+		copyPixels(inputPixels, outputPixels, bounds.Min.Y, bounds.Max.Y, bounds.Min.X, bounds.Max.X)
+	}
+	drawFrame(outputPixels, bounds, width, c)
+
+	if expand {
+		// the framed image is the original of the new buffers; its source pixels are lost
+		img.in = outputPixels
+		img.out = outputPixels
+		if !inPlace {
+			img.out = image.NewRGBA64(bounds)
+		}
+		img.Bounds = bounds
+		img.Final = 0
+		img.mask = nil
+		img.srcOverwritten = true
+	} else {
+		if outputPixels == img.in {
+			img.srcOverwritten = true
+		}
+		img.Final = 1 - img.Final
+	}
+	// a colored border makes a gray image colored (see `IsGray`)
+	if c.R != c.G || c.G != c.B {
+		img.isGray = false
+	}
+}
+
+// drawFrame sets the pixels of 'pixels' within 'width' of the edges of 'bounds' to 'c'
+func drawFrame(pixels *image.RGBA64, bounds image.Rectangle, width int, c color.RGBA64) {
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		// rows of the top and bottom borders are filled; the others only at their ends
+		edgeRow := y < bounds.Min.Y+width || y >= bounds.Max.Y-width
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if edgeRow || x < bounds.Min.X+width || x >= bounds.Max.X-width {
+				pixels.SetRGBA64(x, y, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBorder(t *testing.T) {
+	red := color.RGBA64{65535, 0, 0, 65535}
+	source := gradient(20, 12)
+	// loads the source with two buffers or, if 'inPlace', one, inverted so the last modified buffer is the second
+	load := func(inPlace bool) *Image {
+		t.Helper()
+		var img *Image
+		var err error
+		if path := writePNG(t, "img.png", source); inPlace {
+			img, err = LoadInPlace(path)
+		} else {
+			img, err = Load(path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		img.ApplyEffects(CreateKernels([]string{"I"}))
+		return img
+	}
+	want := applyEffect(t, source, "I")
+
+	for _, inPlace := range []bool{false, true} {
+		// inside: the outer 3 pixels are red, the interior as it was, and the size is kept
+		img := load(inPlace)
+		Border(img, 3, red, false)
+		final, _ := img.GetInputOutputPixels()
+		if img.Bounds != source.Bounds() || img.InPlace() != inPlace {
+			t.Fatalf("in place %v: bounds %v and in place %v after the border", inPlace, img.Bounds, img.InPlace())
+		}
+		for y := 0; y < 12; y++ {
+			for x := 0; x < 20; x++ {
+				border := x < 3 || x >= 17 || y < 3 || y >= 9
+				if px := final.RGBA64At(x, y); border && px != red || !border && px != want.RGBA64At(x, y) {
+					t.Fatalf("in place %v: pixel (%d, %d) is %v, border %v", inPlace, x, y, px, border)
+				}
+			}
+		}
+		if img.IsGray() {
+			t.Errorf("in place %v: the image is gray after a red border", inPlace)
+		}
+
+		// expanded: a 2 pixel frame around the whole image, in new buffers
+		img = load(inPlace)
+		Border(img, 2, red, true)
+		final, _ = img.GetInputOutputPixels()
+		if img.Bounds != image.Rect(0, 0, 24, 16) || final.Bounds() != img.Bounds || img.InPlace() != inPlace {
+			t.Fatalf("in place %v: expanded to bounds %v, buffer %v, in place %v; want 24x16",
+				inPlace, img.Bounds, final.Bounds(), img.InPlace())
+		}
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 24; x++ {
+				border := x < 2 || x >= 22 || y < 2 || y >= 14
+				if px := final.RGBA64At(x, y); border && px != red || !border && px != want.RGBA64At(x-2, y-2) {
+					t.Fatalf("in place %v: expanded pixel (%d, %d) is %v, border %v", inPlace, x, y, px, border)
+				}
+			}
+		}
+		// effects go on from the framed image
+		img.ApplyEffects(CreateKernels([]string{"I"}))
+		if final, _ = img.GetInputOutputPixels(); final.RGBA64At(0, 0) != (color.RGBA64{0, 65535, 65535, 65535}) {
+			t.Errorf("in place %v: inverted frame is %v", inPlace, final.RGBA64At(0, 0))
+		}
+	}
+
+	// a border of width 0 is a no-op, and one wider than half the image fills it
+	img := NewImageFromRGBA64(cloneRGBA64(source))
+	Border(img, 0, red, false)
+	if final, _ := img.GetInputOutputPixels(); !equalPixels(final, source) {
+		t.Error("a border of width 0 changed the image")
+	}
+	Border(img, 7, red, false)
+	if final, _ := img.GetInputOutputPixels(); !equalPixels(final, uniformOf(20, 12, red)) {
+		t.Error("a border wider than half the image did not fill it")
+	}
+}
+
+// uniformOf returns a 'width' x 'height' image of color 'c'
+func uniformOf(width, height int, c color.RGBA64) *image.RGBA64 {
+	pixels := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixels.SetRGBA64(x, y, c)
+		}
+	}
+	return pixels
+}
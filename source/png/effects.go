@@ -3,19 +3,65 @@
 package png
 
 import (
+	"bufio"
+	"errors"
 	"image/color"
 	"math"
 	"image"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
-// hashmap of effects and their corresponding kernels in this project
+// hashmap of effects and their corresponding kernels in this project; more can be added with `RegisterEffect`
+// obs: guarded by 'effectsMu', since effects may be registered while kernels are created by other goroutines.
+// Read it with `effectValues`, which copies the values, so kernels never share them with the map.
 var effects = map[string][]float64{
 	"S": {0, -1, 0, -1, 5, -1, 0, -1, 0},
 	"E": {-1, -1, -1, -1, 8, -1, -1, -1, -1},
 	"B": {1/9.0, 1/9.0, 1/9.0, 1/9.0, 1/9.0, 1/9.0, 1/9.0, 1/9.0, 1/9.0},
 }
 
+var effectsMu sync.RWMutex
+
+// effectValues returns a copy of the kernel values of 'effect' in `effects`; false if it is not one of them.
+// The copy can be modified (eg: normalized) without changing the kernels of other images.
+func effectValues(effect string) ([]float64, bool) {
+	effectsMu.RLock()
+	defer effectsMu.RUnlock()
+	values, ok := effects[effect]
+	if !ok {
+		return nil, false
+	}
+	return append([]float64(nil), values...), true
+}
+
+// RegisterEffect adds the convolution effect 'code' with the kernel 'values', given row by row, to `effects`,
+// so it can be used in effect chains as the built-in ones. eg: RegisterEffect("EMB", []float64{-2, -1, 0, -1, 1, 1, 0, 1, 2})
+// The kernel must be square with an odd side. 'values' is copied; it can be reused by the caller.
+// Returns an error if 'code' is empty or already a valid effect (see `ValidEffect`), or if the kernel is not square.
+// Safe to call while kernels are created by other goroutines; kernels created before keep their values.
+func RegisterEffect(code string, values []float64) error {
+	dim := int(math.Sqrt(float64(len(values))))
+	if dim*dim != len(values) || dim%2 == 0 {
+		return fmt.Errorf("kernel of effect %q has %d values: expected a square with an odd side", code, len(values))
+	}
+	if code == "" || ValidEffect(code) {
+		return fmt.Errorf("invalid effect code %q: empty or already an effect", code)
+	}
+	effectsMu.Lock()
+	defer effectsMu.Unlock()
+	// obs: checked again, in case it was registered since `ValidEffect`
+	if _, ok := effects[code]; ok {
+		return fmt.Errorf("invalid effect code %q: empty or already an effect", code)
+	}
+	effects[code] = append([]float64(nil), values...)
+	return nil
+}
+
 //=============================================================================
 // Kernel struct and methods
 //=============================================================================
@@ -23,14 +69,615 @@ var effects = map[string][]float64{
 // Kernel struct represents a kernel to be applied to an image
 // @values: array of kernel values
 // @size: number of elements in the kernel
-// @dim: dimension of the kernel (i.e., dim x dim)
-// @center: index of the center element of the kernel
-// obs: all kernels in this project are assumed to be square matrices
+// @rows, cols: dimensions of the kernel (i.e., rows x cols), both odd
+// @centerRow, centerCol: indexes of the row and column of the center element of the kernel
+// @effect: effect code without its parameter. eg: "VIG0.5" -> "VIG"
+// @param: parameter of the effect, if any. eg: "VIG0.5" -> 0.5
+// @matrix: coefficients of the color matrix effect, row by row (see `ColorMatrix`)
+// @keepAlpha: convolutions only. If true, the alpha of the source is kept instead of made opaque (see `alphaEffect`)
+// @equalization: auto-contrast only. Lookup table of the image, built once for all slices (see `equalization`)
+// @weights: luminosity grayscale only. Coefficients of the red, green and blue channels (see `lumaWeights`)
+// @dithering: dithering only. Levels of the palette; the whole image is dithered once for all slices (see `dithering`)
+// @lut: lookup table only. Mapping of each channel, shared by all kernels of the same table (see `LoadLUT`)
+// @stages: merged convolutions only. Kernels merged into this one, in the order they apply (see `OptimizeChain`)
+// @fixed: convolutions only. Values in fixed point, if set to convolve 8 bit channels (see `SetEightBit`)
+// obs: the kernels of the effects in `effects` are square; custom kernels may be rectangular (see `parseCustomKernel`)
+// obs: point effects (eg: vignette) have no kernel values; `effect` selects the operation to apply.
+// obs: composite effects (eg: binary edges) have the values of their convolution and a point op applied after it.
 type Kernel struct{
 	values []float64
 	size int
-	dim int
-	center int
+	rows int
+	cols int
+	centerRow int
+	centerCol int
+	effect string
+	param float64
+	matrix [9]float64
+	keepAlpha bool
+	equalization *equalization
+	weights [3]float64
+	dithering *dithering
+	lut [3][]uint16
+	stages []*Kernel
+	fixed []int64
+}
+
+// Effects with a parameter, given as the effect code followed by a number. eg: "VIG0.5"
+// The values are the valid range of the parameter.
+var paramEffects = map[string][2]float64{
+	"VIG": {0, 1},		// vignette: darkening at the corners
+	"T":   {0, 255},	// threshold: luminosity cutoff (8-bit scale) for black/white
+	"EB":  {0, 255},	// binary edges: edge-detect followed by threshold at the given cutoff
+}
+
+// Composite effects: convolution with the kernel of another effect followed by a point op.
+// eg: "EB128" => convolution with the "E" kernel, then threshold at 128
+var convolutionOf = map[string]string{
+	"EB": "E",
+}
+
+// parseParamEffect splits an effect with a parameter into its code and parameter. eg: "VIG0.5" -> "VIG", 0.5
+// Returns false if 'effect' is not a valid effect with a parameter.
+func parseParamEffect(effect string) (string, float64, bool) {
+	for code, paramRange := range paramEffects {
+		if !strings.HasPrefix(effect, code) {
+			continue
+		}
+		param, err := strconv.ParseFloat(effect[len(code):], 64)
+		if err != nil || param < paramRange[0] || param > paramRange[1] {
+			return "", 0, false
+		}
+		return code, param, true
+	}
+	return "", 0, false
+}
+
+// Color matrix effect: "CM" followed by the 9 coefficients of the matrix, row by row, separated by ':'.
+// eg: "CM0:0:1:0:1:0:1:0:0" swaps the red and blue channels (see `ColorMatrix`)
+// obs: ':' instead of ',' so the effect can be given in comma separated lists (eg: the effects of the serve mode)
+const colorMatrixCode = "CM"
+
+// parseColorMatrix parses the coefficients of a color matrix effect. eg: "CM1:0:0:0:1:0:0:0:1" -> identity
+// Returns false if 'effect' is not a valid color matrix effect.
+func parseColorMatrix(effect string) ([9]float64, bool) {
+	var matrix [9]float64
+	if !strings.HasPrefix(effect, colorMatrixCode) {
+		return matrix, false
+	}
+	coefficients := strings.Split(effect[len(colorMatrixCode):], ":")
+	if len(coefficients) != len(matrix) {
+		return matrix, false
+	}
+	for i, coefficient := range coefficients {
+		value, err := strconv.ParseFloat(coefficient, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return matrix, false
+		}
+		matrix[i] = value
+	}
+	return matrix, true
+}
+
+// Custom convolution effect: "K" followed by the dimensions of the kernel as <rows>x<cols> and its values,
+// row by row, separated by ':'. Dimensions must be odd so the kernel has a center element.
+// eg: "K1x5:0.2:0.2:0.2:0.2:0.2" => horizontal blur; "K3x1:0.25:0.5:0.25" => vertical blur
+const customKernelCode = "K"
+
+// parseCustomKernel parses the dimensions and values of a custom convolution effect. eg: "K1x3:1:0:-1" -> 1, 3, [1 0 -1]
+// Returns false if 'effect' is not a valid custom kernel.
+func parseCustomKernel(effect string) (int, int, []float64, bool) {
+	if !strings.HasPrefix(effect, customKernelCode) {
+		return 0, 0, nil, false
+	}
+	fields := strings.Split(effect[len(customKernelCode):], ":")
+	dims := strings.Split(fields[0], "x")
+	if len(dims) != 2 {
+		return 0, 0, nil, false
+	}
+	rows, errRows := strconv.Atoi(dims[0])
+	cols, errCols := strconv.Atoi(dims[1])
+	if errRows != nil || errCols != nil || rows < 1 || cols < 1 || rows%2 == 0 || cols%2 == 0 ||
+		len(fields)-1 != rows*cols {
+		return 0, 0, nil, false
+	}
+	values := make([]float64, rows*cols)
+	for i, field := range fields[1:] {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return 0, 0, nil, false
+		}
+		values[i] = value
+	}
+	return rows, cols, values, true
+}
+
+// Kernel file effect: "KF" followed by the path of a text file with the values of a custom kernel. eg: "KFsobel.txt"
+// The file holds the matrix of the kernel as written by numpy.savetxt: one row per line, values separated by whitespace.
+// Rows must have the same number of values and both dimensions must be odd, as for "K" (see `customKernelCode`).
+// Empty lines and lines starting with '#' are ignored.
+const kernelFileCode = "KF"
+
+// kernelFiles caches the kernels of the files given in effects by path, so they are read once (see `parseKernelFile`)
+var kernelFiles = struct {
+	sync.Mutex
+	kernels map[string]*Kernel
+}{kernels: make(map[string]*Kernel)}
+
+// LoadKernelMatrix returns the custom convolution kernel in the text file at 'path' (see `kernelFileCode`).
+// Returns an error naming the line for rows with a different number of values than the first one (ragged rows)
+// and values that are not finite numbers, and an error for empty matrices and even dimensions.
+func LoadKernelMatrix(path string) (*Kernel, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var values []float64
+	rows, cols := 0, 0
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if rows == 0 {
+			cols = len(fields)
+		} else if len(fields) != cols {
+			return nil, fmt.Errorf("%s:%d: ragged row with %d values, expected %d as the first row", path, line, len(fields), cols)
+		}
+		for _, field := range fields {
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				return nil, fmt.Errorf("%s:%d: invalid value %q: expected a finite number", path, line, field)
+			}
+			values = append(values, value)
+		}
+		rows++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, fmt.Errorf("%s: no kernel values", path)
+	}
+	if rows%2 == 0 || cols%2 == 0 {
+		return nil, fmt.Errorf("%s: kernel of %dx%d values; both dimensions must be odd", path, rows, cols)
+	}
+	kernel := &Kernel{effect: customKernelCode}
+	kernel.setRectValues(values, rows, cols)
+	return kernel, nil
+}
+
+// parseKernelFile returns the kernel of a kernel file effect. eg: "KFsobel.txt" -> kernel in sobel.txt
+// Returns false if 'effect' is not a kernel file effect or its file can't be loaded (see `LoadKernelMatrix`).
+// obs: kernels are cached by path; each call returns a copy, sharing the values, which are never modified.
+func parseKernelFile(effect string) (*Kernel, bool) {
+	path, ok := strings.CutPrefix(effect, kernelFileCode)
+	if !ok || path == "" {
+		return nil, false
+	}
+	kernelFiles.Lock()
+	defer kernelFiles.Unlock()
+	kernel, ok := kernelFiles.kernels[path]
+	if !ok {
+		var err error
+		if kernel, err = LoadKernelMatrix(path); err != nil {
+			return nil, false
+		}
+		kernelFiles.kernels[path] = kernel
+	}
+	kernelCopy := *kernel
+	return &kernelCopy, true
+}
+
+// Motion blur effect: "MB" followed by the length of the streak in pixels (odd, 1-99) and its angle in degrees,
+// counterclockwise from the horizontal, separated by '@'. eg: "MB9@0" => horizontal; "MB9@90" => vertical
+// The kernel is a line of the given length through its center, rasterized in the smallest grid holding it
+// (see `motionBlurValues`), so horizontal and vertical motion blurs have 1 x len and len x 1 kernels.
+const motionBlurCode = "MB"
+
+// parseMotionBlur parses the length and angle of a motion blur effect. eg: "MB9@45" -> 9, 45
+// Returns false if 'effect' is not a valid motion blur effect.
+func parseMotionBlur(effect string) (int, float64, bool) {
+	if !strings.HasPrefix(effect, motionBlurCode) {
+		return 0, 0, false
+	}
+	lengthStr, angleStr, found := strings.Cut(effect[len(motionBlurCode):], "@")
+	if !found {
+		return 0, 0, false
+	}
+	length, err := strconv.Atoi(lengthStr)
+	if err != nil || length < 1 || length > 99 || length%2 == 0 {
+		return 0, 0, false
+	}
+	angle, err := strconv.ParseFloat(angleStr, 64)
+	if err != nil || math.IsNaN(angle) || math.IsInf(angle, 0) {
+		return 0, 0, false
+	}
+	return length, angle, true
+}
+
+// motionBlurValues returns the values of a motion blur kernel and its dimensions (rows, cols).
+// The line from the center of the kernel to the end of the streak, (ex, ey), is rasterized with Bresenham's
+// algorithm and mirrored through the center, so the kernel is symmetric and its center is always set.
+// Each pixel of the line has the same weight and the values sum to 1.
+// obs: y grows downwards in the image, so the end of a streak at a positive angle is above the center.
+func motionBlurValues(length int, angle float64) ([]float64, int, int) {
+	half := float64(length-1) / 2
+	rad := angle * math.Pi / 180
+	ex := int(math.Round(half * math.Cos(rad)))
+	ey := -int(math.Round(half * math.Sin(rad)))
+	centerRow, centerCol := abs(ey), abs(ex)
+	rows, cols := 2*centerRow+1, 2*centerCol+1
+
+	// Bresenham from (0, 0) to (ex, ey); each point is set along with its mirror through the center
+	grid := make([]bool, rows*cols)
+	dx, dy := abs(ex), -abs(ey)
+	sx, sy := 1, 1
+	if ex < 0 {
+		sx = -1
+	}
+	if ey < 0 {
+		sy = -1
+	}
+	x, y, errTerm := 0, 0, dx+dy
+	for {
+		grid[(centerRow+y)*cols+centerCol+x] = true
+		grid[(centerRow-y)*cols+centerCol-x] = true
+		if x == ex && y == ey {
+			break
+		}
+		e2 := 2 * errTerm
+		if e2 >= dy {
+			errTerm += dy
+			x += sx
+		}
+		if e2 <= dx {
+			errTerm += dx
+			y += sy
+		}
+	}
+
+	// normalize so the values sum to 1
+	var count int
+	for _, set := range grid {
+		if set {
+			count++
+		}
+	}
+	values := make([]float64, len(grid))
+	for i, set := range grid {
+		if set {
+			values[i] = 1 / float64(count)
+		}
+	}
+	return values, rows, cols
+}
+
+// abs returns the absolute value of 'v'
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Gaussian blur effect: "GB" followed by the standard deviation of the Gaussian in pixels and the radius at which
+// it is cut off (0-49), separated by '@'. eg: "GB1.5@4" => 9 x 9 kernel
+// The kernel is the full 2D Gaussian (see `NewGaussianKernel`); a larger radius is closer to the exact blur but
+// reads more pixels. A radius of about 3 sigma keeps nearly all of its weight.
+const gaussianCode = "GB"
+
+// parseGaussian parses the sigma and radius of a Gaussian blur effect. eg: "GB1.5@4" -> 1.5, 4
+// Returns false if 'effect' is not a valid Gaussian blur effect.
+func parseGaussian(effect string) (float64, int, bool) {
+	if !strings.HasPrefix(effect, gaussianCode) {
+		return 0, 0, false
+	}
+	sigmaStr, radiusStr, found := strings.Cut(effect[len(gaussianCode):], "@")
+	if !found {
+		return 0, 0, false
+	}
+	sigma, err := strconv.ParseFloat(sigmaStr, 64)
+	if err != nil || !(sigma > 0) || math.IsInf(sigma, 0) {
+		return 0, 0, false
+	}
+	radius, err := strconv.Atoi(radiusStr)
+	if err != nil || radius < 0 || radius > 49 {
+		return 0, 0, false
+	}
+	return sigma, radius, true
+}
+
+// NewGaussianKernel returns the kernel of a Gaussian blur with standard deviation 'sigma', sampled at the
+// (2*radius+1) x (2*radius+1) pixels around the center and normalized so its values sum to 1.
+// The kernel is applied by `ConvolveFlat` as any other convolution.
+func NewGaussianKernel(sigma float64, radius int) *Kernel {
+	dim := 2*radius + 1
+	values := make([]float64, dim*dim)
+	var sum float64
+	for row := -radius; row <= radius; row++ {
+		for col := -radius; col <= radius; col++ {
+			value := math.Exp(-float64(row*row+col*col) / (2 * sigma * sigma))
+			values[(row+radius)*dim+col+radius] = value
+			sum += value
+		}
+	}
+	for i := range values {
+		values[i] /= sum
+	}
+	kernel := &Kernel{effect: gaussianCode}
+	kernel.setRectValues(values, dim, dim)
+	return kernel
+}
+
+// Auto-contrast effect: histogram equalization of each channel, stretching it to the full range (see `equalize`)
+const equalizeCode = "AC"
+
+// equalization holds the lookup table of the auto-contrast effect for an image.
+// Equalization needs the histogram of the whole image before any pixel is remapped, so it doesn't fit the
+// single pass of the slices: the table is built from the full input by the first slice to need it, while
+// the other slices wait for it.
+// obs: the table is of the first image the kernel is applied to; kernels are created for each image (see `CreateKernels`).
+type equalization struct {
+	once sync.Once
+	lut  [3][256]uint16
+	flat [3]bool	// channels with a single value; kept as is
+}
+
+// table returns the lookup table of 'inputPixels', building it on the first call.
+func (eq *equalization) table(inputPixels *image.RGBA64) *equalization {
+	eq.once.Do(func() {
+		hist := histogram(inputPixels)
+		n := inputPixels.Bounds().Dx() * inputPixels.Bounds().Dy()
+		for c := range hist {
+			// cumulative distribution; values map to [0, 65535] by their share of the pixels below them
+			var cdf, cdfMin int
+			for v, count := range hist[c] {
+				if cdf == 0 {
+					cdfMin = count
+				}
+				cdf += count
+				if n == cdfMin {
+					eq.flat[c] = true
+					break
+				}
+				if cdf > 0 {
+					eq.lut[c][v] = uint16(math.Round(float64(cdf-cdfMin) / float64(n-cdfMin) * 65535))
+				}
+			}
+		}
+	})
+	return eq
+}
+
+// Dithering effect: "DITHER" followed by the number of levels of each channel in the palette. eg: "DITHER2" => 8 colors
+// Each pixel is quantized to the closest palette color and its error is diffused to the next pixels (see `Dither`).
+const ditherCode = "DITHER"
+
+// Valid number of levels of each channel of the dithering palette
+const minDitherLevels, maxDitherLevels = 2, 256
+
+// parseDither returns the levels of each channel of a dithering effect. eg: "DITHER4" -> 4
+// Returns false if 'effect' is not a dithering effect with a valid number of levels.
+func parseDither(effect string) (int, bool) {
+	levels, ok := strings.CutPrefix(effect, ditherCode)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(levels)
+	if err != nil || n < minDitherLevels || n > maxDitherLevels {
+		return 0, false
+	}
+	return n, true
+}
+
+// dithering holds the palette of the dithering effect for an image.
+// The error of each pixel is diffused to the pixels after it, so the image is processed serially, in order,
+// and can't be divided in slices: the whole image is dithered by the first slice to apply it, while the others
+// wait for it, as the table of the auto-contrast (see `equalization`).
+// obs: the output is of the first image the kernel is applied to; kernels are created for each image (see `CreateKernels`).
+type dithering struct {
+	once   sync.Once
+	levels int
+}
+
+// apply dithers the whole 'inputPixels' into 'outputPixels', on the first call.
+func (d *dithering) apply(inputPixels *image.RGBA64, outputPixels *image.RGBA64) {
+	d.once.Do(func() { Dither(inputPixels, outputPixels, d.levels) })
+}
+
+// Invert effect: negative of the image, i.e., each channel c becomes alpha - c. Alpha is kept (see `Invert`).
+const invertCode = "I"
+
+// isGrayscale returns true if 'effect' is the legacy or a luminosity grayscale
+func isGrayscale(effect string) bool {
+	_, ok := parseLuma(effect)
+	return ok || effect == "G"
+}
+
+// Luminosity grayscale effect: "GL" followed by the standard giving the weight of each channel. eg: "GL709"
+// Plain "G" is the legacy grayscale, the simple average of the channels (see `Grayscale`).
+const lumaCode = "GL"
+
+// lumaWeights are the coefficients of the red, green and blue channels of each luminosity standard
+var lumaWeights = map[string][3]float64{
+	"601": {0.299, 0.587, 0.114},		// Rec.601 (SD video, JPEG)
+	"709": {0.2126, 0.7152, 0.0722},	// Rec.709 (HD video, sRGB)
+}
+
+// parseLuma returns the channel weights of a luminosity grayscale effect. eg: "GL709" -> {0.2126, 0.7152, 0.0722}
+// Returns false if 'effect' is not a luminosity grayscale of a known standard.
+func parseLuma(effect string) ([3]float64, bool) {
+	standard, ok := strings.CutPrefix(effect, lumaCode)
+	if !ok {
+		return [3]float64{}, false
+	}
+	weights, ok := lumaWeights[standard]
+	return weights, ok
+}
+
+// Lookup table effect: "LUT" followed by the path of a file with the table. eg: "LUTcurves/warm.txt"
+// Each channel is remapped through its own table (see `ApplyLUT`), eg: tone curves for color grading.
+// The file has one entry per line, from input value 0 up: a single value mapping all channels, or the values of
+// the red, green and blue channels separated by spaces. Values are in [0, 65535]. Empty lines and lines starting
+// with '#' are ignored. With 256 entries, each input is mapped by its 8-bit value; with 65536, by its full value.
+const lutCode = "LUT"
+
+// Valid number of entries of a lookup table
+const lutEntries8, lutEntries16 = 256, 65536
+
+// luts caches the tables loaded by `LoadLUT` by path, so effects given for many images read their file once,
+// and the tables of `GammaLUT` by gamma, so they are computed once
+var luts = struct {
+	sync.Mutex
+	tables map[string][3][]uint16
+	gammas map[float64][3][]uint16
+}{tables: make(map[string][3][]uint16), gammas: make(map[float64][3][]uint16)}
+
+// LoadLUT returns the lookup table of each channel in the file at 'path' (see `lutCode`).
+// Tables are cached: the file is read on the first call for each path, so it must not change during the run.
+func LoadLUT(path string) ([3][]uint16, error) {
+	luts.Lock()
+	defer luts.Unlock()
+	if lut, ok := luts.tables[path]; ok {
+		return lut, nil
+	}
+	lut, err := readLUT(path)
+	if err != nil {
+		return lut, err
+	}
+	luts.tables[path] = lut
+	return lut, nil
+}
+
+// readLUT reads the lookup table in the file at 'path' (see `LoadLUT`)
+func readLUT(path string) ([3][]uint16, error) {
+	var lut [3][]uint16
+	file, err := os.Open(path)
+	if err != nil {
+		return lut, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 1 && len(fields) != 3 {
+			return lut, fmt.Errorf("%s:%d: expected 1 or 3 values, got %d", path, line, len(fields))
+		}
+		// stop at the first entry past the largest table, so a huge file is not read whole
+		if len(lut[0]) == lutEntries16 {
+			return lut, fmt.Errorf("%s:%d: more than %d entries", path, line, lutEntries16)
+		}
+		var values [3]uint16
+		for c := range values {
+			field := fields[0]
+			if len(fields) == 3 {
+				field = fields[c]
+			}
+			value, err := strconv.ParseUint(field, 10, 16)
+			if err != nil {
+				return lut, fmt.Errorf("%s:%d: invalid value %q: expected an integer in [0, 65535]", path, line, field)
+			}
+			values[c] = uint16(value)
+		}
+		for c := range lut {
+			lut[c] = append(lut[c], values[c])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return lut, err
+	}
+	if n := len(lut[0]); n != lutEntries8 && n != lutEntries16 {
+		return lut, fmt.Errorf("%s: %d entries, expected %d or %d", path, n, lutEntries8, lutEntries16)
+	}
+	return lut, nil
+}
+
+// parseLUT returns the lookup table of a lookup table effect. eg: "LUTcurves.txt" -> table in curves.txt
+// Returns false if 'effect' is not a lookup table effect or its file can't be loaded (see `LoadLUT`).
+func parseLUT(effect string) ([3][]uint16, bool) {
+	path, ok := strings.CutPrefix(effect, lutCode)
+	if !ok || path == "" {
+		return [3][]uint16{}, false
+	}
+	lut, err := LoadLUT(path)
+	return lut, err == nil
+}
+
+// Gamma correction effect: "GAMMA" followed by the gamma. eg: "GAMMA2.2" brightens the midtones; "GAMMA0.5" darkens them
+// Each channel becomes 65535 * (c/65535)^(1/gamma); 0 and 65535 are kept. Applied as a lookup table (see `GammaLUT`).
+const gammaCode = "GAMMA"
+
+// Valid range of the gamma; it must be positive
+const maxGamma = 10.0
+
+// parseGamma returns the gamma of a gamma correction effect. eg: "GAMMA2.2" -> 2.2
+// Returns false if 'effect' is not a gamma correction effect with a gamma in (0, `maxGamma`].
+func parseGamma(effect string) (float64, bool) {
+	value, ok := strings.CutPrefix(effect, gammaCode)
+	if !ok {
+		return 0, false
+	}
+	gamma, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(gamma > 0 && gamma <= maxGamma) {
+		return 0, false
+	}
+	return gamma, true
+}
+
+// GammaLUT returns the lookup table of the gamma correction with 'gamma' (see `gammaCode`), with 65536 entries
+// shared by the three channels, so the power is computed once per value instead of once per pixel.
+// Tables are cached by gamma; they must not be modified.
+func GammaLUT(gamma float64) [3][]uint16 {
+	luts.Lock()
+	defer luts.Unlock()
+	if lut, ok := luts.gammas[gamma]; ok {
+		return lut
+	}
+	table := make([]uint16, lutEntries16)
+	for v := range table {
+		table[v] = clamp(math.Round(65535 * math.Pow(float64(v)/65535, 1/gamma)))
+	}
+	lut := [3][]uint16{table, table, table}
+	luts.gammas[gamma] = lut
+	return lut
+}
+
+// Suffix of convolution effects keeping the alpha of the source. eg: "BA" => blur keeping alpha; "EB128A"
+// By default convolutions write opaque pixels (see `ConvolveFlat`), which discards the transparency of the image.
+const alphaSuffix = "A"
+
+// alphaEffect returns the convolution effect of an effect keeping alpha. eg: "BA" -> "B"
+// Returns false if 'effect' is not a convolution effect followed by `alphaSuffix`.
+func alphaEffect(effect string) (string, bool) {
+	base, ok := strings.CutSuffix(effect, alphaSuffix)
+	if !ok {
+		return "", false
+	}
+	if _, ok := effectValues(base); ok {
+		return base, true
+	}
+	if _, _, _, ok := parseCustomKernel(base); ok {
+		return base, true
+	}
+	if _, _, ok := parseMotionBlur(base); ok {
+		return base, true
+	}
+	if _, _, ok := parseGaussian(base); ok {
+		return base, true
+	}
+	if code, _, ok := parseParamEffect(base); ok {
+		_, composite := convolutionOf[code]
+		return base, composite
+	}
+	return "", false
 }
 
 // Creates a Kernel struct given a string representing an effect string and returns a pointer to it.
@@ -38,14 +685,270 @@ func NewKernel(effect string) *Kernel{
 	if effect == "G"{
 		return nil
 	}
+	if base, ok := alphaEffect(effect); ok {
+		kernel := NewKernel(base)
+		kernel.keepAlpha = true
+		return kernel
+	}
+	if matrix, ok := parseColorMatrix(effect); ok {
+		return &Kernel{effect: colorMatrixCode, matrix: matrix}
+	}
+	if effect == equalizeCode {
+		return &Kernel{effect: equalizeCode, equalization: &equalization{}}
+	}
+	if effect == invertCode {
+		return &Kernel{effect: invertCode}
+	}
+	if levels, ok := parseDither(effect); ok {
+		return &Kernel{effect: ditherCode, dithering: &dithering{levels: levels}}
+	}
+	if weights, ok := parseLuma(effect); ok {
+		return &Kernel{effect: lumaCode, weights: weights}
+	}
+	if lut, ok := parseLUT(effect); ok {
+		return &Kernel{effect: lutCode, lut: lut}
+	}
+	if gamma, ok := parseGamma(effect); ok {
+		return &Kernel{effect: lutCode, param: gamma, lut: GammaLUT(gamma)}
+	}
+	if rows, cols, values, ok := parseCustomKernel(effect); ok {
+		kernel := &Kernel{effect: customKernelCode}
+		kernel.setRectValues(values, rows, cols)
+		return kernel
+	}
+	if kernel, ok := parseKernelFile(effect); ok {
+		return kernel
+	}
+	if length, angle, ok := parseMotionBlur(effect); ok {
+		kernel := &Kernel{effect: motionBlurCode}
+		values, rows, cols := motionBlurValues(length, angle)
+		kernel.setRectValues(values, rows, cols)
+		return kernel
+	}
+	if sigma, radius, ok := parseGaussian(effect); ok {
+		return NewGaussianKernel(sigma, radius)
+	}
+	if code, param, ok := parseParamEffect(effect); ok {
+		kernel := &Kernel{effect: code, param: param}
+		if base, ok := convolutionOf[code]; ok {
+			values, _ := effectValues(base)
+			kernel.setValues(values)
+		}
+		return kernel
+	}
 	var kernel Kernel
-	kernel.values = effects[effect]
-	kernel.size = len(kernel.values)
-	kernel.dim = int(math.Sqrt(float64(kernel.size)))
-	kernel.center = kernel.dim / 2
+	kernel.effect = effect
+	values, _ := effectValues(effect)
+	kernel.setValues(values)
 	return &kernel
 }
 
+// Reach returns the number of rows above and below each pixel that the effect of 'kernel' reads to compute it,
+// i.e., the halo of rows a slice of the image needs around its own rows. 0 for point effects (eg: grayscale, invert).
+// Returns false for effects reading the whole image (eg: auto-contrast, dithering, vignette), which can't be
+// applied to a part of the image alone.
+func (kernel *Kernel) Reach() (int, bool) {
+	if kernel == nil {
+		return 0, true
+	}
+	switch kernel.effect {
+	case "VIG", equalizeCode, ditherCode:
+		return 0, false
+	}
+	if kernel.values == nil {
+		return 0, true
+	}
+	// obs: the kernel is inverted (see `ConvolveFlat`), so it reads 'centerRow' rows below and the rest above
+	if above := kernel.rows - 1 - kernel.centerRow; above > kernel.centerRow {
+		return above, true
+	}
+	return kernel.centerRow, true
+}
+
+// InPlace returns true if the effect of 'kernel' can be applied with the same buffer as input and output
+// (see `LoadInPlace`), i.e., each pixel depends only on the same pixel of the input (and its position).
+// eg: grayscale, invert, color matrices; not convolutions, which read the neighbors of the pixel, nor
+// auto-contrast and dithering, which read the whole image.
+func (kernel *Kernel) InPlace() bool {
+	if kernel == nil {
+		return true
+	}
+	switch kernel.effect {
+	case "VIG", "T", invertCode, colorMatrixCode, lumaCode, lutCode:
+		return true
+	}
+	return false
+}
+
+// InPlaceChain returns true if all the effects of 'kernels' can be applied in place (see `Kernel.InPlace`).
+func InPlaceChain(kernels []*Kernel) bool {
+	for _, kernel := range kernels {
+		if !kernel.InPlace() {
+			return false
+		}
+	}
+	return true
+}
+
+// Normalize scales the values of a custom kernel ("K" or "KF") so they sum to 1, keeping the brightness of the image.
+// eg: "K3x3:1:1:1:1:1:1:1:1:1" => values 1/9 each, i.e., the blur "B"
+// Only kernels with a positive sum are scaled: edge-detection kernels sum to 0 and are left as they are, as kernels
+// with a negative sum; kernels already summing to 1 (eg: sharpen) are unchanged. Other effects are never modified.
+// Returns true if the values were scaled.
+// obs: the values are replaced, not scaled in place, since kernels of the same file share them (see `parseKernelFile`)
+func (kernel *Kernel) Normalize() bool {
+	if kernel == nil || kernel.effect != customKernelCode {
+		return false
+	}
+	sum := 0.0
+	for _, value := range kernel.values {
+		sum += value
+	}
+	if sum <= 0 || sum == 1 {
+		return false
+	}
+	values := make([]float64, len(kernel.values))
+	for i, value := range kernel.values {
+		values[i] = value / sum
+	}
+	kernel.values = values
+	return true
+}
+
+// NormalizeKernels normalizes the custom kernels of 'kernels' (see `Kernel.Normalize`)
+func NormalizeKernels(kernels []*Kernel) {
+	for _, kernel := range kernels {
+		kernel.Normalize()
+	}
+}
+
+// fixedBits is the number of fractional bits of the fixed point values of 8 bit convolutions (see `Kernel.SetEightBit`)
+// obs: the rounding of the values adds less than 1 to the result of kernels of up to 250 values
+const fixedBits = 24
+
+// SetEightBit makes `ConvolveFlat` convolve the 8 most significant bits of each channel with the values of the kernel
+// in fixed point (see `fixedBits`), accumulating in integers instead of floats. The result is rounded to 8 bits and
+// scaled back to 16 (v * 257), so the next effects read it as any other pixel.
+// Each channel is within 255 times the sum of the absolute values of the kernel, plus 130, of the float convolution.
+// eg: within 385 for the blur "B", 2425 for the sharpen "S". Returns false if 'kernel' is not a convolution.
+// obs: the borders of merged kernels are still recomputed from their stages in floats (see `mergedBorder`)
+func (kernel *Kernel) SetEightBit() bool {
+	if kernel == nil || kernel.values == nil {
+		return false
+	}
+	kernel.fixed = make([]int64, len(kernel.values))
+	for i, value := range kernel.values {
+		kernel.fixed[i] = int64(math.Round(value * (1 << fixedBits)))
+	}
+	return true
+}
+
+// EightBitKernels sets the convolutions of 'kernels' to convolve 8 bit channels (see `Kernel.SetEightBit`)
+func EightBitKernels(kernels []*Kernel) {
+	for _, kernel := range kernels {
+		kernel.SetEightBit()
+	}
+}
+
+// setValues sets the convolution 'values' of a square kernel and its dimensions
+func (kernel *Kernel) setValues(values []float64) {
+	dim := int(math.Sqrt(float64(len(values))))
+	kernel.setRectValues(values, dim, dim)
+}
+
+// setRectValues sets the convolution 'values' of a 'rows' x 'cols' kernel, given row by row, and its dimensions
+func (kernel *Kernel) setRectValues(values []float64, rows, cols int) {
+	kernel.values = values
+	kernel.size = len(kernel.values)
+	kernel.rows, kernel.cols = rows, cols
+	kernel.centerRow, kernel.centerCol = rows/2, cols/2
+}
+
+// ValidEffect returns true if 'effect' is an effect code supported in this project.
+func ValidEffect(effect string) bool {
+	_, ok := effectValues(effect)
+	_, _, okParam := parseParamEffect(effect)
+	_, okMatrix := parseColorMatrix(effect)
+	_, _, _, okCustom := parseCustomKernel(effect)
+	_, _, okMotion := parseMotionBlur(effect)
+	_, _, okGaussian := parseGaussian(effect)
+	_, okAlpha := alphaEffect(effect)
+	_, okLuma := parseLuma(effect)
+	_, okDither := parseDither(effect)
+	_, okLUT := parseLUT(effect)
+	_, okGamma := parseGamma(effect)
+	_, okFile := parseKernelFile(effect)
+	return ok || okParam || okMatrix || okCustom || okMotion || okGaussian || okAlpha || okLuma || okDither || okLUT ||
+		okGamma || okFile || effect == "G" || effect == equalizeCode || effect == invertCode
+}
+
+// ReadsFile returns true if 'effect' is given with the path of a file it reads, eg: "LUTcurves.txt", "KFsobel.txt".
+// Such effects must not be accepted from untrusted clients (see `scheduler.NewServeHandler`).
+func ReadsFile(effect string) bool {
+	return strings.HasPrefix(effect, lutCode) || strings.HasPrefix(effect, kernelFileCode)
+}
+
+// ParseEffectChain parses a chain of effects given as their codes separated by commas. Spaces around the codes
+// are ignored. eg: "B,B,S,GL709" -> ["B", "B", "S", "GL709"]; "VIG0.5, T128" -> ["VIG0.5", "T128"]
+// obs: effects with several parameters separate them by ':' or '@', so they can be given in the chain. eg: "MB9@45"
+// Returns an error if a code of the chain is empty or not a valid effect (see `ValidEffect`).
+func ParseEffectChain(chain string) ([]string, error) {
+	codes := strings.Split(chain, ",")
+	effects := make([]string, len(codes))
+	for i, code := range codes {
+		effect := strings.TrimSpace(code)
+		if !ValidEffect(effect) {
+			return nil, fmt.Errorf("invalid effect %q in %q", effect, chain)
+		}
+		effects[i] = effect
+	}
+	return effects, nil
+}
+
+// FormatEffectChain returns 'effects' as a chain of codes separated by commas, the inverse of `ParseEffectChain`.
+// eg: ["B", "B", "S"] -> "B,B,S"
+func FormatEffectChain(effects []string) string {
+	return strings.Join(effects, ",")
+}
+
+// Effects returns the codes of all effects supported in this project, sorted.
+// Effects with a parameter are listed with the valid range of the parameter. eg: "VIG<0-1>"
+func Effects() []string {
+	names := []string{"G", equalizeCode, invertCode}
+	effectsMu.RLock()
+	for effect := range effects {
+		names = append(names, effect)
+	}
+	effectsMu.RUnlock()
+	for code, paramRange := range paramEffects {
+		names = append(names, fmt.Sprintf("%s<%g-%g>", code, paramRange[0], paramRange[1]))
+	}
+	names = append(names, colorMatrixCode+"<m11:m12:m13:m21:m22:m23:m31:m32:m33>")
+	names = append(names, customKernelCode+"<rows>x<cols>:<v1>:...:<vN>")
+	names = append(names, motionBlurCode+"<length>@<angle>")
+	names = append(names, gaussianCode+"<sigma>@<radius>")
+	names = append(names, "<convolution>"+alphaSuffix)
+	names = append(names, lumaCode+"<601|709>")
+	names = append(names, fmt.Sprintf("%s<%d-%d>", ditherCode, minDitherLevels, maxDitherLevels))
+	names = append(names, lutCode+"<file>")
+	names = append(names, kernelFileCode+"<file>")
+	names = append(names, fmt.Sprintf("%s<0-%g>", gammaCode, maxGamma))
+	sort.Strings(names)
+	return names
+}
+
+// KernelSizes returns the number of elements of the kernel of each effect (i.e., multiply-adds per pixel and channel).
+// Grayscale has no kernel and is reported with size 0.
+func KernelSizes() map[string]int {
+	sizes := map[string]int{"G": 0}
+	effectsMu.RLock()
+	for effect, values := range effects {
+		sizes[effect] = len(values)
+	}
+	effectsMu.RUnlock()
+	return sizes
+}
+
 // Creates a slice of Kernel structs given a slice of strings representing effects and returns a pointer to it.
 func CreateKernels(effects []string) []*Kernel{
 	kernels := make([]*Kernel, len(effects))
@@ -55,29 +958,225 @@ func CreateKernels(effects []string) []*Kernel{
 	return kernels
 }
 
+//=============================================================================
+// Effect chain analysis
+//=============================================================================
+
+// commutes tells whether applying two effects in either order gives the same image. Keys are sorted pairs.
+// Convolutions and grayscale are linear, so in theory they commute; in practice every effect
+// clamps its output to [0, 65535]. Blur and grayscale never leave this range, while sharpen and
+// edge-detect do, so they do not commute with a different effect.
+// obs: the results of commuting effects might still differ slightly due to float rounding and zero-padding.
+var commutes = map[[2]string]bool{
+	{"B", "B"}: true, {"S", "S"}: true, {"E", "E"}: true, {"G", "G"}: true,
+	{"B", "G"}: true, {"VIG", "VIG"}: true, {"G", "VIG"}: true, {"I", "I"}: true,
+	{"B", "E"}: false, {"B", "S"}: false, {"E", "S"}: false,
+	{"E", "G"}: false, {"G", "S"}: false,
+}
+
+// EffectChainReport is the result of `AnalyzeEffectChain`
+// @Invalid: effect codes in the chain not supported in this project
+// @GrayscaleFirst: true if grayscale is applied before a convolution; the convolution then acts on the gray image
+// @Warnings: advisory messages for adjacent effects whose reordering would change the result
+type EffectChainReport struct {
+	Invalid        []string
+	GrayscaleFirst bool
+	Warnings       []string
+}
+
+// Commutes returns true if applying effects 'a' and 'b' in either order gives the same result.
+func Commutes(a, b string) bool {
+	// convolutions keeping alpha are compared as the convolution. eg: "BA" -> "B"
+	if base, ok := alphaEffect(a); ok {
+		a = base
+	}
+	if base, ok := alphaEffect(b); ok {
+		b = base
+	}
+	// effects with parameters are compared by their code. eg: "VIG0.5" -> "VIG"
+	if code, _, ok := parseParamEffect(a); ok {
+		a = code
+	}
+	if code, _, ok := parseParamEffect(b); ok {
+		b = code
+	}
+	if a > b {
+		a, b = b, a
+	}
+	return commutes[[2]string{a, b}]
+}
+
+// AnalyzeEffectChain checks the chain of 'effects' and warns when reordering them would change the result.
+func AnalyzeEffectChain(effects []string) EffectChainReport {
+	var report EffectChainReport
+	for i, effect := range effects {
+		if !ValidEffect(effect) {
+			report.Invalid = append(report.Invalid, effect)
+			continue
+		}
+		if isGrayscale(effect) {
+			for _, next := range effects[i+1:] {
+				if !isGrayscale(next) && ValidEffect(next) {
+					report.GrayscaleFirst = true
+				}
+			}
+		}
+		// only adjacent effects are checked: these are the ones users usually swap
+		if i > 0 && ValidEffect(effects[i-1]) && !Commutes(effects[i-1], effect) {
+			report.Warnings = append(report.Warnings, fmt.Sprintf(
+				"effects %s,%s do not commute: applying %s,%s gives a different result", effects[i-1], effect, effect, effects[i-1]))
+		}
+	}
+	return report
+}
+
+//=============================================================================
+// Inverse effects
+//=============================================================================
+
+// ErrNotInvertible is returned by `Inverse` for effects whose input can't be recovered exactly from their output
+var ErrNotInvertible = errors.New("effect is not invertible")
+
+// Inverse returns the effect undoing 'effect' exactly, i.e., applying both gives back the original pixels.
+// Invertible effects: invert (its own inverse) and color matrices permuting the channels (eg: channel swaps),
+// whose inverse is the transposed matrix. Other color matrices are invertible in theory, but rounding and
+// clamping lose information, as do convolutions, grayscale, thresholds, etc.; these return `ErrNotInvertible`.
+func Inverse(effect string) (string, error) {
+	if !ValidEffect(effect) {
+		return "", fmt.Errorf("invalid effect %s", effect)
+	}
+	if effect == invertCode {
+		return invertCode, nil
+	}
+	if matrix, ok := parseColorMatrix(effect); ok && isPermutation(matrix) {
+		coefficients := make([]string, len(matrix))
+		for row := 0; row < 3; row++ {
+			for col := 0; col < 3; col++ {
+				coefficients[row*3+col] = strconv.FormatFloat(matrix[col*3+row], 'g', -1, 64)
+			}
+		}
+		return colorMatrixCode + strings.Join(coefficients, ":"), nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrNotInvertible, effect)
+}
+
+// InverseChain returns the chain of effects undoing 'effects', i.e., the inverse of each effect in reverse order.
+// eg: ["I", "CM0:1:0:0:0:1:1:0:0"] -> ["CM0:0:1:1:0:0:0:1:0", "I"]
+// Returns an error wrapping `ErrNotInvertible` if any effect of the chain is not invertible (see `Inverse`).
+func InverseChain(effects []string) ([]string, error) {
+	inverse := make([]string, len(effects))
+	for i, effect := range effects {
+		inverseEffect, err := Inverse(effect)
+		if err != nil {
+			return nil, err
+		}
+		inverse[len(effects)-1-i] = inverseEffect
+	}
+	return inverse, nil
+}
+
+// isPermutation returns true if the color matrix 'm' has a single 1 in each row and column and 0 elsewhere,
+// i.e., it only moves channels around, so no value is rounded or clamped.
+func isPermutation(m [9]float64) bool {
+	var rows, cols [3]int
+	for i, value := range m {
+		if value != 0 && value != 1 {
+			return false
+		}
+		if value == 1 {
+			rows[i/3]++
+			cols[i%3]++
+		}
+	}
+	return rows == [3]int{1, 1, 1} && cols == [3]int{1, 1, 1}
+}
+
 //=============================================================================
 // Effect application methods
 //=============================================================================
 
 // Apply effect represented by 'kernel' to the 'img'. Used by 'parfiles' implementation.
 func (img *Image) ApplyEffect(kernel *Kernel) {
+	// grayscale source: skip the effect. Flipping 'Final' here is undone by the caller's flip,
+	// so the last modified buffer is passed through untouched.
+	if kernel == nil && img.isGray {
+		img.Final = 1 - img.Final
+		return
+	}
 	inputPixels, outputPixels := img.GetInputOutputPixels()
 	bounds := inputPixels.Bounds()
-	if kernel == nil{
-		img.Grayscale(inputPixels, outputPixels, bounds.Min.Y, bounds.Max.Y, bounds.Min.X, bounds.Max.X)
-	} else{
-		img.ConvolveFlat(kernel, inputPixels, outputPixels, bounds.Min.Y, bounds.Max.Y, bounds.Min.X, bounds.Max.X)
+	img.applyKernel(kernel, inputPixels, outputPixels, bounds.Min.Y, bounds.Max.Y, bounds.Min.X, bounds.Max.X)
+}
+
+// applyKernel applies the effect represented by 'kernel' to the slice of the image delimited by the indexes.
+// nil kernel => grayscale; point effects => selected by `kernel.effect`; otherwise => convolution.
+// obs: position-dependent effects receive the full bounds of the image, so each slice is processed correctly.
+func (img *Image) applyKernel(kernel *Kernel, inputPixels *image.RGBA64, outputPixels *image.RGBA64,
+	YStart, YEnd, XStart, XEnd int) {
+	// masked image: once the effect is applied, the pixels out of the mask are restored (see `SetMask`)
+	if img.mask != nil {
+		defer applyMask(img.mask, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+	}
+	// the original pixels are overwritten (see `Unchanged`)
+	// obs: only the slice at the top of the image writes the flag, as `isGray` below
+	if outputPixels == img.in && YStart == inputPixels.Bounds().Min.Y {
+		img.srcOverwritten = true
+	}
+	if kernel == nil {
+		img.Grayscale(inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+		return
+	}
+	switch kernel.effect {
+	case "VIG":
+		Vignette(inputPixels, outputPixels, kernel.param, inputPixels.Bounds(), YStart, YEnd, XStart, XEnd)
+	case "T":
+		Threshold(inputPixels, outputPixels, kernel.param, YStart, YEnd, XStart, XEnd)
+	case invertCode:
+		Invert(inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+	case colorMatrixCode:
+		// a gray pixel stays gray only if all rows of the matrix have the same sum; otherwise the
+		// grayscale effect can't be skipped anymore (see `ApplyEffect`).
+		// obs: only the slice at the top of the image writes the flag, so concurrent slices don't race;
+		// it is read by later effects, after all slices of this one are done.
+		if YStart == inputPixels.Bounds().Min.Y && !keepsGray(kernel.matrix) {
+			img.isGray = false
+		}
+		ColorMatrix(inputPixels, outputPixels, kernel.matrix, YStart, YEnd, XStart, XEnd)
+	case lumaCode:
+		img.Luminosity(inputPixels, outputPixels, kernel.weights, YStart, YEnd, XStart, XEnd)
+	case lutCode:
+		// as color matrices, tables differing between channels make gray pixels colored (see `ColorMatrix` above)
+		if YStart == inputPixels.Bounds().Min.Y && !sameTables(kernel.lut) {
+			img.isGray = false
+		}
+		ApplyLUT(inputPixels, outputPixels, kernel.lut, YStart, YEnd, XStart, XEnd)
+	case equalizeCode:
+		equalize(inputPixels, outputPixels, kernel.equalization.table(inputPixels), YStart, YEnd, XStart, XEnd)
+	case ditherCode:
+		// obs: the slice is written with the rest of the image (see `dithering`)
+		kernel.dithering.apply(inputPixels, outputPixels)
+	default:
+		// obs: composite effects are also handled by `ConvolveFlat`
+		img.ConvolveFlat(kernel, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+		if kernel.stages != nil {
+			mergedBorder(kernel, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+		}
+	}
+}
+
+// Apply all effects in 'kernels' to the 'img' in sequence. Used by the 'serve' mode.
+func (img *Image) ApplyEffects(kernels []*Kernel) {
+	for _, kernel := range kernels {
+		img.ApplyEffect(kernel)
+		// invert image buffer for application of next effect (see png.Image struct definition)
+		img.Final = 1 - img.Final
 	}
 }
 
 // Apply effect represented by 'kernel' to a slice of 'img'. Used by 'parslices' implementation.
 func (img *Image) ApplyEffectSlice(kernel *Kernel, YStart, YEnd, XStart, XEnd int, wgEffect *sync.WaitGroup) {
 	inputPixels, outputPixels := img.GetInputOutputPixels()
-	if kernel == nil{
-		img.Grayscale(inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
-	} else{
-		img.ConvolveFlat(kernel, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
-	}
+	img.applyKernel(kernel, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
 	// signal effect application complete
 	wgEffect.Done()
 }
@@ -85,11 +1184,26 @@ func (img *Image) ApplyEffectSlice(kernel *Kernel, YStart, YEnd, XStart, XEnd in
 // Apply effect represented by 'kernel' to a slice of 'img'. Used by 'parslices2' implementation.
 func (img *Image) ApplyEffectSlice2(kernel *Kernel, YStart, YEnd, XStart, XEnd int) {
 	inputPixels, outputPixels := img.GetInputOutputPixels()
-	if kernel == nil{
-		img.Grayscale(inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
-	} else{
-		img.ConvolveFlat(kernel, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
-	}
+	img.applyKernel(kernel, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+}
+
+// Apply effect represented by 'kernel' to a slice of 'img', reading 'inputPixels' and writing 'outputPixels' instead of
+// the buffers of the image. eg: buffers private to the slice, holding its rows and the rows around them it reads (see `Kernel.Reach`).
+// The buffers are indexed as the image, i.e., they cover the rows of the slice at their coordinates in the image.
+// The flags and mask of the image are used as by `ApplyEffectSlice2`; they are only written by the slice whose
+// first row is the first row of 'inputPixels'.
+func (img *Image) ApplyEffectBuffers(kernel *Kernel, inputPixels, outputPixels *image.RGBA64, YStart, YEnd, XStart, XEnd int) {
+	img.applyKernel(kernel, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+}
+
+// Apply effect represented by 'kernel' to a slice of 'img' only where 'mask' is set (white, i.e., value >= 128).
+// Elsewhere, the input pixels are copied to the output, so they are unchanged by the effect. eg: selective blur
+// Pixels of the slice out of the bounds of 'mask' are unchanged too.
+// Obs: to mask all effects of a chain in any mode, set the mask of the image instead (see `SetMask`).
+func (img *Image) ApplyEffectMasked(kernel *Kernel, mask *image.Gray, YStart, YEnd, XStart, XEnd int) {
+	inputPixels, outputPixels := img.GetInputOutputPixels()
+	img.applyKernel(kernel, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+	applyMask(mask, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
 }
 
 // Grayscale applies a grayscale filtering effect to the image
@@ -98,6 +1212,12 @@ func (img *Image) ApplyEffectSlice2(kernel *Kernel, YStart, YEnd, XStart, XEnd i
 // @YStart, YEnd, XStart, XEnd: indexes delimiting the slice of the image pixels to be filtered
 func (img *Image) Grayscale(inputPixels *image.RGBA64, 
 	outputPixels *image.RGBA64, YStart int, YEnd int, XStart int, XEnd int) {
+	// grayscale source: channels are already equal, just copy the slice without reading pixels.
+	// obs: slices are processed concurrently, so the buffers can't be flipped here as in 'ApplyEffect'
+	if img.isGray {
+		copyPixels(inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+		return
+	}
 	for y := YStart; y < YEnd; y++ {
 		for x := XStart; x < XEnd; x++ {
 			//Returns the pixel (i.e., RGBA) value at a (x,y) position
@@ -112,6 +1232,299 @@ func (img *Image) Grayscale(inputPixels *image.RGBA64,
 	}
 }
 
+// Luminosity applies a grayscale filtering effect weighting the channels by 'weights' (see `lumaWeights`),
+// instead of the simple average of `Grayscale`. Alpha is kept.
+// @inputPixels: pointer to the pixels of image to be filtered
+// @outputPixels: pointer to the pixels of image to be written to
+// @weights: coefficients of the red, green and blue channels; they sum to 1
+// @YStart, YEnd, XStart, XEnd: indexes delimiting the slice of the image pixels to be filtered
+// obs: values are rounded, so gray pixels are unchanged despite the float error of the weighted sum
+func (img *Image) Luminosity(inputPixels *image.RGBA64, outputPixels *image.RGBA64, weights [3]float64,
+	YStart int, YEnd int, XStart int, XEnd int) {
+	// grayscale source: weights sum to 1, so the pixels are unchanged (see `Grayscale`)
+	if img.isGray {
+		copyPixels(inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+		return
+	}
+	for y := YStart; y < YEnd; y++ {
+		for x := XStart; x < XEnd; x++ {
+			px := inputPixels.RGBA64At(x, y)
+			luma := clamp(weights[0]*float64(px.R) + weights[1]*float64(px.G) + weights[2]*float64(px.B) + 0.5)
+			outputPixels.SetRGBA64(x, y, color.RGBA64{luma, luma, luma, px.A})
+		}
+	}
+}
+
+// Vignette darkens the image by the distance of each pixel from the center of the image
+// Each pixel is scaled by 1 - strength * d^2, where d is the distance from the center normalized
+// so that d = 1 at the corners, i.e. the center is unchanged and corners are scaled by 1 - strength.
+// @inputPixels: pointer to the pixels of image to be filtered
+// @outputPixels: pointer to the pixels of image to be written to
+// @strength: darkening at the corners, between 0 and 1
+// @bounds: bounds of the full image. obs: not of the slice; distances are relative to the image center
+// @YStart, YEnd, XStart, XEnd: indexes delimiting the slice of the image pixels to be filtered
+func Vignette(inputPixels *image.RGBA64, outputPixels *image.RGBA64, strength float64,
+	bounds image.Rectangle, YStart int, YEnd int, XStart int, XEnd int) {
+	// center of the image and squared distance from the center to the corners
+	centerX := float64(bounds.Min.X+bounds.Max.X-1) / 2
+	centerY := float64(bounds.Min.Y+bounds.Max.Y-1) / 2
+	maxDist2 := (centerX-float64(bounds.Min.X))*(centerX-float64(bounds.Min.X)) +
+		(centerY-float64(bounds.Min.Y))*(centerY-float64(bounds.Min.Y))
+	if maxDist2 == 0 {
+		maxDist2 = 1
+	}
+
+	for y := YStart; y < YEnd; y++ {
+		dy := float64(y) - centerY
+		for x := XStart; x < XEnd; x++ {
+			dx := float64(x) - centerX
+			factor := 1 - strength*(dx*dx+dy*dy)/maxDist2
+
+			r, g, b, a := inputPixels.At(x, y).RGBA()
+			outputPixels.Set(x, y, color.RGBA64{clamp(float64(r) * factor), clamp(float64(g) * factor),
+				clamp(float64(b) * factor), uint16(a)})
+		}
+	}
+}
+
+// Threshold converts the image to pure black/white by the luminosity of each pixel
+// @inputPixels: pointer to the pixels of image to be filtered
+// @outputPixels: pointer to the pixels of image to be written to
+// @cutoff: luminosity (8-bit scale, 0-255) from which pixels become white
+// @YStart, YEnd, XStart, XEnd: indexes delimiting the slice of the image pixels to be filtered
+func Threshold(inputPixels *image.RGBA64, outputPixels *image.RGBA64, cutoff float64,
+	YStart int, YEnd int, XStart int, XEnd int) {
+	for y := YStart; y < YEnd; y++ {
+		for x := XStart; x < XEnd; x++ {
+			r, g, b, a := inputPixels.At(x, y).RGBA()
+			v := thresholdValue(uint16(r), uint16(g), uint16(b), cutoff)
+			outputPixels.Set(x, y, color.RGBA64{v, v, v, uint16(a)})
+		}
+	}
+}
+
+// Invert replaces each channel c of the pixels by its negative, alpha - c. Alpha is kept.
+// obs: pixels are alpha-premultiplied, so subtracting from alpha instead of 65535 keeps them valid;
+// for opaque pixels both are the same. Applying it twice gives back the original pixels.
+// Channels over the alpha (invalid premultiplied colors) are clamped to it, so they invert to 0 instead of wrapping around.
+// @inputPixels: pointer to the pixels of image to be filtered
+// @outputPixels: pointer to the pixels of image to be written to
+// @YStart, YEnd, XStart, XEnd: indexes delimiting the slice of the image pixels to be filtered
+func Invert(inputPixels *image.RGBA64, outputPixels *image.RGBA64, YStart int, YEnd int, XStart int, XEnd int) {
+	for y := YStart; y < YEnd; y++ {
+		for x := XStart; x < XEnd; x++ {
+			px := inputPixels.RGBA64At(x, y)
+			outputPixels.SetRGBA64(x, y, color.RGBA64{px.A - min16(px.R, px.A), px.A - min16(px.G, px.A),
+				px.A - min16(px.B, px.A), px.A})
+		}
+	}
+}
+
+// ApplyLUT remaps each channel of the pixels through its lookup table: c' = lut[channel][c], with 65536 entries,
+// or lut[channel][c >> 8], i.e., by the 8-bit value of the channel, with 256 entries. Alpha is kept.
+// eg: identity table => no-op; lut[c][v] = 65535 - v => invert (for opaque pixels, see `Invert`)
+// obs: channels are alpha-premultiplied, so tables other than the identity apply to the premultiplied values.
+// @inputPixels: pointer to the pixels of image to be filtered
+// @outputPixels: pointer to the pixels of image to be written to
+// @lut: table of the red, green and blue channels; each has 256 or 65536 entries
+// @YStart, YEnd, XStart, XEnd: indexes delimiting the slice of the image pixels to be filtered
+func ApplyLUT(inputPixels *image.RGBA64, outputPixels *image.RGBA64, lut [3][]uint16,
+	YStart int, YEnd int, XStart int, XEnd int) {
+	var shift [3]uint
+	for c := range lut {
+		if len(lut[c]) == lutEntries8 {
+			shift[c] = 8
+		}
+	}
+	for y := YStart; y < YEnd; y++ {
+		for x := XStart; x < XEnd; x++ {
+			px := inputPixels.RGBA64At(x, y)
+			outputPixels.SetRGBA64(x, y, color.RGBA64{lut[0][px.R>>shift[0]], lut[1][px.G>>shift[1]],
+				lut[2][px.B>>shift[2]], px.A})
+		}
+	}
+}
+
+// Dither quantizes each channel of the whole image to 'levels' evenly spaced values (see `quantize`) with
+// Floyd–Steinberg error diffusion: the error of each pixel is added to its neighbors not processed yet,
+// 7/16 to the right, 3/16 below left, 5/16 below and 1/16 below right. So the average color of each area
+// is kept, while each pixel only has colors of the palette. Pixels are processed row by row, left to right.
+// Alpha is kept.
+// @inputPixels: pointer to the pixels of image to be filtered
+// @outputPixels: pointer to the pixels of image to be written to
+// @levels: number of values of each channel in the palette (at least 2). eg: 2 => 8 colors
+func Dither(inputPixels *image.RGBA64, outputPixels *image.RGBA64, levels int) {
+	bounds := inputPixels.Bounds()
+	width := bounds.Dx()
+	// errors diffused to the pixels of the current and next rows, per channel; one extra pixel on each side
+	errRow := make([][3]float64, width+2)
+	errNext := make([][3]float64, width+2)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := x - bounds.Min.X + 1
+			px := inputPixels.RGBA64At(x, y)
+			var out [3]uint16
+			for c, v := range [3]uint16{px.R, px.G, px.B} {
+				value := float64(v) + errRow[i][c]
+				out[c] = quantize(value, levels)
+				diff := value - float64(out[c])
+				errRow[i+1][c] += diff * 7 / 16
+				errNext[i-1][c] += diff * 3 / 16
+				errNext[i][c] += diff * 5 / 16
+				errNext[i+1][c] += diff * 1 / 16
+			}
+			outputPixels.SetRGBA64(x, y, color.RGBA64{out[0], out[1], out[2], px.A})
+		}
+		errRow, errNext = errNext, errRow
+		for i := range errNext {
+			errNext[i] = [3]float64{}
+		}
+	}
+}
+
+// quantize returns the closest of 'levels' evenly spaced values in [0, 65535] to 'value'. eg: 2 levels => 0 or 65535
+func quantize(value float64, levels int) uint16 {
+	step := 65535 / float64(levels-1)
+	return clamp(math.Round(value/step) * step)
+}
+
+// ColorMatrix replaces the color of each pixel by a linear combination of its channels:
+// [r' g' b'] = m x [r g b], with 'm' given row by row, i.e. r' = m[0]*r + m[1]*g + m[2]*b and so on.
+// Alpha is kept. eg: identity => no-op; {0,0,1, 0,1,0, 1,0,0} => swaps red and blue;
+// sepia => {.393,.769,.189, .349,.686,.168, .272,.534,.131}; grayscale => all coefficients 1/3.
+// @inputPixels: pointer to the pixels of image to be filtered
+// @outputPixels: pointer to the pixels of image to be written to
+// @m: coefficients of the matrix, row by row. New values are clamped to [0, 65535]
+// @YStart, YEnd, XStart, XEnd: indexes delimiting the slice of the image pixels to be filtered
+func ColorMatrix(inputPixels *image.RGBA64, outputPixels *image.RGBA64, m [9]float64,
+	YStart int, YEnd int, XStart int, XEnd int) {
+	for y := YStart; y < YEnd; y++ {
+		for x := XStart; x < XEnd; x++ {
+			r, g, b, a := inputPixels.At(x, y).RGBA()
+			rf, gf, bf := float64(r), float64(g), float64(b)
+			outputPixels.Set(x, y, color.RGBA64{
+				clamp(m[0]*rf + m[1]*gf + m[2]*bf),
+				clamp(m[3]*rf + m[4]*gf + m[5]*bf),
+				clamp(m[6]*rf + m[7]*gf + m[8]*bf),
+				uint16(a)})
+		}
+	}
+}
+
+// equalize remaps each channel of the pixels with the lookup table of the histogram equalization of the image,
+// so the values of each channel spread over the full range [0, 65535]. Alpha is kept.
+// Channels are equalized independently, with 256 bins each; gray pixels stay gray since their channels share the table.
+// @inputPixels: pointer to the pixels of image to be filtered
+// @outputPixels: pointer to the pixels of image to be written to
+// @eq: lookup table built from the full 'inputPixels' (see `equalization`)
+// @YStart, YEnd, XStart, XEnd: indexes delimiting the slice of the image pixels to be filtered
+func equalize(inputPixels *image.RGBA64, outputPixels *image.RGBA64, eq *equalization,
+	YStart int, YEnd int, XStart int, XEnd int) {
+	remap := func(c int, v uint16) uint16 {
+		if eq.flat[c] {
+			return v
+		}
+		return eq.lut[c][v>>8]
+	}
+	for y := YStart; y < YEnd; y++ {
+		for x := XStart; x < XEnd; x++ {
+			px := inputPixels.RGBA64At(x, y)
+			outputPixels.SetRGBA64(x, y, color.RGBA64{remap(0, px.R), remap(1, px.G), remap(2, px.B), px.A})
+		}
+	}
+}
+
+// Histogram returns the number of pixels of the last modified buffer of 'img' with each value of
+// each channel (R, G, B), in 8-bit scale. eg: Histogram(img)[0][255] => pixels with the brightest red
+func Histogram(img *Image) [3][256]int {
+	inputPixels, _ := img.GetInputOutputPixels()
+	return histogram(inputPixels)
+}
+
+// histogram returns the histogram of each channel of 'pixels' (see `Histogram`)
+func histogram(pixels *image.RGBA64) [3][256]int {
+	var hist [3][256]int
+	bounds := pixels.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		// obs: the high byte of each 16-bit channel is its 8-bit value (8 bytes per pixel: R, G, B, A; big endian)
+		start := pixels.PixOffset(bounds.Min.X, y)
+		row := pixels.Pix[start : start+bounds.Dx()*8]
+		for o := 0; o+8 <= len(row); o += 8 {
+			hist[0][row[o]]++
+			hist[1][row[o+2]]++
+			hist[2][row[o+4]]++
+		}
+	}
+	return hist
+}
+
+// keepsGray returns true if the color matrix 'm' maps gray pixels to gray pixels (i.e., all rows have the same sum)
+func keepsGray(m [9]float64) bool {
+	sum := m[0] + m[1] + m[2]
+	return m[3]+m[4]+m[5] == sum && m[6]+m[7]+m[8] == sum
+}
+
+// sameTables returns true if the lookup tables of all channels are equal, i.e., gray pixels stay gray
+func sameTables(lut [3][]uint16) bool {
+	for c := 1; c < len(lut); c++ {
+		if len(lut[c]) != len(lut[0]) {
+			return false
+		}
+		// obs: tables shared by the channels (eg: gamma) are not compared value by value
+		if &lut[c][0] == &lut[0][0] {
+			continue
+		}
+		for i := range lut[c] {
+			if lut[c][i] != lut[0][i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// thresholdValue returns white (65535) if the luminosity of the pixel is at least 'cutoff' (8-bit scale); black (0) otherwise.
+// obs: luminosity is the mean of the channels, as in `Grayscale`
+func thresholdValue(r, g, b uint16, cutoff float64) uint16 {
+	if (float64(r)+float64(g)+float64(b))/3 >= cutoff*257 {
+		return 65535
+	}
+	return 0
+}
+
+// min16 returns the smallest of 'a' and 'b'
+func min16(a, b uint16) uint16 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// copyPixels copies the slice of 'inputPixels' delimited by the indexes to 'outputPixels', row by row
+func copyPixels(inputPixels *image.RGBA64, outputPixels *image.RGBA64, YStart int, YEnd int, XStart int, XEnd int) {
+	for y := YStart; y < YEnd; y++ {
+		start := inputPixels.PixOffset(XStart, y)
+		end := inputPixels.PixOffset(XEnd, y)
+		// obs: the buffers may cover different rows (see `ApplyEffectBuffers`)
+		copy(outputPixels.Pix[outputPixels.PixOffset(XStart, y):], inputPixels.Pix[start:end])
+	}
+}
+
+// applyMask copies the pixels of the slice of 'inputPixels' delimited by the indexes where 'mask' is not set
+// (value < 128, or out of the bounds of 'mask') to 'outputPixels', undoing the effect written to them.
+func applyMask(mask *image.Gray, inputPixels *image.RGBA64, outputPixels *image.RGBA64, YStart int, YEnd int, XStart int, XEnd int) {
+	for y := YStart; y < YEnd; y++ {
+		for x := XStart; x < XEnd; x++ {
+			if (image.Point{X: x, Y: y}).In(mask.Rect) && mask.Pix[mask.PixOffset(x, y)] >= 128 {
+				continue
+			}
+			// obs: the buffers may cover different rows (see `ApplyEffectBuffers`), so each has its own offset
+			i, o := inputPixels.PixOffset(x, y), outputPixels.PixOffset(x, y)
+			copy(outputPixels.Pix[o:o+8], inputPixels.Pix[i:i+8])
+		}
+	}
+}
+
 // ConvolveFlat applies a convolution filtering effect to the image using a flat kernel
 // @kernel: pointer to the kernel to be applied
 // @inputPixels: pointer to the pixels of image to be filtered
@@ -120,44 +1533,196 @@ func (img *Image) Grayscale(inputPixels *image.RGBA64,
 // references:
 // 1) http://www.songho.ca/dsp/convolution/convolution2d_example.html
 // 2) https://www.allaboutcircuits.com/technical-articles/two-dimensional-convolution-in-image-processing/
+//
+// obs: pixels are read from and written to the `Pix` buffers directly, one output row at a time, instead of
+// through `At`/`Set`, which convert each pixel through the color interface. The inner loops are written so
+// the compiler can prove the slice accesses in bounds and drop the bounds checks (BCE):
+//   - each input row overlapped by the kernel is resliced once to the image width ('inRow');
+//   - kernel columns falling outside the image are excluded by reslicing the kernel row ('kRow') to the
+//     columns within the image, which is then ranged over, i.e. zero-padding without a branch or index
+//     check per element;
+//   - each pixel is resliced with a fixed length and capacity (`row[o : o+8 : o+8]`), so the 8 byte
+//     accesses of the pixel need a single check.
+// Products are accumulated in the same order as the kernel values, skipping out of bounds elements, so the
+// output is identical to the `At`/`Set` version.
 func (img *Image) ConvolveFlat(kernel *Kernel, inputPixels *image.RGBA64, 
 	outputPixels *image.RGBA64, YStart int, YEnd int, XStart int, XEnd int){
 	
+	// 8 bit channels and fixed point values (see `Kernel.SetEightBit`)
+	if kernel.fixed != nil {
+		convolveEightBit(kernel, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+		return
+	}
+
 	bounds := inputPixels.Bounds()
+	// composite effect: threshold each pixel right after its convolution (see `convolutionOf`)
+	// obs: fused in the same pass; threshold is a point op, so no barrier is needed between the two steps
+	threshold := kernel.effect == "EB"
+
+	rows, cols := kernel.rows, kernel.cols
+	// offsets from the output pixel to the image pixel under the first kernel row/column
+	// obs: the kernel is inverted, i.e. kernel row m covers image row y + (centerRow - (rows - 1 - m)) = y + shiftY + m
+	shiftY := kernel.centerRow - (rows - 1)
+	shiftX := kernel.centerCol - (cols - 1)
+	// width of an image row in bytes (8 bytes per pixel: 16-bit R, G, B, A; big endian)
+	rowLen := bounds.Dx() * 8
+
 	// iterate over image rows
 	for y := YStart; y < YEnd; y++ {
+		outStart := outputPixels.PixOffset(XStart, y)
+		outRow := outputPixels.Pix[outStart : outStart+(XEnd-XStart)*8]
+		// source pixels of the row; read for their alpha only
+		srcStart := inputPixels.PixOffset(XStart, y)
+		srcRow := inputPixels.Pix[srcStart : srcStart+(XEnd-XStart)*8]
+
 		// iterave over image columns
 		for x := XStart; x < XEnd; x++ {
 			// new pixel colors
 			var rNew, gNew, bNew float64
 
-			// iterate over kernel "rows" and "columns"
-			for i:=0; i < kernel.size; i++ {
-				m := i / kernel.dim // row index in the kernel
-				n := i % kernel.dim // column index in the kernel
-				
-				// invert kernel indexes 
-				mm := kernel.dim - 1 - m
-				nn := kernel.dim - 1 - n
-				
-				// adjusted indices to access image pixels
-				yy := y + (kernel.center - mm)
-				xx := x + (kernel.center - nn)
-
-				// if inbounds, set new values (i.e. zero-padding for out of bounds elements)
-				if xx >= bounds.Min.X && xx < bounds.Max.X && yy >= bounds.Min.Y &&  yy < bounds.Max.Y {
-					r, g , b , _ := inputPixels.At(xx, yy).RGBA()
-					rNew += float64(r) * kernel.values[i]
-					gNew += float64(g) * kernel.values[i]
-					bNew += float64(b) * kernel.values[i]
+			// range of kernel columns within the image for this pixel
+			nStart, nEnd := 0, cols
+			if bounds.Min.X-(x+shiftX) > nStart {
+				nStart = bounds.Min.X - (x + shiftX)
+			}
+			if bounds.Max.X-(x+shiftX) < nEnd {
+				nEnd = bounds.Max.X - (x + shiftX)
+			}
+
+			// iterate over kernel rows
+			for m := 0; m < rows; m++ {
+				yy := y + shiftY + m
+				// zero-padding for rows out of bounds
+				if yy < bounds.Min.Y || yy >= bounds.Max.Y {
+					continue
 				}
+				inStart := inputPixels.PixOffset(bounds.Min.X, yy)
+				inRow := inputPixels.Pix[inStart : inStart+rowLen]
+				kRow := kernel.values[m*cols+nStart : m*cols+nEnd]
+
+				// iterate over kernel columns within the image
+				o := (x + shiftX + nStart - bounds.Min.X) * 8
+				for _, k := range kRow {
+					px := inRow[o : o+8 : o+8]
+					rNew += float64(uint16(px[0])<<8|uint16(px[1])) * k
+					gNew += float64(uint16(px[2])<<8|uint16(px[3])) * k
+					bNew += float64(uint16(px[4])<<8|uint16(px[5])) * k
+					o += 8
+				}
+			}
+
+			var r, g, b uint16
+			if threshold {
+				v := thresholdValue(clamp(rNew), clamp(gNew), clamp(bNew), kernel.param)
+				r, g, b = v, v, v
+			} else {
+				r, g, b = clamp(rNew), clamp(gNew), clamp(bNew)
 			}
 			// obs: keeping 'a' channel constant; changing it sometimes gave results different from the 'expected' images
-			outputPixels.Set(x, y, color.RGBA64{clamp(rNew), clamp(gNew), clamp(bNew), 65535})
+			// unless the kernel keeps the alpha of the source (see `alphaEffect`)
+			o := (x - XStart) * 8
+			var a uint16 = 65535
+			if kernel.keepAlpha {
+				src := srcRow[o : o+8 : o+8]
+				a = uint16(src[6])<<8 | uint16(src[7])
+				// channels are alpha-premultiplied, so they can't exceed the alpha (eg: blurring opaque pixels
+				// into transparent ones); brighter values are invalid colors
+				r, g, b = min16(r, a), min16(g, a), min16(b, a)
+			}
+			px := outRow[o : o+8 : o+8]
+			px[0], px[1] = uint8(r>>8), uint8(r)
+			px[2], px[3] = uint8(g>>8), uint8(g)
+			px[4], px[5] = uint8(b>>8), uint8(b)
+			px[6], px[7] = uint8(a>>8), uint8(a)
+		}
+	}
+}
+
+// convolveEightBit applies the convolution of 'kernel' as `ConvolveFlat`, reading only the most significant byte of
+// each channel and accumulating its products with the fixed point values of the kernel in integers
+// (see `Kernel.SetEightBit`). Each sum is rounded to 8 bits and written back scaled to 16 (v * 257).
+// obs: same loop structure and bounds check elimination as `ConvolveFlat`; alpha and threshold are handled alike.
+func convolveEightBit(kernel *Kernel, inputPixels *image.RGBA64,
+	outputPixels *image.RGBA64, YStart int, YEnd int, XStart int, XEnd int) {
+
+	bounds := inputPixels.Bounds()
+	threshold := kernel.effect == "EB"
+	rows, cols := kernel.rows, kernel.cols
+	shiftY := kernel.centerRow - (rows - 1)
+	shiftX := kernel.centerCol - (cols - 1)
+	rowLen := bounds.Dx() * 8
+
+	for y := YStart; y < YEnd; y++ {
+		outStart := outputPixels.PixOffset(XStart, y)
+		outRow := outputPixels.Pix[outStart : outStart+(XEnd-XStart)*8]
+		srcStart := inputPixels.PixOffset(XStart, y)
+		srcRow := inputPixels.Pix[srcStart : srcStart+(XEnd-XStart)*8]
+
+		for x := XStart; x < XEnd; x++ {
+			// sums in fixed point (see `fixedBits`)
+			var rSum, gSum, bSum int64
+
+			nStart, nEnd := 0, cols
+			if bounds.Min.X-(x+shiftX) > nStart {
+				nStart = bounds.Min.X - (x + shiftX)
+			}
+			if bounds.Max.X-(x+shiftX) < nEnd {
+				nEnd = bounds.Max.X - (x + shiftX)
+			}
+
+			for m := 0; m < rows; m++ {
+				yy := y + shiftY + m
+				if yy < bounds.Min.Y || yy >= bounds.Max.Y {
+					continue
+				}
+				inStart := inputPixels.PixOffset(bounds.Min.X, yy)
+				inRow := inputPixels.Pix[inStart : inStart+rowLen]
+				kRow := kernel.fixed[m*cols+nStart : m*cols+nEnd]
+
+				o := (x + shiftX + nStart - bounds.Min.X) * 8
+				for _, k := range kRow {
+					px := inRow[o : o+5 : o+5]
+					rSum += int64(px[0]) * k
+					gSum += int64(px[2]) * k
+					bSum += int64(px[4]) * k
+					o += 8
+				}
+			}
+
+			r, g, b := fixedTo16(rSum), fixedTo16(gSum), fixedTo16(bSum)
+			if threshold {
+				v := thresholdValue(r, g, b, kernel.param)
+				r, g, b = v, v, v
+			}
+			o := (x - XStart) * 8
+			var a uint16 = 65535
+			if kernel.keepAlpha {
+				src := srcRow[o : o+8 : o+8]
+				a = uint16(src[6])<<8 | uint16(src[7])
+				r, g, b = min16(r, a), min16(g, a), min16(b, a)
+			}
+			px := outRow[o : o+8 : o+8]
+			px[0], px[1] = uint8(r>>8), uint8(r)
+			px[2], px[3] = uint8(g>>8), uint8(g)
+			px[4], px[5] = uint8(b>>8), uint8(b)
+			px[6], px[7] = uint8(a>>8), uint8(a)
 		}
 	}
 }
 
+// fixedTo16 rounds 'sum', an 8 bit channel in fixed point (see `fixedBits`), to 8 bits clamped to [0, 255]
+// and scales it to 16 bits
+func fixedTo16(sum int64) uint16 {
+	v := (sum + 1<<(fixedBits-1)) >> fixedBits
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 65535
+	}
+	return uint16(v) * 257
+}
+
 //=============================================================================
 // Methods for debugging and testing
 //=============================================================================
@@ -0,0 +1,1030 @@
+package png
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// applyChain returns the pixels of 'input' after the chain of 'effects'
+func applyChain(input *image.RGBA64, effects []string) *image.RGBA64 {
+	in := image.NewRGBA64(input.Bounds())
+	copy(in.Pix, input.Pix)
+	img := &Image{in: in, out: image.NewRGBA64(input.Bounds()), Bounds: input.Bounds()}
+	img.ApplyEffects(CreateKernels(effects))
+	final, _ := img.GetInputOutputPixels()
+	return final
+}
+
+// maxChannelDiff returns the largest difference between a channel of 'a' and the same channel of 'b'
+func maxChannelDiff(a, b *image.RGBA64) uint16 {
+	var max uint16
+	for i := 0; i < len(a.Pix); i += 2 {
+		va, vb := uint16(a.Pix[i])<<8|uint16(a.Pix[i+1]), uint16(b.Pix[i])<<8|uint16(b.Pix[i+1])
+		if va > vb && va-vb > max {
+			max = va - vb
+		} else if vb > va && vb-va > max {
+			max = vb - va
+		}
+	}
+	return max
+}
+
+func TestCommutes(t *testing.T) {
+	input := gradient(16, 12)
+	tests := []struct {
+		a, b     string
+		commutes bool
+	}{
+		// two blurs: the same image up to the float rounding of each pass
+		{"B", "B", true},
+		{"B", "G", true},
+		// sharpening a blurred image is not blurring a sharpened one
+		{"B", "S", false},
+	}
+	for _, test := range tests {
+		if got := Commutes(test.a, test.b); got != test.commutes || Commutes(test.b, test.a) != got {
+			t.Errorf("Commutes(%s, %s) = %v, want %v in both orders", test.a, test.b, got, test.commutes)
+		}
+		warnings := AnalyzeEffectChain([]string{test.a, test.b}).Warnings
+		if test.commutes != (len(warnings) == 0) {
+			t.Errorf("%s,%s: got warnings %v", test.a, test.b, warnings)
+		}
+
+		diff := maxChannelDiff(applyChain(input, []string{test.a, test.b}), applyChain(input, []string{test.b, test.a}))
+		if test.commutes && diff > 2 {
+			t.Errorf("%s,%s and %s,%s differ by %d, want the same image up to rounding", test.a, test.b, test.b, test.a, diff)
+		} else if !test.commutes && diff <= 2 {
+			t.Errorf("%s,%s and %s,%s give the same image, but do not commute", test.a, test.b, test.b, test.a)
+		}
+	}
+
+	if report := AnalyzeEffectChain([]string{"G", "B", "X"}); !report.GrayscaleFirst || !reflect.DeepEqual(report.Invalid, []string{"X"}) {
+		t.Errorf("G,B,X: got %+v, want grayscale first and X invalid", report)
+	}
+}
+
+// clampMinMax is the original clamp, through math.Min and math.Max; the reference of `clamp`
+func clampMinMax(comp float64) uint16 {
+	return uint16(math.Min(65535, math.Max(0, comp)))
+}
+
+func TestClampMatchesMinMax(t *testing.T) {
+	// every integer of the range and beyond, and the values in between
+	for v := -70000.0; v <= 140000; v += 0.25 {
+		if got, want := clamp(v), clampMinMax(v); got != want {
+			t.Fatalf("clamp(%v) = %d, want %d", v, got, want)
+		}
+	}
+	special := []float64{math.Inf(-1), math.Inf(1), -math.MaxFloat64, math.MaxFloat64, -0.0, 0.5, 65534.999, 65535.0001,
+		math.Nextafter(0, -1), math.Nextafter(65535, 1e9), 1e300, -1e300}
+	for _, v := range special {
+		if got, want := clamp(v), clampMinMax(v); got != want {
+			t.Errorf("clamp(%v) = %d, want %d", v, got, want)
+		}
+	}
+}
+
+// clampInputs are values of convolution sums: mostly in range, some below 0 and above 65535
+var clampInputs = func() []float64 {
+	inputs := make([]float64, 4096)
+	for i := range inputs {
+		inputs[i] = float64(i*37%90000) - 10000
+	}
+	return inputs
+}()
+
+var clampSink uint16
+
+func BenchmarkClamp(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, v := range clampInputs {
+			clampSink += clamp(v)
+		}
+	}
+}
+
+func BenchmarkClampMinMax(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, v := range clampInputs {
+			clampSink += clampMinMax(v)
+		}
+	}
+}
+
+func TestVignette(t *testing.T) {
+	// odd sides, so a pixel is at the center
+	input := image.NewRGBA64(image.Rect(0, 0, 9, 7))
+	for y := 0; y < 7; y++ {
+		for x := 0; x < 9; x++ {
+			input.SetRGBA64(x, y, color.RGBA64{40000, 40000, 40000, 65535})
+		}
+	}
+	output := applyChain(input, []string{"VIG0.5"})
+	if got := output.RGBA64At(4, 3); got != input.RGBA64At(4, 3) {
+		t.Errorf("the center changed to %v", got)
+	}
+	// the corners are scaled by 1 - strength
+	for _, corner := range []image.Point{{0, 0}, {8, 0}, {0, 6}, {8, 6}} {
+		if got := output.RGBA64At(corner.X, corner.Y); got != (color.RGBA64{20000, 20000, 20000, 65535}) {
+			t.Errorf("corner %v is %v, want half of 40000", corner, got)
+		}
+	}
+
+	// slices of rows compute the distances from the center of the whole image
+	sliced := image.NewRGBA64(input.Bounds())
+	for _, rows := range [][2]int{{0, 2}, {2, 5}, {5, 7}} {
+		Vignette(input, sliced, 0.5, input.Bounds(), rows[0], rows[1], 0, 9)
+	}
+	if !bytes.Equal(sliced.Pix, output.Pix) {
+		t.Error("the vignette of slices differs from the one of the whole image")
+	}
+}
+
+func TestBinaryEdges(t *testing.T) {
+	// a strong vertical edge: black on the left half, white on the right half
+	const w, h = 12, 8
+	input := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := w / 2; x < w; x++ {
+			input.SetRGBA64(x, y, color.RGBA64{65535, 65535, 65535, 65535})
+		}
+	}
+	output := applyEffect(t, input, "EB128")
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := output.RGBA64At(x, y)
+			if c.R != c.G || c.G != c.B || (c.R != 0 && c.R != 65535) {
+				t.Fatalf("pixel (%d, %d) is %v, want black or white", x, y, c)
+			}
+			// away from the image border, only the white column next to the edge is white
+			// obs: at the border the zero-padding is an edge too
+			if y == 0 || y == h-1 || x == 0 || x == w-1 {
+				continue
+			}
+			if want := x == w/2; (c.R == 65535) != want {
+				t.Errorf("pixel (%d, %d) is %v, want white %v", x, y, c, want)
+			}
+		}
+	}
+}
+
+// convolveAtSet is the `At`/`Set` version of `ConvolveFlat`, the reference of the convolution on the `Pix` rows.
+// Same kernel inversion and order of the products; out of bounds elements are skipped (zero-padding).
+func convolveAtSet(kernel *Kernel, inputPixels *image.RGBA64, outputPixels *image.RGBA64, YStart, YEnd, XStart, XEnd int) {
+	bounds := inputPixels.Bounds()
+	for y := YStart; y < YEnd; y++ {
+		for x := XStart; x < XEnd; x++ {
+			var rNew, gNew, bNew float64
+			for i := 0; i < kernel.rows*kernel.cols; i++ {
+				mm := kernel.rows - 1 - i/kernel.cols
+				nn := kernel.cols - 1 - i%kernel.cols
+				yy := y + (kernel.centerRow - mm)
+				xx := x + (kernel.centerCol - nn)
+				if xx >= bounds.Min.X && xx < bounds.Max.X && yy >= bounds.Min.Y && yy < bounds.Max.Y {
+					r, g, b, _ := inputPixels.At(xx, yy).RGBA()
+					rNew += float64(r) * kernel.values[i]
+					gNew += float64(g) * kernel.values[i]
+					bNew += float64(b) * kernel.values[i]
+				}
+			}
+			if kernel.effect == "EB" {
+				v := thresholdValue(clamp(rNew), clamp(gNew), clamp(bNew), kernel.param)
+				outputPixels.Set(x, y, color.RGBA64{v, v, v, 65535})
+				continue
+			}
+			outputPixels.Set(x, y, color.RGBA64{clamp(rNew), clamp(gNew), clamp(bNew), 65535})
+		}
+	}
+}
+
+// convolutionKernels are kernels of all shapes: square, rows, columns, off-center and larger than the test images
+var convolutionKernels = []string{"B", "S", "E", "EB128", "K1x5:0.2:0.2:0.2:0.2:0.2", "K3x1:0.25:0.5:0.25",
+	"K3x5:1:0:-1:2:0:0:-2:1:0:3:-1:0:1:0:2", "MB9@30", "GB2@3", "GB3@12"}
+
+func TestConvolveFlatMatchesAtSet(t *testing.T) {
+	input := gradient(17, 11)
+	// rectangles: the whole image, a slice of rows, and a slice of rows and columns
+	rects := []image.Rectangle{input.Bounds(), image.Rect(0, 3, 17, 7), image.Rect(4, 2, 9, 11)}
+	for _, effect := range convolutionKernels {
+		kernel := NewKernel(effect)
+		for _, rect := range rects {
+			got := image.NewRGBA64(input.Bounds())
+			want := image.NewRGBA64(input.Bounds())
+			NewImage(1, 1).ConvolveFlat(kernel, input, got, rect.Min.Y, rect.Max.Y, rect.Min.X, rect.Max.X)
+			convolveAtSet(kernel, input, want, rect.Min.Y, rect.Max.Y, rect.Min.X, rect.Max.X)
+			for i := range want.Pix {
+				if got.Pix[i] != want.Pix[i] {
+					x, y := (i/8)%17, i/8/17
+					t.Fatalf("%s over %v: pixel (%d, %d) is %v, want %v", effect, rect, x, y, got.RGBA64At(x, y), want.RGBA64At(x, y))
+				}
+			}
+		}
+	}
+}
+
+// 8 bit convolutions are within their documented bound of the float ones, and write 8 bit channels
+func TestEightBitConvolution(t *testing.T) {
+	input := noise(17, 11)
+	rects := []image.Rectangle{input.Bounds(), image.Rect(4, 2, 9, 11)}
+	// obs: not the binary edges "EB128", whose pixels near the cutoff flip between black and white
+	for _, effect := range append([]string{"BA", "SA"}, convolutionKernels...) {
+		if effect == "EB128" {
+			continue
+		}
+		want := NewKernel(effect)
+		kernel := NewKernel(effect)
+		if !kernel.SetEightBit() {
+			t.Fatalf("%s: not set to 8 bits", effect)
+		}
+		sum := 0.0
+		for _, value := range kernel.values {
+			sum += math.Abs(value)
+		}
+		bound := uint16(255*sum + 130)
+		for _, rect := range rects {
+			got, ref := image.NewRGBA64(input.Bounds()), image.NewRGBA64(input.Bounds())
+			NewImage(1, 1).ConvolveFlat(kernel, input, got, rect.Min.Y, rect.Max.Y, rect.Min.X, rect.Max.X)
+			NewImage(1, 1).ConvolveFlat(want, input, ref, rect.Min.Y, rect.Max.Y, rect.Min.X, rect.Max.X)
+			if diff := maxChannelDiff(got, ref); diff > bound {
+				t.Errorf("%s over %v: within %d of the float convolution, want at most %d", effect, rect, diff, bound)
+			}
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					if px := got.RGBA64At(x, y); px.R%257 != 0 || px.G%257 != 0 || px.B%257 != 0 {
+						t.Fatalf("%s over %v: pixel (%d, %d) %v is not 8 bit", effect, rect, x, y, px)
+					}
+				}
+			}
+		}
+	}
+
+	for _, effect := range []string{"G", "VIG0.5", "I"} {
+		if NewKernel(effect).SetEightBit() {
+			t.Errorf("%s set to 8 bits", effect)
+		}
+	}
+}
+
+func benchmarkConvolve(b *testing.B, convolve func(*Kernel, *image.RGBA64, *image.RGBA64, int, int, int, int)) {
+	input := gradient(512, 512)
+	output := image.NewRGBA64(input.Bounds())
+	for _, effect := range []string{"B", "GB2@7"} {
+		kernel := NewKernel(effect)
+		b.Run(effect, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				convolve(kernel, input, output, 0, 512, 0, 512)
+			}
+		})
+	}
+}
+
+func BenchmarkConvolveFlat(b *testing.B) {
+	img := NewImage(1, 1)
+	benchmarkConvolve(b, img.ConvolveFlat)
+}
+
+func BenchmarkConvolveEightBit(b *testing.B) {
+	img := NewImage(1, 1)
+	benchmarkConvolve(b, func(kernel *Kernel, inputPixels *image.RGBA64, outputPixels *image.RGBA64, YStart, YEnd, XStart, XEnd int) {
+		if kernel.fixed == nil {
+			kernel.SetEightBit()
+		}
+		img.ConvolveFlat(kernel, inputPixels, outputPixels, YStart, YEnd, XStart, XEnd)
+	})
+}
+
+func BenchmarkConvolveAtSet(b *testing.B) {
+	benchmarkConvolve(b, convolveAtSet)
+}
+
+// applyEffect returns the pixels of 'input' after 'effect'
+func applyEffect(t *testing.T, input *image.RGBA64, effect string) *image.RGBA64 {
+	t.Helper()
+	if !ValidEffect(effect) {
+		t.Fatalf("%s is not a valid effect", effect)
+	}
+	img := NewImageFromRGBA64(cloneRGBA64(input))
+	img.ApplyEffects(CreateKernels([]string{effect}))
+	final, _ := img.GetInputOutputPixels()
+	return final
+}
+
+func TestColorMatrix(t *testing.T) {
+	input := gradient(16, 8)
+	if output := applyEffect(t, input, "CM1:0:0:0:1:0:0:0:1"); !equalPixels(output, input) {
+		t.Error("the identity matrix changed the image")
+	}
+
+	swapped := applyEffect(t, input, "CM0:0:1:0:1:0:1:0:0")
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			in, out := input.RGBA64At(x, y), swapped.RGBA64At(x, y)
+			if out != (color.RGBA64{in.B, in.G, in.R, in.A}) {
+				t.Fatalf("swap of pixel (%d, %d) %v is %v", x, y, in, out)
+			}
+		}
+	}
+
+	// red doubled, green negated, blue = red + blue
+	clamped := applyEffect(t, input, "CM2:0:0:0:-1:0:1:0:1")
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			in, out := input.RGBA64At(x, y), clamped.RGBA64At(x, y)
+			want := color.RGBA64{clampMinMax(2 * float64(in.R)), 0, clampMinMax(float64(in.R) + float64(in.B)), in.A}
+			if out != want {
+				t.Fatalf("pixel (%d, %d) %v is %v, want %v", x, y, in, out, want)
+			}
+		}
+	}
+	if clamped.RGBA64At(15, 0).R != 65535 {
+		t.Error("values over 65535 are not clamped")
+	}
+
+	for _, effect := range []string{"CM1:0:0:0:1:0:0:0", "CM1:0:0:0:1:0:0:0:1:0", "CM1:0:0:0:x:0:0:0:1", "CM1:0:0:0:NaN:0:0:0:1"} {
+		if ValidEffect(effect) {
+			t.Errorf("%s is a valid effect", effect)
+		}
+	}
+}
+
+// equalPixels returns true if 'a' and 'b' have the same bounds and pixels
+func equalPixels(a, b *image.RGBA64) bool {
+	return a.Bounds() == b.Bounds() && bytes.Equal(a.Pix, b.Pix)
+}
+
+func TestConvolveKeepAlpha(t *testing.T) {
+	// opaque white at the left fading to transparent at the right (alpha-premultiplied)
+	input := image.NewRGBA64(image.Rect(0, 0, 16, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 16; x++ {
+			a := uint16(65535 - x*65535/15)
+			input.SetRGBA64(x, y, color.RGBA64{a, a, a, a})
+		}
+	}
+	for _, effect := range []string{"BA", "SA", "GB2@3A", "EB10A"} {
+		output := applyEffect(t, input, effect)
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 16; x++ {
+				in, out := input.RGBA64At(x, y), output.RGBA64At(x, y)
+				if out.A != in.A {
+					t.Fatalf("%s: alpha of pixel (%d, %d) is %d, want %d", effect, x, y, out.A, in.A)
+				}
+				if out.R > out.A || out.G > out.A || out.B > out.A {
+					t.Fatalf("%s: pixel (%d, %d) %v has a channel over its alpha", effect, x, y, out)
+				}
+			}
+		}
+	}
+	// the default stays opaque
+	if output := applyEffect(t, input, "B"); output.RGBA64At(15, 0).A != 65535 {
+		t.Error("a blur without the alpha suffix is not opaque")
+	}
+}
+
+// dot returns a 'size' x 'size' opaque black image with a white pixel at its center
+func dot(size int) *image.RGBA64 {
+	pixels := image.NewRGBA64(image.Rect(0, 0, size, size))
+	for i := 0; i < size*size; i++ {
+		pixels.SetRGBA64(i%size, i/size, color.RGBA64{0, 0, 0, 65535})
+	}
+	pixels.SetRGBA64(size/2, size/2, color.RGBA64{65535, 65535, 65535, 65535})
+	return pixels
+}
+
+// spread returns the pixels of 'pixels' whose red channel isn't black, as their offsets from the center
+func spread(pixels *image.RGBA64) map[image.Point]uint16 {
+	bounds := pixels.Bounds()
+	center := image.Pt(bounds.Dx()/2, bounds.Dy()/2)
+	lit := make(map[image.Point]uint16)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if r := pixels.RGBA64At(x, y).R; r != 0 {
+				lit[image.Pt(x, y).Sub(center)] = r
+			}
+		}
+	}
+	return lit
+}
+
+func TestRectangularKernel(t *testing.T) {
+	// a dot is smeared over the 5 pixels of its row, and no other row
+	lit := spread(applyEffect(t, dot(9), "K1x5:0.2:0.2:0.2:0.2:0.2"))
+	if len(lit) != 5 {
+		t.Fatalf("%d pixels lit, want 5: %v", len(lit), lit)
+	}
+	for dx := -2; dx <= 2; dx++ {
+		if r := lit[image.Pt(dx, 0)]; r != 13107 {
+			t.Errorf("pixel %d from the dot is %d, want 13107", dx, r)
+		}
+	}
+
+	// a horizontal edge stays sharp
+	edge := gradient(12, 12)
+	for x := 0; x < 12; x++ {
+		for y := 6; y < 12; y++ {
+			edge.SetRGBA64(x, y, color.RGBA64{65535, 65535, 65535, 65535})
+		}
+	}
+	blurred := applyEffect(t, edge, "K1x5:0.2:0.2:0.2:0.2:0.2")
+	for x := 2; x < 10; x++ {
+		if px := blurred.RGBA64At(x, 6); px != (color.RGBA64{65535, 65535, 65535, 65535}) {
+			t.Errorf("pixel (%d, 6) below the edge is %v, want white", x, px)
+		}
+	}
+
+	// the vertical kernel smears along the column
+	lit = spread(applyEffect(t, dot(9), "K3x1:0.25:0.5:0.25"))
+	want := map[image.Point]uint16{{0, -1}: 16383, {0, 0}: 32767, {0, 1}: 16383}
+	if !reflect.DeepEqual(lit, want) {
+		t.Errorf("vertical kernel lit %v, want %v", lit, want)
+	}
+}
+
+func TestMotionBlur(t *testing.T) {
+	input := gradient(16, 12)
+	if !equalPixels(applyEffect(t, input, "MB5@0"), applyEffect(t, input, "K1x5:0.2:0.2:0.2:0.2:0.2")) {
+		t.Error("a 0° motion blur differs from the 1x5 horizontal box blur")
+	}
+	if !equalPixels(applyEffect(t, input, "MB5@90"), applyEffect(t, input, "K5x1:0.2:0.2:0.2:0.2:0.2")) {
+		t.Error("a 90° motion blur differs from the 5x1 vertical box blur")
+	}
+	// 180° is the same streak as 0°
+	if !equalPixels(applyEffect(t, input, "MB7@180"), applyEffect(t, input, "MB7@0")) {
+		t.Error("a 180° motion blur differs from the 0° one")
+	}
+
+	// a 45° streak goes up to the right: x and y offsets from the dot are opposite (y grows downwards)
+	lit := spread(applyEffect(t, dot(11), "MB9@45"))
+	if len(lit) < 3 {
+		t.Fatalf("%d pixels lit by a 45° streak: %v", len(lit), lit)
+	}
+	for p := range lit {
+		if p.X != -p.Y {
+			t.Errorf("pixel %v lit out of the 45° streak", p)
+		}
+	}
+
+	for _, length := range []int{1, 3, 9, 31, 99} {
+		for _, angle := range []float64{0, 10, 45, 90, 135, 200, -30} {
+			values, rows, cols := motionBlurValues(length, angle)
+			var sum float64
+			for _, v := range values {
+				sum += v
+			}
+			if math.Abs(sum-1) > 1e-9 || len(values) != rows*cols || rows%2 == 0 || cols%2 == 0 {
+				t.Errorf("MB%d@%v: %d x %d kernel of %d values summing to %v", length, angle, rows, cols, len(values), sum)
+			}
+		}
+	}
+
+	for _, effect := range []string{"MB4@0", "MB0@0", "MB101@0", "MB5", "MB5@x", "MB5@Inf"} {
+		if ValidEffect(effect) {
+			t.Errorf("%s is a valid effect", effect)
+		}
+	}
+}
+
+// channelRange returns the minimum and maximum of each channel of 'pixels'
+func channelRange(pixels *image.RGBA64) (min, max [3]uint16) {
+	min = [3]uint16{65535, 65535, 65535}
+	bounds := pixels.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			px := pixels.RGBA64At(x, y)
+			for c, v := range [3]uint16{px.R, px.G, px.B} {
+				if v < min[c] {
+					min[c] = v
+				}
+				if v > max[c] {
+					max[c] = v
+				}
+			}
+		}
+	}
+	return min, max
+}
+
+func TestAutoContrast(t *testing.T) {
+	// dull image: all channels within [30000, 34000)
+	dull := image.NewRGBA64(image.Rect(0, 0, 20, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			dull.SetRGBA64(x, y, color.RGBA64{uint16(30000 + x*200), uint16(30000 + y*400), uint16(30000 + (x+y)*130), 65535})
+		}
+	}
+	hist := Histogram(NewImageFromRGBA64(dull))
+	for c := range hist {
+		var n int
+		for _, count := range hist[c] {
+			n += count
+		}
+		if n != 200 {
+			t.Errorf("histogram of channel %d counts %d pixels, want 200", c, n)
+		}
+	}
+
+	min, max := channelRange(applyEffect(t, dull, "AC"))
+	if min != [3]uint16{0, 0, 0} || max != [3]uint16{65535, 65535, 65535} {
+		t.Errorf("auto-contrast output ranges from %v to %v, want the full range", min, max)
+	}
+
+	// a flat image is kept as is
+	flat := image.NewRGBA64(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 16; i++ {
+		flat.SetRGBA64(i%4, i/4, color.RGBA64{20000, 30000, 40000, 65535})
+	}
+	if !equalPixels(applyEffect(t, flat, "AC"), flat) {
+		t.Error("auto-contrast changed a flat image")
+	}
+}
+
+func TestMask(t *testing.T) {
+	input := gradient(16, 8)
+	// white on the left half
+	mask := image.NewGray(input.Bounds())
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			mask.SetGray(x, y, color.Gray{255})
+		}
+	}
+	blurred := applyEffect(t, input, "B")
+
+	img := NewImageFromRGBA64(cloneRGBA64(input))
+	img.ApplyEffectMasked(NewKernel("B"), mask, 0, 8, 0, 16)
+	_, masked := img.GetInputOutputPixels()
+
+	// a chain masked through the image: every effect is restricted to the left half
+	chain := NewImageFromRGBA64(cloneRGBA64(input))
+	if err := chain.SetMask(mask); err != nil {
+		t.Fatal(err)
+	}
+	chain.ApplyEffects(CreateKernels([]string{"B", "S"}))
+	chained, _ := chain.GetInputOutputPixels()
+
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			want := blurred.RGBA64At(x, y)
+			if x >= 8 {
+				want = input.RGBA64At(x, y)
+				if got := chained.RGBA64At(x, y); got != want {
+					t.Errorf("masked chain changed pixel (%d, %d) from %v to %v", x, y, want, got)
+				}
+			}
+			if got := masked.RGBA64At(x, y); got != want {
+				t.Errorf("masked blur of pixel (%d, %d) is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	if err := chain.SetMask(image.NewGray(image.Rect(0, 0, 4, 4))); err == nil {
+		t.Error("a mask of other bounds than the image was set")
+	}
+}
+
+// uniform returns a 4x4 image with all pixels of color 'c'
+func uniform(c color.RGBA64) *image.RGBA64 {
+	pixels := image.NewRGBA64(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 16; i++ {
+		pixels.SetRGBA64(i%4, i/4, c)
+	}
+	return pixels
+}
+
+func TestLuma(t *testing.T) {
+	tests := []struct {
+		effect string
+		green  uint16 // gray of pure green: the green weight of the standard
+	}{
+		{"GL601", 38469}, // 0.587 * 65535
+		{"GL709", 46871}, // 0.7152 * 65535
+		{"G", 21845},     // average, the legacy default
+	}
+	for _, test := range tests {
+		for _, v := range []uint16{0, 1, 32768, 65535} {
+			gray := uniform(color.RGBA64{v, v, v, 65535})
+			if output := applyEffect(t, gray, test.effect); !equalPixels(output, gray) {
+				t.Errorf("%s changed gray %d to %v", test.effect, v, output.RGBA64At(0, 0))
+			}
+		}
+		green := applyEffect(t, uniform(color.RGBA64{0, 65535, 0, 65535}), test.effect)
+		if px := green.RGBA64At(2, 2); px != (color.RGBA64{test.green, test.green, test.green, 65535}) {
+			t.Errorf("%s of pure green is %v, want gray %d", test.effect, px, test.green)
+		}
+	}
+	if ValidEffect("GL2020") {
+		t.Error("GL2020 is a valid effect")
+	}
+}
+
+func TestInverse(t *testing.T) {
+	// translucent gradient: channels scaled by the alpha of the column (alpha-premultiplied)
+	input := gradient(16, 8)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			px := input.RGBA64At(x, y)
+			a := uint32(x * 65535 / 15)
+			input.SetRGBA64(x, y, color.RGBA64{uint16(uint32(px.R) * a / 65535), uint16(uint32(px.G) * a / 65535),
+				uint16(uint32(px.B) * a / 65535), uint16(a)})
+		}
+	}
+	img := NewImageFromRGBA64(cloneRGBA64(input))
+	img.ApplyEffects(CreateKernels([]string{"I", "I"}))
+	if final, _ := img.GetInputOutputPixels(); !equalPixels(final, input) {
+		t.Error("inverting twice did not give back the original")
+	}
+
+	// a chain followed by its inverse gives back the original
+	chain := []string{"I", "CM0:0:1:1:0:0:0:1:0"}
+	inverse, err := InverseChain(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img = NewImageFromRGBA64(cloneRGBA64(input))
+	img.ApplyEffects(CreateKernels(append(chain, inverse...)))
+	if final, _ := img.GetInputOutputPixels(); !equalPixels(final, input) {
+		t.Errorf("%v followed by its inverse %v did not give back the original", chain, inverse)
+	}
+
+	for _, effect := range []string{"B", "S", "CM2:0:0:0:1:0:0:0:1"} {
+		if _, err := Inverse(effect); !errors.Is(err, ErrNotInvertible) {
+			t.Errorf("inverse of %s: got %v, want %v", effect, err, ErrNotInvertible)
+		}
+	}
+	if _, err := InverseChain([]string{"I", "B"}); !errors.Is(err, ErrNotInvertible) {
+		t.Errorf("inverse of a chain with a blur: got %v, want %v", err, ErrNotInvertible)
+	}
+
+	// channels over the alpha don't wrap around
+	invalid := uniform(color.RGBA64{40000, 10000, 30000, 20000})
+	if px := applyEffect(t, invalid, "I").RGBA64At(0, 0); px != (color.RGBA64{0, 10000, 0, 20000}) {
+		t.Errorf("inverted %v to %v", invalid.RGBA64At(0, 0), px)
+	}
+}
+
+func TestDither(t *testing.T) {
+	for _, levels := range []int{2, 4} {
+		effect := fmt.Sprintf("DITHER%d", levels)
+		palette := make(map[uint16]bool)
+		for l := 0; l < levels; l++ {
+			palette[uint16(l*65535/(levels-1))] = true
+		}
+		output := applyEffect(t, gradient(32, 16), effect)
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 32; x++ {
+				px := output.RGBA64At(x, y)
+				if !palette[px.R] || !palette[px.G] || !palette[px.B] || px.A != 65535 {
+					t.Fatalf("%s: pixel (%d, %d) %v is not a palette color", effect, x, y, px)
+				}
+			}
+		}
+	}
+
+	// uniform mid-gray, between the 2 levels: error diffusion alternates black and white,
+	// so neighbors differ and the average stays close to the input
+	output := applyEffect(t, uniform(color.RGBA64{32768, 32768, 32768, 65535}), "DITHER2")
+	var sum float64
+	differ := 0
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			sum += float64(output.RGBA64At(x, y).R)
+			if x > 0 && output.RGBA64At(x, y) != output.RGBA64At(x-1, y) {
+				differ++
+			}
+		}
+	}
+	if differ == 0 {
+		t.Error("no adjacent pixels differ: the error is not diffused")
+	}
+	if mean := sum / 16; math.Abs(mean-32768) > 65535/8 {
+		t.Errorf("mean of the dithered gray is %.0f, want about 32768", mean)
+	}
+
+	for _, effect := range []string{"DITHER1", "DITHER257", "DITHER"} {
+		if ValidEffect(effect) {
+			t.Errorf("%s is a valid effect", effect)
+		}
+	}
+}
+
+func TestGaussianKernel(t *testing.T) {
+	for _, sigma := range []float64{0.5, 1, 2.5} {
+		for _, radius := range []int{0, 1, 4, 10} {
+			kernel := NewGaussianKernel(sigma, radius)
+			dim := 2*radius + 1
+			if kernel.rows != dim || kernel.cols != dim || kernel.centerRow != radius || kernel.centerCol != radius {
+				t.Fatalf("sigma %v radius %d: %d x %d kernel centered at (%d, %d)", sigma, radius, kernel.rows, kernel.cols,
+					kernel.centerRow, kernel.centerCol)
+			}
+			var sum float64
+			center := kernel.values[radius*dim+radius]
+			for row := 0; row < dim; row++ {
+				for col := 0; col < dim; col++ {
+					v := kernel.values[row*dim+col]
+					sum += v
+					// symmetric about both axes and the diagonal
+					for _, mirror := range []float64{kernel.values[(dim-1-row)*dim+col], kernel.values[row*dim+dim-1-col],
+						kernel.values[col*dim+row]} {
+						if math.Abs(v-mirror) > 1e-15 {
+							t.Fatalf("sigma %v radius %d: value (%d, %d) %v differs from its mirror %v", sigma, radius, row, col, v, mirror)
+						}
+					}
+					if (row != radius || col != radius) && v >= center {
+						t.Fatalf("sigma %v radius %d: value (%d, %d) %v is not below the center %v", sigma, radius, row, col, v, center)
+					}
+				}
+			}
+			if math.Abs(sum-1) > 1e-9 {
+				t.Errorf("sigma %v radius %d: values sum to %v", sigma, radius, sum)
+			}
+		}
+	}
+
+	// a Gaussian of radius 0 is the identity
+	input := gradient(10, 10)
+	if !equalPixels(applyEffect(t, input, "GB1@0"), input) {
+		t.Error("a Gaussian of radius 0 changed the image")
+	}
+	for _, effect := range []string{"GB0@2", "GB-1@2", "GB1@-1", "GB1@50", "GB1", "GBx@2"} {
+		if ValidEffect(effect) {
+			t.Errorf("%s is a valid effect", effect)
+		}
+	}
+}
+
+func TestParseEffectChain(t *testing.T) {
+	tests := []struct {
+		chain string
+		want  []string // nil: the chain is invalid
+	}{
+		{"B,B,S,GL709", []string{"B", "B", "S", "GL709"}},
+		{"GB2@5", []string{"GB2@5"}},
+		{" VIG0.5 , T128", []string{"VIG0.5", "T128"}},
+		{"", nil},
+		{"B,,S", nil},
+		{"B,", nil},
+		{"B;S", nil},
+		{"X", nil},
+		{"GL600", nil},
+		{"GB2@", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseEffectChain(tt.chain)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseEffectChain(%q) = %q, want an error", tt.chain, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseEffectChain(%q): %v", tt.chain, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseEffectChain(%q) = %q, want %q", tt.chain, got, tt.want)
+		}
+		// formatting the effects gives back the chain, without spaces
+		if again, _ := ParseEffectChain(FormatEffectChain(got)); !reflect.DeepEqual(again, got) {
+			t.Errorf("ParseEffectChain(FormatEffectChain(%q)) = %q", got, again)
+		}
+	}
+}
+
+// writeLUT writes a lookup table file 'name' in a temporary directory with 'n' entries, entry v being
+// 'entry'(v), and returns its path
+func writeLUT(t *testing.T, name string, n int, entry func(v int) string) string {
+	t.Helper()
+	var lines strings.Builder
+	lines.WriteString("# generated table\n")
+	for v := 0; v < n; v++ {
+		lines.WriteString(entry(v) + "\n")
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(lines.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLUT(t *testing.T) {
+	input := gradient(16, 8)
+	identity := func(v int) string { return strconv.Itoa(v) }
+	if path := writeLUT(t, "identity.txt", lutEntries16, identity); !equalPixels(applyEffect(t, input, lutCode+path), input) {
+		t.Error("identity table changed the image")
+	}
+	// with 256 entries, channels are mapped by their 8-bit value
+	path := writeLUT(t, "identity8.txt", lutEntries8, func(v int) string { return identity(v << 8) })
+	got := applyEffect(t, input, lutCode+path)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			px := input.RGBA64At(x, y)
+			if want := (color.RGBA64{px.R &^ 0xff, px.G &^ 0xff, px.B &^ 0xff, px.A}); got.RGBA64At(x, y) != want {
+				t.Fatalf("8-bit identity table: pixel (%d, %d) is %v, want %v", x, y, got.RGBA64At(x, y), want)
+			}
+		}
+	}
+
+	// an inverting table is the invert effect on opaque pixels, with one or three values per entry
+	inverting := writeLUT(t, "invert.txt", lutEntries16, func(v int) string { return strconv.Itoa(65535 - v) })
+	perChannel := writeLUT(t, "invert3.txt", lutEntries16, func(v int) string {
+		return fmt.Sprintf("%d %d %d", 65535-v, 65535-v, 65535-v)
+	})
+	want := applyEffect(t, input, invertCode)
+	for _, path := range []string{inverting, perChannel} {
+		if !equalPixels(applyEffect(t, input, lutCode+path), want) {
+			t.Errorf("table %s differs from the invert effect", filepath.Base(path))
+		}
+	}
+
+	// malformed tables are errors, and their effects are not valid
+	for _, path := range []string{
+		writeLUT(t, "short.txt", 100, identity),
+		writeLUT(t, "long.txt", lutEntries16+1, identity),
+		writeLUT(t, "range.txt", lutEntries8, func(v int) string { return strconv.Itoa(v * 1000) }),
+		writeLUT(t, "two.txt", lutEntries8, func(v int) string { return "1 2" }),
+	} {
+		if _, err := LoadLUT(path); err == nil {
+			t.Errorf("table %s loaded without error", filepath.Base(path))
+		}
+		if ValidEffect(lutCode + path) {
+			t.Errorf("table %s is a valid effect", filepath.Base(path))
+		}
+	}
+	// reading stops at the first entry past the largest table
+	huge := writeLUT(t, "huge.txt", 3*lutEntries16, identity)
+	if _, err := readLUT(huge); err == nil || !strings.Contains(err.Error(), fmt.Sprintf(":%d:", lutEntries16+2)) {
+		t.Errorf("table of %d entries: got error %v, want one at entry %d", 3*lutEntries16, err, lutEntries16+1)
+	}
+}
+
+func TestGamma(t *testing.T) {
+	input := gradient(16, 8)
+	if !equalPixels(applyEffect(t, input, "GAMMA1"), input) {
+		t.Error("gamma 1 changed the image")
+	}
+
+	// gamma 2.2 brightens the midtones as 65535 * (c/65535)^(1/2.2), keeping the endpoints
+	for c, want := range map[uint16]uint16{0: 0, 16384: 34899, 32768: 47824, 65535: 65535} {
+		px := applyEffect(t, uniform(color.RGBA64{c, c, c, 65535}), "GAMMA2.2").RGBA64At(0, 0)
+		if px != (color.RGBA64{want, want, want, 65535}) {
+			t.Errorf("gamma 2.2 of %d: got %v, want %d", c, px, want)
+		}
+	}
+	table := GammaLUT(2.2)[0]
+	for v := 1; v < len(table); v++ {
+		if table[v] < table[v-1] {
+			t.Fatalf("gamma 2.2 table decreases at %d: %d -> %d", v, table[v-1], table[v])
+		}
+	}
+
+	for _, effect := range []string{"GAMMA", "GAMMA0", "GAMMA-1", "GAMMA11", "GAMMAx"} {
+		if ValidEffect(effect) {
+			t.Errorf("%s is a valid effect", effect)
+		}
+	}
+}
+
+func TestLoadKernelMatrix(t *testing.T) {
+	write := func(name, content string) string {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// a 3x5 matrix as written by numpy.savetxt, with a comment and blank lines
+	kernel, err := LoadKernelMatrix(write("valid.txt", "# header\n0 0 1 0 0\n\n1.5e-1 -2 3 .5 0\n0 0 1 0 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{0, 0, 1, 0, 0, 0.15, -2, 3, 0.5, 0, 0, 0, 1, 0, 0}
+	if kernel.rows != 3 || kernel.cols != 5 || !reflect.DeepEqual(kernel.values, want) {
+		t.Errorf("got %dx%d kernel %v, want 3x5 %v", kernel.rows, kernel.cols, kernel.values, want)
+	}
+
+	// the kernel in a file gives the same image as the same values given inline
+	box := write("box.txt", "1 1 1\n1 1 1\n1 1 1\n")
+	input := gradient(12, 10)
+	if !equalPixels(applyEffect(t, input, kernelFileCode+box), applyEffect(t, input, "K3x3:1:1:1:1:1:1:1:1:1")) {
+		t.Error("the kernel file differs from the inline kernel")
+	}
+
+	for name, test := range map[string]struct{ content, wantErr string }{
+		"ragged":      {"1 2 3\n4 5\n6 7 8\n", "valid.txt:2: ragged row"},
+		"non-numeric": {"1 2 3\n4 x 6\n7 8 9\n", "valid.txt:2: invalid value \"x\""},
+		"infinite":    {"1 2 3\n4 Inf 6\n7 8 9\n", "valid.txt:2: invalid value \"Inf\""},
+		"even":        {"1 2\n3 4\n", "both dimensions must be odd"},
+		"empty":       {"# nothing\n\n", "no kernel values"},
+	} {
+		path := write("valid.txt", test.content)
+		if _, err := LoadKernelMatrix(path); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: got error %v, want %q", name, err, test.wantErr)
+		}
+		if ValidEffect(kernelFileCode + path) {
+			t.Errorf("%s: the kernel file effect is valid", name)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	input := gradient(12, 10)
+	box := CreateKernels([]string{"K3x3:1:1:1:1:1:1:1:1:1"})
+	if !box[0].Normalize() {
+		t.Fatal("the box kernel was not normalized")
+	}
+	sum := 0.0
+	for _, value := range box[0].values {
+		sum += value
+	}
+	if math.Abs(sum-1) > 1e-12 {
+		t.Errorf("normalized box kernel sums to %v", sum)
+	}
+	img := NewImageFromRGBA64(cloneRGBA64(input))
+	img.ApplyEffects(box)
+	if final, _ := img.GetInputOutputPixels(); !equalPixels(final, applyEffect(t, input, "B")) {
+		t.Error("the normalized box kernel differs from the blur")
+	}
+
+	// kernels summing to 0 (edges) or 1 (sharpen), negative sums and built-in effects are left as they are
+	for _, effect := range []string{"K3x3:-1:-1:-1:-1:8:-1:-1:-1:-1", "K3x3:0:-1:0:-1:5:-1:0:-1:0", "K1x3:-1:-1:-1", "B", "E"} {
+		kernel := CreateKernels([]string{effect})[0]
+		values := append([]float64(nil), kernel.values...)
+		if kernel.Normalize() || !reflect.DeepEqual(kernel.values, values) {
+			t.Errorf("%s was normalized", effect)
+		}
+	}
+
+	// the kernels of a file share its values; normalizing one leaves the others as in the file
+	path := filepath.Join(t.TempDir(), "box.txt")
+	if err := os.WriteFile(path, []byte("2 2 2\n2 2 2\n2 2 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	NormalizeKernels(CreateKernels([]string{kernelFileCode + path}))
+	if values := CreateKernels([]string{kernelFileCode + path})[0].values; values[0] != 2 {
+		t.Errorf("normalizing a kernel of a file changed its values to %v", values)
+	}
+}
+
+// registerRuns counts the runs of `TestRegisterEffectConcurrently`, which registers new codes each run (eg: -count)
+var registerRuns atomic.Int32
+
+// run with -race to also check the registry for data races
+func TestRegisterEffectConcurrently(t *testing.T) {
+	const n = 16
+	prefix := fmt.Sprintf("REG%dC", registerRuns.Add(1))
+	emboss := []float64{-2, -1, 0, -1, 1, 1, 0, 1, 2}
+	var wg sync.WaitGroup
+	var registered atomic.Int32
+	for i := 0; i < n; i++ {
+		// each code is registered by two goroutines at once: exactly one of them succeeds
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(code string) {
+				defer wg.Done()
+				if RegisterEffect(code, emboss) == nil {
+					registered.Add(1)
+				}
+			}(fmt.Sprintf("%s%d", prefix, i))
+		}
+		// while kernels of built-in and registered effects are created
+		wg.Add(1)
+		go func(code string) {
+			defer wg.Done()
+			for k := 0; k < 100; k++ {
+				kernels := CreateKernels([]string{"B", code})
+				if kernels[0].values[0] != 1/9.0 {
+					t.Errorf("blur kernel with values %v", kernels[0].values)
+					return
+				}
+				ValidEffect(code)
+				KernelSizes()
+			}
+		}(fmt.Sprintf("%s%d", prefix, i))
+	}
+	wg.Wait()
+
+	if registered.Load() != n {
+		t.Fatalf("%d registrations succeeded, want %d", registered.Load(), n)
+	}
+	sizes := KernelSizes()
+	emboss[0] = 100 // the registry keeps its own copy
+	for i := 0; i < n; i++ {
+		code := fmt.Sprintf("%s%d", prefix, i)
+		kernel := CreateKernels([]string{code})[0]
+		if sizes[code] != 9 || !reflect.DeepEqual(kernel.values, []float64{-2, -1, 0, -1, 1, 1, 0, 1, 2}) {
+			t.Errorf("%s registered with size %d and values %v", code, sizes[code], kernel.values)
+		}
+	}
+}
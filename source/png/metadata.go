@@ -0,0 +1,154 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+//=============================================================================
+// Text metadata of PNG files (tEXt chunks)
+//=============================================================================
+
+// EffectsKeyword is the keyword of the tEXt chunk recording the effect chain applied to an output.
+// eg: "Effects" => "B,B,S" (see `FormatEffectChain`)
+const EffectsKeyword = "Effects"
+
+const (
+	pngSignature  = "\x89PNG\r\n\x1a\n"
+	chunkHeader   = 8  // length and type of a chunk
+	chunkCRC      = 4  // CRC of the type and data of a chunk
+	ihdrLen       = 13 // data of the IHDR chunk, always the first one
+	maxKeywordLen = 79
+	// headerLen is the length of the signature and the IHDR chunk, after which the text chunks are written
+	headerLen = len(pngSignature) + chunkHeader + ihdrLen + chunkCRC
+)
+
+// ErrNotPNG is returned when reading the text chunks of data that is not a PNG file
+var ErrNotPNG = errors.New("not a PNG file")
+
+// SaveText saves the image Final state to the given file as `Save`, with a tEXt chunk recording 'text'
+// under 'keyword'. eg: keyword `EffectsKeyword`, text "B,B,S"
+// The keyword must have 1 to 79 characters and, as the text, no NUL characters;
+// both are stored as Latin-1 (see the PNG specification).
+// Returns an error wrapping `ErrParentNotDir` if a directory of 'filePath' is a file, as `Save`.
+func (img *Image) SaveText(filePath string, keyword string, text string) error {
+	chunk, err := textChunk(keyword, text)
+	if err != nil {
+		return err
+	}
+
+	outWriter, err := createFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer outWriter.Close()
+
+	return img.SaveWriter(&textWriter{w: outWriter, chunk: chunk}, "png")
+}
+
+// LoadText returns the text chunks of the PNG file at 'filePath', by keyword (see `ReadText`).
+func LoadText(filePath string) (map[string]string, error) {
+	inReader, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer inReader.Close()
+
+	return ReadText(inReader)
+}
+
+// ReadText returns the tEXt chunks of the PNG file read from 'inReader', by keyword. Pixels are not decoded.
+// Returns `ErrNotPNG` if the data does not start with the PNG signature.
+// Obs: if a keyword is repeated, the last chunk wins; compressed (zTXt) and international (iTXt) chunks are ignored.
+func ReadText(inReader io.Reader) (map[string]string, error) {
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(inReader, signature); err != nil || string(signature) != pngSignature {
+		return nil, ErrNotPNG
+	}
+
+	text := make(map[string]string)
+	header := make([]byte, chunkHeader)
+	for {
+		if _, err := io.ReadFull(inReader, header); err != nil {
+			return nil, fmt.Errorf("reading chunk: %w", err)
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		chunkType := string(header[4:])
+		switch chunkType {
+		case "IEND":
+			return text, nil
+		case "tEXt":
+			data := make([]byte, length)
+			if _, err := io.ReadFull(inReader, data); err != nil {
+				return nil, fmt.Errorf("reading tEXt chunk: %w", err)
+			}
+			keyword, value, ok := bytes.Cut(data, []byte{0})
+			if !ok {
+				return nil, fmt.Errorf("tEXt chunk without keyword separator")
+			}
+			text[string(keyword)] = string(value)
+			if _, err := io.CopyN(io.Discard, inReader, chunkCRC); err != nil {
+				return nil, fmt.Errorf("reading tEXt chunk: %w", err)
+			}
+		default:
+			if _, err := io.CopyN(io.Discard, inReader, int64(length)+chunkCRC); err != nil {
+				return nil, fmt.Errorf("reading %s chunk: %w", chunkType, err)
+			}
+		}
+	}
+}
+
+// textChunk returns the tEXt chunk recording 'text' under 'keyword', with its length, type and CRC.
+func textChunk(keyword string, text string) ([]byte, error) {
+	if len(keyword) < 1 || len(keyword) > maxKeywordLen {
+		return nil, fmt.Errorf("text keyword %q must have 1 to %d characters", keyword, maxKeywordLen)
+	}
+	if bytes.IndexByte([]byte(keyword), 0) >= 0 || bytes.IndexByte([]byte(text), 0) >= 0 {
+		return nil, fmt.Errorf("text %q of keyword %q has a NUL character", text, keyword)
+	}
+
+	data := make([]byte, 0, len(keyword)+1+len(text))
+	data = append(data, keyword...)
+	data = append(data, 0)
+	data = append(data, text...)
+
+	chunk := make([]byte, chunkHeader, chunkHeader+len(data)+chunkCRC)
+	binary.BigEndian.PutUint32(chunk[:4], uint32(len(data)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:])), nil
+}
+
+// textWriter writes 'chunk' right after the IHDR chunk of the PNG data written through it.
+// obs: the rest of the data is passed on as written, so the encoded image is not held in memory.
+type textWriter struct {
+	w       io.Writer
+	chunk   []byte // written once 'headerLen' bytes were written
+	written int
+}
+
+func (tw *textWriter) Write(p []byte) (int, error) {
+	if tw.written >= headerLen || tw.written+len(p) < headerLen {
+		n, err := tw.w.Write(p)
+		tw.written += n
+		return n, err
+	}
+	// obs: the write completes the header; the chunk goes between its end and the rest of 'p'
+	split := headerLen - tw.written
+	n, err := tw.w.Write(p[:split])
+	tw.written += n
+	if err != nil {
+		return n, err
+	}
+	if _, err := tw.w.Write(tw.chunk); err != nil {
+		return n, err
+	}
+	m, err := tw.w.Write(p[split:])
+	tw.written += m
+	return n + m, err
+}
@@ -0,0 +1,178 @@
+package png
+
+import (
+	"image"
+)
+
+//=============================================================================
+// Effect chain optimization
+//=============================================================================
+
+// Two convolutions in a row are a single convolution with the convolution of their kernels. eg: "B,B" => a 5x5
+// blur, applied in one pass over the image instead of two. This only holds if the output of the first one is not
+// clamped, so only kernels with non-negative values summing to at most 1 (eg: blurs) are merged; sharpen and
+// edge-detect, point effects and grayscale are left as they are and stop the merging.
+// obs: the merged kernel reads the image up to the sum of the reaches of its kernels, so it has more multiply-adds
+// per pixel than the kernels it replaces (eg: 25 vs 2 x 9); it pays when the passes over the image cost more.
+
+// maxMergedSize is the largest kernel (rows x cols) `OptimizeChain` creates. eg: "B,B,B" => "B+B" (5x5), "B"
+const maxMergedSize = 25
+
+// Code of merged kernels: the codes of their kernels joined by it. eg: "B+B". Not valid effects (see `ValidEffect`).
+const mergeCode = "+"
+
+// OptimizeChain returns the kernels of a chain with consecutive convolutions merged into single kernels,
+// up to `maxMergedSize` elements each. The pixels are the same as applying 'kernels' in sequence, but for the
+// rounding of the intermediate images, which the merged kernels skip (at most 2 of 65535 per channel for each
+// merge: each pass truncates by up to 1, eg: a linear gradient blurred to integers computed a tiny bit below them;
+// later effects may amplify it, eg: sharpen).
+// Kernels are not modified; the result may share them.
+// eg: ["B", "B", "G", "B"] -> ["B+B", "G", "B"]
+func OptimizeChain(kernels []*Kernel) []*Kernel {
+	var optimized []*Kernel
+	for _, kernel := range kernels {
+		if n := len(optimized); n > 0 && mergeable(optimized[n-1]) && mergeable(kernel) &&
+			(optimized[n-1].rows+kernel.rows-1)*(optimized[n-1].cols+kernel.cols-1) <= maxMergedSize {
+			optimized[n-1] = mergeKernels(optimized[n-1], kernel)
+			continue
+		}
+		optimized = append(optimized, kernel)
+	}
+	return optimized
+}
+
+// mergeable returns true if 'kernel' is a convolution whose output never has to be clamped,
+// i.e., its values are non-negative and sum to at most 1 (eg: blurs).
+func mergeable(kernel *Kernel) bool {
+	if kernel == nil || kernel.values == nil {
+		return false
+	}
+	// composite effects apply a point op after the convolution (eg: threshold)
+	if _, composite := convolutionOf[kernel.effect]; composite {
+		return false
+	}
+	var sum float64
+	for _, value := range kernel.values {
+		if value < 0 {
+			return false
+		}
+		sum += value
+	}
+	// obs: tolerance for the float error of normalized kernels. eg: 9 x 1/9.0
+	return sum <= 1+1e-9
+}
+
+// mergeKernels returns the kernel applying 'first' and then 'second' in one pass: the convolution of their values.
+// Each value of 'first' at offset a from the center and of 'second' at offset b adds to the value at offset a + b.
+// The alpha of the source is kept only if both keep it (see `alphaEffect`); the colors don't depend on it.
+func mergeKernels(first, second *Kernel) *Kernel {
+	rows, cols := first.rows+second.rows-1, first.cols+second.cols-1
+	values := make([]float64, rows*cols)
+	for i, v1 := range first.values {
+		for j, v2 := range second.values {
+			row, col := i/first.cols+j/second.cols, i%first.cols+j%second.cols
+			values[row*cols+col] += v1 * v2
+		}
+	}
+	merged := &Kernel{effect: first.effect + mergeCode + second.effect, keepAlpha: first.keepAlpha && second.keepAlpha,
+		stages: append(first.mergedStages(), second.mergedStages()...)}
+	merged.setRectValues(values, rows, cols)
+	return merged
+}
+
+// mergedStages returns the kernels merged into 'kernel', or 'kernel' itself if it is not merged
+func (kernel *Kernel) mergedStages() []*Kernel {
+	if kernel.stages != nil {
+		return kernel.stages
+	}
+	return []*Kernel{kernel}
+}
+
+// mergedBorder recomputes the pixels of the slice delimited by the indexes whose merged kernel reaches beyond
+// 'inputPixels', applying the stages of 'kernel' one by one (see `stagesAt`).
+// At the borders, the convolutions are zero-padded: the intermediate images of the stages are padded with zeros,
+// while the merged kernel would read their values computed from the pixels within the image.
+func mergedBorder(kernel *Kernel, inputPixels *image.RGBA64, outputPixels *image.RGBA64, YStart, YEnd, XStart, XEnd int) {
+	bounds := inputPixels.Bounds()
+	// rows above and below, columns left and right of each pixel read by the kernel (see `ConvolveFlat`)
+	above, below := kernel.rows-1-kernel.centerRow, kernel.centerRow
+	left, right := kernel.cols-1-kernel.centerCol, kernel.centerCol
+	for y := YStart; y < YEnd; y++ {
+		if y-above < bounds.Min.Y || y+below >= bounds.Max.Y {
+			for x := XStart; x < XEnd; x++ {
+				setStagesAt(kernel, inputPixels, outputPixels, x, y)
+			}
+			continue
+		}
+		for x := XStart; x < XEnd && x-left < bounds.Min.X; x++ {
+			setStagesAt(kernel, inputPixels, outputPixels, x, y)
+		}
+		for x := XEnd - 1; x >= XStart && x+right >= bounds.Max.X && x-left >= bounds.Min.X; x-- {
+			setStagesAt(kernel, inputPixels, outputPixels, x, y)
+		}
+	}
+}
+
+// setStagesAt sets the pixel (x, y) of 'outputPixels' to the stages of 'kernel' applied to 'inputPixels'.
+// Alpha is set as by `ConvolveFlat`.
+func setStagesAt(kernel *Kernel, inputPixels *image.RGBA64, outputPixels *image.RGBA64, x, y int) {
+	rgb := stagesAt(kernel.stages, inputPixels, x, y)
+	px := inputPixels.RGBA64At(x, y)
+	px.R, px.G, px.B = clamp(rgb[0]), clamp(rgb[1]), clamp(rgb[2])
+	if !kernel.keepAlpha {
+		px.A = 0xffff
+	}
+	outputPixels.SetRGBA64(x, y, px)
+}
+
+// stagesAt returns the red, green and blue of the pixel (x, y) after convolving 'inputPixels' with each kernel of
+// 'stages' in turn, zero-padded. Only the pixels of each intermediate image the next stages read are computed:
+// a window around (x, y), growing by the reach of each stage from the last one back.
+func stagesAt(stages []*Kernel, inputPixels *image.RGBA64, x, y int) [3]float64 {
+	bounds := inputPixels.Bounds()
+	// windows[i]: pixels of the input of stage i needed; the last one is the output pixel
+	windows := make([]image.Rectangle, len(stages)+1)
+	windows[len(stages)] = image.Rect(x, y, x+1, y+1)
+	for i := len(stages) - 1; i >= 0; i-- {
+		k := stages[i]
+		windows[i] = image.Rect(windows[i+1].Min.X-(k.cols-1-k.centerCol), windows[i+1].Min.Y-(k.rows-1-k.centerRow),
+			windows[i+1].Max.X+k.centerCol, windows[i+1].Max.Y+k.centerRow).Intersect(bounds)
+	}
+
+	// values of the input of the first stage, 3 per pixel, row by row
+	window := windows[0]
+	values := make([]float64, 0, 3*window.Dx()*window.Dy())
+	for yy := window.Min.Y; yy < window.Max.Y; yy++ {
+		for xx := window.Min.X; xx < window.Max.X; xx++ {
+			px := inputPixels.RGBA64At(xx, yy)
+			values = append(values, float64(px.R), float64(px.G), float64(px.B))
+		}
+	}
+	for i, k := range stages {
+		in, out := windows[i], windows[i+1]
+		next := make([]float64, 3*out.Dx()*out.Dy())
+		// obs: the kernel is inverted, as in `ConvolveFlat`
+		shiftY, shiftX := k.centerRow-(k.rows-1), k.centerCol-(k.cols-1)
+		for yy := out.Min.Y; yy < out.Max.Y; yy++ {
+			for xx := out.Min.X; xx < out.Max.X; xx++ {
+				o := 3 * ((yy-out.Min.Y)*out.Dx() + xx - out.Min.X)
+				for m := 0; m < k.rows; m++ {
+					for n := 0; n < k.cols; n++ {
+						p := image.Pt(xx+shiftX+n, yy+shiftY+m)
+						// zero-padding: the window is within the image
+						if !p.In(in) {
+							continue
+						}
+						v := k.values[m*k.cols+n]
+						j := 3 * ((p.Y-in.Min.Y)*in.Dx() + p.X - in.Min.X)
+						next[o] += v * values[j]
+						next[o+1] += v * values[j+1]
+						next[o+2] += v * values[j+2]
+					}
+				}
+			}
+		}
+		values = next
+	}
+	return [3]float64{values[0], values[1], values[2]}
+}
@@ -0,0 +1,83 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// noise returns a 'width' x 'height' opaque image of pseudo-random pixels, the worst case of the rounding of blurs
+func noise(width, height int) *image.RGBA64 {
+	pixels := image.NewRGBA64(image.Rect(0, 0, width, height))
+	state := uint32(1)
+	next := func() uint16 {
+		state = state*1664525 + 1013904223
+		return uint16(state >> 16)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixels.SetRGBA64(x, y, color.RGBA64{next(), next(), next(), 65535})
+		}
+	}
+	return pixels
+}
+
+// effectsOf returns the effect codes of 'kernels'; "G" for grayscale
+func effectsOf(kernels []*Kernel) []string {
+	effects := make([]string, len(kernels))
+	for i, kernel := range kernels {
+		effects[i] = "G"
+		if kernel != nil {
+			effects[i] = kernel.effect
+		}
+	}
+	return effects
+}
+
+func TestOptimizeChain(t *testing.T) {
+	tests := []struct {
+		effects []string
+		want    []string
+	}{
+		{[]string{"B", "B"}, []string{"B+B"}},
+		// merged up to 5x5
+		{[]string{"B", "B", "B"}, []string{"B+B", "B"}},
+		// grayscale and non-linear effects stop the merging; sharpen and edges have negative values
+		{[]string{"B", "B", "G", "B"}, []string{"B+B", "G", "B"}},
+		{[]string{"B", "T128", "B"}, []string{"B", "T", "B"}},
+		{[]string{"B", "S", "E"}, []string{"B", "S", "E"}},
+		{[]string{"K1x3:0.25:0.5:0.25", "K3x1:0.25:0.5:0.25"}, []string{"K+K"}},
+	}
+	for _, test := range tests {
+		if got := effectsOf(OptimizeChain(CreateKernels(test.effects))); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v optimized to %v, want %v", test.effects, got, test.want)
+		}
+	}
+
+	// each merge differs by at most 2 from the effects applied separately
+	merges := []struct {
+		effects   []string
+		tolerance uint16
+	}{
+		{[]string{"B", "B"}, 2},
+		{[]string{"B", "B", "B"}, 2},
+		{[]string{"K1x3:0.25:0.5:0.25", "K3x1:0.25:0.5:0.25"}, 2},
+		{[]string{"B", "B", "B", "B"}, 4},
+	}
+	for _, test := range merges {
+		input := noise(24, 18)
+		separate := NewImageFromRGBA64(cloneRGBA64(input))
+		separate.ApplyEffects(CreateKernels(test.effects))
+		merged := NewImageFromRGBA64(cloneRGBA64(input))
+		kernels := OptimizeChain(CreateKernels(test.effects))
+		merged.ApplyEffects(kernels)
+
+		if len(kernels) >= len(test.effects) {
+			t.Errorf("%v: %d passes optimized, want fewer than %d", test.effects, len(kernels), len(test.effects))
+		}
+		if !merged.EqualWithin(separate, test.tolerance) {
+			t.Errorf("%v: merged kernels differ by more than %d from the effects applied separately", test.effects, test.tolerance)
+		}
+	}
+}
@@ -3,12 +3,17 @@
 package png
 
 import (
+	"bytes"
+	"errors"
 	"image"
 	"image/color"
+	"image/jpeg"
 	"image/png"
-	"math"
+	"io"
+	"io/fs"
 	"os"
 	"fmt"
+	"path/filepath"
 )
 
 //=============================================================================
@@ -18,11 +23,40 @@ import (
 // 'Image' is a structure for working with PNG images.
 // 'int' and 'out' are buffers for the image's pixels, that are swapped after each effect is applied
 // 'Final' controls which of the buffers contains the last modified image. Used to apply effects sequentially.
+// Obs: images loaded in place have a single buffer, i.e., 'in' and 'out' are the same (see `LoadInPlace`).
 type Image struct {
 	in     *image.RGBA64   // Buffer 1 for pixels; equals the original image at initialization
 	out    *image.RGBA64   // Buffer 2 for pixels
 	Bounds image.Rectangle // The size of the image
 	Final int			   // 0 if in is the last modified image, 1 if out is the last modified image
+	isGray bool			   // true if the source image is grayscale; used to skip the grayscale effect
+	srcOverwritten bool	   // true once an effect wrote to 'in', i.e., the original pixels are lost (see `Unchanged`)
+	srcFormat string	   // format of the source the image was decoded from. eg: "png", "jpeg"; "" if not loaded
+	mask *image.Gray	   // if not nil, effects only change the pixels where the mask is set (see `SetMask`)
+	grayOutput bool		   // if true, gray images are saved with a single channel (see `SetGrayOutput`)
+	eightBitOutput bool	   // if true, the image is saved with 8 bits per channel (see `SetEightBitOutput`)
+}
+
+// Unchanged returns true if the last modified buffer still has the pixels of the original image,
+// i.e., the effects applied (if any) did not change any pixel. eg: no effects; grayscale on a gray image
+// Obs: compares the buffers while the original pixels are kept in 'in'; once an effect writes to 'in'
+// (i.e., the second effect of a chain), returns false even if the pixels came back to the original ones.
+func (im *Image) Unchanged() bool {
+	if im.srcOverwritten {
+		return false
+	}
+	final, _ := im.GetInputOutputPixels()
+	return final == im.in || bytes.Equal(final.Pix, im.in.Pix)
+}
+
+// SourceFormat returns the format of the source the image was decoded from. eg: "png", "jpeg"; "" if not loaded
+func (im *Image) SourceFormat() string {
+	return im.srcFormat
+}
+
+// IsGray returns true if the image was loaded from a grayscale source (i.e., all channels are equal)
+func (im *Image) IsGray() bool {
+	return im.isGray
 }
 
 
@@ -38,71 +72,507 @@ func (im *Image) GetInputOutputPixels() (*image.RGBA64, *image.RGBA64) {
 	}
 }
 
+// Clone returns a deep copy of the image: both buffers, 'Bounds' and 'Final'.
+// The copy shares no memory with the original, so it can be handed to another goroutine.
+// Obs: the copy of an image loaded in place has a single buffer too.
+func (im *Image) Clone() *Image {
+	clone := *im
+	clone.in = cloneRGBA64(im.in)
+	clone.out = clone.in
+	if !im.InPlace() {
+		clone.out = cloneRGBA64(im.out)
+	}
+	return &clone
+}
+
+// InPlace returns true if the image has a single buffer, so effects write back into the pixels they read
+// (see `LoadInPlace`).
+func (im *Image) InPlace() bool {
+	return im.out == im.in
+}
+
+// cloneRGBA64 returns a deep copy of 'pixels'
+func cloneRGBA64(pixels *image.RGBA64) *image.RGBA64 {
+	if pixels == nil {
+		return nil
+	}
+	clone := *pixels
+	clone.Pix = make([]uint8, len(pixels.Pix))
+	copy(clone.Pix, pixels.Pix)
+	return &clone
+}
+
+// Result returns a copy of the last modified buffer, i.e., the image with the effects applied so far.
+// The copy shares no memory with the image (eg: to be cached while the image is modified).
+func (im *Image) Result() *image.RGBA64 {
+	final, _ := im.GetInputOutputPixels()
+	return cloneRGBA64(final)
+}
+
+// SetResult copies 'pixels' to the output buffer and makes it the last modified one, as if the effects
+// giving 'pixels' had been applied to the image (eg: a result from a cache; see `Result`).
+// 'pixels' must have the bounds of the image; it is only read.
+func (im *Image) SetResult(pixels *image.RGBA64) error {
+	if pixels.Bounds() != im.Bounds {
+		return fmt.Errorf("result bounds %v differ from image bounds %v", pixels.Bounds(), im.Bounds)
+	}
+	_, out := im.GetInputOutputPixels()
+	copy(out.Pix, pixels.Pix)
+	if out == im.in {
+		im.srcOverwritten = true
+	}
+	im.Final = 1 - im.Final
+	return nil
+}
+
+// Equal returns true if the images have the same bounds and the same pixels in their last modified buffers
+// (see `GetInputOutputPixels`), each according to its own 'Final'.
+func (im *Image) Equal(other *Image) bool {
+	return im.EqualWithin(other, 0)
+}
+
+// EqualWithin returns true if the images have the same bounds and each channel (alpha too) of the pixels in their
+// last modified buffers differs by at most 'tolerance'. eg: 1 => equal but for rounding (see `OptimizeChain`)
+func (im *Image) EqualWithin(other *Image, tolerance uint16) bool {
+	pixels, _ := im.GetInputOutputPixels()
+	otherPixels, _ := other.GetInputOutputPixels()
+	if pixels.Rect != otherPixels.Rect {
+		return false
+	}
+	rowLen := pixels.Rect.Dx() * 8
+	for y := pixels.Rect.Min.Y; y < pixels.Rect.Max.Y; y++ {
+		start, otherStart := pixels.PixOffset(pixels.Rect.Min.X, y), otherPixels.PixOffset(pixels.Rect.Min.X, y)
+		row, otherRow := pixels.Pix[start:start+rowLen], otherPixels.Pix[otherStart:otherStart+rowLen]
+		if tolerance == 0 {
+			if !bytes.Equal(row, otherRow) {
+				return false
+			}
+			continue
+		}
+		// 16-bit channels, big endian
+		for i := 0; i < rowLen; i += 2 {
+			v, otherV := int(row[i])<<8|int(row[i+1]), int(otherRow[i])<<8|int(otherRow[i+1])
+			if v-otherV > int(tolerance) || otherV-v > int(tolerance) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SetMask restricts the effects applied afterwards to the pixels where 'mask' is set, i.e., white (value >= 128);
+// elsewhere, the pixels are carried over unchanged from one effect to the next (see `ApplyEffectMasked`).
+// 'mask' must have the bounds of the image. A nil 'mask' removes the mask.
+// Obs: the mask is only read, so clones of the image share it.
+func (im *Image) SetMask(mask *image.Gray) error {
+	if mask != nil && mask.Bounds() != im.Bounds {
+		return fmt.Errorf("mask bounds %v differ from image bounds %v", mask.Bounds(), im.Bounds)
+	}
+	im.mask = mask
+	return nil
+}
+
+// LoadMask returns the mask image at 'filePath' as grayscale (see `SetMask`). Accepts the formats of `Load`.
+func LoadMask(filePath string) (*image.Gray, error) {
+	maskReader, err := os.Open(filePath)
+	if err != nil {
+		return nil, openError(err)
+	}
+	defer maskReader.Close()
+
+	return LoadMaskReader(maskReader)
+}
+
+// LoadMaskReader returns the mask image decoded from 'maskReader' as grayscale (see `SetMask`).
+// Obs: colored masks are converted with `color.GrayModel`; `MaxPixels` applies as in `LoadReader`.
+func LoadMaskReader(maskReader io.Reader) (*image.Gray, error) {
+	img, err := LoadReader(maskReader)
+	if err != nil {
+		return nil, err
+	}
+	mask := image.NewGray(img.Bounds)
+	for y := img.Bounds.Min.Y; y < img.Bounds.Max.Y; y++ {
+		for x := img.Bounds.Min.X; x < img.Bounds.Max.X; x++ {
+			mask.Set(x, y, color.GrayModel.Convert(img.in.At(x, y)))
+		}
+	}
+	return mask, nil
+}
+
 // Set color of pixel in 'x' 'y' position to 'c'
 func (im *Image) Set(x, y int, c color.Color) {
 	im.out.Set(x, y, c)
 }
 
+// NewImage returns a blank (transparent black) 'width' x 'height' Image, with both buffers allocated.
+func NewImage(width, height int) *Image {
+	return NewImageFromRGBA64(image.NewRGBA64(image.Rect(0, 0, width, height)))
+}
+
+// NewImageFromRGBA64 returns an Image with 'pixels' as its original image, i.e., the input of the first effect.
+// The output buffer is allocated with the same bounds. eg: to build images for tests without files.
+// Obs: 'pixels' is used as a buffer, not copied; effects after the first one overwrite it.
+// Obs: the image is not flagged as grayscale (see `IsGray`), even if all its channels are equal.
+func NewImageFromRGBA64(pixels *image.RGBA64) *Image {
+	return &Image{in: pixels, out: image.NewRGBA64(pixels.Bounds()), Bounds: pixels.Bounds(), Final: 0}
+}
+
 // Load returns a Image that was loaded based on the filePath parameter
+// Errors of missing files and of decoding are `*LoadError`s (see `LoadReader`).
+// Buffers of released images are reused if they have the size of the image (see `ReleaseImage`).
 func Load(filePath string) (*Image, error) {
+	return load(filePath, false, buffers)
+}
+
+// LoadInPlace is as `Load`, but the image has a single buffer: each effect writes back into the pixels it reads,
+// instead of into a second buffer of the size of the image. Halves the memory of the image, but only effects
+// whose pixels depend on the same pixel of the input alone can be applied to it (see `Kernel.InPlace`).
+// Obs: effects restoring pixels out of a mask need the input once written (see `SetMask`); don't mask these images.
+func LoadInPlace(filePath string) (*Image, error) {
+	return load(filePath, true, buffers)
+}
+
+// load returns the image at 'filePath', with a single buffer if 'inPlace' (see `LoadInPlace`).
+// Buffers are taken from 'pool', or allocated if nil (see `BufferPool`).
+func load(filePath string, inPlace bool, pool *BufferPool) (*Image, error) {
 
 	inReader, err := os.Open(filePath)
 
 	if err != nil {
-		return nil, err
+		return nil, openError(err)
 	}
 	defer inReader.Close()
 
-	inOrig, err := png.Decode(inReader)
+	return loadReader(inReader, inPlace, pool)
+}
 
-	if err != nil {
-		return nil, err
+// MaxPixels is the maximum number of pixels (width x height) of the images loaded. 0 means no limit.
+// Protects against decompression bombs: small files declaring huge dimensions, which would allocate
+// gigabytes of pixel buffers when decoded. eg: a 100000 x 100000 PNG needs 2 x 80GB of `RGBA64` buffers.
+var MaxPixels = 0
+
+// Classes of the errors loading an image. Errors of `Load` and `LoadReader` match one of them with `errors.Is`;
+// `errors.As` with a `*LoadError` gives the underlying cause. eg: errors.Is(err, png.ErrNotFound)
+var (
+	ErrNotFound         = errors.New("image not found")
+	ErrDecode           = errors.New("error decoding image")		// corrupt or truncated data, or not a PNG/JPEG
+	ErrUnsupportedModel = errors.New("unsupported image color model")	// valid image with features the decoders don't support (eg: color type, bit depth)
+	// ErrTooLarge is returned when loading an image with more than `MaxPixels` pixels
+	ErrTooLarge = errors.New("image exceeds the maximum number of pixels")
+)
+
+// LoadError is the error of loading an image
+// @Kind: class of the error: `ErrNotFound`, `ErrDecode`, `ErrUnsupportedModel` or `ErrTooLarge`
+// @Err: underlying cause. eg: the error of `os.Open` or of the decoder
+type LoadError struct {
+	Kind error
+	Err  error
+}
+
+func (e *LoadError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying cause, so `errors.Is` and `errors.As` also match it. eg: fs.ErrNotExist
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if 'target' is the class of the error
+func (e *LoadError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// openError classifies the error of opening an image file: missing files are `ErrNotFound`; others are returned as is.
+func openError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return &LoadError{Kind: ErrNotFound, Err: err}
 	}
+	return err
+}
 
-	bounds := inOrig.Bounds()
+// decodeError classifies the error of decoding an image: features of valid images not supported by the decoders
+// are `ErrUnsupportedModel`; anything else (corrupt data, unknown formats, read errors) is `ErrDecode`.
+func decodeError(err error) error {
+	var pngErr png.UnsupportedError
+	var jpegErr jpeg.UnsupportedError
+	if errors.As(err, &pngErr) || errors.As(err, &jpegErr) {
+		return &LoadError{Kind: ErrUnsupportedModel, Err: err}
+	}
+	return &LoadError{Kind: ErrDecode, Err: err}
+}
 
-	outImg := image.NewRGBA64(bounds)
-	inImg := image.NewRGBA64(bounds)
+// LoadReader returns a Image decoded from 'inReader'. Accepts PNG and JPEG sources.
+// If `MaxPixels` is set, the dimensions in the header of the image are checked before decoding it
+// and `ErrTooLarge` is returned without allocating the image if they exceed the limit.
+// Errors are `*LoadError`s classifying the failure (see `ErrDecode`).
+func LoadReader(inReader io.Reader) (*Image, error) {
+	return loadReader(inReader, false, buffers)
+}
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := inOrig.At(x, y).RGBA()
-			inImg.Set(x, y, color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
+// loadReader returns the image decoded from 'inReader', with a single buffer if 'inPlace' (see `LoadInPlace`).
+// Buffers are taken from 'pool', or allocated if nil (see `BufferPool`).
+func loadReader(inReader io.Reader, inPlace bool, pool *BufferPool) (*Image, error) {
+
+	if MaxPixels > 0 {
+		// decode the header only; the bytes read are replayed for the full decode
+		var header bytes.Buffer
+		imgConfig, _, err := image.DecodeConfig(io.TeeReader(inReader, &header))
+		if err != nil {
+			return nil, decodeError(err)
+		}
+		if int64(imgConfig.Width)*int64(imgConfig.Height) > int64(MaxPixels) {
+			return nil, &LoadError{Kind: ErrTooLarge,
+				Err: fmt.Errorf("%dx%d > %d", imgConfig.Width, imgConfig.Height, MaxPixels)}
 		}
+		inReader = io.MultiReader(&header, inReader)
+	}
+
+	inOrig, format, err := image.Decode(inReader)
+
+	if err != nil {
+		return nil, decodeError(err)
 	}
-	task := &Image{}
-	task.in = inImg
-	task.out = outImg
-	task.Bounds = bounds
-	task.Final = 0
+
+	var task *Image
+	pixels := toRGBA64(inOrig, pool)
+	if inPlace {
+		task = &Image{in: pixels, out: pixels, Bounds: pixels.Bounds(), Final: 0}
+	} else {
+		task = &Image{in: pixels, out: pool.get(pixels.Bounds()), Bounds: pixels.Bounds(), Final: 0}
+	}
+	task.srcFormat = format
+	// obs: convolutions apply the same kernel to all channels, so a gray image stays gray after any effect
+	task.isGray = inOrig.ColorModel() == color.GrayModel || inOrig.ColorModel() == color.Gray16Model
 	return task, nil
 }
 
+// toRGBA64 returns the pixels of 'src' as an `*image.RGBA64` to be used as the working buffer.
+// Avoids the extra full-image copy (and the per-pixel `color.Color` allocations of `At`) when possible:
+// - *image.RGBA64 sources are used directly.
+// - *image.RGBA and *image.NRGBA sources (the usual output of png.Decode) are converted reading `Pix` directly.
+// - Other sources fall back to the generic copy through `At`.
+// Obs: conversions give the same (alpha-premultiplied) values as `At(x, y).RGBA()`.
+// The buffers of the conversions are taken from 'pool', or allocated if nil (see `BufferPool`).
+func toRGBA64(src image.Image, pool *BufferPool) *image.RGBA64 {
+	bounds := src.Bounds()
+
+	switch src := src.(type) {
+	case *image.RGBA64:
+		return src
+
+	case *image.RGBA:
+		dst := pool.get(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			srcI := src.PixOffset(bounds.Min.X, y)
+			dstI := dst.PixOffset(bounds.Min.X, y)
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				// 8-bit -> 16-bit: v * 0x101 == v<<8 | v
+				for c := 0; c < 4; c++ {
+					dst.Pix[dstI+2*c] = src.Pix[srcI+c]
+					dst.Pix[dstI+2*c+1] = src.Pix[srcI+c]
+				}
+				srcI += 4
+				dstI += 8
+			}
+		}
+		return dst
+
+	case *image.NRGBA:
+		dst := pool.get(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			srcI := src.PixOffset(bounds.Min.X, y)
+			dstI := dst.PixOffset(bounds.Min.X, y)
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				s := src.Pix[srcI : srcI+4 : srcI+4]
+				a := uint32(s[3]) * 0x101
+				// premultiply by alpha, as in color.NRGBA.RGBA()
+				r := uint32(s[0]) * 0x101 * a / 0xffff
+				g := uint32(s[1]) * 0x101 * a / 0xffff
+				b := uint32(s[2]) * 0x101 * a / 0xffff
+				d := dst.Pix[dstI : dstI+8 : dstI+8]
+				d[0], d[1] = uint8(r>>8), uint8(r)
+				d[2], d[3] = uint8(g>>8), uint8(g)
+				d[4], d[5] = uint8(b>>8), uint8(b)
+				d[6], d[7] = uint8(a>>8), uint8(a)
+				srcI += 4
+				dstI += 8
+			}
+		}
+		return dst
+
+	default:
+		dst := pool.get(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, a := src.At(x, y).RGBA()
+				dst.Set(x, y, color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
+			}
+		}
+		return dst
+	}
+}
+
+// ErrParentNotDir is returned when saving to a path whose directory is a file. eg: data/out/small is a file
+// and the output is data/out/small/IMG_2029_Out.png
+var ErrParentNotDir = errors.New("output path parent is a file")
+
 // Save saves the image Final state to the given file
+// Returns an error wrapping `ErrParentNotDir` if a directory of 'filePath' is a file.
 func (img *Image) Save(filePath string) error {
 
-	outWriter, err := os.Create(filePath)
+	outWriter, err := createFile(filePath)
 	if err != nil {
 		return err
 	}
 	defer outWriter.Close()
 
+	return img.SaveWriter(outWriter, "png")
+}
+
+// createFile creates the file at 'filePath' as `os.Create`. If it fails because a directory of the path is
+// a file, returns an error wrapping `ErrParentNotDir` with that file, instead of the error of the OS
+// (eg: "not a directory", or "no such file or directory" on some systems).
+func createFile(filePath string) (*os.File, error) {
+	file, err := os.Create(filePath)
+	if err == nil {
+		return file, nil
+	}
+	// obs: the closest existing directory of the path; a file there is the one in the way
+	for dir := filepath.Dir(filePath); ; dir = filepath.Dir(dir) {
+		info, statErr := os.Stat(dir)
+		if statErr == nil {
+			if !info.IsDir() {
+				return nil, fmt.Errorf("%w: %s", ErrParentNotDir, dir)
+			}
+			return nil, err
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return nil, err
+		}
+	}
+}
+
+// SetGrayOutput sets whether the image is saved with a single gray channel if its pixels are gray when saved,
+// i.e., all pixels are opaque with equal channels (eg: after a grayscale effect); otherwise it is saved as RGBA.
+// The channel has 8 bits if no pixel needs more, or 16 bits otherwise (see `grayPixels`).
+func (img *Image) SetGrayOutput(grayOutput bool) {
+	img.grayOutput = grayOutput
+}
+
+// SetEightBitOutput sets whether the image is saved with 8 bits per channel instead of 16, rounding each channel
+// to the closest 8 bit value (at most 128 of 65535 away; see `round8`). Smaller and faster to encode;
+// with `SetGrayOutput`, gray images are saved with an 8 bit channel.
+// Obs: translucent pixels may be further away, as the encoder stores them with their alpha divided out, in 8 bits too.
+func (img *Image) SetEightBitOutput(eightBitOutput bool) {
+	img.eightBitOutput = eightBitOutput
+}
+
+// SaveWriter writes the image Final state to 'outWriter' in the given 'format': "png" or "jpeg" (or "jpg").
+// obs: JPEG is encoded with the default quality of `image/jpeg`
+func (img *Image) SaveWriter(outWriter io.Writer, format string) error {
 	// save the image with the last modified buffer
-	if Final := img.Final; Final == 0 {
-		err = png.Encode(outWriter, img.in)
-	}else{
-		err = png.Encode(outWriter, img.out)
+	var final image.Image = img.in
+	if img.Final != 0 {
+		final = img.out
+	}
+	// obs: the 8 bit values are rounded while converting to the image encoded, without copying the buffer first
+	if img.grayOutput {
+		if gray := grayPixels(final.(*image.RGBA64), img.eightBitOutput); gray != nil {
+			final = gray
+		}
+	}
+	// obs: the encoder writes 16 bits per channel for any *image.RGBA64, even with 8 bit values
+	if pixels, ok := final.(*image.RGBA64); ok && img.eightBitOutput {
+		final = rgbaPixels(pixels)
 	}
 
-	if err != nil {
-		return err
+	switch format {
+	case "png":
+		return png.Encode(outWriter, final)
+	case "jpeg", "jpg":
+		return jpeg.Encode(outWriter, final, nil)
+	default:
+		return fmt.Errorf("unsupported image format: %s", format)
 	}
-	return nil
+}
+
+// grayPixels returns 'pixels' as a single channel image if they are all opaque and gray; nil otherwise.
+// With 'eightBit', each channel is first rounded to the closest 8 bit value (see `round8`).
+// The image is an *image.Gray if every value is a 16 bit value of an 8 bit one (i.e., both bytes are equal),
+// so it converts back to the same pixels; an *image.Gray16 otherwise.
+func grayPixels(pixels *image.RGBA64, eightBit bool) image.Image {
+	bounds := pixels.Bounds()
+	gray16 := image.NewGray16(bounds)
+	is8Bit := true
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := pixels.Pix[(y-bounds.Min.Y)*pixels.Stride:]
+		grayRow := gray16.Pix[(y-bounds.Min.Y)*gray16.Stride:]
+		for x := 0; x < bounds.Dx(); x++ {
+			// obs: 8 bytes per pixel, R, G, B and A, each big endian
+			px := row[8*x : 8*x+8]
+			r, g, b, a := channel(px[0:2]), channel(px[2:4]), channel(px[4:6]), channel(px[6:8])
+			if eightBit {
+				r, g, b, a = round8(r)*0x101, round8(g)*0x101, round8(b)*0x101, round8(a)*0x101
+			}
+			if r != g || r != b || a != 0xffff {
+				return nil
+			}
+			is8Bit = is8Bit && r>>8 == r&0xff
+			grayRow[2*x], grayRow[2*x+1] = uint8(r>>8), uint8(r)
+		}
+	}
+	if !is8Bit {
+		return gray16
+	}
+	gray := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		grayRow := gray16.Pix[(y-bounds.Min.Y)*gray16.Stride:]
+		row := gray.Pix[(y-bounds.Min.Y)*gray.Stride:]
+		for x := 0; x < bounds.Dx(); x++ {
+			row[x] = grayRow[2*x]
+		}
+	}
+	return gray
+}
+
+// channel returns the big endian 16 bit value of a channel in the 2 bytes of 'b'
+func channel(b []uint8) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// round8 returns the closest 8 bit value of the 16 bit value 'v', i.e., round(v / 257). eg: 0x80FF -> 0x80
+// obs: rounding keeps the channels of the alpha-premultiplied pixels at most their alpha.
+func round8(v uint16) uint16 {
+	return uint16((uint32(v) + 128) / 257)
+}
+
+// rgbaPixels returns 'pixels' as an *image.RGBA, with each channel (alpha too) rounded to the closest 8 bit value
+// (see `round8`)
+func rgbaPixels(pixels *image.RGBA64) *image.RGBA {
+	bounds := pixels.Bounds()
+	rgba := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := pixels.Pix[(y-bounds.Min.Y)*pixels.Stride:]
+		rgbaRow := rgba.Pix[(y-bounds.Min.Y)*rgba.Stride:]
+		for i := 0; i < 4*bounds.Dx(); i++ {
+			rgbaRow[i] = uint8(round8(channel(row[2*i : 2*i+2])))
+		}
+	}
+	return rgba
 }
 
 //clamp will clamp the 'comp' parameter to zero if 'comp'<0 or 65535 if 'comp'>65535
+// obs: branches instead of math.Min/math.Max so the compiler inlines it in the convolution loop;
+// gives the same result as uint16(math.Min(65535, math.Max(0, comp))) for any non-NaN 'comp'.
 func clamp(comp float64) uint16 {
-	return uint16(math.Min(65535, math.Max(0, comp)))
+	if comp <= 0 {
+		return 0
+	}
+	if comp >= 65535 {
+		return 65535
+	}
+	return uint16(comp)
 }
 
 //============================================================================
@@ -135,6 +605,9 @@ func (img *Image) PrintPixels(){
 
 
 // CompareImages compares two images pixel by pixel and returns true if they are equal, false otherwise
+//
+// Deprecated: use `Image.Equal` or `Image.EqualWithin`. CompareImages prints every pixel that differs, and always
+// reads the output buffer of 'img1', whether or not it is its last modified buffer.
 func CompareImages(img1 *Image, img2 *Image) bool {
 	equal := true
 	for y := 0; y < img1.out.Bounds().Max.Y; y++ {
@@ -161,11 +634,10 @@ func CompareImages(img1 *Image, img2 *Image) bool {
 }
 
 // WritePixelsToFile writes all pixels of the 'img' to a file
-func (img *Image) WritePixelsToFile(filePath string) {
+func (img *Image) WritePixelsToFile(filePath string) error {
 	file, err := os.Create(filePath)
 	if err != nil {
-		fmt.Println("Unable to create file:", err)
-		os.Exit(1)
+		return err
 	}
 	defer file.Close()
 
@@ -177,6 +649,7 @@ func (img *Image) WritePixelsToFile(filePath string) {
 		}
 		fmt.Fprint(file, "\n")
 	}
+	return nil
 }
 
 
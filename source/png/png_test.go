@@ -0,0 +1,496 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	stdpng "image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// gradient returns a 'width' x 'height' opaque image with a different value in each channel of each pixel
+func gradient(width, height int) *image.RGBA64 {
+	pixels := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixels.SetRGBA64(x, y, color.RGBA64{uint16(x * 65535 / width), uint16(y * 65535 / height),
+				uint16((x + y) * 65535 / (width + height)), 65535})
+		}
+	}
+	return pixels
+}
+
+// writePNG encodes 'img' to a PNG file 'name' in a temporary directory and returns its path
+func writePNG(t testing.TB, name string, img image.Image) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := stdpng.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGrayscaleOfGraySource(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 16, 8))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 7)
+	}
+	img, err := Load(writePNG(t, "gray.png", gray))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !img.IsGray() {
+		t.Fatal("a grayscale PNG is not flagged as gray")
+	}
+	source := img.Clone()
+	// poison the output buffer: any pass of the effect over the image would overwrite it
+	sentinel := color.RGBA64{1, 2, 3, 4}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.out.SetRGBA64(x, y, sentinel)
+		}
+	}
+	final, _ := img.GetInputOutputPixels()
+
+	img.ApplyEffects(CreateKernels([]string{"G"}))
+
+	// the last modified buffer is passed through: no pixel was read or written
+	if result, _ := img.GetInputOutputPixels(); result != final {
+		t.Error("the grayscale effect flipped the buffers of a gray source")
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			if img.out.RGBA64At(x, y) != sentinel {
+				t.Fatalf("the grayscale effect wrote pixel (%d, %d) of a gray source", x, y)
+			}
+		}
+	}
+	if !img.Equal(source) {
+		t.Error("grayscale changed the pixels of a gray source")
+	}
+}
+
+func TestGrayscaleOfColorSource(t *testing.T) {
+	img, err := Load(writePNG(t, "color.png", gradient(16, 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.IsGray() {
+		t.Fatal("a color PNG is flagged as gray")
+	}
+	source := img.Clone()
+	img.ApplyEffects(CreateKernels([]string{"G"}))
+	if img.Equal(source) {
+		t.Error("grayscale did not change the pixels of a color source")
+	}
+}
+
+// genericImage hides the type of an image, so `toRGBA64` takes the generic copy through `At`
+type genericImage struct {
+	image.Image
+}
+
+// translucent returns a 'width' x 'height' 8-bit image of 'model' with varying colors and alpha
+func translucent(model color.Model, width, height int) image.Image {
+	bounds := image.Rect(0, 0, width, height)
+	var pixels draw.Image = image.NewRGBA(bounds)
+	if model == color.NRGBAModel {
+		pixels = image.NewNRGBA(bounds)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixels.Set(x, y, model.Convert(color.NRGBA{uint8(x), uint8(y), uint8(x ^ y), uint8(x + y)}))
+		}
+	}
+	return pixels
+}
+
+func TestToRGBA64(t *testing.T) {
+	for _, model := range []color.Model{color.RGBAModel, color.NRGBAModel} {
+		src := translucent(model, 512, 512)
+		direct := toRGBA64(src, nil)
+		if generic := toRGBA64(genericImage{src}, nil); !bytes.Equal(direct.Pix, generic.Pix) {
+			t.Errorf("%T: reading Pix gives other pixels than At", src)
+		}
+		// the working buffer is the only allocation, not one per pixel
+		if allocs := testing.AllocsPerRun(5, func() { toRGBA64(src, nil) }); allocs > 2 {
+			t.Errorf("%T: %v allocations, want at most 2", src, allocs)
+		}
+	}
+}
+
+func benchmarkToRGBA64(b *testing.B, src image.Image) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		toRGBA64(src, nil)
+	}
+}
+
+func BenchmarkToRGBA64(b *testing.B) {
+	benchmarkToRGBA64(b, translucent(color.RGBAModel, 2048, 2048))
+}
+
+func BenchmarkToRGBA64Generic(b *testing.B) {
+	benchmarkToRGBA64(b, genericImage{translucent(color.RGBAModel, 2048, 2048)})
+}
+
+func TestClone(t *testing.T) {
+	img := NewImageFromRGBA64(gradient(8, 6))
+	img.ApplyEffects(CreateKernels([]string{"B"}))
+	if img.Final != 1 {
+		t.Fatalf("Final is %d after one effect, want 1", img.Final)
+	}
+	original := NewImageFromRGBA64(cloneRGBA64(img.out))
+
+	clone := img.Clone()
+	if clone.Final != img.Final || clone.Bounds != img.Bounds {
+		t.Fatalf("clone has Final %d and bounds %v, want %d and %v", clone.Final, clone.Bounds, img.Final, img.Bounds)
+	}
+	if !clone.Equal(img) {
+		t.Fatal("clone differs from the original")
+	}
+	if clone.in == img.in || clone.out == img.out {
+		t.Fatal("clone shares buffers with the original")
+	}
+
+	// mutate both buffers of the clone and its buffer selection
+	clone.Set(0, 0, color.RGBA64{1, 2, 3, 4})
+	clone.ApplyEffects(CreateKernels([]string{"S", "E"}))
+	clone.Final = 1 - clone.Final
+
+	if img.Final != 1 {
+		t.Errorf("Final of the original changed to %d", img.Final)
+	}
+	if !img.Equal(original) {
+		t.Error("the pixels of the original changed with its clone")
+	}
+}
+
+func TestReaderWriter(t *testing.T) {
+	img := NewImageFromRGBA64(gradient(16, 8))
+	img.ApplyEffects(CreateKernels([]string{"S"}))
+
+	// PNG is lossless: the image read back is the one written
+	var buf bytes.Buffer
+	if err := img.SaveWriter(&buf, "png"); err != nil {
+		t.Fatal(err)
+	}
+	encoded := append([]byte(nil), buf.Bytes()...)
+	loaded, err := LoadReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.SourceFormat() != "png" || !loaded.Equal(img) {
+		t.Errorf("read back a %s image equal to the written one: %v", loaded.SourceFormat(), loaded.Equal(img))
+	}
+
+	// the path based functions write and read the same bytes
+	path := filepath.Join(t.TempDir(), "img.png")
+	if err := img.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := os.ReadFile(path); !bytes.Equal(saved, encoded) {
+		t.Error("Save wrote other bytes than SaveWriter")
+	}
+	if fromFile, err := Load(path); err != nil || !fromFile.Equal(loaded) {
+		t.Errorf("Load gave another image than LoadReader: %v", err)
+	}
+
+	buf.Reset()
+	if err := img.SaveWriter(&buf, "jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if jpeg, err := LoadReader(&buf); err != nil || jpeg.SourceFormat() != "jpeg" || jpeg.Bounds != img.Bounds {
+		t.Errorf("read back the JPEG as %v: %v", jpeg, err)
+	}
+
+	if err := img.SaveWriter(&buf, "gif"); err == nil {
+		t.Error("an unsupported format returned no error")
+	}
+	if _, err := LoadReader(bytes.NewReader([]byte("not an image"))); !errors.Is(err, ErrDecode) {
+		t.Errorf("reading bytes that are not an image: got %v, want %v", err, ErrDecode)
+	}
+}
+
+// pngHeader returns a 1x1 PNG whose header declares 'width' x 'height' pixels
+func pngHeader(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := stdpng.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// IHDR chunk: length (8:12), type (12:16), width (16:20), height (20:24), ..., CRC of type and data (29:33)
+	binary.BigEndian.PutUint32(data[16:20], width)
+	binary.BigEndian.PutUint32(data[20:24], height)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestMaxPixels(t *testing.T) {
+	defer func(old int) { MaxPixels = old }(MaxPixels)
+	MaxPixels = 1000 * 1000
+
+	// a few bytes declaring 50000 x 50000 pixels: 2 buffers of 20GB if decoded
+	bomb := pngHeader(t, 50000, 50000)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := LoadReader(bytes.NewReader(bomb))
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want %v", err, ErrTooLarge)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes rejecting the image", allocated)
+	}
+
+	// one pixel over the limit, from a file
+	if _, err := Load(writePNG(t, "large.png", image.NewGray(image.Rect(0, 0, 1001, 1000)))); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want %v", err, ErrTooLarge)
+	}
+	// at the limit: the bytes read for the header are decoded with the rest
+	img, err := LoadReader(bytes.NewReader(pngHeader(t, 1, 1)))
+	if err != nil || img.Bounds != image.Rect(0, 0, 1, 1) {
+		t.Errorf("loading an image within the limit: %v", err)
+	}
+	if _, err := Load(writePNG(t, "limit.png", image.NewGray(image.Rect(0, 0, 1000, 1000)))); err != nil {
+		t.Errorf("loading an image at the limit: %v", err)
+	}
+}
+
+func TestNewImage(t *testing.T) {
+	img := NewImage(4, 4)
+	in, out := img.GetInputOutputPixels()
+	if img.Bounds != image.Rect(0, 0, 4, 4) || img.Final != 0 || in == out ||
+		in.Bounds() != img.Bounds || out.Bounds() != img.Bounds {
+		t.Fatalf("4x4 image with bounds %v, Final %d and buffers of bounds %v and %v", img.Bounds, img.Final, in.Bounds(), out.Bounds())
+	}
+
+	pixels := image.NewRGBA64(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 16; i++ {
+		pixels.SetRGBA64(i%4, i/4, color.RGBA64{uint16(i * 1000), uint16(i * 2000), uint16(i * 3000), 65535})
+	}
+	img = NewImageFromRGBA64(pixels)
+	img.ApplyEffects(CreateKernels([]string{"G"}))
+	if img.Final != 1 {
+		t.Fatalf("Final is %d after grayscale, want 1", img.Final)
+	}
+	final, _ := img.GetInputOutputPixels()
+	for i := 0; i < 16; i++ {
+		gray := uint16(i * 2000) // average of i*1000, i*2000 and i*3000
+		if px := final.RGBA64At(i%4, i/4); px != (color.RGBA64{gray, gray, gray, 65535}) {
+			t.Errorf("pixel (%d, %d) is %v, want gray %d", i%4, i/4, px, gray)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	valid := pngHeader(t, 1, 1)
+	// bit depth 4 with color type RGB: a valid header the decoder doesn't support
+	unsupported := append([]byte(nil), valid...)
+	unsupported[24], unsupported[25] = 4, 2
+	binary.BigEndian.PutUint32(unsupported[29:33], crc32.ChecksumIEEE(unsupported[12:29]))
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"not an image", []byte("plain text"), ErrDecode},
+		{"truncated", valid[:len(valid)-20], ErrDecode},
+		{"corrupt header", append([]byte{0}, valid[1:]...), ErrDecode},
+		{"unsupported model", unsupported, ErrUnsupportedModel},
+	}
+	classes := []error{ErrNotFound, ErrDecode, ErrUnsupportedModel, ErrTooLarge}
+	for _, test := range tests {
+		_, err := LoadReader(bytes.NewReader(test.data))
+		for _, class := range classes {
+			if want := class == test.want; errors.Is(err, class) != want {
+				t.Errorf("%s: errors.Is(%v, %v) = %v, want %v", test.name, err, class, !want, want)
+			}
+		}
+		var loadErr *LoadError
+		if !errors.As(err, &loadErr) || loadErr.Err == nil {
+			t.Errorf("%s: %v is not a *LoadError with its cause", test.name, err)
+		}
+	}
+
+	_, err := Load(filepath.Join(t.TempDir(), "missing.png"))
+	if !errors.Is(err, ErrNotFound) || !errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrDecode) {
+		t.Errorf("loading a missing file: got %v, want %v wrapping %v", err, ErrNotFound, fs.ErrNotExist)
+	}
+	if _, err := Load(writePNG(t, "ok.png", gradient(2, 2))); err != nil {
+		t.Errorf("loading a valid file: %v", err)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := NewImageFromRGBA64(gradient(8, 6))
+	b := NewImageFromRGBA64(gradient(8, 6))
+	if !a.Equal(b) || !b.Equal(a) {
+		t.Fatal("images with the same pixels are not equal")
+	}
+
+	// one channel of one pixel off by 2
+	px := b.in.RGBA64At(3, 2)
+	px.G += 2
+	b.in.SetRGBA64(3, 2, px)
+	tests := []struct {
+		tolerance uint16
+		want      bool
+	}{{0, false}, {1, false}, {2, true}, {65535, true}}
+	for _, test := range tests {
+		if a.EqualWithin(b, test.tolerance) != test.want || b.EqualWithin(a, test.tolerance) != test.want {
+			t.Errorf("a pixel off by 2 is equal within %d: %v, want %v", test.tolerance, !test.want, test.want)
+		}
+	}
+	// alpha is compared too
+	px.G -= 2
+	px.A = 65534
+	b.in.SetRGBA64(3, 2, px)
+	if a.Equal(b) || !a.EqualWithin(b, 1) {
+		t.Error("alpha off by 1 is not compared")
+	}
+
+	// the last modified buffer of each image, according to its own Final: the pixels of 'a' in its output buffer
+	flipped := &Image{in: image.NewRGBA64(a.Bounds), out: cloneRGBA64(a.in), Bounds: a.Bounds, Final: 1}
+	if !flipped.Equal(a) || !a.Equal(flipped) {
+		t.Error("images with the same last modified pixels in different buffers are not equal")
+	}
+	flipped.Final = 0
+	if flipped.Equal(a) || a.Equal(flipped) {
+		t.Error("the buffer not last modified is compared")
+	}
+
+	if a.Equal(NewImageFromRGBA64(gradient(6, 8))) {
+		t.Error("images of different bounds are equal")
+	}
+}
+
+func TestSaveParentNotDir(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "small")
+	if err := os.WriteFile(blocker, []byte("a file where the output directory should be"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img := NewImageFromRGBA64(gradient(4, 4))
+	for _, path := range []string{filepath.Join(blocker, "IMG_Out.png"), filepath.Join(blocker, "sub", "IMG_Out.png")} {
+		err := img.Save(path)
+		if !errors.Is(err, ErrParentNotDir) || !strings.Contains(err.Error(), blocker) {
+			t.Errorf("saving to %s: got %v, want %v naming %s", path, err, ErrParentNotDir, blocker)
+		}
+		if err := img.SaveText(path, EffectsKeyword, "B"); !errors.Is(err, ErrParentNotDir) {
+			t.Errorf("saving with text to %s: got %v, want %v", path, err, ErrParentNotDir)
+		}
+	}
+	// a missing directory is another error
+	if err := img.Save(filepath.Join(dir, "missing", "IMG_Out.png")); err == nil || errors.Is(err, ErrParentNotDir) {
+		t.Errorf("saving to a missing directory: got %v", err)
+	}
+}
+
+func TestGrayOutput(t *testing.T) {
+	// decoded returns the PNG color type (0: gray, 2: RGB, 6: RGBA) and the image saved by 'img', and the size of its file
+	decoded := func(img *Image) (byte, image.Image, int) {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := img.SaveWriter(&buf, "png"); err != nil {
+			t.Fatal(err)
+		}
+		colorType, size := buf.Bytes()[25], buf.Len()
+		saved, err := stdpng.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return colorType, saved, size
+	}
+
+	img := NewImageFromRGBA64(gradient(32, 16))
+	img.ApplyEffects(CreateKernels([]string{"G"}))
+	final, _ := img.GetInputOutputPixels()
+	_, _, rgbaSize := decoded(img)
+
+	img.SetGrayOutput(true)
+	colorType, saved, size := decoded(img)
+	gray, ok := saved.(*image.Gray16)
+	if colorType != 0 || !ok {
+		t.Fatalf("grayscale output saved with color type %d as %T, want 0 as *image.Gray16", colorType, saved)
+	}
+	if size >= rgbaSize {
+		t.Errorf("single channel PNG of %d bytes, not smaller than the %d bytes of RGBA", size, rgbaSize)
+	}
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			if got, want := gray.Gray16At(x, y).Y, final.RGBA64At(x, y).R; got != want {
+				t.Fatalf("pixel (%d, %d) saved as %d, want the luminance %d", x, y, got, want)
+			}
+		}
+	}
+
+	// 8 bit luminances are saved with 8 bits
+	img = NewImageFromRGBA64(uniform(color.RGBA64{0x4242, 0x4242, 0x4242, 65535}))
+	img.SetGrayOutput(true)
+	if colorType, saved, _ := decoded(img); colorType != 0 || saved.(*image.Gray).GrayAt(0, 0).Y != 0x42 {
+		t.Errorf("8 bit gray saved with color type %d as %v, want 0 as 0x42", colorType, saved.At(0, 0))
+	}
+
+	// color or translucent pixels keep their channels: truecolor (2) or with alpha (6)
+	for pixels, want := range map[*image.RGBA64]byte{gradient(8, 8): 2, uniform(color.RGBA64{0x4242, 0x4242, 0x4242, 0x8000}): 6} {
+		img = NewImageFromRGBA64(pixels)
+		img.SetGrayOutput(true)
+		if colorType, _, _ := decoded(img); colorType != want {
+			t.Errorf("%v saved with color type %d, want %d", pixels.RGBA64At(1, 1), colorType, want)
+		}
+	}
+}
+
+func TestLoadInPlace(t *testing.T) {
+	path := writePNG(t, "color.png", gradient(16, 8))
+	// point effects only: each pixel depends on the same pixel of the input alone
+	chains := [][]string{{"G"}, {"GL709"}, {"G", "I"}, {"I", "VIG0.5", "T128"}}
+	for _, chain := range chains {
+		kernels := CreateKernels(chain)
+		if !InPlaceChain(kernels) {
+			t.Fatalf("%v: not an in-place chain", chain)
+		}
+		twoBuffers, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oneBuffer, err := LoadInPlace(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if twoBuffers.InPlace() || !oneBuffer.InPlace() || !oneBuffer.Clone().InPlace() {
+			t.Fatalf("%v: images loaded in place have a single buffer, the others two", chain)
+		}
+		source := twoBuffers.Clone()
+		twoBuffers.ApplyEffects(kernels)
+		oneBuffer.ApplyEffects(kernels)
+		if twoBuffers.Equal(source) {
+			t.Fatalf("%v: the effects did not change the pixels", chain)
+		}
+		if !oneBuffer.Equal(twoBuffers) {
+			t.Errorf("%v: different pixels with a single buffer than with two", chain)
+		}
+	}
+	// a convolution reads the neighbors of the pixels it writes
+	if InPlaceChain(CreateKernels([]string{"G", "B"})) {
+		t.Error("a chain with a blur is in place")
+	}
+}
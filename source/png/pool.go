@@ -0,0 +1,95 @@
+package png
+
+import (
+	"image"
+	"sync"
+)
+
+//=============================================================================
+// Pools of pixel buffers
+//=============================================================================
+
+// BufferPool holds pixel buffers of released images, to be reused by the next images loaded from the pool
+// instead of allocating new ones (see `BufferPool.Load`). eg: one pool per worker, so each worker reuses the buffers
+// of its own previous images, recently touched by it (warm in its caches and likely in memory local to it),
+// and the garbage collector has fewer buffers to reclaim.
+// Buffers are kept by size in `sync.Pool`s, so unused buffers are still freed by the garbage collector.
+// A nil *BufferPool is valid: images are loaded with new buffers and released ones are left to the garbage collector.
+type BufferPool struct {
+	mu    sync.Mutex
+	pools map[image.Point]*sync.Pool // free buffers of each size (width, height)
+}
+
+// buffers is the pool of the package-level loads (see `Load` and `ReleaseImage`)
+var buffers = NewBufferPool()
+
+// ReleaseImage returns the buffers of 'img' to the pool of `Load`, `LoadInPlace` and `LoadReader`, so the next
+// images of the same size loaded by them reuse the buffers instead of allocating new ones.
+// Only release an image once nothing uses it anymore (eg: after its output is saved); 'img' is left without pixels.
+// Obs: images are not required to be released; unreleased buffers are freed by the garbage collector as usual.
+func ReleaseImage(img *Image) {
+	buffers.Release(img)
+}
+
+// NewBufferPool returns an empty pool of buffers
+func NewBufferPool() *BufferPool {
+	return &BufferPool{pools: make(map[image.Point]*sync.Pool)}
+}
+
+// Load is as `Load`, with the buffers of the image taken from the pool if it has free ones of its size.
+func (p *BufferPool) Load(filePath string) (*Image, error) {
+	return load(filePath, false, p)
+}
+
+// LoadInPlace is as `LoadInPlace`, with the buffer of the image taken from the pool if it has a free one of its size.
+func (p *BufferPool) LoadInPlace(filePath string) (*Image, error) {
+	return load(filePath, true, p)
+}
+
+// Release returns the buffers of 'img' to the pool, to be reused by the next images of the same size.
+// 'img' must not be used afterwards, nor any buffer taken from it. eg: release an image once its output is saved
+// Obs: clones own their buffers (see `Image.Clone`), so each of them can be released too.
+func (p *BufferPool) Release(img *Image) {
+	if p == nil || img == nil {
+		return
+	}
+	p.put(img.in)
+	if !img.InPlace() {
+		p.put(img.out)
+	}
+	img.in, img.out = nil, nil
+}
+
+// pool returns the pool of free buffers of 'size'
+func (p *BufferPool) pool(size image.Point) *sync.Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool, ok := p.pools[size]
+	if !ok {
+		pool = &sync.Pool{}
+		p.pools[size] = pool
+	}
+	return pool
+}
+
+// get returns a buffer with 'bounds', free in the pool or new if there is none (or the pool is nil).
+// Obs: reused buffers keep the pixels of their previous image; the caller must write all of them.
+func (p *BufferPool) get(bounds image.Rectangle) *image.RGBA64 {
+	if p == nil {
+		return image.NewRGBA64(bounds)
+	}
+	if pixels, ok := p.pool(bounds.Size()).Get().(*image.RGBA64); ok {
+		// obs: same size, hence same stride; only the origin of the buffer might differ
+		pixels.Rect = bounds
+		return pixels
+	}
+	return image.NewRGBA64(bounds)
+}
+
+// put adds 'pixels' to the free buffers of its size
+func (p *BufferPool) put(pixels *image.RGBA64) {
+	if pixels == nil {
+		return
+	}
+	p.pool(pixels.Rect.Size()).Put(pixels)
+}
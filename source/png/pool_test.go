@@ -0,0 +1,131 @@
+package png
+
+import (
+	"image"
+	"image/draw"
+	"testing"
+)
+
+// gradient8 returns `gradient` with 8 bits per channel, the usual PNG, which is converted into a buffer of the pool
+// when loaded (see `toRGBA64`). obs: 16-bit PNGs are decoded into a new buffer, used as is
+func gradient8(width, height int) *image.RGBA {
+	pixels := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(pixels, pixels.Bounds(), gradient(width, height), image.Point{}, draw.Src)
+	return pixels
+}
+
+// buffersOf returns the first pixel of each buffer of 'img', identifying its buffers
+func buffersOf(img *Image) map[*uint8]bool {
+	return map[*uint8]bool{&img.in.Pix[0]: true, &img.out.Pix[0]: true}
+}
+
+// reuses reports whether 'load' reuses a buffer of an image released to 'pool' by 'release'.
+// obs: a `sync.Pool` may drop what is put in it (always on some GCs, randomly with -race), so a few attempts are made.
+func reuses(t *testing.T, load func() (*Image, error), release func(*Image)) bool {
+	t.Helper()
+	for attempt := 0; attempt < 10; attempt++ {
+		img, err := load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		released := buffersOf(img)
+		release(img)
+		if img, err = load(); err != nil {
+			t.Fatal(err)
+		}
+		for buffer := range buffersOf(img) {
+			if released[buffer] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestBufferPoolReuse(t *testing.T) {
+	first := writePNG(t, "first.png", gradient8(40, 30))
+	second := writePNG(t, "second.png", noise(40, 30))
+	pool := NewBufferPool()
+
+	// the next image of the same size loaded from the pool of a worker takes the buffers released to it
+	if !reuses(t, func() (*Image, error) { return pool.Load(first) }, pool.Release) {
+		t.Error("the pool did not reuse the buffers of a released image")
+	}
+	// and gets its own pixels, not those left in the buffers
+	img, _ := pool.Load(first)
+	pool.Release(img)
+	got, err := pool.Load(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := Load(second); !got.Equal(want) {
+		t.Error("an image loaded into reused buffers differs from one loaded into new buffers")
+	}
+
+	// other pools and images of other sizes don't take them
+	other := NewBufferPool()
+	if reuses(t, func() (*Image, error) { return other.Load(first) }, pool.Release) {
+		t.Error("a pool took the buffers released to another")
+	}
+	small := writePNG(t, "small.png", gradient8(20, 30))
+	for attempt := 0; attempt < 10; attempt++ {
+		img, _ := pool.Load(first)
+		pool.Release(img)
+		if img, _ = pool.Load(small); img.in.Rect != image.Rect(0, 0, 20, 30) || len(img.in.Pix) != 20*30*8 {
+			t.Fatalf("image of 20x30 pixels loaded into a buffer of %v with %d bytes", img.in.Rect, len(img.in.Pix))
+		}
+	}
+
+	// a nil pool allocates new buffers
+	var none *BufferPool
+	if reuses(t, func() (*Image, error) { return none.Load(first) }, none.Release) {
+		t.Error("a nil pool reused buffers")
+	}
+}
+
+func TestReleaseImage(t *testing.T) {
+	path := writePNG(t, "img.png", gradient8(40, 30))
+
+	// images loaded by the package functions reuse the buffers of the images released before
+	if !reuses(t, func() (*Image, error) { return Load(path) }, ReleaseImage) {
+		t.Error("Load did not reuse the buffers of a released image")
+	}
+	if !reuses(t, func() (*Image, error) { return LoadInPlace(path) }, ReleaseImage) {
+		t.Error("LoadInPlace did not reuse the buffer of a released image")
+	}
+
+	// a released image is left without pixels, and releasing nothing is a no-op
+	img, _ := Load(path)
+	ReleaseImage(img)
+	if img.in != nil || img.out != nil {
+		t.Error("a released image kept its buffers")
+	}
+	ReleaseImage(nil)
+}
+
+// benchmarkLoad loads and releases an image of 512x512 pixels with 'pool' each iteration.
+// eg: the package pool (see `ReleaseImage`) vs nil, allocating the buffers of each image
+func benchmarkLoad(b *testing.B, pool *BufferPool) {
+	path := writePNG(b, "bench.png", gradient8(512, 512))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		img, err := pool.Load(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pool.Release(img)
+	}
+}
+
+func BenchmarkLoadWorkerPool(b *testing.B) {
+	benchmarkLoad(b, NewBufferPool())
+}
+
+func BenchmarkLoadNoPool(b *testing.B) {
+	benchmarkLoad(b, nil)
+}
+
+func BenchmarkLoadReleased(b *testing.B) {
+	benchmarkLoad(b, buffers)
+}
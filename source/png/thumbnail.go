@@ -0,0 +1,80 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+//=============================================================================
+// Thumbnails and grids of images
+//=============================================================================
+
+// Thumbnail returns a copy of the image (its last modified buffer) downscaled to fit in a 'size' x 'size' square,
+// keeping its aspect ratio. Each pixel of the thumbnail is the average of the block of pixels it covers (box filter).
+// Images already fitting in the square are copied at their size; they are not upscaled.
+// eg: 400x300, size 128 => 128x96
+func (im *Image) Thumbnail(size int) *Image {
+	src, _ := im.GetInputOutputPixels()
+	width, height := im.Bounds.Dx(), im.Bounds.Dy()
+	thumbWidth, thumbHeight := width, height
+	if width > size || height > size {
+		if width >= height {
+			thumbWidth, thumbHeight = size, max1(height*size/width)
+		} else {
+			thumbWidth, thumbHeight = max1(width*size/height), size
+		}
+	}
+
+	thumb := image.NewRGBA64(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		// rows of the source covered by row 'y' of the thumbnail
+		y0 := im.Bounds.Min.Y + y*height/thumbHeight
+		y1 := im.Bounds.Min.Y + (y+1)*height/thumbHeight
+		for x := 0; x < thumbWidth; x++ {
+			x0 := im.Bounds.Min.X + x*width/thumbWidth
+			x1 := im.Bounds.Min.X + (x+1)*width/thumbWidth
+
+			var r, g, b, a uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := src.RGBA64At(sx, sy)
+					r, g, b, a = r+uint64(c.R), g+uint64(c.G), b+uint64(c.B), a+uint64(c.A)
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			thumb.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return NewImageFromRGBA64(thumb)
+}
+
+// max1 returns 'v', or 1 if it is smaller; a downscaled side has at least one pixel
+func max1(v int) int {
+	if v < 1 {
+		return 1
+	}
+	return v
+}
+
+// Grid returns an image with 'images' laid out in rows of 'cols' cells of 'cellSize' x 'cellSize' pixels, in order.
+// Each image is centered in its cell and cropped to it if larger (eg: thumbnails of 'cellSize'; see `Thumbnail`).
+// Cells without an image are left transparent.
+// eg: 4 images, 2 cols, cellSize 128 => 256x256
+func Grid(images []*Image, cols int, cellSize int) *Image {
+	rows := (len(images) + cols - 1) / cols
+	grid := image.NewRGBA64(image.Rect(0, 0, cols*cellSize, rows*cellSize))
+	for i, img := range images {
+		src, _ := img.GetInputOutputPixels()
+		cell := image.Rect(0, 0, cellSize, cellSize).Add(image.Pt((i%cols)*cellSize, (i/cols)*cellSize))
+		offset := image.Pt((cellSize-img.Bounds.Dx())/2, (cellSize-img.Bounds.Dy())/2)
+		if offset.X < 0 {
+			offset.X = 0
+		}
+		if offset.Y < 0 {
+			offset.Y = 0
+		}
+		draw.Draw(grid, cell.Add(offset).Intersect(cell), src, img.Bounds.Min, draw.Src)
+	}
+	return NewImageFromRGBA64(grid)
+}
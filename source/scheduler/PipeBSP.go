@@ -2,10 +2,10 @@ package scheduler
 
 import (
 	"fmt"
-	"proj3/utils"
 	"time"
 	ws "proj3/WorkStealing"
 	c "proj3/constants"
+	"proj3/utils"
 )
 
 //=====================================================================================================================
@@ -56,7 +56,7 @@ func Run3(input <-chan ws.Runnable){
 //==============================================================================
 // Pipeline BSP execution
 //==============================================================================
-func RunPipeBSP(config Config){
+func RunPipeBSP(config Config) (Result, error) {
 
 	//start timer
 	startTime := time.Now()
@@ -66,7 +66,10 @@ func RunPipeBSP(config Config){
 	//--------------------------------------------------------------------------
 	
 	// create a list of tasks based off of the data directories
-	tasks := utils.CreateTasks(config.DataDirs)
+	tasks, err := createTasks(config)
+	if err != nil {
+		return Result{}, err
+	}
 
 	// compute number of threads to use in work stealing
 	nThreads := config.ThreadCount
@@ -74,6 +77,9 @@ func RunPipeBSP(config Config){
 		nThreads = len(tasks.Tasks)
 	}
 
+	// workers of each phase
+	phases := phaseThreads(config, nThreads, len(tasks.Tasks))
+
 	// timers for parallel section
 	var totalParallelTime time.Duration
 	startParallel := time.Now()
@@ -93,6 +99,11 @@ func RunPipeBSP(config Config){
 		chunks = []int{0, len(tasks.Tasks)}
 	}
 
+	// aggregate time of each pipeline phase over all chunks
+	var phaseTimes []time.Duration
+	// tasks waiting in each phase, sampled over all chunks (if enabled)
+	backlogs := newPhaseBacklogs(config, c.PipePhases)
+
 	// run the whole pipeline for each chunk of tasks
 	for i := 0; i < len(chunks)-1; i++ {
 		start := chunks[i]
@@ -100,14 +111,20 @@ func RunPipeBSP(config Config){
 		taskSubset := tasks.Tasks[start:end]
 
 		// create a PipeContext for the pipeline
-		pipeCtx := NewPipeContext(&config, c.PipePhases, len(taskSubset))
+		pipeCtx := NewPipeContext(&config, c.PipePhases, len(taskSubset), utils.CountOutputs(taskSubset))
+		stopSampling := backlogs.sample(pipeCtx)
 
 		// Start workers for each phase, each listening on the output channel of the previous phase
-		for i := 0; i < nThreads; i++ {
+		for i := 0; i < phases[0]; i++ {
 		  	go Run1(pipeCtx.channels[0])
+		}
+		for i := 0; i < phases[1]; i++ {
 		  	go Run2(pipeCtx.channels[1])
+		}
+		for i := 0; i < phases[2] && config.Writers == 0; i++ {
 		  	go Run3(pipeCtx.channels[2])
 		}
+		startWriters(pipeCtx)
 
 		// Create Tasks Phase 1 and send them over the pipeline
 		for i := range taskSubset {
@@ -128,7 +145,10 @@ func RunPipeBSP(config Config){
 				close(pipeCtx.channels[i+1])
 			}
 		}
+		stopSampling()
+		phaseTimes = pipeCtx.AddPhaseTimes(phaseTimes)
 	}
+	backlogs.print()
 	
 	//=============================================================================
 	// Save results
@@ -141,7 +161,7 @@ func RunPipeBSP(config Config){
 	elapsedTime := time.Since(startTime)
 
 	// write times + settings into JSON format 
-	// Obs: PipeBSP mode = "pipebspws_<nSubThreads><_chunkSize>"
+	// Obs: PipeBSP mode = "pipebspws_<nSubThreads><_chunkSize><_phases>"
 	
 	var chunkSizeStr string
 	if config.ChunkSize == 0 {
@@ -149,11 +169,13 @@ func RunPipeBSP(config Config){
 	} else {
 		chunkSizeStr = fmt.Sprintf("_%d", config.ChunkSize)
 	}
+	if config.SliceStrategy != "" {
+		chunkSizeStr += "_" + config.SliceStrategy
+	}
+	chunkSizeStr += phaseThreadsSuffix(config, phases)
 
-	writeStr := fmt.Sprintf("{\"mode\": \"%s_%d%s\", \"threads\": %d, \"timeElapsed\": %f, \"timeParallel\": %f , \"datadir\": \"%s\"}\n", 
-				config.Mode, config.SubThreadCount, chunkSizeStr ,nThreads, elapsedTime.Seconds(), totalParallelTime.Seconds(), config.DataDirs)
-	
-	// write results to file
-	utils.WriteToFile(resultsPath, writeStr)
+	return Result{Mode: fmt.Sprintf("%s_%d%s", config.Mode, config.SubThreadCount, chunkSizeStr), Threads: nThreads,
+		TimeElapsed: elapsedTime.Seconds(), TimeParallel: totalParallelTime.Seconds(), DataDir: config.DataDirs,
+		PhaseTimes: phaseTimesResult(config, phaseTimes)}, nil
 	
 }
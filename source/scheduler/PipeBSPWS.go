@@ -1,7 +1,9 @@
 package scheduler
 
 import (
+	"errors"
 	"fmt"
+	"runtime"
 	ws "proj3/WorkStealing"
 	"proj3/utils"
 	"time"
@@ -25,90 +27,284 @@ import (
 
 // PipeWorker is a wrapper around a WorkStealing worker for usage in the pipeline.
 type PipeWorker struct {
-	worker   *ws.Worker			// WorkStealing worker
-	numTasks int				// number of tasks of a pipeline stage assigend to the worker
-	done 	 chan struct{}		// channel to signal for workers to stop execution/stealing
+	worker   	*ws.Worker			// WorkStealing worker
+	numTasks 	int					// number of tasks of a pipeline stage to retrieve from the input channel
+	taskIndexes []int				// indexes of the tasks of a pipeline stage assigned to the worker
+	done 	 	chan struct{}		// channel to signal for workers to stop execution/stealing; shared by the workers of a phase
 }
 
 // Create a slice of PipeWorkers for a pipeline stage and divide the tasks among them.
 // eg: If numThreads = 4, will create 4 PipeWorkers with 1/4 of the tasks each.
-func PrepareWorkers(nWorkers int, numTasks int) []*PipeWorker {
+// All workers share the same `done` channel, so closing it once the stage is finished stops all of them.
+// If 'roundRobin', tasks are interleaved among workers; otherwise, each worker gets a block of tasks (see `AssignTasks`).
+// @stealPolicy: number of tasks workers steal at a time (see `ws.Worker.SetStealPolicy`)
+func PrepareWorkers(nWorkers int, numTasks int, roundRobin bool, stealPolicy string) []*PipeWorker {
 	Workers := make([]*PipeWorker, nWorkers)
-	wsWorkers := InitTaskStealing(nWorkers)
+	wsWorkers := InitTaskStealing(nWorkers, stealPolicy)
 	
-	tasksPerWorker := numTasks / nWorkers
-	remainder	:= numTasks % nWorkers
+	assignment := AssignTasks(numTasks, nWorkers, roundRobin)
+	done := make(chan struct{})
 	for i := range Workers {
-		if i != nWorkers-1 {
-			Workers[i] = &PipeWorker{worker: wsWorkers[i], numTasks: tasksPerWorker, done: make(chan struct{})}
-		} else {
-			Workers[i] = &PipeWorker{worker: wsWorkers[i], numTasks: tasksPerWorker + remainder, done: make(chan struct{})}
-		}
+		Workers[i] = &PipeWorker{worker: wsWorkers[i], numTasks: len(assignment[i]), taskIndexes: assignment[i], done: done}
 	}
 	return Workers
 }
 
+// AssignTasks divides the indexes of 'numTasks' tasks among 'nWorkers' workers.
+// - block: each worker gets 'numTasks/nWorkers' consecutive tasks; the last worker also gets the remainder.
+// - round robin: worker i gets tasks i, i+n, i+2n, ...; the remainder is spread over the first workers.
+// eg: 10 tasks, 4 workers => block: [0 1] [2 3] [4 5] [6 7 8 9]; round robin: [0 4 8] [1 5 9] [2 6] [3 7]
+// In both cases each index is assigned to exactly one worker, also if there are more workers than tasks
+// (eg: 2 tasks, 3 workers => block: [] [] [0 1]). Returns no assignment if 'nWorkers' < 1.
+// Obs: with round robin, images of different sizes in the task list are mixed among workers,
+// balancing the work of each worker from the start instead of relying on stealing.
+func AssignTasks(numTasks int, nWorkers int, roundRobin bool) [][]int {
+	if nWorkers < 1 {
+		return nil
+	}
+	assignment := make([][]int, nWorkers)
+	if roundRobin {
+		for i := 0; i < numTasks; i++ {
+			assignment[i%nWorkers] = append(assignment[i%nWorkers], i)
+		}
+		return assignment
+	}
+
+	tasksPerWorker := numTasks / nWorkers
+	for i := range assignment {
+		start := i * tasksPerWorker
+		end := start + tasksPerWorker
+		if i == nWorkers-1 {
+			end = numTasks
+		}
+		for j := start; j < end; j++ {
+			assignment[i] = append(assignment[i], j)
+		}
+	}
+	return assignment
+}
+
+// ErrTaskAssignment is returned when the tasks sent over the channel of a pipeline phase do not add up to the tasks
+// its workers retrieve from it: workers would wait forever for tasks never sent, or tasks would never be executed.
+// The pipeline still runs to the end with the tasks sent (see `PipeContext.checkSent`).
+var ErrTaskAssignment = errors.New("tasks assigned to the workers do not match the tasks of the phase")
+
+// assignPhaseTasks sets the tasks the workers of each pipeline phase after the first one retrieve from its channel
+// (see `PipeContext.assign`). Phase 1 workers get their tasks in their DEqueue instead (see `AssignPhase1Tasks`);
+// with `Config.Writers`, the phase 3 workers are not started and the writers save all tasks sent.
+func assignPhaseTasks(pipeCtx *PipeContext, pipeWorkers [][]*PipeWorker) {
+	for i := 1; i < len(pipeWorkers); i++ {
+		if i == len(pipeWorkers)-1 && pipeCtx.config.Writers > 0 {
+			break
+		}
+		assigned := 0
+		for _, worker := range pipeWorkers[i] {
+			assigned += worker.numTasks
+		}
+		pipeCtx.assign(i, assigned)
+	}
+}
+
+// waitPhases waits for all phases of the pipeline to finish, one after the other:
+// - once a phase is finished, no more tasks are sent to the next one: close its channel and check the tasks sent
+//   against those assigned to its workers (see `PipeContext.checkSent`)
+// - signal the workers of the finished phase to stop execution/stealing (see `PrepareWorkers`)
+// This prevents goroutine leaks and waits for the full pipeline execution, also if the tasks sent don't match.
+// Returns the first error wrapping `ErrTaskAssignment`, if any.
+func waitPhases(pipeCtx *PipeContext, pipeWorkers [][]*PipeWorker) error {
+	var err error
+	for i, wg := range pipeCtx.wgs {
+		if i > 0 {
+			if errSent := pipeCtx.checkSent(i); errSent != nil && err == nil {
+				err = errSent
+			}
+		}
+		wg.Wait()
+		if i < len(pipeCtx.wgs)-1 {
+			close(pipeCtx.channels[i+1])
+		}
+		close(pipeWorkers[i][0].done)
+	}
+	return err
+}
+
+// AssignPhase1Tasks adds the phase 1 tasks of 'taskSubset' to the DEqueues of 'workers' as given by their `taskIndexes`.
+// Obs: must be called before the workers start running (only the owner of a DEqueue can push to it).
+// Phase 2 and 3 tasks are created as images complete the previous phase, so they are retrieved from the channels.
+func AssignPhase1Tasks(pipeCtx *PipeContext, workers []*PipeWorker, taskSubset []utils.Task) {
+	for _, worker := range workers {
+		addPhase1Tasks(pipeCtx, worker.worker, worker.taskIndexes, taskSubset)
+		// all tasks already in the DEqueue; nothing to retrieve from the input channel
+		worker.numTasks = 0
+	}
+}
+
+// addPhase1Tasks adds the phase 1 tasks of 'taskSubset' at 'indexes' to the DEqueue of 'worker'.
+// The owner of a DEqueue executes the last task added first, while thieves take the first ones (see `ws.Worker`):
+// - default: tasks are added in reverse, so the worker executes them in the order of the effects file.
+// - `Config.LIFO`: tasks are added in order, so the worker executes the most recently added images (the last in
+//   the effects file) first, while idle workers steal the older backlog from the other end.
+func addPhase1Tasks(pipeCtx *PipeContext, worker *ws.Worker, indexes []int, taskSubset []utils.Task) {
+	for i := range indexes {
+		index := indexes[len(indexes)-1-i]
+		if pipeCtx.config.LIFO {
+			index = indexes[i]
+		}
+		worker.AddTask(NewTaskPhase1(pipeCtx, &taskSubset[index], 0))
+	}
+}
+
+// pipeConcurrency returns an upper bound on the goroutines executing the pipeline with 'nThreads' workers
+// and 'phases' workers per phase (see `phaseThreads`):
+// - separate pools: 'phases[i]' workers for phase i; phase 3 workers are replaced by `Config.Writers`, if any.
+// - shared pool: 'nThreads' workers for all phases, plus the writers.
+// Each phase 2 worker may also spawn `Config.SubThreadCount` sub-threads, while it waits for them.
+// eg: nThreads = 8, subThreads = 4 => separate: 24 workers + 32 sub-threads = 56; shared: 8 + 32 = 40
+func pipeConcurrency(config Config, nThreads int, phases []int) int {
+	workers, computeWorkers := nThreads, nThreads
+	if !config.SharedPool {
+		workers, computeWorkers = phases[0]+phases[1], phases[1]
+		if config.Writers == 0 {
+			workers += phases[2]
+		}
+	}
+	total := workers + config.Writers
+	if config.SubThreadCount > 1 {
+		total += computeWorkers * config.SubThreadCount
+	}
+	return total
+}
+
+// checkConcurrency prints a warning if the goroutines of the pipeline (see `pipeConcurrency`) exceed `GOMAXPROCS`.
+// Obs: idle workers keep trying to steal tasks, so workers of the other phases compete for the cores with the busy ones.
+func checkConcurrency(config Config, nThreads int, phases []int) {
+	total := pipeConcurrency(config, nThreads, phases)
+	if procs := runtime.GOMAXPROCS(0); total > procs {
+		fmt.Printf("Warning: up to %d goroutines for %d procs (GOMAXPROCS); consider fewer threads/sub-threads", total, procs)
+		if !config.SharedPool {
+			fmt.Print(" or -sharedpool")
+		}
+		fmt.Println()
+	}
+}
+
+// runSharedPool runs the pipeline for 'taskSubset' with a single pool of 'nThreads' workers executing the tasks of all phases.
+// Phase 1 tasks are added to the DEqueues of the workers; each task pushes the task of the next phase
+// to the DEqueue of the worker executing it (see `PipeContext.send`). Workers stop once all phases are done.
+func runSharedPool(config Config, pipeCtx *PipeContext, nThreads int, taskSubset []utils.Task) {
+	pipeCtx.workers = InitTaskStealing(nThreads, config.StealPolicy)
+	for _, worker := range pipeCtx.workers {
+		worker.SetEventHook(config.events.workerHook(0))
+	}
+	assignment := AssignTasks(len(taskSubset), nThreads, config.RoundRobin)
+	for i, worker := range pipeCtx.workers {
+		addPhase1Tasks(pipeCtx, worker, assignment[i], taskSubset)
+	}
+	startWriters(pipeCtx)
+	close(pipeCtx.channels[0])
+
+	done := make(chan struct{})
+	for _, worker := range pipeCtx.workers {
+		go worker.Run(done)
+	}
+
+	// wait for each phase; closing the channel of the next phase stops the writers after phase 2
+	for i, wg := range pipeCtx.wgs {
+		wg.Wait()
+		if i < len(pipeCtx.wgs)-1 {
+			close(pipeCtx.channels[i+1])
+		}
+	}
+	close(done)
+}
+
 //=====================================================================================================================
 // Pipeline phases callers
 //=====================================================================================================================
 // Run the phase 1 of the pipeline.
 func RunPhase1(input <-chan ws.Runnable, worker *PipeWorker) {
 	// retrieve tasks from 1st stage of pipeline assigned to `worker` and add them to it's DEqueue
-	for i := 0; i < worker.numTasks; i++ {
-		task := <- input
-		worker.worker.AddTask(task)
-	}
+	retrieveTasks(input, worker)
 	// start execution/stealing
 	worker.worker.Run(worker.done)
 }
 
-// Run the phase 1 of the pipeline.
+// Run the phase 2 of the pipeline.
 func RunPhase2(input <-chan ws.Runnable, worker *PipeWorker) {
-	for i := 0; i < worker.numTasks; i++ {
 	// retrieve tasks from 2nd stage of pipeline assigned to `worker` and add them to it's DEqueue
-		task := <- input
-		worker.worker.AddTask(task)
-	}
+	retrieveTasks(input, worker)
 	// start execution/stealing
 	worker.worker.Run(worker.done)
 }
 
 // Run the phase 3 of the pipeline.
 func RunPhase3(input <-chan ws.Runnable, worker *PipeWorker) {
+	// retrieve tasks from 3rd stage of pipeline assigned to `worker` and add them to it's DEqueue
+	retrieveTasks(input, worker)
+	worker.worker.Run(worker.done)
+}
+
+// retrieveTasks adds the `numTasks` tasks of 'worker' to its DEqueue as they arrive on 'input'.
+// Stops early if 'input' is closed, i.e., fewer tasks were sent than assigned (see `PipeContext.checkSent`):
+// otherwise the worker would add nil tasks, which can't be executed.
+func retrieveTasks(input <-chan ws.Runnable, worker *PipeWorker) {
 	for i := 0; i < worker.numTasks; i++ {
-		// retrieve tasks from 3rd stage of pipeline assigned to `worker` and add them to it's DEqueue
-		task := <- input
+		task, ok := <- input
+		if !ok {
+			return
+		}
 		worker.worker.AddTask(task)
 	}
-	worker.worker.Run(worker.done)
 }
 
 //==============================================================================
 // Pipeline BSP with work stealing refinement execution
 //==============================================================================
-func RunPipeBSPWS(config Config){
+func RunPipeBSPWS(config Config) (Result, error) {
 	//start timer
 	startTime := time.Now()
 
 	//--------------------------------------------------------------------------
 	// Initialization
 	//--------------------------------------------------------------------------
+
+	if config.StealPolicy != "" && config.StealPolicy != ws.StealOne && config.StealPolicy != ws.StealHalf {
+		return Result{}, fmt.Errorf("unknown steal policy %q: expected %q or %q", config.StealPolicy, ws.StealOne, ws.StealHalf)
+	}
 	
 	// create a list of tasks based off of the data directories
-	tasks := utils.CreateTasks(config.DataDirs)
+	tasks, err := createTasks(config)
+	if err != nil {
+		return Result{}, err
+	}
 
 	// compute number of threads to use in work stealing
 	nThreads := config.ThreadCount
 	if nThreads > len(tasks.Tasks){
 		nThreads = len(tasks.Tasks)
 	}
-
-	// nSubThreads := config.SubThreadCount
+	// obs: at least one worker per phase; otherwise no worker would retrieve the tasks (see `AssignTasks`)
+	if nThreads < 1 {
+		nThreads = 1
+	}
 
 	// timers for parallel section
 	var totalParallelTime time.Duration
 	startParallel := time.Now()
 
+	// autotuning: the first images pick the sub-threads of the rest (see `tuneSubThreads`)
+	// obs: part of the parallel section, since these images are processed too
+	if config.AutoSubThreads {
+		config.SubThreadCount, tasks.Tasks = tuneSubThreads(&config, tasks.Tasks)
+		fmt.Printf("Auto sub-threads: %d\n", config.SubThreadCount)
+	}
+
+	// workers of each phase of the separate pools
+	phases := phaseThreads(config, nThreads, len(tasks.Tasks))
+
+	// nSubThreads := config.SubThreadCount
+	checkConcurrency(config, nThreads, phases)
+
 	//--------------------------------------------------------------------------
 	// Execute pipeline
 	//--------------------------------------------------------------------------
@@ -117,13 +313,21 @@ func RunPipeBSPWS(config Config){
 
 	// create chunks of tasks to process based on user input
 	// if no input, defaults to all tasks
+	// obs: no chunks if the autotuner processed all images
 	var chunks []int
 	if config.ChunkSize > 0{
 		chunks = ChunksOfTasks(len(tasks.Tasks), config.ChunkSize)
-	} else {
+	} else if len(tasks.Tasks) > 0 {
 		chunks = []int{0, len(tasks.Tasks)}
 	}
 
+	// aggregate time of each pipeline phase over all chunks
+	var phaseTimes []time.Duration
+	// capacity reached by the DEqueues of the workers of all chunks and phases
+	var capacities dequeCapacities
+	// tasks waiting in each phase, sampled over all chunks (if enabled)
+	backlogs := newPhaseBacklogs(config, c.PipePhases)
+
 	// run the whole pipeline for each chunk of tasks
 	for i := 0; i < len(chunks)-1; i++ {
 		start := chunks[i]
@@ -131,44 +335,77 @@ func RunPipeBSPWS(config Config){
 		taskSubset := tasks.Tasks[start:end]
 
 		// create a PipeContext for the pipeline
-		pipeCtx := NewPipeContext(&config, c.PipePhases, len(taskSubset))
+		pipeCtx := NewPipeContext(&config, c.PipePhases, len(taskSubset), utils.CountOutputs(taskSubset))
+
+		// shared pool: the same workers execute the tasks of all phases
+		if config.SharedPool {
+			stopSampling := backlogs.sample(pipeCtx)
+			runSharedPool(config, pipeCtx, nThreads, taskSubset)
+			stopSampling()
+			phaseTimes = pipeCtx.AddPhaseTimes(phaseTimes)
+			capacities.add("shared", pipeCtx.workers)
+			continue
+		}
 		
 		// create groups of pipe workers for each phase and divide tasks among them
 		// eg: if numThreads = 4, will create 4 PipeWorkers for each phase with 1/4 of the tasks each.
+		// obs: unless the workers of a phase are given (see `phaseThreads`)
 		pipeWorkers := make([][]*PipeWorker, c.PipePhases)
+		// obs: the phases after the first one have a task for each output of the images
+		nOutputs := utils.CountOutputs(taskSubset)
 		for i := range pipeWorkers {
-			pipeWorkers[i] = PrepareWorkers(nThreads, len(taskSubset))
+			nTasks := len(taskSubset)
+			if i > 0 {
+				nTasks = nOutputs
+			}
+			pipeWorkers[i] = PrepareWorkers(phases[i], nTasks, config.RoundRobin, config.StealPolicy)
+			for _, worker := range pipeWorkers[i] {
+				worker.worker.SetEventHook(config.events.workerHook(i+1))
+			}
 		}
+		// Add Phase1 tasks to the DEqueues of phase 1 workers; the next phases retrieve theirs from the channels
+		AssignPhase1Tasks(pipeCtx, pipeWorkers[0], taskSubset)
+		assignPhaseTasks(pipeCtx, pipeWorkers)
+		pipeCtx.phaseWorkers = pipeWorkers
+		stopSampling := backlogs.sample(pipeCtx)
 
 		// Start routines for each phase, each listening on the output channel of the previous phase
-		for i := 0; i < nThreads; i++ {
-			go RunPhase1(pipeCtx.channels[0], pipeWorkers[0][i])
-			go RunPhase2(pipeCtx.channels[1], pipeWorkers[1][i])
-			go RunPhase3(pipeCtx.channels[2], pipeWorkers[2][i])
-	  	}
-		// Send Phase1 tasks over the channel
-		for i := range taskSubset {
-			pipeCtx.channels[0] <- NewTaskPhase1(pipeCtx, &taskSubset[i], 0)
+		for _, worker := range pipeWorkers[0] {
+			go RunPhase1(pipeCtx.channels[0], worker)
+		}
+		for _, worker := range pipeWorkers[1] {
+			go RunPhase2(pipeCtx.channels[1], worker)
+		}
+		if config.Writers == 0 {
+			for _, worker := range pipeWorkers[2] {
+				go RunPhase3(pipeCtx.channels[2], worker)
+			}
 		}
+		// obs: with writers, phase 3 workers are not started; the writers save the images instead
+		startWriters(pipeCtx)
 		// close channel to signal end of tasks
+		// obs: Phase1 tasks were added to the workers' DEqueues; none is sent over the channel
 		close(pipeCtx.channels[0]) 
 
 
-		// Loop: for all pipeline phases:
-		// - Wait for all tasks of a pipeline stage to finish
-		// - Close the respective channels when they are finished 
-		// - Signal workers to stop execution/stealing when phase is finished
-		// This prevents goroutine leaks and wait for the full pipeline execution
-		for i, wg := range pipeCtx.wgs {
-			wg.Wait()
-			if i < len(pipeCtx.wgs)-1 {
-				// Phase 1 finished -> close channel receiving Phase 2 tasks
-				close(pipeCtx.channels[i+1])
-				// Phase 1 finished -> signal workers to stop execution/stealing
-				close(pipeWorkers[i][0].done)
+		// wait for all phases to finish, closing their channels and stopping their workers
+		err := waitPhases(pipeCtx, pipeWorkers)
+		stopSampling()
+		if err != nil {
+			return Result{}, err
+		}
+		phaseTimes = pipeCtx.AddPhaseTimes(phaseTimes)
+		// obs: with writers, phase 3 workers were not started; their DEqueues are empty
+		for i, phaseWorkers := range pipeWorkers {
+			workers := make([]*ws.Worker, len(phaseWorkers))
+			for j, worker := range phaseWorkers {
+				workers[j] = worker.worker
 			}
+			capacities.add(fmt.Sprintf("phase %d", i+1), workers)
 		}
 	}
+	capacities.print()
+	backlogs.print()
 	
 	//--------------------------------------------------------------------------
 	// Save results
@@ -181,18 +418,26 @@ func RunPipeBSPWS(config Config){
 	elapsedTime := time.Since(startTime)
 
 	// write times + settings into JSON format 
-	// Obs: PipeBSPWS mode = "pipebspws_<nSubThreads><_chunkSize>"
+	// Obs: PipeBSPWS mode = "pipebspws_<nSubThreads><_chunkSize><_shared><_auto><_phases>"; with autotuning, the sub-threads picked
 	var chunkSizeStr string
 	if config.ChunkSize == 0 {
 		chunkSizeStr = ""
 	} else {
 		chunkSizeStr = fmt.Sprintf("_%d", config.ChunkSize)
 	}
+	if config.SliceStrategy != "" {
+		chunkSizeStr += "_" + config.SliceStrategy
+	}
+	if config.SharedPool {
+		chunkSizeStr += "_shared"
+	}
+	if config.AutoSubThreads {
+		chunkSizeStr += "_auto"
+	}
+	chunkSizeStr += phaseThreadsSuffix(config, phases)
 
-	writeStr := fmt.Sprintf("{\"mode\": \"%s_%d%s\", \"threads\": %d, \"timeElapsed\": %f, \"timeParallel\": %f , \"datadir\": \"%s\"}\n", 
-				config.Mode, config.SubThreadCount, chunkSizeStr ,nThreads, elapsedTime.Seconds(), totalParallelTime.Seconds(), config.DataDirs)
-	
-	// write results to file
-	utils.WriteToFile(resultsPath, writeStr)
+	return Result{Mode: fmt.Sprintf("%s_%d%s", config.Mode, config.SubThreadCount, chunkSizeStr), Threads: nThreads,
+		TimeElapsed: elapsedTime.Seconds(), TimeParallel: totalParallelTime.Seconds(), DataDir: config.DataDirs,
+		PhaseTimes: phaseTimesResult(config, phaseTimes)}, nil
 	
 }
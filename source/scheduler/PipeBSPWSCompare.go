@@ -3,9 +3,9 @@ package scheduler
 import (
 	"fmt"
 	ws "proj3/WorkStealing"
-	"proj3/utils"
 	"time"
 	c "proj3/constants"
+	"proj3/utils"
 )
 
 // THIS VERSION IS FOR TESTING PURPOSES ONLY.
@@ -54,7 +54,7 @@ func RunP3(input <-chan ws.Runnable, worker *PipeWorker) {
 //==============================================================================
 // Pipeline BSP with work stealing refinement execution
 //==============================================================================
-func RunPipeBSPWSCompare(config Config){
+func RunPipeBSPWSCompare(config Config) (Result, error) {
 	//start timer
 	startTime := time.Now()
 
@@ -63,13 +63,20 @@ func RunPipeBSPWSCompare(config Config){
 	//--------------------------------------------------------------------------
 	
 	// create a list of tasks based off of the data directories
-	tasks := utils.CreateTasks(config.DataDirs)
+	tasks, err := createTasks(config)
+	if err != nil {
+		return Result{}, err
+	}
 
 	// compute number of threads to use in work stealing
 	nThreads := config.ThreadCount
 	if nThreads > len(tasks.Tasks){
 		nThreads = len(tasks.Tasks)
 	}
+	// obs: at least one worker per phase; otherwise no worker would retrieve the tasks (see `AssignTasks`)
+	if nThreads < 1 {
+		nThreads = 1
+	}
 
 	// nSubThreads := config.SubThreadCount
 
@@ -92,6 +99,11 @@ func RunPipeBSPWSCompare(config Config){
 		chunks = []int{0, len(tasks.Tasks)}
 	}
 
+	// aggregate time of each pipeline phase over all chunks
+	var phaseTimes []time.Duration
+	// tasks waiting in each phase, sampled over all chunks (if enabled)
+	backlogs := newPhaseBacklogs(config, c.PipePhases)
+
 	// run the whole pipeline for each chunk of tasks
 	for i := 0; i < len(chunks)-1; i++ {
 		start := chunks[i]
@@ -99,44 +111,51 @@ func RunPipeBSPWSCompare(config Config){
 		taskSubset := tasks.Tasks[start:end]
 
 		// create a PipeContext for the pipeline
-		pipeCtx := NewPipeContext(&config, c.PipePhases, len(taskSubset))
+		pipeCtx := NewPipeContext(&config, c.PipePhases, len(taskSubset), utils.CountOutputs(taskSubset))
 		
 		// create groups of pipe workers for each phase and divide tasks among them
 		// eg: if numThreads = 4, will create 4 PipeWorkers for each phase with 1/4 of the tasks each.
 		pipeWorkers := make([][]*PipeWorker, c.PipePhases)
+		// obs: the phases after the first one have a task for each output of the images
+		nOutputs := utils.CountOutputs(taskSubset)
 		for i := range pipeWorkers {
-			pipeWorkers[i] = PrepareWorkers(nThreads, len(taskSubset))
+			nTasks := len(taskSubset)
+			if i > 0 {
+				nTasks = nOutputs
+			}
+			// obs: no stealing in this mode; the policy is irrelevant
+			pipeWorkers[i] = PrepareWorkers(nThreads, nTasks, config.RoundRobin, ws.StealOne)
 		}
+		// Add Phase1 tasks to the DEqueues of phase 1 workers; the next phases retrieve theirs from the channels
+		AssignPhase1Tasks(pipeCtx, pipeWorkers[0], taskSubset)
+		assignPhaseTasks(pipeCtx, pipeWorkers)
+		pipeCtx.phaseWorkers = pipeWorkers
+		stopSampling := backlogs.sample(pipeCtx)
 
 		// Start routines for each phase, each listening on the output channel of the previous phase
 		for i := 0; i < nThreads; i++ {
 			go RunPhase1(pipeCtx.channels[0], pipeWorkers[0][i])
 			go RunPhase2(pipeCtx.channels[1], pipeWorkers[1][i])
-			go RunPhase3(pipeCtx.channels[2], pipeWorkers[2][i])
+			if config.Writers == 0 {
+				go RunPhase3(pipeCtx.channels[2], pipeWorkers[2][i])
+			}
 	  	}
-		// Send Phase1 tasks over the channel
-		for i := range taskSubset {
-			pipeCtx.channels[0] <- NewTaskPhase1(pipeCtx, &taskSubset[i], 0)
-		}
+		// obs: with writers, phase 3 workers are not started; the writers save the images instead
+		startWriters(pipeCtx)
 		// close channel to signal end of tasks
+		// obs: Phase1 tasks were added to the workers' DEqueues; none is sent over the channel
 		close(pipeCtx.channels[0]) 
 
 
-		// Loop: for all pipeline phases:
-		// - Wait for all tasks of a pipeline stage to finish
-		// - Close the respective channels when they are finished 
-		// - Signal workers to stop execution/stealing when phase is finished
-		// This prevents goroutine leaks and wait for the full pipeline execution
-		for i, wg := range pipeCtx.wgs {
-			wg.Wait()
-			if i < len(pipeCtx.wgs)-1 {
-				// Phase 1 finished -> close channel receiving Phase 2 tasks
-				close(pipeCtx.channels[i+1])
-				// Phase 1 finished -> signal workers to stop execution/stealing
-				close(pipeWorkers[i][0].done)
-			}
+		// wait for all phases to finish, closing their channels and stopping their workers
+		err := waitPhases(pipeCtx, pipeWorkers)
+		stopSampling()
+		if err != nil {
+			return Result{}, err
 		}
+		phaseTimes = pipeCtx.AddPhaseTimes(phaseTimes)
 	}
+	backlogs.print()
 	
 	//--------------------------------------------------------------------------
 	// Save results
@@ -157,10 +176,8 @@ func RunPipeBSPWSCompare(config Config){
 		chunkSizeStr = fmt.Sprintf("_%d", config.ChunkSize)
 	}
 
-	writeStr := fmt.Sprintf("{\"mode\": \"%s_%d%s\", \"threads\": %d, \"timeElapsed\": %f, \"timeParallel\": %f , \"datadir\": \"%s\"}\n", 
-				config.Mode, config.SubThreadCount, chunkSizeStr ,nThreads, elapsedTime.Seconds(), totalParallelTime.Seconds(), config.DataDirs)
-	
-	// write results to file
-	utils.WriteToFile(resultsPath, writeStr)
+	return Result{Mode: fmt.Sprintf("%s_%d%s", config.Mode, config.SubThreadCount, chunkSizeStr), Threads: nThreads,
+		TimeElapsed: elapsedTime.Seconds(), TimeParallel: totalParallelTime.Seconds(), DataDir: config.DataDirs,
+		PhaseTimes: phaseTimesResult(config, phaseTimes)}, nil
 	
 }
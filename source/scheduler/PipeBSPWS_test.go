@@ -0,0 +1,276 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	ws "proj3/WorkStealing"
+	cons "proj3/constants"
+	"proj3/utils"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// goroutinesBack waits up to a second for the number of goroutines to be back to 'before'; returns the last count
+func goroutinesBack(before int) int {
+	deadline := time.Now().Add(time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= before || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAssignTasks(t *testing.T) {
+	tests := []struct {
+		numTasks, nWorkers int
+		block, roundRobin  [][]int
+	}{
+		{10, 4, [][]int{{0, 1}, {2, 3}, {4, 5}, {6, 7, 8, 9}}, [][]int{{0, 4, 8}, {1, 5, 9}, {2, 6}, {3, 7}}},
+		{6, 3, [][]int{{0, 1}, {2, 3}, {4, 5}}, [][]int{{0, 3}, {1, 4}, {2, 5}}},
+		{2, 3, [][]int{nil, nil, {0, 1}}, [][]int{{0}, {1}, nil}},
+		{3, 1, [][]int{{0, 1, 2}}, [][]int{{0, 1, 2}}},
+		{5, 0, nil, nil},
+	}
+	for _, test := range tests {
+		if got := AssignTasks(test.numTasks, test.nWorkers, false); !reflect.DeepEqual(got, test.block) {
+			t.Errorf("%d tasks, %d workers in blocks: got %v, want %v", test.numTasks, test.nWorkers, got, test.block)
+		}
+		if got := AssignTasks(test.numTasks, test.nWorkers, true); !reflect.DeepEqual(got, test.roundRobin) {
+			t.Errorf("%d tasks, %d workers round robin: got %v, want %v", test.numTasks, test.nWorkers, got, test.roundRobin)
+		}
+	}
+}
+
+// TestPhase1Order checks the order the phase 1 tasks of a worker are executed by it (from the bottom of its
+// DEqueue) and stolen by the others (from the top), by default and with `Config.LIFO`.
+func TestPhase1Order(t *testing.T) {
+	tasks := []utils.Task{{InPath: "IMG_0"}, {InPath: "IMG_1"}, {InPath: "IMG_2"}, {InPath: "IMG_3"}, {InPath: "IMG_4"}}
+	tests := []struct {
+		lifo  bool
+		owner []string // order executed by the owner; thieves steal in reverse
+	}{
+		{false, []string{"IMG_0", "IMG_2", "IMG_4"}},
+		{true, []string{"IMG_4", "IMG_2", "IMG_0"}},
+	}
+	for _, test := range tests {
+		queue := ws.NewUDEqueue(2)
+		worker := ws.NewWorker(0, []*ws.UDEqueue{queue})
+		addPhase1Tasks(&PipeContext{config: &Config{LIFO: test.lifo}}, worker, []int{0, 2, 4}, tasks)
+		var stolen []string
+		for task := queue.PopTop(); task != nil; task = queue.PopTop() {
+			stolen = append(stolen, task.(*TaskPhase1).baseTask.InPath)
+		}
+		owner := make([]string, len(stolen))
+		for i, path := range stolen {
+			owner[len(stolen)-1-i] = path
+		}
+		if !reflect.DeepEqual(owner, test.owner) {
+			t.Errorf("LIFO %v: the owner executes %v, want %v", test.lifo, owner, test.owner)
+		}
+	}
+}
+
+// sendTask is a phase 1 task sending 'n' tasks to phase 2, each counting itself in 'executed' when done
+type sendTask struct {
+	pipeCtx  *PipeContext
+	n        int
+	executed *atomic.Int64
+}
+
+func (st *sendTask) Execute(wID int) {
+	for i := 0; i < st.n; i++ {
+		st.pipeCtx.send(wID, 1, &stageTask{done: func() {
+			st.executed.Add(1)
+			st.pipeCtx.wgs[1].Done()
+		}})
+	}
+	st.pipeCtx.wgs[0].Done()
+}
+
+func (st *sendTask) GetTaskID() int { return 0 }
+
+// runSendPipeline runs a two phase pipeline with 'nWorkers' workers per phase, in blocks for phase 1 and round robin
+// for phase 2, and 'nTasks' tasks per phase; phase 1 task i sends 'sends(i)' tasks to phase 2.
+// Returns the phase 2 tasks executed and the error of `waitPhases`; fails if the pipeline doesn't finish.
+func runSendPipeline(t *testing.T, nTasks, nWorkers int, sends func(i int) int) (int, error) {
+	t.Helper()
+	pipeCtx := NewPipeContext(&Config{}, 2, nTasks, nTasks)
+	pipeWorkers := [][]*PipeWorker{PrepareWorkers(nWorkers, nTasks, false, ""), PrepareWorkers(nWorkers, nTasks, true, "")}
+	var executed atomic.Int64
+	for _, worker := range pipeWorkers[0] {
+		for _, i := range worker.taskIndexes {
+			worker.worker.AddTask(&sendTask{pipeCtx: pipeCtx, n: sends(i), executed: &executed})
+		}
+	}
+	assignPhaseTasks(pipeCtx, pipeWorkers)
+	for i := range pipeWorkers[0] {
+		go RunPhase1(pipeCtx.channels[0], pipeWorkers[0][i])
+		go RunPhase2(pipeCtx.channels[1], pipeWorkers[1][i])
+	}
+	close(pipeCtx.channels[0])
+
+	waited := make(chan error, 1)
+	go func() { waited <- waitPhases(pipeCtx, pipeWorkers) }()
+	select {
+	case err := <-waited:
+		return int(executed.Load()), err
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%d tasks, %d workers: the pipeline did not finish", nTasks, nWorkers)
+		return 0, nil
+	}
+}
+
+func TestPhaseTaskCounts(t *testing.T) {
+	// task counts not divisible by the worker counts, and fewer tasks than workers: all tasks sent are executed
+	for nTasks := 0; nTasks <= 13; nTasks++ {
+		for nWorkers := 1; nWorkers <= 5; nWorkers++ {
+			executed, err := runSendPipeline(t, nTasks, nWorkers, func(int) int { return 1 })
+			if err != nil || executed != nTasks {
+				t.Errorf("%d tasks, %d workers: %d executed, error %v", nTasks, nWorkers, executed, err)
+			}
+		}
+	}
+}
+
+// a phase 1 task sending no task or two tasks to phase 2, i.e., tasks sent not matching those assigned to the
+// phase 2 workers, is reported instead of leaving the workers waiting or the tasks in the channel
+func TestPhaseTaskCountsMismatch(t *testing.T) {
+	tests := []struct {
+		sent     int // tasks sent by the phase 1 task 3, out of 10
+		executed int
+	}{
+		{0, 9},
+		{2, 10},
+	}
+	for _, test := range tests {
+		before := runtime.NumGoroutine()
+		executed, err := runSendPipeline(t, 10, 4, func(i int) int {
+			if i == 3 {
+				return test.sent
+			}
+			return 1
+		})
+		if !errors.Is(err, ErrTaskAssignment) {
+			t.Errorf("task sending %d tasks: got %v, want %v", test.sent, err, ErrTaskAssignment)
+		}
+		if executed != test.executed {
+			t.Errorf("task sending %d tasks: %d tasks executed, want %d", test.sent, executed, test.executed)
+		}
+		if after := goroutinesBack(before); after > before {
+			t.Errorf("task sending %d tasks: %d goroutines after the pipeline, %d before", test.sent, after, before)
+		}
+	}
+}
+
+// multiple outputs per image and images failing to load send as many tasks as the phases after the first one have
+func TestPipeBSPWSTaskCounts(t *testing.T) {
+	outDir := useTestImages(t, 5, nil)
+	var lines []string
+	for i := 0; i < 5; i++ {
+		line, _ := json.Marshal(map[string]interface{}{"inPath": fmt.Sprintf("IMG_%d.png", i), "outputs": []map[string]interface{}{
+			{"outPath": fmt.Sprintf("IMG_%d_blur.png", i), "effects": []string{"B"}},
+			{"outPath": fmt.Sprintf("IMG_%d_sharp.png", i), "effects": []string{"S"}},
+		}})
+		lines = append(lines, string(line))
+	}
+	if err := os.WriteFile(cons.EffectsPathFile, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(cons.InDir, "small", "IMG_2.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, config := range []Config{
+		{Mode: "pipebspws", ThreadCount: 3},
+		{Mode: "pipebspws", ThreadCount: 4, ChunkSize: 3, RoundRobin: true},
+		{Mode: "pipebspws", ThreadCount: 3, Writers: 2},
+		{Mode: "pipebspwscompare", ThreadCount: 3},
+	} {
+		config.DataDirs = "small"
+		if _, err := run(config); err != nil {
+			t.Errorf("%+v: %v", config, err)
+		}
+		// the 4 images loaded have both outputs saved
+		if entries, _ := os.ReadDir(outDir); len(entries) != 8 {
+			t.Errorf("%+v: %d outputs saved, want 8", config, len(entries))
+		}
+	}
+}
+
+func TestPipeBSPWSStopsWorkers(t *testing.T) {
+	outDir := useTestImages(t, 8, []string{"B"})
+	configs := []Config{
+		{Mode: "pipebspws", ThreadCount: 4},
+		{Mode: "pipebspws", ThreadCount: 3, ChunkSize: 3},
+		{Mode: "pipebspws", ThreadCount: 4, Writers: 2},
+		{Mode: "pipebspws", ThreadCount: 4, SharedPool: true},
+		{Mode: "pipebspwscompare", ThreadCount: 3},
+	}
+	for _, config := range configs {
+		config.DataDirs = "small"
+		before := runtime.NumGoroutine()
+		if _, err := run(config); err != nil {
+			t.Fatalf("%+v: %v", config, err)
+		}
+		// the workers of all phases return with the run, also those left stealing once their phase is done
+		if after := goroutinesBack(before); after > before {
+			t.Errorf("%s with %d threads: %d goroutines after the run, %d before", config.Mode, config.ThreadCount, after, before)
+		}
+	}
+	if entries, _ := os.ReadDir(outDir); len(entries) != 8 {
+		t.Errorf("%d images written, want 8", len(entries))
+	}
+}
+
+// TestSharedPoolConcurrency samples the goroutines during shared pool runs: above those before the run,
+// there are never more than the bound of `pipeConcurrency`.
+func TestSharedPoolConcurrency(t *testing.T) {
+	useTestImages(t, 16, []string{"B", "S", "E"})
+	for _, config := range []Config{
+		{ThreadCount: 4},
+		{ThreadCount: 4, SubThreadCount: 3},
+		{ThreadCount: 3, Writers: 2},
+	} {
+		config.Mode, config.DataDirs, config.SharedPool = "pipebspws", "small", true
+		before := runtime.NumGoroutine()
+		var peak atomic.Int64
+		stop := make(chan struct{})
+		sampled := make(chan struct{})
+		go func() {
+			defer close(sampled)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// obs: minus the sampler itself
+				if n := int64(runtime.NumGoroutine() - 1); n > peak.Load() {
+					peak.Store(n)
+				}
+				runtime.Gosched()
+			}
+		}()
+		_, err := run(config)
+		close(stop)
+		<-sampled
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bound := pipeConcurrency(config, config.ThreadCount, phaseThreads(config, config.ThreadCount, 16))
+		if extra := int(peak.Load()) - before; extra > bound {
+			t.Errorf("%d threads, %d sub-threads, %d writers: up to %d goroutines above the %d before the run, bound %d",
+				config.ThreadCount, config.SubThreadCount, config.Writers, extra, before, bound)
+		}
+	}
+}
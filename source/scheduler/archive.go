@@ -0,0 +1,167 @@
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"proj3/png"
+	cons "proj3/constants"
+	"proj3/utils"
+	"sync"
+	"time"
+)
+
+// Pick tasks from 'taskQueue' and apply effects to the images read from 'archive'.
+// Outputs are written to 'outArchive' if not nil, or to the path of the task otherwise.
+// The first error of all workers is sent to 'errs'; failed tasks are skipped.
+func ExecuteArchiveTask(taskQueue *utils.TaskQueue, archive *utils.Archive, outArchive *utils.ArchiveWriter,
+	config *Config, errs chan<- error, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	// obs: 'errs' holds one error; later ones are dropped
+	fail := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	for task := taskQueue.Dequeue(); task != nil; task = taskQueue.Dequeue() {
+		taskStart := time.Now()
+		img, err := loadArchiveImage(task, archive)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		forEachBranch(task, img, func(task *utils.Task, img *png.Image) {
+			if err := processArchiveTask(task, img, outArchive); err != nil {
+				fail(err)
+				return
+			}
+			config.taskDone(task, img, taskStart)
+		})
+	}
+}
+
+// loadArchiveImage reads the image of 'task' from 'archive' and, if the task has a mask, restricts its effects to the mask.
+func loadArchiveImage(task *utils.Task, archive *utils.Archive) (*png.Image, error) {
+	reader, err := archive.Open(task.InPath)
+	if err != nil {
+		return nil, err
+	}
+	img, err := png.LoadReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", task.InPath, err)
+	}
+	// obs: the mask is also read from the archive
+	if task.Mask != "" {
+		maskReader, err := archive.Open(task.Mask)
+		if err != nil {
+			return nil, err
+		}
+		mask, err := png.LoadMaskReader(maskReader)
+		if err != nil {
+			return nil, fmt.Errorf("decoding mask %s: %w", task.Mask, err)
+		}
+		if err := img.SetMask(mask); err != nil {
+			return nil, fmt.Errorf("mask %s: %w", task.Mask, err)
+		}
+	}
+	return img, nil
+}
+
+// processArchiveTask applies the effects of 'task' to 'img' and writes the output.
+func processArchiveTask(task *utils.Task, img *png.Image, outArchive *utils.ArchiveWriter) error {
+	img.ApplyEffects(png.CreateKernels(task.Effects))
+
+	if outArchive == nil {
+		return img.Save(task.OutPath)
+	}
+	var buf bytes.Buffer
+	if err := img.SaveWriter(&buf, "png"); err != nil {
+		return err
+	}
+	return outArchive.Add(task.OutPath, buf.Bytes())
+}
+
+// Process the images of the archive at 'config.DataDirs' (.zip, .tar.gz or .tar) as given by 'effects.txt',
+// deploying 'config.ThreadCount' goroutines to apply effects to each image in parallel, as in `RunParallelFiles`.
+// Images are read from the archive in memory, without unpacking it to disk.
+// Outputs are written to the archive 'config.OutArchive' if given, or to the output directory otherwise
+// with the archive name as prefix (e.g. small.zip => data/out/small_IMG_2029_Out.png).
+// Obs: resuming from a checkpoint is not supported; all images of the archive are processed.
+func RunArchive(config Config) (Result, error) {
+	// start timer for total elapsed time
+	startTime := time.Now()
+
+	archive, err := utils.ReadArchive(config.DataDirs)
+	if err != nil {
+		return Result{}, err
+	}
+	archiveName := utils.ArchiveName(config.DataDirs)
+	taskQueue, err := utils.CreateArchiveTasks(archiveName, config.DirEffects)
+	if err != nil {
+		return Result{}, err
+	}
+	if len(taskQueue.Tasks) == 0 {
+		return Result{}, ErrNoTasks
+	}
+
+	// output to the archive or to files named as those of a data directory (see `utils.CreateTasks`)
+	if config.OutArchive == "" {
+		for i := range taskQueue.Tasks {
+			taskQueue.Tasks[i].OutPath = cons.OutDir + "/" + archiveName + "_" + taskQueue.Tasks[i].OutPath
+			for j := range taskQueue.Tasks[i].Outputs {
+				taskQueue.Tasks[i].Outputs[j].OutPath = cons.OutDir + "/" + archiveName + "_" + taskQueue.Tasks[i].Outputs[j].OutPath
+			}
+		}
+	}
+	if config.ContentHash {
+		utils.AddContentHashes(taskQueue.Tasks, archive.Open)
+	}
+	if err := checkCollisions(taskQueue.Tasks); err != nil {
+		return Result{}, err
+	}
+	var outArchive *utils.ArchiveWriter
+	if config.OutArchive != "" {
+		if outArchive, err = utils.NewArchiveWriter(config.OutArchive); err != nil {
+			return Result{}, err
+		}
+	}
+
+	// compute number of threads to use; if more threads than tasks, use number of tasks
+	nThreads := config.ThreadCount
+	if nThreads > len(taskQueue.Tasks) {
+		nThreads = len(taskQueue.Tasks)
+	}
+	if nThreads < 1 {
+		nThreads = 1
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 1)
+
+	// start timer for parallel tasks
+	parallelTime := time.Now()
+	for i := 0; i < nThreads; i++ {
+		wg.Add(1)
+		go ExecuteArchiveTask(taskQueue, archive, outArchive, &config, errs, &wg)
+	}
+	wg.Wait()
+	totalParallelTime := time.Since(parallelTime)
+
+	if outArchive != nil {
+		if err := outArchive.Close(); err != nil {
+			return Result{}, err
+		}
+	}
+	select {
+	case err := <-errs:
+		return Result{}, err
+	default:
+	}
+
+	// compute total elapsed time
+	elapsedTime := time.Since(startTime)
+
+	return Result{Mode: config.Mode, Threads: nThreads, TimeElapsed: elapsedTime.Seconds(),
+		TimeParallel: totalParallelTime.Seconds(), DataDir: config.DataDirs}, nil
+}
@@ -0,0 +1,92 @@
+package scheduler
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	cons "proj3/constants"
+	"proj3/utils"
+	"testing"
+)
+
+// zipImages writes the images 'names' of the data directory "small" to the zip 'zipPath', in the folder "imgs"
+func zipImages(t *testing.T, zipPath string, names []string) {
+	t.Helper()
+	file, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zipWriter := zip.NewWriter(file)
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(cons.InDir, "small", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer, err := zipWriter.Create("imgs/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveZip(t *testing.T) {
+	outDir := useTestImages(t, 2, []string{"B", "G"})
+	// reference: the same images processed from the data directory
+	if _, err := run(Config{DataDirs: "small", Mode: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	zipPath := filepath.Join(t.TempDir(), "imgs.zip")
+	zipImages(t, zipPath, []string{"IMG_0.png", "IMG_1.png"})
+
+	// outputs to the output directory, with the archive name as prefix
+	result, err := run(Config{DataDirs: zipPath, Mode: "archive", ThreadCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Mode != "archive" {
+		t.Errorf("result of mode %q", result.Mode)
+	}
+	for _, name := range []string{"IMG_0_Out.png", "IMG_1_Out.png"} {
+		want, err := os.ReadFile(filepath.Join(outDir, "small_"+name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(outDir, "imgs_"+name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s of the zip differs from the one of the data directory", name)
+		}
+	}
+
+	// outputs to another zip
+	outZip := filepath.Join(t.TempDir(), "out.zip")
+	if _, err := run(Config{DataDirs: zipPath, Mode: "archive", ThreadCount: 2, OutArchive: outZip}); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := utils.ReadArchive(outZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"IMG_0_Out.png", "IMG_1_Out.png"} {
+		reader, err := archive.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(reader)
+		want, _ := os.ReadFile(filepath.Join(outDir, "small_"+name))
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s of the output zip differs from the one of the data directory", name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package scheduler
+
+import (
+	"fmt"
+	"proj3/constants"
+	"proj3/png"
+	"proj3/utils"
+	"runtime"
+	"time"
+)
+
+// Autotuning of the sub-threads of the pipeline (see `Config.AutoSubThreads`).
+// The best number of sub-threads depends on the size of the images and on the machine, so instead of
+// guessing it, the first images of the run are processed with each candidate count and the fastest one
+// (per pixel and effect, so images of different sizes compare) is used for the rest of the images.
+
+// subThreadCandidates returns the sub-thread counts explored by the autotuner: powers of 2 up to 'max', plus 'max'.
+// eg: 6 -> [1 2 4 6]; 8 -> [1 2 4 8]
+func subThreadCandidates(max int) []int {
+	candidates := []int{}
+	for n := 1; n < max; n *= 2 {
+		candidates = append(candidates, n)
+	}
+	return append(candidates, max)
+}
+
+// bestSubThreads returns the candidate with the lowest cost given by 'measure'; ties go to the fewest sub-threads.
+// 'measure' returns false if it could not measure a candidate (eg: no images left), which ends the exploration;
+// the best of the candidates measured so far is returned, or the first candidate if none was.
+func bestSubThreads(candidates []int, measure func(subThreads int) (float64, bool)) int {
+	best, bestCost := candidates[0], 0.0
+	for i, candidate := range candidates {
+		cost, ok := measure(candidate)
+		if !ok {
+			break
+		}
+		if i == 0 || cost < bestCost {
+			best, bestCost = candidate, cost
+		}
+	}
+	return best
+}
+
+// tuneSubThreads processes the first images of 'tasks', one with each candidate number of sub-threads
+// (up to `Config.SubThreadCount` if greater than 1, or `GOMAXPROCS` otherwise; see `subThreadCandidates`),
+// and returns the count with the lowest time per pixel and effect, with the tasks not processed yet.
+// Images are processed in this goroutine, one at a time, so the measurements don't interfere with each other.
+// Their outputs are saved as in the pipeline; images that can't be loaded are skipped.
+// Obs: each candidate is measured on a single image, the first one also with cold caches, so the measurements are noisy:
+// the count picked is a rough guess, more reliable with large images and candidates far apart in cost.
+func tuneSubThreads(config *Config, tasks []utils.Task) (int, []utils.Task) {
+	max := config.SubThreadCount
+	if max <= 1 {
+		max = runtime.GOMAXPROCS(0)
+	}
+	best := bestSubThreads(subThreadCandidates(max), func(subThreads int) (float64, bool) {
+		for len(tasks) > 0 {
+			task := &tasks[0]
+			tasks = tasks[1:]
+			taskStart := time.Now()
+			img, err := loadImage(task)
+			if err != nil {
+				fmt.Printf("Error loading image %s: %v\n", task.InPath, err)
+				continue
+			}
+			// obs: all outputs of the image are measured together
+			var elapsed time.Duration
+			work := 0
+			forEachBranch(task, img, func(task *utils.Task, img *png.Image) {
+				kernels := config.createKernels(task.Effects)
+
+				start := time.Now()
+				if n := effectiveSubThreads(img, subThreads, constants.MinRowsPerSlice); n > 1 {
+					applySlices(img, kernels, n, BarrierCond, config.SliceStrategy, nil)
+				} else {
+					applyOneThread(img, kernels, nil)
+				}
+				elapsed += time.Since(start)
+
+				config.saveTask(task, img, taskStart)
+				work += img.Bounds.Dx() * img.Bounds.Dy() * len(kernels)
+			})
+			if work == 0 {
+				work = 1
+			}
+			return float64(elapsed) / float64(work), true
+		}
+		return 0, false
+	})
+	return best, tasks
+}
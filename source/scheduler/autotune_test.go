@@ -0,0 +1,46 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubThreadCandidates(t *testing.T) {
+	for max, want := range map[int][]int{1: {1}, 2: {1, 2}, 6: {1, 2, 4, 6}, 8: {1, 2, 4, 8}} {
+		if got := subThreadCandidates(max); !reflect.DeepEqual(got, want) {
+			t.Errorf("max %d: got %v, want %v", max, got, want)
+		}
+	}
+}
+
+func TestBestSubThreads(t *testing.T) {
+	candidates := []int{1, 2, 4, 8}
+	tests := []struct {
+		name     string
+		costs    map[int]float64 // cost of each candidate; candidates without a cost can't be measured
+		want     int
+		measured []int
+	}{
+		{"minimum in the middle", map[int]float64{1: 8, 2: 4, 4: 3, 8: 5}, 4, []int{1, 2, 4, 8}},
+		{"minimum at the end", map[int]float64{1: 8, 2: 4, 4: 2, 8: 1}, 8, []int{1, 2, 4, 8}},
+		{"one thread is best", map[int]float64{1: 1, 2: 2, 4: 3, 8: 4}, 1, []int{1, 2, 4, 8}},
+		{"tie goes to fewer", map[int]float64{1: 5, 2: 3, 4: 3, 8: 3}, 2, []int{1, 2, 4, 8}},
+		{"early stop keeps the best measured", map[int]float64{1: 5, 2: 3}, 2, []int{1, 2, 4}},
+		{"nothing measured", map[int]float64{}, 1, []int{1}},
+	}
+	for _, test := range tests {
+		var measured []int
+		got := bestSubThreads(candidates, func(subThreads int) (float64, bool) {
+			measured = append(measured, subThreads)
+			cost, ok := test.costs[subThreads]
+			return cost, ok
+		})
+		if got != test.want {
+			t.Errorf("%s: got %d sub-threads, want %d", test.name, got, test.want)
+		}
+		// the exploration ends at the first candidate that can't be measured
+		if !reflect.DeepEqual(measured, test.measured) {
+			t.Errorf("%s: measured %v, want %v", test.name, measured, test.measured)
+		}
+	}
+}
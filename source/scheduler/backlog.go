@@ -0,0 +1,96 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Backlog of the pipeline phases: the tasks sent to a phase that none of its workers started yet.
+// A phase whose backlog stays high is the bottleneck of the pipeline; eg: if the backlog of phase 2 keeps growing
+// while the one of phase 3 stays near 0, images are loaded faster than the effects are applied to them.
+
+// backlogPhases names the pipeline phases in the backlog summary (see `phaseBacklogs.print`)
+var backlogPhases = []string{"load", "process", "save"}
+
+// phaseBacklogs accumulates samples of the backlog of each pipeline phase over all the chunks of a run.
+// Obs: all methods are no-ops on a nil *phaseBacklogs, so the pipelines need not check whether sampling is enabled.
+type phaseBacklogs struct {
+	interval time.Duration
+	max      []int
+	sum      []int
+	samples  int
+}
+
+// newPhaseBacklogs returns the backlogs of 'nPhases' phases sampled every `Config.BacklogInterval`, or nil if not set.
+func newPhaseBacklogs(config Config, nPhases int) *phaseBacklogs {
+	if config.BacklogInterval <= 0 {
+		return nil
+	}
+	return &phaseBacklogs{interval: config.BacklogInterval, max: make([]int, nPhases), sum: make([]int, nPhases)}
+}
+
+// sample samples the backlog of each phase of 'p' every interval, in a new goroutine, until the returned function
+// is called; it returns once the sampling stopped, so the samples can be read afterwards.
+func (b *phaseBacklogs) sample(p *PipeContext) (stop func()) {
+	if b == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				b.samples++
+				for phase := range b.max {
+					backlog := p.backlog(phase)
+					b.sum[phase] += backlog
+					if backlog > b.max[phase] {
+						b.max[phase] = backlog
+					}
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// print prints the maximum and average backlog of each phase. eg:
+// "Backlog (max/avg tasks waiting, 120 samples every 10ms): load 0/0.0, process 9/6.3, save 1/0.2"
+func (b *phaseBacklogs) print() {
+	if b == nil {
+		return
+	}
+	phases := make([]string, len(b.max))
+	for phase := range b.max {
+		avg := 0.0
+		if b.samples > 0 {
+			avg = float64(b.sum[phase]) / float64(b.samples)
+		}
+		phases[phase] = fmt.Sprintf("%s %d/%.1f", backlogPhases[phase], b.max[phase], avg)
+	}
+	fmt.Printf("Backlog (max/avg tasks waiting, %d samples every %v): %s\n", b.samples, b.interval, strings.Join(phases, ", "))
+}
+
+// backlog returns the number of tasks of 'phase' not started yet: those in its channel and, with separate pools of
+// work stealing workers, those in the DEqueues of its workers, which take them from the channel as they arrive
+// (see `retrieveTasks`).
+// Obs: with a shared pool, the DEqueues hold tasks of all phases, so only the channel is counted.
+func (p *PipeContext) backlog(phase int) int {
+	backlog := len(p.channels[phase])
+	if phase < len(p.phaseWorkers) {
+		for _, worker := range p.phaseWorkers[phase] {
+			backlog += worker.worker.QueueSize()
+		}
+	}
+	return backlog
+}
@@ -0,0 +1,65 @@
+package scheduler
+
+import (
+	ws "proj3/WorkStealing"
+	"testing"
+	"time"
+)
+
+// stageTask is a task of a pipeline phase that takes 'delay' and sends the task of the next phase, if any
+type stageTask struct {
+	delay time.Duration
+	next  ws.Runnable
+	out   chan<- ws.Runnable
+	done  func()
+}
+
+func (st *stageTask) Execute(wID int) {
+	time.Sleep(st.delay)
+	if st.next != nil {
+		st.out <- st.next
+	}
+	st.done()
+}
+
+func (st *stageTask) GetTaskID() int { return 0 }
+
+// a slow process phase between fast load and save phases has the largest backlog
+func TestBacklogOfSlowPhase(t *testing.T) {
+	const n = 30
+	config := Config{BacklogInterval: time.Millisecond}
+	backlogs := newPhaseBacklogs(config, 3)
+	pipeCtx := NewPipeContext(&config, 3, n, n)
+	stop := backlogs.sample(pipeCtx)
+
+	// 4 workers load and save, only 1 processes, and each process task takes 2ms
+	for i := 0; i < 4; i++ {
+		go Run1(pipeCtx.channels[0])
+		go Run3(pipeCtx.channels[2])
+	}
+	go Run2(pipeCtx.channels[1])
+	for i := 0; i < n; i++ {
+		save := &stageTask{done: pipeCtx.wgs[2].Done}
+		process := &stageTask{delay: 2 * time.Millisecond, next: save, out: pipeCtx.channels[2], done: pipeCtx.wgs[1].Done}
+		pipeCtx.channels[0] <- &stageTask{next: process, out: pipeCtx.channels[1], done: pipeCtx.wgs[0].Done}
+	}
+	close(pipeCtx.channels[0])
+	for i, wg := range pipeCtx.wgs {
+		wg.Wait()
+		if i < len(pipeCtx.wgs)-1 {
+			close(pipeCtx.channels[i+1])
+		}
+	}
+	stop()
+
+	if backlogs.samples == 0 {
+		t.Fatal("no samples were taken")
+	}
+	// the loads are done well before the first process tasks are: most images wait to be processed
+	if backlogs.max[1] < n/2 {
+		t.Errorf("max backlog of the process phase %d, want at least %d of %d tasks", backlogs.max[1], n/2, n)
+	}
+	if backlogs.sum[1] <= backlogs.sum[0] || backlogs.sum[1] <= backlogs.sum[2] {
+		t.Errorf("backlogs (max %v, sum %v) don't point to the process phase", backlogs.max, backlogs.sum)
+	}
+}
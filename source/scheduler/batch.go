@@ -0,0 +1,242 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"proj3/constants"
+	"proj3/mysync"
+	"proj3/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Batch mode: long runs that can be stopped and resumed. Workers process images as in parfiles until all are done
+// or `Config.Context` is cancelled (eg: Ctrl+C); then the images in progress are finished, but no new ones started.
+// The outputs completed are snapshotted periodically to the state file of the batch, and once more when it stops,
+// so a batch started again with the same state file skips them. eg: editor small batch state.json 4
+
+// batchSnapshot is the content of the state file of a batch
+// @Done: output paths completed, sorted
+// @Failed: errors of the outputs that could not be saved in the last run, by output path; retried when resuming
+// @Total: number of outputs of the batch, done or not
+type batchSnapshot struct {
+	Done   []string          `json:"done"`
+	Failed map[string]string `json:"failed,omitempty"`
+	Total  int               `json:"total"`
+}
+
+// batchState tracks the outputs completed by a batch and snapshots them to its state file.
+// @TASLock: test and set lock to synchronize workers completing images in parallel
+// @done: output paths completed, including those of previous runs of the batch
+// @failed: errors of the outputs that could not be saved in this run, by output path
+// Obs: all methods are no-ops on a nil *batchState, as in `utils.Checkpoint`, so outside the batch mode
+// `Config.taskDone` need not check it.
+type batchState struct {
+	mysync.TASLock
+	path   string
+	done   map[string]bool
+	failed map[string]string
+	total  int
+}
+
+// loadBatchState returns the state of the batch at 'path' with the outputs done in previous runs;
+// none if the file does not exist.
+func loadBatchState(path string) (*batchState, error) {
+	// obs: failures of previous runs are not loaded; their outputs are retried and fail again if the cause remains
+	state := &batchState{TASLock: mysync.NewTasLock(), path: path, done: make(map[string]bool), failed: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot batchSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("parsing batch state %s: %w", path, err)
+	}
+	for _, outPath := range snapshot.Done {
+		state.done[outPath] = true
+	}
+	return state, nil
+}
+
+// markDone records 'outPath' as completed in thread safe manner; it is written with the next snapshot.
+func (b *batchState) markDone(outPath string) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.done[outPath] = true
+	b.Unlock()
+}
+
+// markFailed records that 'outPath' could not be saved because of 'err', in thread safe manner;
+// it is written with the next snapshot.
+func (b *batchState) markFailed(outPath string, err error) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.failed[outPath] = err.Error()
+	b.Unlock()
+}
+
+// countFailed returns the number of outputs that could not be saved
+func (b *batchState) countFailed() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.failed)
+}
+
+// count returns the number of outputs completed
+func (b *batchState) count() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.done)
+}
+
+// snapshot writes the outputs completed so far to the state file.
+// obs: written to a temporary file renamed over the state file, so a crash while writing keeps the last snapshot.
+func (b *batchState) snapshot() error {
+	b.Lock()
+	snapshot := batchSnapshot{Done: make([]string, 0, len(b.done)), Total: b.total}
+	for outPath := range b.done {
+		snapshot.Done = append(snapshot.Done, outPath)
+	}
+	if len(b.failed) > 0 {
+		snapshot.Failed = make(map[string]string, len(b.failed))
+		for outPath, err := range b.failed {
+			snapshot.Failed[outPath] = err
+		}
+	}
+	b.Unlock()
+	sort.Strings(snapshot.Done)
+
+	writeBytes, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := b.path + ".tmp"
+	if err := os.WriteFile(tmpPath, writeBytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, b.path)
+}
+
+// snapshotEvery snapshots the state and prints the progress of the batch every 'interval' until 'stop' is closed.
+// Failed snapshots are reported; the next one tries again.
+func (b *batchState) snapshotEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := b.snapshot(); err != nil {
+				fmt.Println("Error writing batch state:", err)
+			}
+			fmt.Printf("Batch: %d/%d outputs done\n", b.count(), b.total)
+		}
+	}
+}
+
+// RunBatch processes the images of the run with 'config.ThreadCount' workers, skipping the outputs recorded in the
+// state file 'config.StatePath' by previous runs, and snapshots the outputs completed to it every
+// 'config.SnapshotInterval' (`constants.SnapshotInterval` if not positive).
+// If 'config.Context' is cancelled, the images in progress are finished and a last snapshot is written;
+// returns an error wrapping the error of the context, with the outputs done so far.
+func RunBatch(config Config) (Result, error) {
+	startTime := time.Now()
+	if config.StatePath == "" {
+		return Result{}, errors.New("the batch mode requires a state file")
+	}
+	ctx := config.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	interval := config.SnapshotInterval
+	if interval <= 0 {
+		interval = constants.SnapshotInterval
+	}
+
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		return Result{}, err
+	}
+	state, err := loadBatchState(config.StatePath)
+	if err != nil {
+		return Result{}, err
+	}
+	state.total = utils.CountOutputs(taskQueue.Tasks)
+	// obs: the outputs done are recorded by `taskDone`, as in the checkpoint
+	config.batch = state
+	pending := skipDone(taskQueue.Tasks, state.done)
+	if skipped := len(taskQueue.Tasks) - len(pending); skipped > 0 {
+		fmt.Printf("Batch: skipping %d images already processed\n", skipped)
+	}
+
+	nThreads := config.ThreadCount
+	if nThreads < 1 {
+		nThreads = 1
+	}
+	// feed the pending images to the workers until they are all taken or the batch is cancelled
+	tasks := make(chan *utils.Task)
+	go func() {
+		defer close(tasks)
+		for i := range pending {
+			select {
+			case tasks <- &pending[i]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// obs: the last snapshot waits for the periodic ones to return; both write the same temporary file
+	stopSnapshots, snapshotsDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(snapshotsDone)
+		state.snapshotEvery(interval, stopSnapshots)
+	}()
+
+	parallelTime := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < nThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool := config.workerPool()
+			for task := range tasks {
+				processFile(task, &config, pool)
+			}
+		}()
+	}
+	wg.Wait()
+	totalParallelTime := time.Since(parallelTime)
+	close(stopSnapshots)
+	<-snapshotsDone
+
+	// last snapshot, with the images finished after cancelling
+	if err := state.snapshot(); err != nil {
+		return Result{}, fmt.Errorf("writing batch state %s: %w", config.StatePath, err)
+	}
+	done := state.count()
+	fmt.Printf("Batch: %d/%d outputs done\n", done, state.total)
+	if failed := state.countFailed(); failed > 0 {
+		fmt.Printf("Batch: %d outputs could not be saved; see %s\n", failed, config.StatePath)
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, fmt.Errorf("batch stopped with %d/%d outputs done; run it again to resume: %w",
+			done, state.total, err)
+	}
+
+	return Result{Mode: config.Mode, Threads: config.ThreadCount, TimeElapsed: time.Since(startTime).Seconds(),
+		TimeParallel: totalParallelTime.Seconds(), DataDir: config.DataDirs}, nil
+}
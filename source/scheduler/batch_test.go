@@ -0,0 +1,160 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	cons "proj3/constants"
+	"proj3/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+// outputsIn returns the names of the files in 'dir'
+func outputsIn(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// a batch cancelled midway and run again completes every image exactly once across the two runs
+func TestBatchCancelAndResume(t *testing.T) {
+	const n = 10
+	outDir := useTestImages(t, n, []string{"B", "S", "E"})
+	// the images after the first are larger, so the batch is cancelled while they are being processed
+	for i := 1; i < n; i++ {
+		img := png.NewImageFromRGBA64(testImage(400, 400, i))
+		if err := img.Save(filepath.Join(cons.InDir, "small", fmt.Sprintf("IMG_%d.png", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	// cancel once the first output is saved
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			if entries, _ := os.ReadDir(outDir); len(entries) > 0 {
+				break
+			}
+		}
+		cancel()
+	}()
+	config := Config{DataDirs: "small", Mode: "batch", ThreadCount: 1, StatePath: statePath, Context: ctx}
+	if _, err := run(config); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled batch returned %v, want %v", err, context.Canceled)
+	}
+	first := outputsIn(t, outDir)
+	if len(first) == 0 || len(first) == n {
+		t.Fatalf("cancelled batch saved %d of %d outputs, want some but not all", len(first), n)
+	}
+	state, err := loadBatchState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.done) != len(first) {
+		t.Errorf("state file records %d outputs done, %d were saved", len(state.done), len(first))
+	}
+
+	// the restarted batch saves only the remaining outputs
+	for _, name := range first {
+		if err := os.Remove(filepath.Join(outDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.Context = nil
+	if _, err := run(config); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]int)
+	for _, name := range append(first, outputsIn(t, outDir)...) {
+		seen[name]++
+	}
+	if len(seen) != n {
+		t.Errorf("%d distinct outputs across the two runs, want %d", len(seen), n)
+	}
+	for name, count := range seen {
+		if count != 1 {
+			t.Errorf("%s saved %d times across the two runs, want 1", name, count)
+		}
+	}
+	if state, err = loadBatchState(statePath); err != nil {
+		t.Fatal(err)
+	} else if len(state.done) != n {
+		t.Errorf("state file records %d outputs done, want %d", len(state.done), n)
+	}
+}
+
+// outputs that can't be saved because their directory is a file are recorded as failed, not done, and retried
+func TestBatchParentNotDir(t *testing.T) {
+	useTestImages(t, 2, []string{"B"})
+	blocker := filepath.Join(t.TempDir(), "out")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cons.OutDir = blocker
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	config := Config{DataDirs: "small", Mode: "batch", ThreadCount: 2, StatePath: statePath}
+	if _, err := run(config); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot batchSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Done) != 0 || len(snapshot.Failed) != 2 {
+		t.Fatalf("state with %d outputs done and %d failed, want 0 and 2", len(snapshot.Done), len(snapshot.Failed))
+	}
+	for outPath, msg := range snapshot.Failed {
+		if !strings.Contains(msg, png.ErrParentNotDir.Error()) {
+			t.Errorf("%s failed with %q, want %q", outPath, msg, png.ErrParentNotDir)
+		}
+	}
+
+	// once the directory is in place, resuming saves them
+	if err := os.Remove(blocker); err == nil {
+		err = os.Mkdir(blocker, 0755)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(config); err != nil {
+		t.Fatal(err)
+	}
+	if saved := outputsIn(t, blocker); len(saved) != 2 {
+		t.Errorf("the resumed batch saved %v, want 2 outputs", saved)
+	}
+}
+
+// snapshots taken all the time: the periodic ones never overlap the last one
+func TestBatchSnapshotsDontOverlap(t *testing.T) {
+	useTestImages(t, 2, []string{"G"})
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	for i := 0; i < 50; i++ {
+		config := Config{DataDirs: "small", Mode: "batch", ThreadCount: 2, StatePath: statePath, SnapshotInterval: time.Microsecond}
+		if err := os.Remove(statePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Fatal(err)
+		}
+		if _, err := run(config); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"proj3/png"
+)
+
+// Benchmark harness: runs a scheduler scheme across a list of thread counts (and repetitions)
+// in a single invocation, writing one `Result` per run to the results file.
+// The results are consumable by `benchmark/stats.go` to compute speedups.
+
+// RunBench sweeps 'config.BenchMode' over 'config.BenchThreads', repeating each
+// thread count 'config.BenchRepeat' times, and returns the results of all runs.
+// Obs: a sequential run is added to each repetition as the baseline for speedups.
+// With `Config.ResultCacheSize`, all runs share one cache, so only the first run of each image applies its effects.
+func RunBench(config Config) []Result {
+	config.results = newResultCache(config.ResultCacheSize)
+	repeat := config.BenchRepeat
+	if repeat < 1 {
+		repeat = 1
+	}
+
+	results := make([]Result, 0, repeat*(len(config.BenchThreads)+1))
+	for i := 0; i < repeat; i++ {
+		// sequential baseline; skipped if the benchmarked mode itself is sequential
+		if config.BenchMode != "s" {
+			if result, err := benchRun(config, "s", 1); err == nil {
+				results = append(results, result)
+			}
+		}
+		for _, threads := range config.BenchThreads {
+			if result, err := benchRun(config, config.BenchMode, threads); err == nil {
+				results = append(results, result)
+			}
+		}
+	}
+	return results
+}
+
+// RunBarrierBench compares the barrier strategies of `applySlices` by sweeping 'parslices' with each of them
+// over 'config.BenchThreads', repeating each thread count 'config.BenchRepeat' times, and returns the results.
+// Results are written with the barrier in the mode. eg: "parslices_wg", "parslices_cond", "parslices_pool".
+// Before timing, checks that all strategies give the same output (see `checkBarriers`).
+// obs: the strategies differ in their overhead per effect, so chains of many effects show the differences best
+// (see `Config.DirEffects`).
+// Obs: a sequential run is added to each repetition as the baseline for speedups.
+func RunBarrierBench(config Config) ([]Result, error) {
+	if err := checkBarriers(config); err != nil {
+		return nil, err
+	}
+	repeat := config.BenchRepeat
+	if repeat < 1 {
+		repeat = 1
+	}
+
+	results := make([]Result, 0, repeat*(len(barrierStrategies)*len(config.BenchThreads)+1))
+	for i := 0; i < repeat; i++ {
+		if result, err := benchRun(config, "s", 1); err == nil {
+			results = append(results, result)
+		}
+		for _, threads := range config.BenchThreads {
+			// obs: strategies alternate for each thread count, so all run under similar conditions
+			for _, barrier := range barrierStrategies {
+				config.Barrier = barrier
+				if result, err := benchRun(config, "parslices", threads); err == nil {
+					results = append(results, result)
+				}
+			}
+		}
+	}
+	return results, nil
+}
+
+// checkBarriers applies the effects of the first image of the run with each barrier strategy
+// and returns an error if the outputs differ, in which case their timings are not comparable.
+// Uses the largest thread count of the sweep (at least 2), so the image is actually sliced.
+func checkBarriers(config Config) error {
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		return err
+	}
+	if len(taskQueue.Tasks) == 0 {
+		return ErrNoTasks
+	}
+	// obs: the effects of the first output, if the image has several
+	task := taskQueue.Tasks[0].Branches()[0]
+
+	nThreads := 2
+	for _, threads := range config.BenchThreads {
+		if threads > nThreads {
+			nThreads = threads
+		}
+	}
+
+	img, err := loadImage(&task)
+	if err != nil {
+		return err
+	}
+	var reference []byte
+	for _, barrier := range barrierStrategies {
+		imgBarrier := img.Clone()
+		kernels := png.CreateKernels(task.Effects)
+		if barrier == BarrierPool {
+			pool := newSlicePool(nThreads)
+			pool.applySlices(imgBarrier, kernels, nThreads, config.SliceStrategy, nil)
+			pool.close()
+		} else {
+			applySlices(imgBarrier, kernels, nThreads, barrier, config.SliceStrategy, nil)
+		}
+		var buf bytes.Buffer
+		if err := imgBarrier.SaveWriter(&buf, "png"); err != nil {
+			return err
+		}
+		if reference == nil {
+			reference = buf.Bytes()
+		} else if !bytes.Equal(buf.Bytes(), reference) {
+			return fmt.Errorf("barrier strategies %s and %s give different outputs for %s",
+				barrierStrategies[0], barrier, task.InPath)
+		}
+	}
+	return nil
+}
+
+// benchRun executes a single run of the sweep and writes its result.
+// If the run fails (eg: no tasks to process), prints and returns the error; nothing is written.
+// Each run gets a fresh copy of the settings, so no state leaks from one run to the next.
+func benchRun(config Config, mode string, threads int) (Result, error) {
+	runConfig := Config{
+		DataDirs:         config.DataDirs,
+		Mode:             mode,
+		ThreadCount:      threads,
+		SubThreadCount:   config.SubThreadCount,
+		ChunkSize:        config.ChunkSize,
+		PinProcs:         config.PinProcs,
+		PhaseTimes:       config.PhaseTimes,
+		BacklogInterval:  config.BacklogInterval,
+		RoundRobin:       config.RoundRobin,
+		CopyUnchanged:    config.CopyUnchanged,
+		EmbedProvenance:  config.EmbedProvenance,
+		GrayOutput:       config.GrayOutput,
+		StealPolicy:      config.StealPolicy,
+		PeakMem:          config.PeakMem,
+		DirEffects:       config.DirEffects,
+		Writers:          config.Writers,
+		SharedPool:       config.SharedPool,
+		LIFO:             config.LIFO,
+		AutoSubThreads:   config.AutoSubThreads,
+		Semaphore:        config.Semaphore,
+		LockFreeQueue:    config.LockFreeQueue,
+		Shuffle:          config.Shuffle,
+		Seed:             config.Seed,
+		SortTasks:        config.SortTasks,
+		Sample:           config.Sample,
+		SampleCount:      config.SampleCount,
+		Barrier:          config.Barrier,
+		SliceStrategy:    config.SliceStrategy,
+		ThumbSize:        config.ThumbSize,
+		LoadThreads:      config.LoadThreads,
+		ProcessThreads:   config.ProcessThreads,
+		SaveThreads:      config.SaveThreads,
+		OptimizeChain:    config.OptimizeChain,
+		Quality:          config.Quality,
+		InPlace:          config.InPlace,
+		WorkerPools:      config.WorkerPools,
+		NormalizeKernels: config.NormalizeKernels,
+		Effects:          config.Effects,
+		results:          config.results,
+		// obs: checkpoints and event logs are not passed; every run of the sweep must process all images.
+		// Intermediate images are not saved and outputs are not content hashed either; they would distort the timings.
+	}
+	restoreProcs := pinProcs(runConfig)
+	result, err := run(runConfig)
+	restoreProcs()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return result, err
+	}
+	writeResult(result)
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"os"
+	"proj3/png"
+	"proj3/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunBenchSweep(t *testing.T) {
+	useTestImages(t, 3, []string{"B", "S"})
+	if err := os.Truncate(resultsPath, 0); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	results := RunBench(Config{DataDirs: "small", BenchMode: "parfiles", BenchThreads: []int{1, 2}, BenchRepeat: 1})
+
+	// the sequential baseline and one run per thread count
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3: %+v", len(results), results)
+	}
+	want := []struct {
+		mode    string
+		threads int
+	}{{"s", 1}, {"parfiles", 1}, {"parfiles", 2}}
+	for i, result := range results {
+		if result.Mode != want[i].mode || result.Threads != want[i].threads || result.DataDir != "small" {
+			t.Errorf("result %d is %s with %d threads on %s, want %s with %d on small",
+				i, result.Mode, result.Threads, result.DataDir, want[i].mode, want[i].threads)
+		}
+	}
+	written, err := os.ReadFile(resultsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(written), "\n"); lines != 3 {
+		t.Errorf("the results file has %d lines, want 3", lines)
+	}
+}
+
+func TestComputeBenchExcludesIO(t *testing.T) {
+	outDir := useTestImages(t, 4, []string{"B"})
+	// a slow load: 4 images take at least 200ms, far more than blurring them
+	const loadDelay = 50 * time.Millisecond
+	defer func(old func(*utils.Task) (*png.Image, error)) { loadComputeImage = old }(loadComputeImage)
+	loadComputeImage = func(task *utils.Task) (*png.Image, error) {
+		time.Sleep(loadDelay)
+		return loadImage(task)
+	}
+
+	start := time.Now()
+	results, err := RunComputeBench(Config{DataDirs: "small", BenchMode: "parfiles", BenchThreads: []int{1, 2}, BenchRepeat: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// images are loaded once for the whole sweep, not once per run, and no run counts it
+	if elapsed := time.Since(start); elapsed < 4*loadDelay || elapsed > 8*loadDelay {
+		t.Fatalf("the sweep took %v, want about the %v of loading the images once", elapsed, 4*loadDelay)
+	}
+	if len(results) != 6 {
+		t.Fatalf("got %d results, want 6: %+v", len(results), results)
+	}
+	for _, result := range results {
+		if !strings.HasPrefix(result.Mode, computeModePrefix) {
+			t.Errorf("result mode %s without the prefix %s", result.Mode, computeModePrefix)
+		}
+		if result.TimeElapsed >= loadDelay.Seconds() {
+			t.Errorf("%s with %d threads took %vs, the time of loading an image", result.Mode, result.Threads, result.TimeElapsed)
+		}
+	}
+	// and nothing is saved
+	if entries, err := os.ReadDir(outDir); err != nil || len(entries) != 0 {
+		t.Errorf("the compute-only sweep saved %d outputs (%v)", len(entries), err)
+	}
+}
@@ -0,0 +1,136 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"proj3/utils"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestResumeAfterCrash(t *testing.T) {
+	outDir := useTestImages(t, 4, []string{"B", "S"})
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.txt")
+	outPath := func(name string) string { return filepath.Join(outDir, "small_"+name+"_Out.png") }
+
+	// a run that crashed after completing two of the four images
+	crashed := utils.NewCheckpoint(checkpointPath)
+	for _, name := range []string{"IMG_0", "IMG_2"} {
+		if err := crashed.MarkDone(outPath(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crashed.Close()
+
+	config := Config{DataDirs: "small", Mode: "parfiles", ThreadCount: 2, CheckpointPath: checkpointPath, Resume: true}
+	if _, err := run(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the images not completed before the crash are processed
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []string
+	for _, entry := range entries {
+		written = append(written, entry.Name())
+	}
+	sort.Strings(written)
+	if want := []string{"small_IMG_1_Out.png", "small_IMG_3_Out.png"}; len(written) != 2 || written[0] != want[0] || written[1] != want[1] {
+		t.Errorf("the resumed run wrote %v, want %v", written, want)
+	}
+	// and all of them are recorded as completed
+	done := utils.NewCheckpoint(checkpointPath).Load()
+	for i := 0; i < 4; i++ {
+		if name := fmt.Sprintf("IMG_%d", i); !done[outPath(name)] {
+			t.Errorf("%s is not recorded in the checkpoint", name)
+		}
+	}
+
+	// a resumed run with everything done has nothing to process, which is not a missing input
+	if _, err := run(config); !errors.Is(err, ErrNothingToResume) {
+		t.Errorf("resuming a completed run returned %v, want %v", err, ErrNothingToResume)
+	}
+}
+
+func TestCheckpointReset(t *testing.T) {
+	useTestImages(t, 2, []string{"B"})
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint.txt")
+	previous := utils.NewCheckpoint(checkpointPath)
+	if err := previous.MarkDone("IMG_0_Out.png"); err != nil {
+		t.Fatal(err)
+	}
+	previous.Close()
+
+	// a run with invalid options doesn't start, so the checkpoint of the previous run is kept
+	config := Config{DataDirs: "small", Mode: "s", CheckpointPath: checkpointPath, SortTasks: true, Shuffle: true}
+	if _, err := run(config); err == nil {
+		t.Fatal("sorting and shuffling the tasks returned no error")
+	}
+	if done := utils.NewCheckpoint(checkpointPath).Load(); !done["IMG_0_Out.png"] {
+		t.Error("the checkpoint was reset by a run with invalid options")
+	}
+
+	// a checkpoint that can't be reset fails the run
+	notEmpty := t.TempDir()
+	if err := os.WriteFile(filepath.Join(notEmpty, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(Config{DataDirs: "small", Mode: "s", CheckpointPath: notEmpty}); err == nil {
+		t.Error("a checkpoint that can't be removed returned no error")
+	}
+}
+
+// outputs that can't be saved are not recorded in the checkpoint, so a resumed run processes them again
+func TestCheckpointSkipsFailedSaves(t *testing.T) {
+	outDir := useTestImages(t, 2, []string{"B"})
+	// a file in place of the output directory: no output can be saved
+	if err := os.Remove(outDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"s", "parfiles", "parslices", "pipebsp", "pipebspws"} {
+		checkpointPath := filepath.Join(t.TempDir(), "checkpoint.txt")
+		run(Config{DataDirs: "small", Mode: mode, ThreadCount: 2, CheckpointPath: checkpointPath})
+		if done := utils.NewCheckpoint(checkpointPath).Load(); len(done) != 0 {
+			t.Errorf("%s: %d outputs not saved recorded in the checkpoint", mode, len(done))
+		}
+	}
+}
+
+// a checkpoint that can't be written doesn't stop the run: each task is reported and its output saved anyway
+func TestCheckpointWriteErrors(t *testing.T) {
+	outDir := useTestImages(t, 2, []string{"B"})
+	// the checkpoint can't be created: its directory is a file (resuming, so it isn't reset before the run)
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *os.File) { os.Stdout = old }(os.Stdout)
+	os.Stdout = writer
+	_, runErr := run(Config{DataDirs: "small", Mode: "parfiles", ThreadCount: 2, CheckpointPath: filepath.Join(notDir, "checkpoint.txt"),
+		Resume: true})
+	writer.Close()
+	output, _ := io.ReadAll(reader)
+
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	if reported := strings.Count(string(output), "in the checkpoint"); reported != 2 {
+		t.Errorf("%d checkpoint errors reported, want 2:\n%s", reported, output)
+	}
+	if entries, _ := os.ReadDir(outDir); len(entries) != 2 {
+		t.Errorf("%d outputs saved, want 2", len(entries))
+	}
+}
@@ -0,0 +1,172 @@
+package scheduler
+
+import (
+	"fmt"
+	"proj3/constants"
+	"proj3/png"
+	"sync"
+	"time"
+)
+
+// Compute-only benchmark: the images of the run are loaded once into memory and the sweep times
+// only the application of their effects, so the scaling of the parallel algorithms is measured without
+// the noise of loading and saving (see `RunComputeBench`).
+
+// computeModePrefix is added to the mode of compute-only results. eg: "compute_parslices"
+// Obs: compute-only speedups are relative to "compute_s", not to "s" (see `benchmark/stats.go`).
+const computeModePrefix = "compute_"
+
+// computeImage is an image of the run kept in memory with the effect chain of one of its outputs.
+type computeImage struct {
+	img     *png.Image // pixels as loaded; never modified, each run applies the effects to a clone
+	effects []string
+}
+
+// computeModes maps the schemes timed by the compute-only benchmark to the function applying the effects of 'images'
+// with 'nThreads' goroutines, as the scheme does between loading and saving.
+var computeModes = map[string]func(images []*png.Image, kernels [][]*png.Kernel, nThreads int, config Config){
+	"s": func(images []*png.Image, kernels [][]*png.Kernel, nThreads int, config Config) {
+		for i, img := range images {
+			applyOneThread(img, kernels[i], nil)
+		}
+	},
+	// each goroutine takes the next image not taken yet, as the workers of `ExecuteTask`
+	"parfiles": func(images []*png.Image, kernels [][]*png.Kernel, nThreads int, config Config) {
+		var next int
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for t := 0; t < nThreads; t++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					mu.Lock()
+					i := next
+					next++
+					mu.Unlock()
+					if i >= len(images) {
+						return
+					}
+					applyOneThread(images[i], kernels[i], nil)
+				}
+			}()
+		}
+		wg.Wait()
+	},
+	// each image at a time, in slices synchronized by 'config.Barrier', as `RunParallelSlices`
+	"parslices": func(images []*png.Image, kernels [][]*png.Kernel, nThreads int, config Config) {
+		barrier := config.Barrier
+		if barrier == "" {
+			barrier = BarrierWaitGroup
+		}
+		var pool *slicePool
+		if barrier == BarrierPool {
+			pool = newSlicePool(nThreads)
+			defer pool.close()
+		}
+		for i, img := range images {
+			// small images are processed by fewer threads; tiny images in this goroutine (see `effectiveSubThreads`)
+			nImgThreads := effectiveSubThreads(img, nThreads, constants.MinRowsPerSlice)
+			if nImgThreads == 1 {
+				applyOneThread(img, kernels[i], nil)
+			} else if pool != nil {
+				pool.applySlices(img, kernels[i], nImgThreads, config.SliceStrategy, nil)
+			} else {
+				applySlices(img, kernels[i], nImgThreads, barrier, config.SliceStrategy, nil)
+			}
+		}
+	},
+}
+
+// RunComputeBench sweeps 'config.BenchMode' over 'config.BenchThreads' as `RunBench`, but timing only the application
+// of the effects: the images are loaded once before the sweep and no outputs are saved.
+// Each thread count is run 'config.BenchRepeat' times, and a sequential run is added to each repetition as the baseline.
+// Results are written with `computeModePrefix` in the mode, and times cover the effects alone. eg: "compute_parslices"
+// Obs: each run applies the effects to clones of the images, made before its timer starts;
+// the sweep holds each image twice in memory.
+func RunComputeBench(config Config) ([]Result, error) {
+	if _, ok := computeModes[config.BenchMode]; !ok {
+		return nil, fmt.Errorf("mode %q can't be timed compute-only: expected one of s, parfiles or parslices", config.BenchMode)
+	}
+	if config.Barrier != "" && !validBarrier(config.Barrier) {
+		return nil, fmt.Errorf("unknown barrier strategy %q: expected one of %v", config.Barrier, barrierStrategies)
+	}
+	if !validSliceStrategy(config.SliceStrategy) {
+		return nil, fmt.Errorf("unknown slice strategy %q: expected one of %v", config.SliceStrategy, sliceStrategies)
+	}
+	if !validQuality(config.Quality) {
+		return nil, fmt.Errorf("unknown quality %q: expected one of %s, %s or %s", config.Quality, QualityHigh, QualityBalanced, QualityFast)
+	}
+	images, err := loadComputeImages(config)
+	if err != nil {
+		return nil, err
+	}
+	repeat := config.BenchRepeat
+	if repeat < 1 {
+		repeat = 1
+	}
+
+	results := make([]Result, 0, repeat*(len(config.BenchThreads)+1))
+	for i := 0; i < repeat; i++ {
+		// sequential baseline; skipped if the benchmarked mode itself is sequential
+		if config.BenchMode != "s" {
+			results = append(results, computeRun(images, config, "s", 1))
+		}
+		for _, threads := range config.BenchThreads {
+			results = append(results, computeRun(images, config, config.BenchMode, threads))
+		}
+	}
+	return results, nil
+}
+
+// loadComputeImage loads the image of a task for the compute-only benchmark; `loadImage`, replaced by tests
+// to check the time loading is not counted in the results.
+var loadComputeImage = loadImage
+
+// loadComputeImages loads the images of the run into memory, one `computeImage` per output.
+// Images that can't be loaded (eg: over `png.MaxPixels`) are skipped, as by the schemes themselves.
+func loadComputeImages(config Config) ([]computeImage, error) {
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(taskQueue.Tasks) == 0 {
+		return nil, ErrNoTasks
+	}
+	var images []computeImage
+	for i := range taskQueue.Tasks {
+		img, err := loadComputeImage(&taskQueue.Tasks[i])
+		if err != nil {
+			fmt.Printf("Error loading image %s: %v\n", taskQueue.Tasks[i].InPath, err)
+			continue
+		}
+		// obs: the outputs of an image share its pixels; they are only read
+		for _, branch := range taskQueue.Tasks[i].Branches() {
+			images = append(images, computeImage{img: img, effects: branch.Effects})
+		}
+	}
+	return images, nil
+}
+
+// computeRun applies the effects of 'images' with 'mode' and 'threads' goroutines and writes its result.
+// Only the application of the effects is timed; the clones and kernels are made before.
+func computeRun(images []computeImage, config Config, mode string, threads int) Result {
+	clones := make([]*png.Image, len(images))
+	kernels := make([][]*png.Kernel, len(images))
+	for i, image := range images {
+		clones[i] = image.img.Clone()
+		kernels[i] = config.createKernels(image.effects)
+	}
+
+	// obs: pinned as a run of `mode` alone would be (see `pinProcs`)
+	restoreProcs := pinProcs(Config{Mode: mode, ThreadCount: threads, PinProcs: config.PinProcs})
+	start := time.Now()
+	computeModes[mode](clones, kernels, threads, config)
+	elapsed := time.Since(start)
+	restoreProcs()
+
+	result := Result{Mode: computeModePrefix + mode, Threads: threads, TimeElapsed: elapsed.Seconds(),
+		TimeParallel: elapsed.Seconds(), DataDir: config.DataDirs}
+	writeResult(result)
+	return result
+}
@@ -0,0 +1,125 @@
+package scheduler
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	ws "proj3/WorkStealing"
+	"proj3/constants"
+	"time"
+)
+
+// Event is a line of the event log of a run (see `Config.EventLog`), in JSON.
+// eg: {"t":1532100,"event":"start","phase":2,"worker":1,"task":"./data/in/small/IMG_2029.png"}
+// @Time: nanoseconds since the event log was opened, from the monotonic clock
+// @Event: "start"/"finish" of the execution of a pipeline task, or the "run"/"steal" of a work stealing worker (see `ws.EventRun`)
+// @Phase: pipeline phase of the task (1: load, 2: process, 3: save). For worker events, phase of the pool of the worker;
+// 0 (omitted) if the worker is shared by all phases (see `Config.SharedPool`)
+// @Worker: id of the worker within the pool of its phase. obs: writers (see `Config.Writers`) are all worker 0
+// @Task: input path of the image of the task; omitted for worker events
+type Event struct {
+	Time   int64  `json:"t"`
+	Event  string `json:"event"`
+	Phase  int    `json:"phase,omitempty"`
+	Worker int    `json:"worker"`
+	Task   string `json:"task,omitempty"`
+}
+
+// Events of the execution of a pipeline task
+const (
+	EventStart  = "start"
+	EventFinish = "finish"
+)
+
+// eventLog writes the events of a run to a JSONL file, one `Event` per line.
+// Workers send the events over a buffered channel, drained by a single writer goroutine, so recording
+// an event takes no lock and doesn't wait for the file (unless the buffer is full).
+// Obs: the events of each worker are in order, with increasing times. Events of different workers recorded
+// at about the same time might be written out of order; sort by time to reconstruct a timeline.
+// All methods do nothing on a nil log.
+type eventLog struct {
+	start  time.Time
+	events chan Event
+	closed chan struct{} // closed by `Close`; events recorded afterwards are dropped
+	done   chan error    // receives the result of writing the file when the writer returns
+}
+
+// newEventLog creates the event log file at 'path' and starts its writer goroutine.
+// Must be closed with `Close` to write the remaining events.
+func newEventLog(path string) (*eventLog, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &eventLog{start: time.Now(), events: make(chan Event, constants.EventLogBuffer),
+		closed: make(chan struct{}), done: make(chan error, 1)}
+	go l.write(file)
+	return l, nil
+}
+
+// write encodes the events received until the log is closed and the events in the buffer are written, then closes 'file'
+func (l *eventLog) write(file *os.File) {
+	out := bufio.NewWriter(file)
+	encoder := json.NewEncoder(out)
+	var err error
+	encode := func(event Event) {
+		// obs: after an error, events are still received so senders don't block
+		if err == nil {
+			err = encoder.Encode(event)
+		}
+	}
+	for open := true; open; {
+		select {
+		case event := <-l.events:
+			encode(event)
+		case <-l.closed:
+			open = false
+		}
+	}
+	// events recorded before closing
+	for len(l.events) > 0 {
+		encode(<-l.events)
+	}
+	if flushErr := out.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	l.done <- err
+}
+
+// record adds an event to the log, timestamped now. Dropped if the log is closed.
+func (l *eventLog) record(event string, phase int, worker int, task string) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.events <- Event{Time: int64(time.Since(l.start)), Event: event, Phase: phase, Worker: worker, Task: task}:
+	case <-l.closed:
+	}
+}
+
+// workerHook returns the event hook recording the events of the workers of a pipeline 'phase' (see `ws.Worker.SetEventHook`),
+// or nil if there's no log.
+// obs: exits are not recorded; workers are signaled to stop once their phase is done, without waiting for them,
+// so they usually return after the log is closed.
+func (l *eventLog) workerHook(phase int) func(id int, event string) {
+	if l == nil {
+		return nil
+	}
+	return func(id int, event string) {
+		if event != ws.EventExit {
+			l.record(event, phase, id, "")
+		}
+	}
+}
+
+// Close waits for the events recorded to be written and closes the file. Events recorded afterwards are dropped.
+func (l *eventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	close(l.closed)
+	return <-l.done
+}
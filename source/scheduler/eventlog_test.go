@@ -0,0 +1,70 @@
+package scheduler
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestEventLog runs pipebspws with an event log: every task of each phase has a start and a later finish,
+// and the events of each worker have increasing times.
+func TestEventLog(t *testing.T) {
+	useTestImages(t, 6, []string{"B", "S"})
+	logPath := filepath.Join(t.TempDir(), "events.jsonl")
+	if _, err := run(Config{DataDirs: "small", Mode: "pipebspws", ThreadCount: 2, EventLog: logPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	type phaseTask struct {
+		phase int
+		task  string
+	}
+	type phaseWorker struct{ phase, worker int }
+	starts, finishes := make(map[phaseTask]int64), make(map[phaseTask]int64)
+	last := make(map[phaseWorker]int64)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("line %d: %v", line, err)
+		}
+		worker := phaseWorker{event.Phase, event.Worker}
+		if previous, ok := last[worker]; ok && event.Time < previous {
+			t.Errorf("line %d: worker %d of phase %d at %d after %d", line, event.Worker, event.Phase, event.Time, previous)
+		}
+		last[worker] = event.Time
+
+		key := phaseTask{event.Phase, event.Task}
+		switch event.Event {
+		case EventStart:
+			if _, ok := starts[key]; ok {
+				t.Errorf("line %d: second start of %s in phase %d", line, event.Task, event.Phase)
+			}
+			starts[key] = event.Time
+		case EventFinish:
+			if _, ok := finishes[key]; ok {
+				t.Errorf("line %d: second finish of %s in phase %d", line, event.Task, event.Phase)
+			}
+			finishes[key] = event.Time
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(starts) != 3*6 || len(finishes) != 3*6 {
+		t.Errorf("%d starts and %d finishes, want one of each for the 6 tasks of 3 phases", len(starts), len(finishes))
+	}
+	for key, start := range starts {
+		if finish, ok := finishes[key]; !ok || finish < start {
+			t.Errorf("%s in phase %d: started at %d, finished at %d (logged %v)", key.task, key.phase, start, finish, ok)
+		}
+	}
+}
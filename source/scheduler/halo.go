@@ -0,0 +1,122 @@
+package scheduler
+
+import (
+	"image"
+	"proj3/png"
+	"sync"
+)
+
+// Boundary rows of sliced convolutions.
+// A convolution of the rows of a slice near its boundaries reads rows of the adjacent slices, up to the reach
+// of the kernel (see `png.Kernel.Reach`). With the shared strategies (see `SlicesByRow`) all slices read the same
+// input buffer of the image, so these rows are simply there; the price is that the buffers can only be flipped
+// once every slice is done with the effect, i.e., the barrier between effects is global.
+// With `SliceHalo`, each slice works on buffers of its own, holding its band of rows and a halo of the rows
+// around it. After each effect, a slice only needs the new boundary rows of its two neighbors: it copies them
+// into its halo (halo exchange) and goes on. The slices never write memory shared with the others until the
+// last effect, which writes the band of each slice to the image (eg: to compare with the shared buffers on NUMA
+// machines, or for false sharing at the boundaries).
+
+// SliceHalo divides images into bands of rows with buffers private to each slice and halo exchange between effects
+const SliceHalo = "halo"
+
+// haloSlice is a band of rows of an image with its own pair of buffers. The buffers cover the rows of the band
+// plus 'halo' rows above and below it (within the image), at their coordinates in the image.
+type haloSlice struct {
+	ImageSlice
+	buffers [2]*image.RGBA64 // input and output of the current effect, swapped after each one
+}
+
+// newHaloSlice returns the halo slice of 'slice' of 'img' with a halo of 'halo' rows, with the rows of the last modified
+// buffer of the image copied to its input buffer.
+// obs: at least one row, so only the first slice of the image starts at its buffer's first row (see `png.Image.ApplyEffectBuffers`)
+func newHaloSlice(img *png.Image, slice ImageSlice, halo int) *haloSlice {
+	if halo < 1 {
+		halo = 1
+	}
+	rect := image.Rect(slice.XStart, slice.YStart-halo, slice.XEnd, slice.YEnd+halo).Intersect(img.Bounds)
+	hs := &haloSlice{ImageSlice: slice, buffers: [2]*image.RGBA64{image.NewRGBA64(rect), image.NewRGBA64(rect)}}
+	final, _ := img.GetInputOutputPixels()
+	copyRows(hs.buffers[0], final, rect.Min.Y, rect.Max.Y)
+	return hs
+}
+
+// exchange copies the rows of the bands of 'neighbors' within the halo of the slice from their input buffers to its own.
+// Usually only the slices above and below it; more if the halo is higher than their bands.
+// Obs: the neighbors only read their band while the slice writes its halo, so it needs no lock.
+func (hs *haloSlice) exchange(neighbors []*haloSlice) {
+	for _, neighbor := range neighbors {
+		if neighbor == hs {
+			continue
+		}
+		rows := hs.buffers[0].Rect.Intersect(image.Rect(neighbor.XStart, neighbor.YStart, neighbor.XEnd, neighbor.YEnd))
+		copyRows(hs.buffers[0], neighbor.buffers[0], rows.Min.Y, rows.Max.Y)
+	}
+}
+
+// copyRows copies the rows ['yStart', 'yEnd') from 'src' to 'dst'; both must cover them, with the same columns.
+func copyRows(dst, src *image.RGBA64, yStart, yEnd int) {
+	if yStart >= yEnd {
+		return
+	}
+	start, end := src.PixOffset(src.Rect.Min.X, yStart), src.PixOffset(src.Rect.Min.X, yEnd)
+	copy(dst.Pix[dst.PixOffset(dst.Rect.Min.X, yStart):], src.Pix[start:end])
+}
+
+// applyHaloSlices applies the effects in 'kernels' to 'img' divided into 'nThreads' bands (see `SliceHalo`).
+// Each effect is applied to all slices in parallel; before the next one, each slice exchanges its halo with its
+// neighbors. The last effect writes the band of each slice to the output buffer of the image, so the result
+// is the same as with the shared buffers, as if the effects had been applied in sequence.
+// Effects reading the whole image (see `png.Kernel.Reach`) can't be applied to a band alone; chains with them,
+// or with 'onStep' (which needs the image after each effect), are applied with the shared buffers instead.
+func applyHaloSlices(img *png.Image, kernels []*png.Kernel, nThreads int, onStep func(step int)) {
+	halo := 0
+	for _, kernel := range kernels {
+		reach, ok := kernel.Reach()
+		if !ok || onStep != nil {
+			applySlices(img, kernels, nThreads, BarrierWaitGroup, SliceBands, onStep)
+			return
+		}
+		if reach > halo {
+			halo = reach
+		}
+	}
+	if len(kernels) == 0 {
+		return
+	}
+
+	bands := SlicesByRow(img, nThreads, SliceBands)
+	slices := make([]*haloSlice, len(bands))
+	for i, band := range bands {
+		slices[i] = newHaloSlice(img, band, halo)
+	}
+
+	var wgEffect sync.WaitGroup
+	for step, kernel := range kernels {
+		last := step == len(kernels)-1
+		for _, slice := range slices {
+			wgEffect.Add(1)
+			go func(hs *haloSlice) {
+				defer wgEffect.Done()
+				// the halo of the input is the output of the neighbors for the previous effect
+				if step > 0 {
+					hs.exchange(slices)
+				}
+				// obs: the last effect writes the band to the image; the flags of the image are set as with shared buffers
+				out := hs.buffers[1]
+				if last {
+					_, out = img.GetInputOutputPixels()
+				}
+				img.ApplyEffectBuffers(kernel, hs.buffers[0], out, hs.YStart, hs.YEnd, hs.XStart, hs.XEnd)
+			}(slice)
+		}
+		// wait for all slices before the next effect, so the neighbors' outputs are complete
+		wgEffect.Wait()
+		// obs: swapped once all slices are done, since the neighbors read the input buffers during the exchange
+		for _, slice := range slices {
+			slice.buffers[0], slice.buffers[1] = slice.buffers[1], slice.buffers[0]
+		}
+	}
+	// obs: a single flip, since the intermediate effects were applied to the buffers of the slices
+	img.Final = 1 - img.Final
+}
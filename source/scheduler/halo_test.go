@@ -0,0 +1,37 @@
+package scheduler
+
+import (
+	"proj3/png"
+	"testing"
+)
+
+func TestHaloSlices(t *testing.T) {
+	chains := [][]string{
+		{"B"},
+		{"B", "S", "E", "G"},
+		// reach of 5 rows: more than the bands of 7 slices of 30 rows, so the halo spans several neighbors
+		{"GB2@5", "S"},
+		{"MB9@90", "K5x1:0.2:0.2:0.2:0.2:0.2", "I"},
+		// auto-contrast reads the whole image: applied with the shared buffers
+		{"B", "AC"},
+	}
+	for _, effects := range chains {
+		want := png.NewImageFromRGBA64(testImage(40, 30, 1))
+		applyOneThread(want, png.CreateKernels(effects), nil)
+
+		for _, nThreads := range []int{1, 2, 3, 7, 30} {
+			shared := png.NewImageFromRGBA64(testImage(40, 30, 1))
+			applySlices(shared, png.CreateKernels(effects), nThreads, BarrierWaitGroup, SliceBands, nil)
+			halo := png.NewImageFromRGBA64(testImage(40, 30, 1))
+			applyHaloSlices(halo, png.CreateKernels(effects), nThreads, nil)
+
+			if !shared.Equal(want) {
+				t.Errorf("%v with %d shared slices differs from the whole image", effects, nThreads)
+			}
+			// obs: compares the last modified buffers; the halo slices write the last effect to the output buffer
+			if !halo.Equal(want) {
+				t.Errorf("%v with %d halo slices differs from the whole image", effects, nThreads)
+			}
+		}
+	}
+}
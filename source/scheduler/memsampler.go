@@ -0,0 +1,69 @@
+package scheduler
+
+import (
+	"proj3/constants"
+	"runtime"
+	"time"
+)
+
+// memSampler polls `runtime.ReadMemStats` in a goroutine, tracking the peak `HeapInuse` and number of goroutines.
+// Obs: `ReadMemStats` stops the world, so the interval is coarse (see `constants.MemSampleInterval`)
+// to keep the overhead negligible. Peaks between samples might be missed.
+type memSampler struct {
+	peak 	uint64			// peak heap in use, in bytes. Only read after `stopped` is closed.
+	peakGoroutines int		// peak number of goroutines, including the sampler itself
+	done 	chan struct{}	// closed to signal the sampler to stop
+	stopped chan struct{}	// closed by the sampler when it exits
+}
+
+// startMemSampler starts sampling the heap if 'enabled' and returns the sampler; returns nil otherwise.
+func startMemSampler(enabled bool) *memSampler {
+	if !enabled {
+		return nil
+	}
+	m := &memSampler{done: make(chan struct{}), stopped: make(chan struct{})}
+	go m.run()
+	return m
+}
+
+// run samples the heap until `done` is closed
+func (m *memSampler) run() {
+	defer close(m.stopped)
+	ticker := time.NewTicker(constants.MemSampleInterval)
+	defer ticker.Stop()
+
+	m.sample()
+	for {
+		select {
+		case <-m.done:
+			// last sample, so short runs also get a value
+			m.sample()
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+// sample updates the peaks with the current heap in use and number of goroutines
+func (m *memSampler) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapInuse > m.peak {
+		m.peak = stats.HeapInuse
+	}
+	if n := runtime.NumGoroutine(); n > m.peakGoroutines {
+		m.peakGoroutines = n
+	}
+}
+
+// Stop stops the sampler, waits for its goroutine to exit and returns the peak heap in use, in bytes,
+// and the peak number of goroutines. Returns 0, 0 on a nil sampler (i.e., sampling disabled).
+func (m *memSampler) Stop() (uint64, int) {
+	if m == nil {
+		return 0, 0
+	}
+	close(m.done)
+	<-m.stopped
+	return m.peak, m.peakGoroutines
+}
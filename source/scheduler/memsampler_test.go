@@ -0,0 +1,43 @@
+package scheduler
+
+import (
+	"runtime"
+	"testing"
+)
+
+var memSink []byte
+
+func TestMemSampler(t *testing.T) {
+	if peak, _ := startMemSampler(false).Stop(); peak != 0 {
+		t.Errorf("a disabled sampler reported a peak of %d bytes", peak)
+	}
+
+	before := runtime.NumGoroutine()
+	sampler := startMemSampler(true)
+	// held until the sampler is stopped, so the last sample sees it
+	memSink = make([]byte, 8<<20)
+	peak, _ := sampler.Stop()
+	memSink = nil
+	if peak < 8<<20 {
+		t.Errorf("peak heap in use of %d bytes, want at least the 8 MiB allocated", peak)
+	}
+	// the sampler goroutine exited with Stop
+	select {
+	case <-sampler.stopped:
+	default:
+		t.Error("the sampler goroutine is still running after Stop")
+	}
+	if after := runtime.NumGoroutine(); after != before {
+		t.Errorf("%d goroutines after the sampler stopped, %d before", after, before)
+	}
+
+	// reported with the result of a run
+	useTestImages(t, 2, []string{"B"})
+	result, err := run(Config{DataDirs: "small", Mode: "parfiles", ThreadCount: 2, PeakMem: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.PeakHeapInuse == 0 {
+		t.Error("no peak heap reported for the run")
+	}
+}
@@ -1,50 +1,102 @@
 package scheduler
 
 import (
+	"fmt"
+	"proj3/mysync"
 	"proj3/png"
 	"proj3/utils"
 	"sync"
-	"fmt"
 	"time"
 )
 
 // Pick tasks from 'taskQueue' and apply effects to the images represented by them.
-func ExecuteTask(taskQueue *utils.TaskQueue, wg *sync.WaitGroup){
+// Completed tasks are recorded in the checkpoint and manifest of 'config' (if enabled).
+// With 'config.WorkerPools', the images of this worker reuse the buffers of its previous ones (see `png.BufferPool`).
+// 'taskQueue' is the `utils.TaskQueue` of the run, or a `utils.LockFreeQueue` with its tasks (see `Config.LockFreeQueue`).
+func ExecuteTask(taskQueue utils.TaskSource, config *Config, wg *sync.WaitGroup){
+	pool := config.workerPool()
+
 	// pick a task from the queue thread-safely
 	task := taskQueue.Dequeue()
 
 	// loop: while there are tasks to be done, pick from queue and apply effects to image
 	for task != nil {
-		// load image and apply effects
-		img, _ := png.Load(task.InPath)
-		
+		processTask(task, config, pool)
+		task = taskQueue.Dequeue()
+	}
+	// signal that this thread is done
+	wg.Done()
+}
+
+// processFile loads the image of 'task', applies its effects in this goroutine and saves the output.
+// Images that can't be loaded (eg: over `png.MaxPixels`) are skipped.
+// Buffers are taken from 'pool' and returned to it once each output is saved; nil allocates them (see `png.BufferPool`).
+func processFile(task *utils.Task, config *Config, pool *png.BufferPool) {
+	// load image and apply effects
+	taskStart := time.Now()
+	img, err := config.loadTaskImageFrom(task, pool)
+	if err != nil {
+		fmt.Printf("Error loading image %s: %v\n", task.InPath, err)
+		return
+	}
+
+	forEachBranch(task, img, func(task *utils.Task, img *png.Image) {
 		// create a slice of kernels representing each effect
-		kernels := png.CreateKernels(task.Effects)
+		kernels := config.createKernels(task.Effects)
 
 		// apply the effects to the image in sequence
-		for _, kernel := range kernels {
-			img.ApplyEffect(kernel)
-			// invert image buffer for application of next effect (see png.Image struct definition)
-			img.Final = 1 - img.Final
-		}
+		config.results.apply(task, img, func() {
+			applyOneThread(img, kernels, config.stepSaver(task, img))
+		})
 
-		// save output and go to next image
-		img.Save(task.OutPath)
-		task = taskQueue.Dequeue()
+		// save output
+		config.saveTask(task, img, taskStart)
+		pool.Release(img)
+	})
+}
+
+// processTask processes the image of a task in parfiles; `processFile`, replaced by tests
+var processTask = processFile
+
+// workerPool returns a new pool of buffers for a worker if `WorkerPools` is set; nil otherwise.
+func (config *Config) workerPool() *png.BufferPool {
+	if !config.WorkerPools {
+		return nil
 	}
-	// signal that this thread is done
-	wg.Done()
+	return png.NewBufferPool()
 }
 
+// dispatchTasks starts a goroutine for each task of 'taskQueue', in order, acquiring 'sem' before each one,
+// so at most `sem.Limit()` images are processed at a time. Returns once all of them are done.
+// Unlike `ExecuteTask`, goroutines are not bound to a fixed number of workers: the limit can be changed
+// while tasks run (see `mysync.Semaphore.SetLimit`).
+func dispatchTasks(taskQueue *utils.TaskQueue, config *Config, sem *mysync.Semaphore) {
+	var wg sync.WaitGroup
+	for i := range taskQueue.Tasks {
+		sem.Acquire()
+		wg.Add(1)
+		go func(task *utils.Task) {
+			defer wg.Done()
+			defer sem.Release()
+			processTask(task, config, nil)
+		}(&taskQueue.Tasks[i])
+	}
+	wg.Wait()
+}
 
 // Process images specified by 'config' and 'effects.txt' deploying 'config.ThreadCount' 
 // goroutines to apply effects to each image in parallel. 
-func RunParallelFiles(config Config) {
+// With 'config.Semaphore', a goroutine is started for each image instead, at most 'config.ThreadCount' at a time (see `dispatchTasks`).
+// With 'config.LockFreeQueue', the goroutines take the images from a `utils.LockFreeQueue` instead of the TAS locked queue.
+func RunParallelFiles(config Config) (Result, error) {
 	// start timer for total elapsed time
 	startTime := time.Now()
 
 	// create a queue of tasks given data directories CMD inputs and effects.txt file
-	taskQueue := utils.CreateTasks(config.DataDirs)
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		return Result{}, err
+	}
 
 	// compute number of threads to use; if more threads than tasks, use number of tasks
 	nThreads := config.ThreadCount
@@ -54,16 +106,27 @@ func RunParallelFiles(config Config) {
 
 	// wait group to wait until all threads are done
 	var wg sync.WaitGroup
+
+	// obs: the lock-free queue is filled before the timer starts, as the TAS locked queue by `createTasks`
+	var tasks utils.TaskSource = taskQueue
+	if config.LockFreeQueue {
+		tasks = utils.NewLockFreeQueueFrom(taskQueue.Tasks)
+	}
 	
 	// start timer for parallel tasks
 	parallelTime := time.Now()
-	// deploy go routines to apply effects to each image
-	for i:=0; i < nThreads; i++{
-		wg.Add(1)
-		go ExecuteTask(taskQueue, &wg)
+	if config.Semaphore {
+		// one goroutine per image, at most 'nThreads' at a time
+		dispatchTasks(taskQueue, &config, mysync.NewSemaphore(nThreads))
+	} else {
+		// deploy go routines to apply effects to each image
+		for i:=0; i < nThreads; i++{
+			wg.Add(1)
+			go ExecuteTask(tasks, &config, &wg)
+		}
+		// wait for all threads to finish
+		wg.Wait()
 	}
-	// wait for all threads to finish
-	wg.Wait()
 	
 	// compute elapsed time for parallel section
 	totalParallelTime := time.Since(parallelTime)
@@ -71,11 +134,16 @@ func RunParallelFiles(config Config) {
 	// compute total elapsed time
 	elapsedTime := time.Since(startTime)
 
-	// write result into JSON format 
-	writeStr := fmt.Sprintf("{\"mode\": \"%s\", \"threads\": %d, \"timeElapsed\": %f, \"timeParallel\": %f , \"datadir\": \"%s\"}\n", 
-								config.Mode ,nThreads, elapsedTime.Seconds(), totalParallelTime.Seconds(), config.DataDirs)
-	// write elapsed time to a text file
-	utils.WriteToFile(resultsPath, writeStr)
+	// return times + settings to be written to the results file
+	// obs: "parfiles_sem" with the semaphore, "parfiles_lockfree" with the lock-free queue
+	mode := config.Mode
+	if config.Semaphore {
+		mode += "_sem"
+	} else if config.LockFreeQueue {
+		mode += "_lockfree"
+	}
+	return Result{Mode: mode, Threads: nThreads, TimeElapsed: elapsedTime.Seconds(),
+		TimeParallel: totalParallelTime.Seconds(), DataDir: config.DataDirs}, nil
 }
 
 
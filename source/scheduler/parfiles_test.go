@@ -0,0 +1,45 @@
+package scheduler
+
+import (
+	"proj3/png"
+	"proj3/utils"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestParfilesConcurrency records the peak number of images processed at the same time by parfiles with each way
+// of dispatching the tasks: never more than `ThreadCount`, and every image processed once.
+func TestParfilesConcurrency(t *testing.T) {
+	useTestImages(t, 12, []string{"B"})
+	defer func(old func(*utils.Task, *Config, *png.BufferPool)) { processTask = old }(processTask)
+	var inFlight, peak, processed atomic.Int64
+	processTask = func(task *utils.Task, config *Config, pool *png.BufferPool) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for old := peak.Load(); n > old && !peak.CompareAndSwap(old, n); old = peak.Load() {
+		}
+		// widen the window for overlapping images
+		time.Sleep(2 * time.Millisecond)
+		processFile(task, config, pool)
+		processed.Add(1)
+	}
+
+	for _, config := range []Config{
+		{ThreadCount: 3},
+		{ThreadCount: 3, Semaphore: true},
+		{ThreadCount: 3, LockFreeQueue: true},
+		{ThreadCount: 1, Semaphore: true},
+	} {
+		config.Mode, config.DataDirs = "parfiles", "small"
+		peak.Store(0)
+		processed.Store(0)
+		if _, err := run(config); err != nil {
+			t.Fatal(err)
+		}
+		if peak.Load() > int64(config.ThreadCount) || processed.Load() != 12 {
+			t.Errorf("%d threads, semaphore %v, lock-free %v: up to %d images at a time, %d of 12 processed",
+				config.ThreadCount, config.Semaphore, config.LockFreeQueue, peak.Load(), processed.Load())
+		}
+	}
+}
@@ -1,28 +1,69 @@
 package scheduler
 
 import (
+	"fmt"
 	"sync"
 	"proj3/png"
+	"proj3/constants"
 	"proj3/utils"
-	"fmt"
 	"time"
 	"math"
 )
 
 
 // 'ImageSlice' contains indexes representing a slice of an image
+// @YStep: distance between the rows of the slice. 0 or 1 => the band of rows [YStart, YEnd);
+// n => rows YStart, YStart+n, YStart+2n, ... below YEnd (see `SliceInterleaved`)
 type ImageSlice struct {
 	XStart int
 	XEnd   int
 	YStart int
 	YEnd   int
+	YStep  int
+}
+
+// apply applies the effect represented by 'kernel' to the rows of the slice of 'img':
+// the whole band at once, or each row of an interleaved slice.
+func (slice ImageSlice) apply(img *png.Image, kernel *png.Kernel) {
+	if slice.YStep <= 1 {
+		img.ApplyEffectSlice2(kernel, slice.YStart, slice.YEnd, slice.XStart, slice.XEnd)
+		return
+	}
+	for y := slice.YStart; y < slice.YEnd; y += slice.YStep {
+		img.ApplyEffectSlice2(kernel, y, y+1, slice.XStart, slice.XEnd)
+	}
+}
+
+// Strategies dividing an image into slices by row (see `SlicesByRow`)
+const (
+	SliceBands       = "bands"       // slice i is the i-th band of consecutive rows, of roughly equal height (default)
+	SliceInterleaved = "interleaved" // slice i has rows i, i+n, i+2n, ...; balances rows of different cost among slices
+)
+
+// sliceStrategies lists the valid values of `Config.SliceStrategy`
+var sliceStrategies = []string{SliceBands, SliceInterleaved, SliceHalo}
+
+// validSliceStrategy returns true if 'strategy' is one of `sliceStrategies`, or "" for the default
+func validSliceStrategy(strategy string) bool {
+	for _, valid := range sliceStrategies {
+		if strategy == valid {
+			return true
+		}
+	}
+	return strategy == ""
 }
 
 // Divide an image into 'numSlices' slices by row.
 // Returns a slice of 'ImageSlice' structs containg indexes for each slice.
 // @img: pointer to the image to be divided
 // @numSlices: number of slices to divide the image into
-func SlicesByRow(img *png.Image, numSlices int) []ImageSlice{
+// @strategy: `SliceBands` (or "") => contiguous bands; `SliceInterleaved` => interleaved rows; `SliceHalo` => bands too
+// eg: 10 rows, 3 slices => bands: [0-3] [4-7] [8-9]; interleaved: [0 3 6 9] [1 4 7] [2 5 8]
+// Obs: either way, every row belongs to exactly one slice.
+func SlicesByRow(img *png.Image, numSlices int, strategy string) []ImageSlice{
+	if strategy == SliceInterleaved {
+		return interleavedSlices(img, numSlices)
+	}
 	// compute number of rows per slice
 	nRows := img.Bounds.Dy()
 	rowsPerSlice := int(math.Ceil(float64(nRows) / float64(numSlices)))
@@ -55,15 +96,170 @@ func SlicesByRow(img *png.Image, numSlices int) []ImageSlice{
 	return slices
 }
 
+// interleavedSlices divides an image into 'numSlices' slices of interleaved rows: slice i has rows i, i+n, ...
+// Slices beyond the number of rows are empty.
+func interleavedSlices(img *png.Image, numSlices int) []ImageSlice {
+	nRows := img.Bounds.Dy()
+	slices := make([]ImageSlice, numSlices)
+	for i := range slices {
+		start := i
+		if start > nRows {
+			start = nRows
+		}
+		slices[i] = ImageSlice{XStart: 0, XEnd: img.Bounds.Dx(), YStart: start, YEnd: nRows, YStep: numSlices}
+	}
+	return slices
+}
+
+// Barrier strategies synchronizing the slices of an image from one effect to the next (see `applySlices`)
+const (
+	BarrierWaitGroup = "wg"   // goroutines spawned for each effect and joined by a WaitGroup (default of parslices)
+	BarrierCond      = "cond" // one goroutine per slice applies all effects, synchronized by a cond variable (as in PipeBSP)
+	BarrierPool      = "pool" // as "wg", but with a persistent pool of goroutines reused across effects and images (see `slicePool`)
+)
+
+// barrierStrategies lists the valid values of `Config.Barrier`
+var barrierStrategies = []string{BarrierWaitGroup, BarrierCond, BarrierPool}
+
+// sliceTask is the application of an effect to a slice of an image, executed by a `slicePool`
+type sliceTask struct {
+	img    *png.Image
+	kernel *png.Kernel
+	slice  ImageSlice
+	wg     *sync.WaitGroup // signaled when the slice is done
+}
+
+// slicePool is a fixed-size pool of goroutines applying effects to slices of images, fed over a channel.
+// The goroutines live for the whole run, instead of spawning one per slice for every effect of every image.
+type slicePool struct {
+	tasks chan sliceTask
+}
+
+// newSlicePool starts a pool of 'nThreads' goroutines. Must be closed with `close` once the run is done.
+func newSlicePool(nThreads int) *slicePool {
+	pool := &slicePool{tasks: make(chan sliceTask, nThreads)}
+	for i := 0; i < nThreads; i++ {
+		go func() {
+			for task := range pool.tasks {
+				task.slice.apply(task.img, task.kernel)
+				task.wg.Done()
+			}
+		}()
+	}
+	return pool
+}
+
+// close stops the goroutines of the pool
+func (pool *slicePool) close() {
+	close(pool.tasks)
+}
+
+// applySlices is the WaitGroup strategy of `applySlices` with the goroutines of the pool:
+// the slices of each effect are sent to the pool, and the next effect starts once all of them are done.
+func (pool *slicePool) applySlices(img *png.Image, kernels []*png.Kernel, nThreads int, strategy string, onStep func(step int)) {
+	// obs: the slices of the halo strategy keep their buffers across effects, so they aren't sent to the pool
+	if strategy == SliceHalo {
+		applyHaloSlices(img, kernels, nThreads, onStep)
+		return
+	}
+	slices := SlicesByRow(img, nThreads, strategy)
+
+	var wgEffect sync.WaitGroup
+	for step, kernel := range kernels {
+		wgEffect.Add(len(slices))
+		for _, slice := range slices {
+			pool.tasks <- sliceTask{img: img, kernel: kernel, slice: slice, wg: &wgEffect}
+		}
+		// wait for all slices before applying next effect
+		wgEffect.Wait()
+		// invert image buffer to apply next effect (see Image definition in png.go)
+		img.Final = 1 - img.Final
+		if onStep != nil {
+			onStep(step)
+		}
+	}
+}
+
+// applySlices applies the effects in 'kernels' to 'img' divided into 'nThreads' slices by row with the
+// slice 'strategy' (see `SlicesByRow`), processed in parallel and synchronized from one effect to the next
+// with the 'barrier' strategy.
+// obs: the pool strategy needs a pool living for the whole run; see `slicePool.applySlices`
+// @onStep: optional; called after each effect with its index in 'kernels', once all slices are done (see `Config.stepSaver`)
+// obs: the halo strategy has buffers per slice and its own barrier (see `applyHaloSlices`)
+func applySlices(img *png.Image, kernels []*png.Kernel, nThreads int, barrier string, strategy string, onStep func(step int)) {
+	if strategy == SliceHalo {
+		applyHaloSlices(img, kernels, nThreads, onStep)
+		return
+	}
+	// create image slices
+	slices := SlicesByRow(img, nThreads, strategy)
+
+	if barrier == BarrierCond {
+		// constructs to synchronize sub-threads
+		sCtx := NewSyncContext(nThreads)
+		sCtx.onStep = onStep
+		sCtx.wg.Add(len(slices))
+
+		// spawn subthreads to process each slice
+		for _, slice := range slices {
+			go applyManyThreads(img, slice, kernels, sCtx)
+		}
+		// wait for all subthreads to finish their slices
+		sCtx.wg.Wait()
+		return
+	}
+
+	var wgEffect sync.WaitGroup
+	// deploy go routines to apply effects to each slice
+	for step, kernel := range kernels {
+		for _, slice := range slices {
+			wgEffect.Add(1)
+			go func(slice ImageSlice, kernel *png.Kernel) {
+				slice.apply(img, kernel)
+				wgEffect.Done()
+			}(slice, kernel)
+		}
+		// wait for all effects to be applied before applying next effect
+		wgEffect.Wait()
+		// invert image buffer to apply next effect (see Image definition in png.go)
+		img.Final = 1 - img.Final
+		if onStep != nil {
+			onStep(step)
+		}
+	}
+}
+
+// validBarrier returns true if 'barrier' is one of `barrierStrategies`
+func validBarrier(barrier string) bool {
+	for _, strategy := range barrierStrategies {
+		if barrier == strategy {
+			return true
+		}
+	}
+	return false
+}
+
 // Process images specified by 'config' and 'effects.txt' dividing them into slices 
 // and deploying 'config.ThreadCount' goroutines to apply effects to each slice. 
+// Slices are synchronized between effects with the 'config.Barrier' strategy (see `applySlices`).
 // Obs: Each image is loaded, processed and saved at a time.
-func RunParallelSlices(config Config) {
+func RunParallelSlices(config Config) (Result, error) {
 	//start timer
 	startTime := time.Now()
 
+	barrier := config.Barrier
+	if barrier == "" {
+		barrier = BarrierWaitGroup
+	}
+	if !validBarrier(barrier) {
+		return Result{}, fmt.Errorf("unknown barrier strategy %q: expected one of %v", barrier, barrierStrategies)
+	}
+
 	// create a queue of tasks given data directories CMD inputs and effects.txt file
-	taskQueue := utils.CreateTasks(config.DataDirs)
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		return Result{}, err
+	}
 	
 	// compute number of threads to use
 	nThreads := config.ThreadCount
@@ -71,48 +267,67 @@ func RunParallelSlices(config Config) {
 		nThreads = len(taskQueue.Tasks)
 	}
 
-	var wgEffect sync.WaitGroup
+	// pool strategy: the goroutines of the pool are reused for all images of the run
+	var pool *slicePool
+	if barrier == BarrierPool {
+		pool = newSlicePool(nThreads)
+		defer pool.close()
+	}
+
 	// cumulative time of all parallel tasks
 	var totalParallelTime time.Duration
 
 	// loop: load each image from the queue, separate into slices, deploy go routines to apply effects to each slice
 	for i := 0; i < len(taskQueue.Tasks); i++ {
 		// load the image
-		img, _ := png.Load(taskQueue.Tasks[i].InPath)
-		
-		// create image slices
-		slices := SlicesByRow(img, nThreads)
-		
-		// create a sice of kernels representing each effect to be acccessed by all threads
-		kernels := png.CreateKernels(taskQueue.Tasks[i].Effects)
+		taskStart := time.Now()
+		img, err := config.loadTaskImage(&taskQueue.Tasks[i])
+		if err != nil {
+			// skip images that can't be loaded (eg: over `png.MaxPixels`)
+			fmt.Printf("Error loading image %s: %v\n", taskQueue.Tasks[i].InPath, err)
+			continue
+		}
 
-		// start timer for parallel section
-		startParallel := time.Now()
+		// small images are processed by fewer threads; tiny images in this goroutine (see `effectiveSubThreads`)
+		nImgThreads := effectiveSubThreads(img, nThreads, constants.MinRowsPerSlice)
 
-		// deploy go routines to apply effects to each slice
-		for _, kernel := range kernels {
-			for j := 0; j < nThreads; j++ {
-				wgEffect.Add(1)
-				go img.ApplyEffectSlice(kernel, slices[j].YStart, slices[j].YEnd, slices[j].XStart, slices[j].XEnd, &wgEffect)
-			}
-			// wait for all effects to be applied before applying next effect
-			wgEffect.Wait()
-			// invert image buffer to apply next effect (see Image definition in png.go)
-			img.Final = 1 - img.Final
-		}
-		// compute elapsed time for parallel section and accumulate
-		totalParallelTime += time.Since(startParallel)
-		
-		// save processed image
-		img.Save(taskQueue.Tasks[i].OutPath)
+		forEachBranch(&taskQueue.Tasks[i], img, func(task *utils.Task, img *png.Image) {
+			// create a sice of kernels representing each effect to be acccessed by all threads
+			kernels := config.createKernels(task.Effects)
+
+			// start timer for parallel section
+			startParallel := time.Now()
+
+			onStep := config.stepSaver(task, img)
+			config.results.apply(task, img, func() {
+				if nImgThreads == 1 {
+					applyOneThread(img, kernels, onStep)
+				} else if pool != nil {
+					pool.applySlices(img, kernels, nImgThreads, config.SliceStrategy, onStep)
+				} else {
+					applySlices(img, kernels, nImgThreads, barrier, config.SliceStrategy, onStep)
+				}
+			})
+			// compute elapsed time for parallel section and accumulate
+			totalParallelTime += time.Since(startParallel)
+
+			// save processed image
+			config.saveTask(task, img, taskStart)
+		})
 	}
 	// compute total elapsed time
 	elapsedTime := time.Since(startTime)
 
-	// write result into JSON format 
-	writeStr := fmt.Sprintf("{\"mode\": \"%s\", \"threads\": %d, \"timeElapsed\": %f, \"timeParallel\": %f , \"datadir\": \"%s\"}\n", 
-								config.Mode ,nThreads, elapsedTime.Seconds(), totalParallelTime.Seconds(), config.DataDirs)
-	// write elapsed time to a text file
-	utils.WriteToFile(resultsPath, writeStr)
+	// return times + settings to be written to the results file
+	// obs: the barrier and slice strategy are added to the mode if given explicitly. eg: "parslices_cond_interleaved"
+	mode := config.Mode
+	if config.Barrier != "" {
+		mode += "_" + config.Barrier
+	}
+	if config.SliceStrategy != "" {
+		mode += "_" + config.SliceStrategy
+	}
+	return Result{Mode: mode, Threads: nThreads, TimeElapsed: elapsedTime.Seconds(),
+		TimeParallel: totalParallelTime.Seconds(), DataDir: config.DataDirs}, nil
 
 }
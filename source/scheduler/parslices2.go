@@ -8,11 +8,10 @@
 
 package scheduler
 import (
+	"fmt"
 	"sync"
 	"proj3/png"
-	"proj3/utils"
 	"proj3/mysync"
-	"fmt"
 	"time"
 )
 
@@ -34,7 +33,7 @@ func worker(img *png.Image, slice ImageSlice, kernels []*png.Kernel, startWG *sy
 		
 		// apply effect
 		// fmt.Println("Thread ", mysync.GetGID(), "applied effect", i)
-		img.ApplyEffectSlice2(kernel, slice.YStart, slice.YEnd, slice.XStart, slice.XEnd)
+		slice.apply(img, kernel)
 
 		// set waitGroup counter to 'nWorkers' for effects synchronization.
 		// obs: only one worker will execute this in each iteration
@@ -63,12 +62,15 @@ func worker(img *png.Image, slice ImageSlice, kernels []*png.Kernel, startWG *sy
 // Process images specified by 'config' and 'effects.txt' dividing them into slices 
 // and deploying 'config.ThreadCount' goroutines to apply effects to each slice. 
 // Obs: Each image is loaded, processed and saved at a time.
-func RunParallelSlices2(config Config) {
+func RunParallelSlices2(config Config) (Result, error) {
 	//start timer
 	startTime := time.Now()
 
 	// create a queue of tasks given data directories CMD inputs and effects.txt file
-	taskQueue := utils.CreateTasks(config.DataDirs)
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		return Result{}, err
+	}
 	
 	// compute number of threads to use
 	nThreads := config.ThreadCount
@@ -92,13 +94,19 @@ func RunParallelSlices2(config Config) {
 	// loop: load image from queue, divide into slices, deploy go routines to process each slice
 	for i := 0; i < len(taskQueue.Tasks); i++ {
 		// load the image
-		img, _ := png.Load(taskQueue.Tasks[i].InPath)
+		taskStart := time.Now()
+		img, err := config.loadTaskImage(&taskQueue.Tasks[i])
+		if err != nil {
+			// skip images that can't be loaded (eg: over `png.MaxPixels`)
+			fmt.Printf("Error loading image %s: %v\n", taskQueue.Tasks[i].InPath, err)
+			continue
+		}
 		
 		// create image slices
-		slices := SlicesByRow(img, nThreads)
+		slices := SlicesByRow(img, nThreads, config.SliceStrategy)
 		
 		// create slice of kernels representing each effect to be accessed by all threads
-		kernels := png.CreateKernels(taskQueue.Tasks[i].Effects)
+		kernels := config.createKernels(taskQueue.Tasks[i].Effects)
 		
 		// start timer for parallel section
 		startParallel := time.Now()
@@ -124,14 +132,13 @@ func RunParallelSlices2(config Config) {
 		
 		// save processed image
 		img.Save(taskQueue.Tasks[i].OutPath)
+		config.taskDone(&taskQueue.Tasks[i], img, taskStart)
 	}
 
 	// compute total elapsed time
 	elapsedTime := time.Since(startTime)
 
-	// write result into JSON format 
-	writeStr := fmt.Sprintf("{\"mode\": \"%s\", \"threads\": %d, \"timeElapsed\": %f, \"timeParallel\": %f , \"datadir\": \"%s\"}\n", 
-								config.Mode ,nThreads, elapsedTime.Seconds(), totalParallelTime.Seconds(), config.DataDirs)
-	// write elapsed time to a text file
-	utils.WriteToFile(resultsPath, writeStr)
+	// return times + settings to be written to the results file
+	return Result{Mode: config.Mode, Threads: nThreads, TimeElapsed: elapsedTime.Seconds(),
+		TimeParallel: totalParallelTime.Seconds(), DataDir: config.DataDirs}, nil
 }
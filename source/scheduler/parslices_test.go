@@ -0,0 +1,207 @@
+package scheduler
+
+import (
+	"os"
+	"path/filepath"
+	"proj3/constants"
+	"proj3/png"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// tinyImages returns 'n' images of 16x16 pixels, below `constants.MinRowsPerSlice` rows
+func tinyImages(n int) []*png.Image {
+	imgs := make([]*png.Image, n)
+	for i := range imgs {
+		imgs[i] = png.NewImageFromRGBA64(testImage(16, 16, i))
+	}
+	return imgs
+}
+
+// tiny images processed in the goroutine of the run, as chosen by `effectiveSubThreads`
+func BenchmarkTinyImagesOneThread(b *testing.B) {
+	imgs := tinyImages(64)
+	kernels := png.CreateKernels([]string{"B", "S", "E"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, img := range imgs {
+			applyOneThread(img, kernels, nil)
+		}
+	}
+}
+
+// tiny images split into 8 slices, one sub-thread each, as before `effectiveSubThreads`
+func BenchmarkTinyImagesSlices(b *testing.B) {
+	imgs := tinyImages(64)
+	kernels := png.CreateKernels([]string{"B", "S", "E"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, img := range imgs {
+			applySlices(img, kernels, 8, BarrierWaitGroup, "", nil)
+		}
+	}
+}
+
+func TestBarriersSameOutput(t *testing.T) {
+	kernels := png.CreateKernels([]string{"B", "S", "E", "G"})
+	want := png.NewImageFromRGBA64(testImage(40, 30, 1))
+	applyOneThread(want, kernels, nil)
+
+	pool := newSlicePool(4)
+	defer pool.close()
+	for _, nThreads := range []int{2, 3, 4} {
+		for _, barrier := range barrierStrategies {
+			img := png.NewImageFromRGBA64(testImage(40, 30, 1))
+			if barrier == BarrierPool {
+				pool.applySlices(img, kernels, nThreads, "", nil)
+			} else {
+				applySlices(img, kernels, nThreads, barrier, "", nil)
+			}
+			if !img.Equal(want) {
+				t.Errorf("%s barrier with %d threads: output differs from the one of a single thread", barrier, nThreads)
+			}
+		}
+	}
+}
+
+func TestSlicePoolReuse(t *testing.T) {
+	kernels := png.CreateKernels([]string{"B", "S", "G"})
+	before := runtime.NumGoroutine()
+	pool := newSlicePool(3)
+	// the same goroutines apply all effects of several images, with every slice strategy
+	for i := 0; i < 4; i++ {
+		for _, strategy := range sliceStrategies {
+			want := png.NewImageFromRGBA64(testImage(24, 20, i))
+			applyOneThread(want, kernels, nil)
+			img := png.NewImageFromRGBA64(testImage(24, 20, i))
+			var steps []int
+			pool.applySlices(img, kernels, 3, strategy, func(step int) { steps = append(steps, step) })
+			if !img.Equal(want) {
+				t.Errorf("image %d, %s slices: output differs from the one of a single thread", i, strategy)
+			}
+			if !reflect.DeepEqual(steps, []int{0, 1, 2}) {
+				t.Errorf("image %d, %s slices: steps %v, want [0 1 2]", i, strategy, steps)
+			}
+		}
+	}
+	// no goroutines spawned per slice: only those of the pool
+	if n := runtime.NumGoroutine(); n > before+3 {
+		t.Errorf("%d goroutines with the pool, want at most %d", n, before+3)
+	}
+	pool.close()
+	if after := goroutinesBack(before); after > before {
+		t.Errorf("%d goroutines after closing the pool, %d before", after, before)
+	}
+}
+
+func TestBarriersSameOutputFiles(t *testing.T) {
+	outDir := useTestImages(t, 3, []string{"B", "S", "E"})
+	// slice the small test images too (see `effectiveSubThreads`)
+	defer func(old int) { constants.MinRowsPerSlice = old }(constants.MinRowsPerSlice)
+	constants.MinRowsPerSlice = 1
+	var want map[string][]byte
+	for _, barrier := range barrierStrategies {
+		if _, err := run(Config{DataDirs: "small", Mode: "parslices", ThreadCount: 3, Barrier: barrier}); err != nil {
+			t.Fatal(err)
+		}
+		outputs := map[string][]byte{}
+		entries, _ := os.ReadDir(outDir)
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(outDir, entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs[entry.Name()] = data
+		}
+		if len(outputs) != 3 {
+			t.Fatalf("%s barrier: %d outputs, want 3", barrier, len(outputs))
+		}
+		if want == nil {
+			want = outputs
+		} else if !reflect.DeepEqual(outputs, want) {
+			t.Errorf("the outputs of the %s barrier differ from the ones of the %s barrier", barrier, barrierStrategies[0])
+		}
+	}
+}
+
+// benchmarkBarrier applies a chain of 4 effects to an image of 64 x 64 pixels in 4 slices
+// with the 'barrier' strategy
+func benchmarkBarrier(b *testing.B, barrier string) {
+	img := png.NewImageFromRGBA64(testImage(64, 64, 1))
+	kernels := png.CreateKernels([]string{"B", "S", "E", "B"})
+	pool := newSlicePool(4)
+	defer pool.close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if barrier == BarrierPool {
+			pool.applySlices(img, kernels, 4, "", nil)
+		} else {
+			applySlices(img, kernels, 4, barrier, "", nil)
+		}
+	}
+}
+
+// goroutines spawned for each effect
+func BenchmarkBarrierWaitGroup(b *testing.B) {
+	benchmarkBarrier(b, BarrierWaitGroup)
+}
+
+// one goroutine per slice for all effects, synchronized by a cond variable
+func BenchmarkBarrierCond(b *testing.B) {
+	benchmarkBarrier(b, BarrierCond)
+}
+
+// goroutines of the pool reused for all effects and images
+func BenchmarkBarrierPool(b *testing.B) {
+	benchmarkBarrier(b, BarrierPool)
+}
+
+func TestSlicesByRowCoverEveryRow(t *testing.T) {
+	for _, strategy := range sliceStrategies {
+		for _, height := range []int{1, 5, 10, 31, 64, 100} {
+			for _, numSlices := range []int{1, 2, 3, 4, 7, 12} {
+				img := png.NewImage(8, height)
+				counts := make([]int, height)
+				for _, slice := range SlicesByRow(img, numSlices, strategy) {
+					if slice.XStart != 0 || slice.XEnd != 8 {
+						t.Fatalf("%s, %d rows, %d slices: columns [%d, %d), want the whole width",
+							strategy, height, numSlices, slice.XStart, slice.XEnd)
+					}
+					step := slice.YStep
+					if step < 1 {
+						step = 1
+					}
+					for y := slice.YStart; y < slice.YEnd; y += step {
+						counts[y]++
+					}
+				}
+				for y, count := range counts {
+					if count != 1 {
+						t.Errorf("%s, %d rows, %d slices: row %d in %d slices", strategy, height, numSlices, y, count)
+					}
+				}
+			}
+		}
+	}
+}
+
+// benchmarkSliceStrategy applies a chain of 3 effects to an image of 1024 x 768 pixels in 8 slices
+// divided with 'strategy'
+func benchmarkSliceStrategy(b *testing.B, strategy string) {
+	img := png.NewImageFromRGBA64(testImage(1024, 768, 1))
+	kernels := png.CreateKernels([]string{"B", "S", "E"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		applySlices(img, kernels, 8, BarrierWaitGroup, strategy, nil)
+	}
+}
+
+func BenchmarkSlicesBands(b *testing.B) {
+	benchmarkSliceStrategy(b, SliceBands)
+}
+
+func BenchmarkSlicesInterleaved(b *testing.B) {
+	benchmarkSliceStrategy(b, SliceInterleaved)
+}
@@ -3,11 +3,15 @@
 package scheduler
 
 import (
+	"fmt"
 	ws "proj3/WorkStealing"
 	"proj3/constants"
 	"proj3/png"
 	"proj3/utils"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // syncContext contains elements to synchronize sub-threads during image processing.
@@ -17,6 +21,7 @@ type syncContext struct{
 	wg 			*sync.WaitGroup
 	counter 	int
 	nThreads 	int
+	onStep 		func(step int)			// optional; called after each effect by the last sub-thread at the barrier
 }
 func NewSyncContext(nThreads int) *syncContext{
 	var mutex sync.Mutex
@@ -31,25 +36,135 @@ type PipeContext struct {
 	config 		*Config					// contains parameters as numThreads, numSubThreads, etc
 	channels	[]chan ws.Runnable		// all channels of the pipeline
 	wgs 		[]*sync.WaitGroup		// wait groups of each pipeline phase to signalize when all tasks are done
+	phaseTimes	[]atomic.Int64			// aggregate time (ns) spent executing the tasks of each pipeline phase
+	workers 	[]*ws.Worker			// workers shared by all phases, if `Config.SharedPool`; nil otherwise (see `send`)
+	phaseWorkers [][]*PipeWorker		// work stealing workers of each phase, with separate pools; nil otherwise (see `backlog`)
+	sent		[]atomic.Int64			// tasks sent over the channel of each phase (see `send`)
+	assigned	[]int					// tasks taken from the channel of each phase; its wait group counts them (see `assign`)
 }
 
-// Create a new PipeContext with `nPhases` channels and WaitGroups and `nTasks` tasks per channel.
-func NewPipeContext(config *Config, nPhases int, nTasks int) *PipeContext{
+// Create a new PipeContext with `nPhases` channels and WaitGroups, `nTasks` tasks for the first phase
+// and `nOutputs` tasks for the next ones: phase 1 sends a task for each output of an image (see `utils.CountOutputs`).
+func NewPipeContext(config *Config, nPhases int, nTasks int, nOutputs int) *PipeContext{
 	channels := make([]chan ws.Runnable, nPhases)
 	wgs := make([]*sync.WaitGroup, nPhases)
+	assigned := make([]int, nPhases)
 	for i := range channels {
-		channels[i] = make(chan ws.Runnable, nTasks)
+		n := nOutputs
+		if i == 0 {
+			n = nTasks
+		}
+		channels[i] = make(chan ws.Runnable, n)
 		wg := &sync.WaitGroup{}
-		wg.Add(nTasks)
+		wg.Add(n)
 		wgs[i] = wg
+		assigned[i] = n
+	}
+	return &PipeContext{config: config, channels: channels, wgs: wgs, phaseTimes: make([]atomic.Int64, nPhases),
+		sent: make([]atomic.Int64, nPhases), assigned: assigned}
+}
+
+// assign sets the number of tasks the workers of pipeline phase 'phase' take from its channel, i.e., the sum of their
+// `numTasks` (see `PrepareWorkers`), and makes the wait group of the phase count them instead of the tasks
+// the phase was created with.
+// Obs: must be called before the tasks of the phase are sent.
+func (p *PipeContext) assign(phase int, nTasks int) {
+	p.wgs[phase].Add(nTasks - p.assigned[phase])
+	p.assigned[phase] = nTasks
+}
+
+// checkSent compares the tasks sent over the channel of pipeline phase 'phase' with the tasks assigned to its workers.
+// If fewer were sent, the workers stop retrieving tasks once the channel is closed (see `retrieveTasks`), so the wait
+// group of the phase stops waiting for the missing ones; tasks sent above those assigned were dropped (see `send`).
+// Returns an error wrapping `ErrTaskAssignment` if they differ.
+// Obs: must be called once the previous phase finished, i.e., no more tasks are sent to the phase.
+func (p *PipeContext) checkSent(phase int) error {
+	sent, assigned := int(p.sent[phase].Load()), p.assigned[phase]
+	if sent == assigned {
+		return nil
+	}
+	if sent < assigned {
+		p.wgs[phase].Add(sent - assigned)
+	}
+	return fmt.Errorf("phase %d: %w: %d tasks sent, %d assigned to its workers", phase+1, ErrTaskAssignment, sent, assigned)
+}
+
+// phaseThreads returns the number of workers of each pipeline phase (separate pools only): `Config.LoadThreads`,
+// `ProcessThreads` and `SaveThreads` if positive, or 'nThreads' otherwise. As 'nThreads', they are capped by 'nTasks'.
+// eg: few load workers on a spinning disk, where concurrent reads thrash, while the effects use all cores.
+// Obs: with `Config.Writers`, the phase 3 workers are not started, so `SaveThreads` has no effect.
+func phaseThreads(config Config, nThreads int, nTasks int) []int {
+	phases := []int{config.LoadThreads, config.ProcessThreads, config.SaveThreads}
+	for i := range phases {
+		if phases[i] < 1 {
+			phases[i] = nThreads
+		}
+		if phases[i] > nTasks {
+			phases[i] = nTasks
+		}
+	}
+	return phases
+}
+
+// phaseThreadsSuffix returns the suffix of the mode of the `Result` if any of the phase worker counts is given.
+// eg: "_phases2-8-8"; "" by default
+func phaseThreadsSuffix(config Config, phases []int) string {
+	if config.LoadThreads < 1 && config.ProcessThreads < 1 && config.SaveThreads < 1 {
+		return ""
+	}
+	return fmt.Sprintf("_phases%d-%d-%d", phases[0], phases[1], phases[2])
+}
+
+// startWriters starts the dedicated pool of `Config.Writers` goroutines saving the images of the pipeline, if enabled.
+// Writers take the phase 3 tasks from the channel as phase 2 workers send them; the channel is buffered
+// for all tasks, so compute workers hand the images over and move on regardless of how long saving takes.
+// They return when the channel is closed after phase 2.
+func startWriters(p *PipeContext) {
+	for i := 0; i < p.config.Writers; i++ {
+		go Run3(p.channels[len(p.channels)-1])
+	}
+}
+
+// send hands 'task' of pipeline phase 'phase' over to the workers of that phase.
+// - separate pools: over the channel of the phase, to be retrieved by its workers.
+// - shared pool: pushed to the DEqueue of worker 'wID', the one executing the task of the previous phase,
+//   so the image stays with it unless another worker steals the task. Saving still goes to the writers, if any.
+// Obs: only the owner of a DEqueue can push to it, so 'wID' must be the worker calling `send`.
+// Tasks sent over a channel above those assigned to the phase are dropped: no worker would retrieve them,
+// and the channel would block once full (see `checkSent`).
+func (p *PipeContext) send(wID int, phase int, task ws.Runnable) {
+	if p.workers == nil || (phase == len(p.channels)-1 && p.config.Writers > 0) {
+		if p.sent[phase].Add(1) > int64(p.assigned[phase]) {
+			return
+		}
+		p.channels[phase] <- task
+		return
 	}
-	return &PipeContext{config: config, channels: channels, wgs: wgs}
+	p.workers[wID].AddTask(task)
+}
+
+// addPhaseTime adds the time elapsed since 'start' to the aggregate time of pipeline phase 'phase'.
+// Obs: atomic because the tasks of a phase are executed by many workers at the same time.
+func (p *PipeContext) addPhaseTime(phase int, start time.Time) {
+	p.phaseTimes[phase].Add(int64(time.Since(start)))
+}
+
+// AddPhaseTimes adds the aggregate time of each pipeline phase to 'phaseTimes' and returns it.
+// Used to accumulate the phase times over the chunks of tasks, each having its own `PipeContext`.
+func (p *PipeContext) AddPhaseTimes(phaseTimes []time.Duration) []time.Duration {
+	if phaseTimes == nil {
+		phaseTimes = make([]time.Duration, len(p.phaseTimes))
+	}
+	for i := range p.phaseTimes {
+		phaseTimes[i] += time.Duration(p.phaseTimes[i].Load())
+	}
+	return phaseTimes
 }
 
 // `InitTaskStealing` creates a slice of `nWorkers` workers and DEQues to hold `Task`s for execution.
 // @memo: `worker` represents a thread executing tasks; a worker holds it's own queue
 // of tasks to execute and might steal from other workers when it's own queue is empty.
-func InitTaskStealing(nWorkers int) []*ws.Worker{
+func InitTaskStealing(nWorkers int, stealPolicy string) []*ws.Worker{
 	workers := make([]*ws.Worker, nWorkers)
 	dequeues := make([]*ws.UDEqueue, nWorkers)
 
@@ -61,10 +176,46 @@ func InitTaskStealing(nWorkers int) []*ws.Worker{
 	// Create workers; workers have access to all DEQueues (for stealing)
 	for i := range workers {
 		workers[i] = ws.NewWorker(i, dequeues)
+		workers[i].SetStealPolicy(stealPolicy)
 	}
 	return workers
 }
 
+// dequeCapacities summarizes the capacity the DEqueues of the work stealing workers of a run reached
+// (see `ws.UDEqueue.MaxCapacityReached`). DEqueues resized above `constants.InitLogCapacity` point to resize
+// pressure, i.e., a larger initial capacity would avoid copying the tasks of the workers.
+type dequeCapacities struct {
+	workers int      // number of workers summarized
+	resized []string // workers whose DEqueue grew above the initial capacity, with the capacity reached
+	max     int      // largest capacity reached by a DEqueue
+}
+
+// add summarizes the DEqueues of the workers of a pool; 'pool' names the pool in the summary (eg: "phase 1")
+// obs: the capacity reached is read atomically, so workers not stopped yet can be added too
+func (d *dequeCapacities) add(pool string, workers []*ws.Worker) {
+	for i, worker := range workers {
+		capacity := worker.MaxCapacityReached()
+		d.workers++
+		if capacity > 1<<constants.InitLogCapacity {
+			d.resized = append(d.resized, fmt.Sprintf("%s worker %d: %d", pool, i, capacity))
+		}
+		if capacity > d.max {
+			d.max = capacity
+		}
+	}
+}
+
+// print prints the summary of the capacities and the workers whose DEqueue resized, if any.
+// eg: "DEqueue capacity: initial 64, max reached 256 (1 of 12 workers resized; phase 1 worker 0: 256)"
+func (d *dequeCapacities) print() {
+	fmt.Printf("DEqueue capacity: initial %d, max reached %d (%d of %d workers resized",
+		1<<constants.InitLogCapacity, d.max, len(d.resized), d.workers)
+	if len(d.resized) > 0 {
+		fmt.Printf("; %s", strings.Join(d.resized, ", "))
+	}
+	fmt.Println(")")
+}
+
 // Divide a group of `tasks` for the full pipeline into Chunks of size `chunkSize`.
 // Example: if 1000 images and chunkSize = 100, returns [0, 100, 200, ..., 1000]
 func ChunksOfTasks(numTasks, chunkSize int) []int {
@@ -101,15 +252,37 @@ func NewTaskPhase1(pipeCtx *PipeContext, baseTask *utils.Task, curPhase int) *Ta
 
 // Loads the image from disk and build the `Kernel` for the effects to be applied.
 func (t *TaskPhase1) Execute(wID int){
-	// load image from disk
-	img, _ := png.Load(t.baseTask.InPath)
+	start := time.Now()
+	t.pipeCtx.config.events.record(EventStart, t.curPhase+1, wID, t.baseTask.InPath)
 
-	// create a kernel based on the effects to be applied to the image
-	kernels := png.CreateKernels(t.baseTask.Effects)
+	// load image from disk
+	// obs: images that can't be loaded (eg: over `png.MaxPixels`) go through the next phases as nil,
+	// so each phase still signals the task done; they are skipped by phases 2 and 3
+	img, err := t.pipeCtx.config.loadTaskImage(t.baseTask)
+	if err != nil {
+		fmt.Printf("Error loading image %s: %v\n", t.baseTask.InPath, err)
+	}
 
-	// create a task for phase of next pipeline stage and send over the respective channel
-	taskPhase2 := NewTaskPhase2(t.pipeCtx, img, kernels, t.baseTask, t.curPhase+1)
-	t.pipeCtx.channels[t.curPhase+1] <- taskPhase2
+	// create a task of the next pipeline stage for each output of the image and send it over the respective channel
+	// obs: the outputs share the loaded image; all but the last one get a clone of it (see `forEachBranch`)
+	var taskPhases2 []*TaskPhase2
+	branches := t.baseTask.Branches()
+	for i := range branches {
+		branchImg := img
+		if img != nil && i < len(branches)-1 {
+			branchImg = img.Clone()
+		}
+		// create a kernel based on the effects to be applied to the image
+		kernels := t.pipeCtx.config.createKernels(branches[i].Effects)
+		taskPhase2 := NewTaskPhase2(t.pipeCtx, branchImg, kernels, &branches[i], t.curPhase+1)
+		taskPhase2.taskStart = start
+		taskPhases2 = append(taskPhases2, taskPhase2)
+	}
+	t.pipeCtx.addPhaseTime(t.curPhase, start)
+	for _, taskPhase2 := range taskPhases2 {
+		t.pipeCtx.send(wID, t.curPhase+1, taskPhase2)
+	}
+	t.pipeCtx.config.events.record(EventFinish, t.curPhase+1, wID, t.baseTask.InPath)
 
 	// signalize this task is done to the go-routine managing the overall pipeline
 	t.pipeCtx.wgs[t.curPhase].Done()
@@ -130,6 +303,7 @@ type TaskPhase2 struct {
 	kernels 		[]*png.Kernel		// effects to be applied to the image
 	baseTask 		*utils.Task			// contains info of the image being processed	
 	curPhase 		int					// pipeline phase this task belongs to	
+	taskStart 		time.Time			// time phase 1 started loading the image; for the manifest
 }
 
 func NewTaskPhase2(pipeCtx *PipeContext, img *png.Image, kernels []*png.Kernel, baseTask *utils.Task, curPhase int) *TaskPhase2{
@@ -140,45 +314,66 @@ func NewTaskPhase2(pipeCtx *PipeContext, img *png.Image, kernels []*png.Kernel,
 // If nSubThreads == 1, the `Worker` thread itself will apply the effects.
 // If nSubThreads > 1, the `Worker` thread will slice the image and spawn `nSubThreads` to process the slices.
 func (t2 *TaskPhase2) Execute(wID int){
-	// nSubThreads > 1 => slice the image and spawn sub-threads to process the slices
-	nSubThreads := t2.pipeCtx.config.SubThreadCount
-	if nSubThreads > 1 {
-		// create slices of the image
-		imgSlices := SlicesByRow(t2.img, nSubThreads)
-		
-		// constructs to synchronize sub-threads
-		sCtx := NewSyncContext(nSubThreads)
-		sCtx.wg.Add(len(imgSlices))
-
-		// spawn subthreads to process each slice 
-		for _, imgSlice := range imgSlices {
-			go  applyManyThreads(t2.img, imgSlice, t2.kernels, sCtx)
-		}
+	start := time.Now()
+	t2.pipeCtx.config.events.record(EventStart, t2.curPhase+1, wID, t2.baseTask.InPath)
 
-		// wait for all subthreads to finish their slices
-		sCtx.wg.Wait()
-	
-	// nSubThreads == 1 => apply effects in 'kernels' to the image 'img' in this thread
-	} else {
-		applyOneThread(t2.img, t2.kernels)
+	// obs: nil if the image was not loaded in phase 1
+	if t2.img != nil {
+		t2.applyEffects()
 	}
 	
 	// create task for phase 3 with results and send to channel
 	taskPhase3 := NewTaskPhase3(t2.pipeCtx, t2.baseTask, t2.img, t2.curPhase+1)
-	t2.pipeCtx.channels[t2.curPhase+1] <- taskPhase3
+	taskPhase3.taskStart = t2.taskStart
+	t2.pipeCtx.addPhaseTime(t2.curPhase, start)
+	t2.pipeCtx.send(wID, t2.curPhase+1, taskPhase3)
+	t2.pipeCtx.config.events.record(EventFinish, t2.curPhase+1, wID, t2.baseTask.InPath)
 
 	// signalize this task is done to the go-routine managing the overall pipeline
 	t2.pipeCtx.wgs[t2.curPhase].Done()
 }
 
+// applyEffects applies the effects in `kernels` to the image `img`, in this thread or by sub-threads (see `Execute`).
+func (t2 *TaskPhase2) applyEffects() {
+	// nSubThreads > 1 => slice the image and spawn sub-threads to process the slices
+	// obs: small images are processed by fewer sub-threads (see `effectiveSubThreads`)
+	nSubThreads := effectiveSubThreads(t2.img, t2.pipeCtx.config.SubThreadCount, constants.MinRowsPerSlice)
+	if nSubThreads > 1 {
+		// slice the image; sub-threads are synchronized by a cond variable barrier between effects
+		applySlices(t2.img, t2.kernels, nSubThreads, BarrierCond, t2.pipeCtx.config.SliceStrategy, nil)
+	
+	// nSubThreads == 1 => apply effects in 'kernels' to the image 'img' in this thread
+	} else {
+		applyOneThread(t2.img, t2.kernels, nil)
+	}
+}
+
+// effectiveSubThreads returns the number of sub-threads to process 'img' with, so that each
+// slice has at least 'minRows' rows. For small images the cost of spawning and synchronizing
+// sub-threads exceeds the convolution work; they are processed by fewer threads (or in-thread).
+// Returns a value between 1 and 'requested'.
+func effectiveSubThreads(img *png.Image, requested, minRows int) int {
+	if minRows < 1 {
+		minRows = 1
+	}
+	nThreads := img.Bounds.Dy() / minRows
+	if nThreads > requested {
+		nThreads = requested
+	}
+	if nThreads < 1 {
+		nThreads = 1
+	}
+	return nThreads
+}
+
 // Apply all effects in 'kernels to a slice of 'img'. Each sub-thread waits for
 // for other sub-threads to finish the application of an effect before proceeding to the next effect.
 func applyManyThreads(img *png.Image, slice ImageSlice, kernels []*png.Kernel, ctx *syncContext) {
    
 	// loop: apply each effect in 'kernels' to the image slice
-   for _, kernel := range kernels {
+   for step, kernel := range kernels {
 	   // apply effect
-	   img.ApplyEffectSlice2(kernel, slice.YStart, slice.YEnd, slice.XStart, slice.XEnd)
+	   slice.apply(img, kernel)
 
 	   // Barrier: waits for the other threads to finish current effect before proceeding to the next. 
 	   // If last thread, reset counter, invert buffer and signal threads can start next effect.
@@ -188,6 +383,9 @@ func applyManyThreads(img *png.Image, slice ImageSlice, kernels []*png.Kernel, c
 			ctx.counter = 0
 			// invert image buffer for application of next effect (see png.Image struct definition)
 			img.Final = 1 - img.Final
+			if ctx.onStep != nil {
+				ctx.onStep(step)
+			}
 			ctx.cond.Broadcast()
 	   } else {
 			ctx.cond.Wait()
@@ -199,11 +397,15 @@ func applyManyThreads(img *png.Image, slice ImageSlice, kernels []*png.Kernel, c
 }
 
 // Apply all effects in 'kernels to the image 'img'.
-func applyOneThread(img *png.Image, kernels []*png.Kernel) {
-	for _, kernel := range kernels {
+// @onStep: optional; called after each effect with its index in 'kernels' (see `Config.stepSaver`)
+func applyOneThread(img *png.Image, kernels []*png.Kernel, onStep func(step int)) {
+	for step, kernel := range kernels {
 		img.ApplyEffect(kernel)
 		// invert image buffer for application of next effect (see png.Image struct definition)
 		img.Final = 1 - img.Final
+		if onStep != nil {
+			onStep(step)
+		}
 	}
 }
 
@@ -221,6 +423,7 @@ type TaskPhase3 struct {
 	baseTask 		*utils.Task		  // contains info of the image to be saved. Ex: outPath
 	img 			*png.Image		  // final image to be saved
 	curPhase 		int				  // pipeline phase this task belongs to
+	taskStart 		time.Time		  // time phase 1 started loading the image; for the manifest
 }
 
 func NewTaskPhase3(pipeCtx *PipeContext, baseTask *utils.Task, img *png.Image, curPhase int) *TaskPhase3{
@@ -228,9 +431,18 @@ func NewTaskPhase3(pipeCtx *PipeContext, baseTask *utils.Task, img *png.Image, c
 }
 
 // Save the image to disk and signalize main routine the task is done.
+// The buffers of the image are released once saved, to be reused by the images loaded next (see `png.ReleaseImage`).
 func (t3 *TaskPhase3) Execute(wID int){
 	// fmt.Println("Saving image: ", t3.baseTask.OutPath)
-	t3.img.Save(t3.baseTask.OutPath)
+	start := time.Now()
+	t3.pipeCtx.config.events.record(EventStart, t3.curPhase+1, wID, t3.baseTask.InPath)
+	// obs: nil if the image was not loaded in phase 1
+	if t3.img != nil {
+		savePhase3(t3)
+		png.ReleaseImage(t3.img)
+	}
+	t3.pipeCtx.addPhaseTime(t3.curPhase, start)
+	t3.pipeCtx.config.events.record(EventFinish, t3.curPhase+1, wID, t3.baseTask.InPath)
 
 	// signalize this task is done to the go-routine managing the overall pipeline
 	t3.pipeCtx.wgs[t3.curPhase].Done()
@@ -239,3 +451,9 @@ func (t3 *TaskPhase3) Execute(wID int){
 // Not used; just to implement the `ws.Runnable` interface.
 func(t3 *TaskPhase3) GetTaskID() int{return 0}
 
+// savePhase3 saves the image of 't3' and records the task done (see `Config.saveTask`); replaced by tests
+// to simulate slow writes.
+var savePhase3 = func(t3 *TaskPhase3) {
+	t3.pipeCtx.config.saveTask(t3.baseTask, t3.img, t3.taskStart)
+}
+
@@ -0,0 +1,150 @@
+package scheduler
+
+import (
+	"os"
+	"proj3/png"
+	"proj3/utils"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEffectiveSubThreads(t *testing.T) {
+	tests := []struct {
+		name                    string
+		height, requested, rows int
+		want                    int
+	}{
+		{"small image in-thread", 50, 8, 64, 1},
+		{"large image all requested", 4000, 8, 64, 8},
+		{"medium image fewer threads", 200, 8, 64, 3},
+		{"one requested", 4000, 1, 64, 1},
+		{"no minimum rows", 5, 8, 0, 5},
+	}
+	for _, test := range tests {
+		img := png.NewImage(10, test.height)
+		if got := effectiveSubThreads(img, test.requested, test.rows); got != test.want {
+			t.Errorf("%s: %d sub-threads, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPhaseTimes(t *testing.T) {
+	useTestImages(t, 6, []string{"B", "S"})
+	for _, mode := range []string{"pipebsp", "pipebspws"} {
+		const nThreads = 2
+		result, err := run(Config{DataDirs: "small", Mode: mode, ThreadCount: nThreads, PhaseTimes: true})
+		if err != nil {
+			t.Fatalf("mode %s: %v", mode, err)
+		}
+		if len(result.PhaseTimes) != 3 {
+			t.Fatalf("mode %s: phase times %v, want load, process and save", mode, result.PhaseTimes)
+		}
+		// each phase has 'nThreads' workers, so the phases sum at most 3*'nThreads' times the parallel section
+		sum := 0.0
+		for i, phaseTime := range result.PhaseTimes {
+			if phaseTime <= 0 {
+				t.Errorf("mode %s: phase %d took %vs", mode, i+1, phaseTime)
+			}
+			sum += phaseTime
+		}
+		if sum > 3*nThreads*result.TimeParallel {
+			t.Errorf("mode %s: phases took %vs in a parallel section of %vs with %d workers per phase",
+				mode, sum, result.TimeParallel, nThreads)
+		}
+
+		if result, _ := run(Config{DataDirs: "small", Mode: mode, ThreadCount: nThreads}); result.PhaseTimes != nil {
+			t.Errorf("mode %s: phase times %v not requested", mode, result.PhaseTimes)
+		}
+	}
+}
+
+func TestWritersSlowSaves(t *testing.T) {
+	const n = 8
+	save := savePhase3
+	defer func() { savePhase3 = save }()
+
+	for _, mode := range []string{"pipebsp", "pipebspws"} {
+		outDir := useTestImages(t, n, []string{"B", "S"})
+		var first sync.Once
+		handedOver := make(chan int, 1)
+		// slow writes: the first one lasts until the other images are processed and handed over to the
+		// writers, or a deadline if the compute workers are blocked by it
+		savePhase3 = func(t3 *TaskPhase3) {
+			first.Do(func() {
+				deadline := time.Now().Add(5 * time.Second)
+				for len(t3.pipeCtx.channels[2]) < n-1 && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				handedOver <- len(t3.pipeCtx.channels[2])
+			})
+			time.Sleep(5 * time.Millisecond)
+			save(t3)
+		}
+		if _, err := run(Config{DataDirs: "small", Mode: mode, ThreadCount: 2, Writers: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-handedOver; got != n-1 {
+			t.Errorf("%s: %d images handed over to the writer while it was saving the first, want %d", mode, got, n-1)
+		}
+		if entries, _ := os.ReadDir(outDir); len(entries) != n {
+			t.Errorf("%s: %d images written, want %d", mode, len(entries), n)
+		}
+	}
+}
+
+func TestPhaseThreads(t *testing.T) {
+	tests := []struct {
+		name                string
+		load, process, save int
+		nThreads, nTasks    int
+		want                []int
+	}{
+		{"defaults to the threads", 0, 0, 0, 4, 10, []int{4, 4, 4}},
+		{"each phase given", 1, 6, 2, 4, 10, []int{1, 6, 2}},
+		{"some phases given", 2, 0, 0, 4, 10, []int{2, 4, 4}},
+		{"capped by the tasks", 1, 16, 0, 8, 5, []int{1, 5, 5}},
+		{"negative is the default", -1, 3, -2, 4, 10, []int{4, 3, 4}},
+	}
+	for _, test := range tests {
+		config := Config{LoadThreads: test.load, ProcessThreads: test.process, SaveThreads: test.save}
+		if got := phaseThreads(config, test.nThreads, test.nTasks); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestLoadThreadsCap counts the images loaded at the same time by the pipelines: never more than `LoadThreads`,
+// while the other phases keep `ThreadCount` workers.
+func TestLoadThreadsCap(t *testing.T) {
+	useTestImages(t, 12, []string{"B"})
+	defer func(old func(*utils.Task, *png.BufferPool) (*png.Image, error)) { loadTaskImageFile = old }(loadTaskImageFile)
+	var inFlight, peak, loads atomic.Int64
+	loadTaskImageFile = func(task *utils.Task, pool *png.BufferPool) (*png.Image, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for old := peak.Load(); n > old && !peak.CompareAndSwap(old, n); old = peak.Load() {
+		}
+		loads.Add(1)
+		// widen the window for overlapping loads
+		time.Sleep(2 * time.Millisecond)
+		return loadImageFrom(task, pool)
+	}
+
+	for _, mode := range []string{"pipebsp", "pipebspws"} {
+		for _, loadThreads := range []int{1, 2} {
+			peak.Store(0)
+			loads.Store(0)
+			config := Config{DataDirs: "small", Mode: mode, ThreadCount: 4, LoadThreads: loadThreads}
+			if _, err := run(config); err != nil {
+				t.Fatalf("mode %s: %v", mode, err)
+			}
+			if peak.Load() > int64(loadThreads) || loads.Load() != 12 {
+				t.Errorf("mode %s, %d load threads: up to %d images loaded at a time, %d of 12 loaded",
+					mode, loadThreads, peak.Load(), loads.Load())
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package scheduler
+
+// Quality levels of `Config.Quality`: a single knob trading the precision of the outputs for speed or size,
+// by enabling the lower level options that change the pixels (see `qualityLevels`).
+// Each level is documented with the largest difference of any channel (of 65535) to the output of `QualityHigh`.
+// Obs: the difference of merging blurs is amplified by the sharpen and edge-detect effects after them, by up to
+// the sum of the absolute values of their kernels (9 for "S", 16 for "E"). eg: "B,B,B,S,E" => up to 84 on 'small'.
+const (
+	QualityHigh     = "high"     // full 16 bit precision, effects applied one at a time (default). The reference.
+	QualityBalanced = "balanced" // consecutive blurs merged into single kernels (see `OptimizeChain`). Within 2 per merge, but amplified.
+	QualityFast     = "fast"     // as balanced, convolving 8 bit channels in integers and saving 8 bits per channel: faster, and about half the size. Within 255 times the sum of the absolute values of the kernel, plus 130, more per convolution (see `png.Kernel.SetEightBit`).
+)
+
+// qualityOptions are the options enabled by a quality level
+type qualityOptions struct {
+	optimizeChain   bool // merge consecutive blurs; skips rounding the intermediate images (see `png.OptimizeChain`)
+	eightBitEffects bool // convolve the 8 most significant bits of each channel in fixed point (see `png.EightBitKernels`)
+	eightBitOutput  bool // save with 8 bits per channel, rounding each one (see `png.Image.SetEightBitOutput`)
+}
+
+// qualityLevels maps the valid values of `Config.Quality` to the options they enable. "" is `QualityHigh`.
+// Obs: the options are added to those set individually; eg: OptimizeChain stays on with `QualityHigh`.
+var qualityLevels = map[string]qualityOptions{
+	"":              {},
+	QualityHigh:     {},
+	QualityBalanced: {optimizeChain: true},
+	QualityFast:     {optimizeChain: true, eightBitEffects: true, eightBitOutput: true},
+}
+
+// validQuality returns true if 'quality' is one of `qualityLevels`
+func validQuality(quality string) bool {
+	_, ok := qualityLevels[quality]
+	return ok
+}
@@ -0,0 +1,71 @@
+package scheduler
+
+import (
+	"fmt"
+	"path/filepath"
+	"proj3/png"
+	"testing"
+)
+
+// maxDiff returns the largest difference of any channel of the pixels of 'a' and 'b', of the same bounds
+func maxDiff(a, b *png.Image) int {
+	diff := 0
+	finalA, _ := a.GetInputOutputPixels()
+	finalB, _ := b.GetInputOutputPixels()
+	for y := a.Bounds.Min.Y; y < a.Bounds.Max.Y; y++ {
+		for x := a.Bounds.Min.X; x < a.Bounds.Max.X; x++ {
+			pa, pb := finalA.RGBA64At(x, y), finalB.RGBA64At(x, y)
+			for _, d := range []int{int(pa.R) - int(pb.R), int(pa.G) - int(pb.G), int(pa.B) - int(pb.B), int(pa.A) - int(pb.A)} {
+				if d < 0 {
+					d = -d
+				}
+				if d > diff {
+					diff = d
+				}
+			}
+		}
+	}
+	return diff
+}
+
+// each quality level saves outputs within its documented tolerance of those of the high quality reference
+func TestQualityTolerance(t *testing.T) {
+	tests := []struct {
+		effects        []string
+		balanced, fast int // largest difference to high allowed for each level
+	}{
+		// fast: the merged blur convolves 8 bit channels, within 255 (sum of absolute values 1) + 130 of balanced
+		{[]string{"B", "B"}, 2, 2 + 385},
+		{[]string{"G", "B", "B"}, 2, 2 + 385},
+		// the difference of the merge amplified by the sharpen after it (sum of absolute values 9), which truncates too;
+		// fast: the sharpen amplifies the difference of the 8 bit blur and adds its own, within 255*9 + 130
+		{[]string{"B", "B", "S"}, 2*9 + 1, 2*9 + 1 + 385*9 + 2425},
+	}
+	for _, test := range tests {
+		outputs := make(map[string][]*png.Image)
+		for _, quality := range []string{QualityHigh, QualityBalanced, QualityFast} {
+			outDir := useTestImages(t, 3, test.effects)
+			if _, err := run(Config{DataDirs: "small", Mode: "s", Quality: quality}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				img, err := png.Load(filepath.Join(outDir, fmt.Sprintf("small_IMG_%d_Out.png", i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				outputs[quality] = append(outputs[quality], img)
+			}
+		}
+		for quality, tolerance := range map[string]int{QualityBalanced: test.balanced, QualityFast: test.fast} {
+			for i, img := range outputs[quality] {
+				if diff := maxDiff(img, outputs[QualityHigh][i]); diff > tolerance {
+					t.Errorf("%v, %s: image %d within %d of high, want at most %d", test.effects, quality, i, diff, tolerance)
+				}
+			}
+		}
+	}
+
+	if _, err := run(Config{DataDirs: "small", Mode: "s", Quality: "low"}); err == nil {
+		t.Error("unknown quality: no error")
+	}
+}
@@ -0,0 +1,120 @@
+package scheduler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Replay: a `Result` of the results file records the settings of its run in its mode, threads and data directory,
+// so a data point of a benchmark can be run again as it was (see `ConfigFromResult`). eg:
+// {"mode": "pipebspws_2_4_shared", "threads": 8, ...} => editor small pipebspws 8 2 4 with -sharedpool
+// Obs: settings not recorded in the mode (eg: -pinprocs, -roundrobin, the effects file) are the defaults of a run.
+
+// ConfigFromResult returns the configuration of the run giving 'result': the inverse of the mode of the `Result`
+// of each scheduler scheme (eg: `RunPipeBSPWS`). The measurements of 'result' are not used, but for
+// `Config.PhaseTimes` and `Config.PeakMem`, set if it reports them.
+// Returns an error if the mode is not of a scheme writing results, or has a suffix the scheme doesn't give.
+func ConfigFromResult(result Result) (Config, error) {
+	parts := strings.Split(result.Mode, "_")
+	config := Config{Mode: parts[0], ThreadCount: result.Threads, SubThreadCount: 1, DataDirs: result.DataDir,
+		PhaseTimes: len(result.PhaseTimes) > 0, PeakMem: result.PeakHeapInuse > 0 || result.PeakGoroutines > 0}
+	if _, ok := runModes[config.Mode]; !ok {
+		return Config{}, fmt.Errorf("replaying %q: mode %q does not write results", result.Mode, config.Mode)
+	}
+
+	suffixes := parts[1:]
+	switch config.Mode {
+	case "pipebsp", "pipebspws", "pipebspwscompare":
+		// obs: the number of sub-threads is always given; the chunk size only if not 0 (all images)
+		if len(suffixes) == 0 {
+			return Config{}, fmt.Errorf("replaying %q: missing number of sub-threads", result.Mode)
+		}
+		subThreads, err := strconv.Atoi(suffixes[0])
+		if err != nil {
+			return Config{}, fmt.Errorf("replaying %q: invalid number of sub-threads %q", result.Mode, suffixes[0])
+		}
+		config.SubThreadCount = subThreads
+		suffixes = suffixes[1:]
+		if len(suffixes) > 0 {
+			if chunkSize, err := strconv.Atoi(suffixes[0]); err == nil {
+				config.ChunkSize = chunkSize
+				suffixes = suffixes[1:]
+			}
+		}
+	}
+	for _, suffix := range suffixes {
+		if !config.setModeSuffix(suffix) {
+			return Config{}, fmt.Errorf("replaying %q: unknown suffix %q of mode %s", result.Mode, suffix, config.Mode)
+		}
+	}
+	return config, nil
+}
+
+// setModeSuffix sets the setting given by 'suffix' of the mode of a `Result` (see `ConfigFromResult`).
+// Returns false if 'suffix' is not one of the mode of 'config'.
+func (config *Config) setModeSuffix(suffix string) bool {
+	pipe := config.Mode == "pipebsp" || config.Mode == "pipebspws"
+	switch {
+	case config.Mode == "parfiles" && suffix == "sem":
+		config.Semaphore = true
+	case config.Mode == "parfiles" && suffix == "lockfree":
+		config.LockFreeQueue = true
+	case config.Mode == "parslices" && validBarrier(suffix):
+		config.Barrier = suffix
+	case (config.Mode == "parslices" || pipe) && suffix != "" && validSliceStrategy(suffix):
+		config.SliceStrategy = suffix
+	case config.Mode == "pipebspws" && suffix == "shared":
+		config.SharedPool = true
+	case config.Mode == "pipebspws" && suffix == "auto":
+		// obs: the number of sub-threads is the one picked; it is also the maximum tried when replaying
+		config.AutoSubThreads = true
+	case pipe && strings.HasPrefix(suffix, "phases"):
+		_, err := fmt.Sscanf(suffix, "phases%d-%d-%d", &config.LoadThreads, &config.ProcessThreads, &config.SaveThreads)
+		return err == nil
+	default:
+		return false
+	}
+	return true
+}
+
+// ReadResult returns the `Result` given by 'arg': the line 'arg' of the results file (from 1), if a number,
+// or the JSON of a `Result` otherwise. eg: "3"; '{"mode": "parfiles", "threads": 4, "datadir": "small"}'
+func ReadResult(arg string) (Result, error) {
+	text := arg
+	if lineNumber, err := strconv.Atoi(arg); err == nil {
+		line, err := resultsLine(lineNumber)
+		if err != nil {
+			return Result{}, err
+		}
+		text = line
+	}
+	var result Result
+	if err := json.Unmarshal([]byte(text), &result); err != nil {
+		return Result{}, fmt.Errorf("parsing result %q: %w", text, err)
+	}
+	return result, nil
+}
+
+// resultsLine returns the line 'lineNumber' (from 1) of the results file
+func resultsLine(lineNumber int) (string, error) {
+	file, err := os.Open(resultsPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		if n == lineNumber {
+			return scanner.Text(), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s has no line %d", resultsPath, lineNumber)
+}
@@ -0,0 +1,59 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// replayed returns the settings of 'config' recorded in the `Result` of its run (see `ConfigFromResult`)
+func replayed(config Config) Config {
+	return Config{Mode: config.Mode, ThreadCount: config.ThreadCount, SubThreadCount: config.SubThreadCount,
+		ChunkSize: config.ChunkSize, DataDirs: config.DataDirs, Semaphore: config.Semaphore,
+		LockFreeQueue: config.LockFreeQueue, Barrier: config.Barrier, SliceStrategy: config.SliceStrategy,
+		SharedPool: config.SharedPool, LoadThreads: config.LoadThreads, ProcessThreads: config.ProcessThreads,
+		SaveThreads: config.SaveThreads, PhaseTimes: config.PhaseTimes}
+}
+
+func TestReplayRoundTrip(t *testing.T) {
+	useTestImages(t, 4, []string{"B", "S"})
+	configs := []Config{
+		{Mode: "s", ThreadCount: 1, SubThreadCount: 1},
+		{Mode: "parfiles", ThreadCount: 3, SubThreadCount: 1},
+		{Mode: "parfiles", ThreadCount: 2, SubThreadCount: 1, Semaphore: true},
+		{Mode: "parfiles", ThreadCount: 2, SubThreadCount: 1, LockFreeQueue: true},
+		{Mode: "parslices", ThreadCount: 3, SubThreadCount: 1, Barrier: BarrierCond, SliceStrategy: SliceInterleaved},
+		{Mode: "parslices", ThreadCount: 2, SubThreadCount: 1, SliceStrategy: SliceHalo},
+		{Mode: "pipebsp", ThreadCount: 2, SubThreadCount: 3, ChunkSize: 2},
+		{Mode: "pipebsp", ThreadCount: 2, SubThreadCount: 2, LoadThreads: 1, ProcessThreads: 3, SaveThreads: 1},
+		{Mode: "pipebspws", ThreadCount: 3, SubThreadCount: 2, SharedPool: true, PhaseTimes: true},
+		{Mode: "pipebspws", ThreadCount: 2, SubThreadCount: 2, ChunkSize: 3, SliceStrategy: SliceBands},
+	}
+	for _, config := range configs {
+		config.DataDirs = "small"
+		result, err := run(config)
+		if err != nil {
+			t.Fatalf("%+v: %v", config, err)
+		}
+		// as read from a line of the results file
+		line, _ := json.Marshal(result)
+		read, err := ReadResult(string(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ConfigFromResult(read)
+		if err != nil {
+			t.Errorf("%s: %v", result.Mode, err)
+			continue
+		}
+		if !reflect.DeepEqual(replayed(got), replayed(config)) {
+			t.Errorf("%s replayed as %+v, want %+v", result.Mode, replayed(got), replayed(config))
+		}
+	}
+
+	for _, mode := range []string{"bench", "parfiles_nope", "pipebsp", "pipebsp_x", "parslices_sem", "parslices_lockfree"} {
+		if _, err := ConfigFromResult(Result{Mode: mode, Threads: 2}); err == nil {
+			t.Errorf("%s replayed", mode)
+		}
+	}
+}
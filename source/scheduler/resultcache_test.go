@@ -0,0 +1,99 @@
+package scheduler
+
+import (
+	"fmt"
+	"path/filepath"
+	"proj3/png"
+	"proj3/utils"
+	"testing"
+)
+
+// cacheTasks saves 'n' different 40x30 images to a temporary directory and returns a task blurring each of them
+func cacheTasks(t *testing.T, n int) []utils.Task {
+	t.Helper()
+	dir := t.TempDir()
+	tasks := make([]utils.Task, n)
+	for i := range tasks {
+		path := filepath.Join(dir, fmt.Sprintf("IMG_%d.png", i))
+		if err := png.NewImageFromRGBA64(testImage(40, 30, i)).Save(path); err != nil {
+			t.Fatal(err)
+		}
+		tasks[i] = utils.Task{InPath: path, OutPath: path + "_Out.png", Effects: []string{"B", "S"}}
+	}
+	return tasks
+}
+
+// applyCounted applies the effects of 'task' to its image through 'cache', counting the calls to the effects in 'calls'
+func applyCounted(t *testing.T, cache *resultCache, task *utils.Task, calls *int) *png.Image {
+	t.Helper()
+	img, err := png.Load(task.InPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.apply(task, img, func() {
+		*calls++
+		img.ApplyEffects(png.CreateKernels(task.Effects))
+	})
+	return img
+}
+
+func TestResultCacheHit(t *testing.T) {
+	task := cacheTasks(t, 1)[0]
+	cache := newResultCache(1 << 20)
+	calls := 0
+	first := applyCounted(t, cache, &task, &calls)
+	second := applyCounted(t, cache, &task, &calls)
+	if calls != 1 {
+		t.Errorf("effects applied %d times for the same task twice, want 1", calls)
+	}
+	if !second.Equal(first) {
+		t.Error("the cached result differs from the computed one")
+	}
+
+	// the same input with other effects is another result
+	other := task
+	other.Effects = []string{"B"}
+	applyCounted(t, cache, &other, &calls)
+	if calls != 2 {
+		t.Errorf("effects applied %d times after a task with other effects, want 2", calls)
+	}
+
+	// no cache: always computed
+	calls = 0
+	applyCounted(t, nil, &task, &calls)
+	applyCounted(t, nil, &task, &calls)
+	if calls != 2 {
+		t.Errorf("effects applied %d times without a cache, want 2", calls)
+	}
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	tasks := cacheTasks(t, 3)
+	// room for the pixels of two images
+	cache := newResultCache(2 * 40 * 30 * 8)
+	calls := 0
+	applyCounted(t, cache, &tasks[0], &calls)
+	applyCounted(t, cache, &tasks[1], &calls)
+	// hit: the first task becomes the most recently used
+	applyCounted(t, cache, &tasks[0], &calls)
+	// evicts the second task, the least recently used
+	applyCounted(t, cache, &tasks[2], &calls)
+	if calls != 3 {
+		t.Fatalf("effects applied %d times before the eviction, want 3", calls)
+	}
+
+	for _, test := range []struct {
+		task int
+		hit  bool
+	}{{0, true}, {2, true}, {1, false}} {
+		before := calls
+		applyCounted(t, cache, &tasks[test.task], &calls)
+		if hit := calls == before; hit != test.hit {
+			t.Errorf("task %d: cache hit %v, want %v", test.task, hit, test.hit)
+		}
+	}
+	if cache.bytes > cache.maxBytes || len(cache.entries) != cache.lru.Len() {
+		t.Errorf("%d bytes cached out of %d, %d entries and %d in the LRU list",
+			cache.bytes, cache.maxBytes, len(cache.entries), cache.lru.Len())
+	}
+}
@@ -0,0 +1,72 @@
+package scheduler
+
+import (
+	"fmt"
+	"proj3/png"
+	"proj3/utils"
+)
+
+// Round trip check: applies the effects of each image followed by their inverse (see `png.InverseChain`)
+// and compares the result with the original pixels. Chains of invertible effects must give them back exactly,
+// so any difference points to a numeric issue in the effects (eg: rounding or clamping).
+
+// printRoundTrips runs the round trip of each task of the run and prints whether it gave back the original image.
+// Images with effects that are not invertible are reported and skipped. No outputs are saved.
+func printRoundTrips(config Config) {
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	var exact, differ, skipped int
+	for i := range taskQueue.Tasks {
+		task := &taskQueue.Tasks[i]
+		img, err := loadImage(task)
+		if err != nil {
+			fmt.Printf("%s: error loading image: %v\n", task.InPath, err)
+			skipped++
+			continue
+		}
+		// obs: each output is a round trip of its own chain
+		forEachBranch(task, img, func(task *utils.Task, img *png.Image) {
+			changed, err := roundTrip(img, task.Effects)
+			switch {
+			case err != nil:
+				fmt.Printf("%s: skipped: %v\n", task.InPath, err)
+				skipped++
+			case changed > 0:
+				fmt.Printf("%s: %d pixels differ from the original\n", task.InPath, changed)
+				differ++
+			default:
+				fmt.Printf("%s: ok\n", task.InPath)
+				exact++
+			}
+		})
+	}
+	fmt.Printf("Round trips: %d exact, %d differ, %d skipped\n", exact, differ, skipped)
+}
+
+// roundTrip applies the chain of 'effects' to 'img' followed by its inverse and returns the number of pixels
+// differing from the original ones; 0 if the chain was undone exactly.
+// Returns an error wrapping `png.ErrNotInvertible` without applying any effect if the chain is not invertible.
+func roundTrip(img *png.Image, effects []string) (int, error) {
+	inverse, err := png.InverseChain(effects)
+	if err != nil {
+		return 0, err
+	}
+	original := img.Result()
+	chain := append(append([]string{}, effects...), inverse...)
+	applyOneThread(img, png.CreateKernels(chain), nil)
+
+	final := img.Result()
+	changed := 0
+	for i := 0; i < len(original.Pix); i += 8 {
+		for c := i; c < i+8; c++ {
+			if original.Pix[c] != final.Pix[c] {
+				changed++
+				break
+			}
+		}
+	}
+	return changed, nil
+}
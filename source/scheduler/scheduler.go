@@ -1,37 +1,672 @@
 package scheduler
 
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"proj3/png"
+	"proj3/utils"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
 type Config struct {
 	DataDirs string //Represents the data directories to use to load the images.
 	Mode     string // Represents which scheduler scheme to use
 	ThreadCount int // Runs parallel version with the specified number of threads
 	SubThreadCount int // Only for PipeBSP modes. Number of routines a worker can spawn for the processing of each image.
 	ChunkSize int // Only for PipeBSP modes. Number of images to be processed at the same time. Defaults to all images provided.
+	BenchMode string // Only for bench and compute modes. Scheduler scheme to benchmark.
+	BenchThreads []int // Only for bench and compute modes. Thread counts to sweep.
+	BenchRepeat int // Only for bench and compute modes. Number of runs for each thread count. Defaults to 1.
+	PinProcs bool // If true, sets GOMAXPROCS to ThreadCount during the run (see `pinProcs`).
+	Addr string // Only for serve mode. Address the HTTP server listens on. Defaults to ":8080".
+	RoundRobin bool // Only for PipeBSPWS modes. If true, tasks are interleaved among workers instead of divided in blocks.
+	StealPolicy string // Only for PipeBSPWS modes. Tasks a worker steals at a time: "one" (default) or "half" of the victim's queue.
+	PhaseTimes bool // Only for PipeBSP modes. If true, the aggregate time of each pipeline phase is added to the `Result`.
+	BacklogInterval time.Duration // Only for PipeBSP modes. If positive, the backlog of each pipeline phase is sampled at this interval and its maximum and average printed at the end of the run (see `phaseBacklogs`).
+	CheckpointPath string // If given, the output path of each completed image is recorded in this file.
+	Resume bool // If true, images recorded in the checkpoint file are not processed again. Requires CheckpointPath.
+	checkpoint *utils.Checkpoint // checkpoint of the run; set by `run` from CheckpointPath
+	tasks *utils.TaskQueue // queue of tasks of the run; set by `run`, so the mode doesn't build it again (see `createTasks`)
+	EventLog string // Only for PipeBSP modes. If given, the start and finish of each pipeline task and the events of the work stealing workers are written to this file, one JSON per line (see `Event`).
+	events *eventLog // event log of the run; set by `run` from EventLog
+	ManifestPath string // If given, a JSON array describing each processed image is written to this file (eg: manifest.json).
+	manifest *utils.Manifest // manifest of the run; set by `run` from ManifestPath
+	PeakMem bool // If true, the peak heap in use and number of goroutines during the run are added to the `Result` (see `memSampler`).
+	Shuffle bool // If true, the order of the tasks is shuffled before distributing them to workers (eg: to load test work stealing).
+	Seed int64 // Seed of the shuffle and of SampleCount; the same seed gives the same order and sample.
+	SortTasks bool // If true, the tasks are sorted by input path before distributing them to workers, instead of in the order of the effects file and data directories (see `sortTasks`). Excludes Shuffle.
+	Sample int // If above 1, only every Sample-th task is processed (the 1st, the Sample+1-th, ...), eg: to preview the results of a large batch (see `sampleTasks`).
+	SampleCount int // If positive, only a random sample of this many tasks is processed, chosen with Seed. Excludes Sample.
+	Barrier string // Only for parslices. Strategy synchronizing the slices between effects: "wg" (default), "cond" or "pool" (see `applySlices`).
+	SliceStrategy string // Only for parslices and PipeBSP modes. Division of each image into slices: "bands" (default), "interleaved" rows (see `SlicesByRow`) or "halo" bands with buffers per slice (see `SliceHalo`).
+	LoadThreads int // Only for PipeBSP modes (separate pools). If positive, number of phase 1 workers (loading images) instead of ThreadCount (see `phaseThreads`).
+	ProcessThreads int // Only for PipeBSP modes (separate pools). If positive, number of phase 2 workers (applying the effects) instead of ThreadCount.
+	SaveThreads int // Only for PipeBSP modes (separate pools). If positive, number of phase 3 workers (saving images) instead of ThreadCount.
+	Writers int // Only for PipeBSP modes. If positive, images are saved by a dedicated pool of 'Writers' goroutines instead of 'ThreadCount' phase 3 workers.
+	MaxPixels int // If positive, images with more pixels (width x height) are rejected before being decoded (see `png.MaxPixels`).
+	OutArchive string // Only for the archive mode. If given, outputs are written to this archive (.zip, .tar.gz or .tar) instead of the output directory.
+	ThumbSize int // Only for the thumbgrid mode. Side of the cells of the grids, in pixels. Defaults to `constants.ThumbSize`.
+	DirEffects map[string][]string // Optional effect chain per data directory, overriding effects.txt (see `utils.LoadDirEffects`).
+	CopyUnchanged bool // If true, outputs whose pixels equal the source are copied from the source file instead of re-encoded (see `saveOutput`).
+	GrayOutput bool // If true, outputs whose pixels are gray and opaque (eg: after a grayscale effect) are saved as single channel PNGs (see `png.Image.SetGrayOutput`).
+	EmbedProvenance bool // If true, outputs record the effect chain applied to them in a tEXt chunk. eg: "Effects" => "B,B,S" (see `saveOutput`).
+	SaveIntermediates bool // Only for s, parfiles and parslices. If true, the image is also saved after each effect (see `stepSaver`).
+	ResultCacheSize int // Only for s, parfiles and parslices. If positive, processed pixels are cached up to this many bytes, so repeated tasks skip the effects (see `resultCache`).
+	results *resultCache // cache of processed pixels; set by `run` from ResultCacheSize, or shared by the runs of a benchmark sweep (see `RunBench`)
+	Semaphore bool // Only for parfiles. If true, one goroutine per image is dispatched, bounded to ThreadCount at a time by a semaphore (see `dispatchTasks`).
+	LockFreeQueue bool // Only for parfiles, without Semaphore. If true, workers take the images from a lock-free queue instead of the TAS locked one (see `utils.LockFreeQueue`).
+	ContentHash bool // If true, output names embed a hash of the input image and effects. eg: IMG_2029_Out.<hash>.png (see `utils.ContentHash`).
+	AutoSubThreads bool // Only for PipeBSPWS modes. If true, the first images are processed with different sub-thread counts (up to SubThreadCount, or GOMAXPROCS if 1) and the fastest is used for the rest (see `tuneSubThreads`).
+	LIFO bool // Only for PipeBSPWS modes. If true, each worker processes its most recently added images first instead of in the order of the effects file (see `addPhase1Tasks`).
+	SharedPool bool // Only for PipeBSPWS modes. If true, the three pipeline phases share one pool of 'ThreadCount' workers instead of one pool each.
+	CheckOrder bool // If true, prints a warning for effect chains whose order changes the result (see `png.AnalyzeEffectChain`).
+	Effects []string // If not nil, the effect chain applied to all images of the data directories instead of the entries of the effects file (see `sourceTasks`).
+	InPlace bool // Only for s, parfiles, parslices and PipeBSP modes. If true, images whose effects are all point effects are loaded with a single buffer, which the effects write back into (see `loadTaskImage`).
+	WorkerPools bool // Only for parfiles and batch modes. If true, each worker loads its images into the buffers of the images it already saved instead of allocating new ones (see `png.BufferPool`).
+	HashManifest string // Only for the verify mode. Path of the manifest of expected output hashes; created if it does not exist (see `printVerification`).
+	Context context.Context // Only for the batch mode. If cancelled, no more images are started and the run stops once the images in progress are done (see `RunBatch`). Defaults to never cancelled.
+	StatePath string // Only for the batch mode. Path of the state file recording the completed outputs, so the batch can be resumed (see `batchState`).
+	SnapshotInterval time.Duration // Only for the batch mode. Time between snapshots of the state file. Defaults to `constants.SnapshotInterval`.
+	batch *batchState // state of the batch; set by `RunBatch` from StatePath
+	NormalizeKernels bool // Only for s, parfiles, parslices and PipeBSP modes. If true, custom kernels with a positive sum are scaled to sum 1 (see `png.Kernel.Normalize`).
+	Quality string // Precision of the outputs traded for speed or size: "high" (default), "balanced" or "fast", each enabling more of the options changing the pixels (see `qualityLevels`).
+	OptimizeChain bool // Only for s, parfiles, parslices and PipeBSP modes. If true, consecutive blurs are merged into single kernels, saving passes over the image (see `png.OptimizeChain`).
+}
+
+// Result contains the times and settings of a run.
+// Obs: the JSON tags match the `Data` struct parsed by `benchmark/stats.go`.
+type Result struct {
+	Mode         string  `json:"mode"`
+	Threads      int     `json:"threads"`
+	TimeElapsed  float64 `json:"timeElapsed"`
+	TimeParallel float64 `json:"timeParallel"`
+	DataDir      string  `json:"datadir"`
+	PhaseTimes   []float64 `json:"phaseTimes,omitempty"` // Only for PipeBSP modes. Aggregate seconds spent in load, process and save.
+	PeakHeapInuse uint64   `json:"peakHeapInuse,omitempty"` // Peak bytes of heap in use during the run. Only if `Config.PeakMem`.
+	PeakGoroutines int     `json:"peakGoroutines,omitempty"` // Peak number of goroutines during the run. Only if `Config.PeakMem`.
+}
+
+// phaseTimesResult returns the pipeline 'phaseTimes' in seconds if 'config.PhaseTimes' is true; nil otherwise.
+// Obs: times are summed over all workers, so they can exceed the elapsed time of the run.
+func phaseTimesResult(config Config, phaseTimes []time.Duration) []float64 {
+	if !config.PhaseTimes {
+		return nil
+	}
+	seconds := make([]float64, len(phaseTimes))
+	for i, phaseTime := range phaseTimes {
+		seconds[i] = phaseTime.Seconds()
+	}
+	return seconds
 }
 
 // Little modification from original: results file common to all scheduling schemes
 const resultsPath = "./benchmark/results.txt"
 
+// writeResult appends 'result' as a JSON line to the results file
+func writeResult(result Result) {
+	writeBytes, _ := json.Marshal(result)
+	utils.WriteToFile(resultsPath, string(writeBytes)+"\n")
+}
+
+// runModes maps each scheduler scheme to the function running it. Each run writes its `Result`.
+var runModes = map[string]func(Config) (Result, error){
+	"s":                RunSequential,
+	"parfiles":         RunParallelFiles,
+	"parslices":        RunParallelSlices,
+	"pipebsp":          RunPipeBSP,
+	"pipebspws":        RunPipeBSPWS,
+	"pipebspwscompare": RunPipeBSPWSCompare,
+	"archive":          RunArchive,
+	"thumbgrid":        RunThumbGrid,
+	"batch":            RunBatch,
+}
+
+// toolModes maps the modes that do not write a `Result` themselves to the function running them.
+var toolModes = map[string]func(Config){
+	// each run of the sweep writes its own result (and pins GOMAXPROCS to its own thread count)
+	"bench": func(config Config) { RunBench(config) },
+	// same as bench, timing only the application of the effects to images loaded once
+	"compute": func(config Config) {
+		if _, err := RunComputeBench(config); err != nil {
+			fmt.Println("Error:", err)
+		}
+	},
+	// same as bench, comparing the barrier strategies of parslices
+	"barriers": func(config Config) {
+		if _, err := RunBarrierBench(config); err != nil {
+			fmt.Println("Error:", err)
+		}
+	},
+	// no images are processed; no results to write
+	"estimate": printEstimate,
+	// no outputs are saved; only the round trip of each image is reported
+	"roundtrip": printRoundTrips,
+	// no outputs are saved; only their hashes are checked against the manifest
+	"verify": printVerification,
+	// runs until the server fails; no results to write
+	"serve": func(config Config) {
+		if err := RunServer(config); err != nil {
+			fmt.Println("Error running server:", err)
+		}
+	},
+}
+
+// Modes returns the names of all modes accepted by `Schedule`, sorted.
+func Modes() []string {
+	modes := make([]string, 0, len(runModes)+len(toolModes))
+	for mode := range runModes {
+		modes = append(modes, mode)
+	}
+	for mode := range toolModes {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	return modes
+}
+
 //Run the correct version based on the Mode field of the configuration value
 func Schedule(config Config) {
-	if config.Mode == "s" {
-		RunSequential(config)
-
-	} else if config.Mode == "parfiles" {
-		RunParallelFiles(config)
-
-	} else if config.Mode == "parslices" {
-		RunParallelSlices(config)
-	
-	} else if config.Mode == "pipebsp" {
-		RunPipeBSP(config)
-	
-	} else if config.Mode == "pipebspws" {
-		RunPipeBSPWS(config)
-
-	} else if config.Mode == "pipebspwscompare" {
-		RunPipeBSPWSCompare(config)
-			
-	} else {
+	defer pinProcs(config)()
+	defer limitPixels(config)()
+	if config.CheckOrder {
+		checkEffectOrder(config)
+	}
+	if runTool, ok := toolModes[config.Mode]; ok {
+		runTool(config)
+		return
+	}
+	result, err := run(config)
+	if errors.Is(err, ErrNothingToResume) {
+		// not an error: the run completed before
+		fmt.Println("Resuming: all images already processed")
+		return
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	writeResult(result)
+}
+
+// ErrNoTasks is returned when the effects file and data directories give no images to process
+var ErrNoTasks = errors.New("no tasks to process: effects file is empty or no input images found in the data directories")
+
+// ErrNothingToResume is returned when resuming a run whose images are all recorded in the checkpoint: the run is complete
+var ErrNothingToResume = errors.New("nothing to resume: all images are recorded in the checkpoint")
+
+// ErrOutputCollision is returned when several tasks of the run write to the same output path (see `utils.DetectCollisions`)
+var ErrOutputCollision = errors.New("output path collisions")
+
+// checkCollisions returns an error wrapping `ErrOutputCollision` and listing the colliding outputs of 'tasks', if any.
+func checkCollisions(tasks []utils.Task) error {
+	collisions := utils.DetectCollisions(tasks)
+	if len(collisions) == 0 {
+		return nil
+	}
+	lines := make([]string, len(collisions))
+	for i, collision := range collisions {
+		lines[i] = collision.String()
+	}
+	return fmt.Errorf("%w: %s", ErrOutputCollision, strings.Join(lines, "; "))
+}
+
+// checkTasks returns the queue of tasks of the run (see `createTasks`), or `ErrNoTasks` if there are no tasks to process,
+// or an error wrapping `ErrOutputCollision` if some of them write to the same output (see `checkCollisions`).
+// Obs: all modes assume at least one task (eg: the number of threads is capped by the number of tasks).
+func checkTasks(config Config) (*utils.TaskQueue, error) {
+	// images of the archive mode are not in data directories; it checks its own tasks
+	if config.Mode == "archive" {
+		return nil, nil
+	}
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		return nil, err
+	}
+	// obs: outputs are checked as written, i.e., with their content hashes if any
+	if err := checkCollisions(taskQueue.Tasks); err != nil {
+		return nil, err
+	}
+
+	for _, task := range taskQueue.Tasks {
+		if _, err := os.Stat(task.InPath); err == nil {
+			return taskQueue, nil
+		}
+	}
+	return nil, ErrNoTasks
+}
+
+// createTasks returns the queue of tasks of the run given the data directories and effects file.
+// If shuffling, the tasks are shuffled (see `shuffleTasks`); if sorting, they are sorted (see `sortTasks`). With `ContentHash`, output paths embed the hash of the task. If resuming, tasks whose output is recorded in the checkpoint are skipped; `ErrNothingToResume` is returned if all of them are.
+// Obs: for tasks with several outputs, only the outputs not recorded are kept; the task is skipped if all of them are.
+// Obs: within a run, the queue is built once by `run` (eg: inputs are hashed once) and returned to the mode as is.
+func createTasks(config Config) (*utils.TaskQueue, error) {
+	if config.tasks != nil {
+		return config.tasks, nil
+	}
+	taskQueue, err := sourceTasks(config, config.DataDirs)
+	if err != nil {
+		return nil, err
+	}
+	if config.Shuffle {
+		shuffleTasks(taskQueue.Tasks, config.Seed)
+	}
+	if config.SortTasks {
+		sortTasks(taskQueue.Tasks)
+	}
+	if config.Sample > 1 || config.SampleCount > 0 {
+		taskQueue.Tasks = sampleTasks(taskQueue.Tasks, config.Sample, config.SampleCount, config.Seed)
+	}
+	// obs: before resuming, so only images whose output with the same content was completed are skipped
+	if config.ContentHash {
+		utils.AddContentHashes(taskQueue.Tasks, nil)
+	}
+	if config.Resume {
+		pending := skipDone(taskQueue.Tasks, config.checkpoint.Load())
+		skipped := len(taskQueue.Tasks) - len(pending)
+		if skipped > 0 && len(pending) == 0 {
+			return nil, ErrNothingToResume
+		}
+		if skipped > 0 {
+			fmt.Printf("Resuming: skipping %d images already processed\n", skipped)
+		}
+		taskQueue.Tasks = pending
+	}
+	return taskQueue, nil
+}
+
+// skipDone removes from 'tasks' the outputs whose path is in 'done', and the tasks with no outputs left.
+// The remaining tasks are kept in order, in the memory of 'tasks'.
+func skipDone(tasks []utils.Task, done map[string]bool) []utils.Task {
+	pending := tasks[:0]
+	for _, task := range tasks {
+		if len(task.Outputs) > 0 {
+			var outputs []utils.Output
+			for _, output := range task.Outputs {
+				if !done[output.OutPath] {
+					outputs = append(outputs, output)
+				}
+			}
+			if task.Outputs = outputs; len(outputs) > 0 {
+				pending = append(pending, task)
+			}
+			continue
+		}
+		if !done[task.OutPath] {
+			pending = append(pending, task)
+		}
+	}
+	return pending
+}
+
+// sourceTasks returns the tasks of the images of 'dataDirs': with the effects of the effects file (see `utils.CreateTasks`),
+// or with `Effects` applied to all images of the directories if given (see `utils.CreateEffectsTasks`).
+func sourceTasks(config Config, dataDirs string) (*utils.TaskQueue, error) {
+	if config.Effects != nil {
+		return utils.CreateEffectsTasks(dataDirs, config.Effects, config.DirEffects)
+	}
+	return utils.CreateTasks(dataDirs, config.DirEffects)
+}
+
+// shuffleTasks shuffles 'tasks' in place with a generator seeded with 'seed', so the order is reproducible.
+// Tasks are independent, so the outputs are the same; only their distribution among workers changes.
+func shuffleTasks(tasks []utils.Task, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(tasks), func(i, j int) { tasks[i], tasks[j] = tasks[j], tasks[i] })
+}
+
+// sortTasks sorts 'tasks' in place by input path, so the order doesn't depend on the effects file and data directories.
+// Tasks of the same input keep their order. eg: sequential runs process the images in the order of their paths.
+// Obs: parallel modes still complete the tasks in any order; only their distribution among workers is fixed.
+func sortTasks(tasks []utils.Task) {
+	sort.SliceStable(tasks, func(i, j int) bool { return tasks[i].InPath < tasks[j].InPath })
+}
+
+// sampleTasks returns every 'every'-th task of 'tasks' if 'every' is above 1, or else a random sample of 'count' tasks
+// chosen with a generator seeded with 'seed', so the sample is reproducible. All tasks are returned if 'count' is not
+// below their number. The sampled tasks keep their order, in the memory of 'tasks'.
+// eg: every = 3 => tasks 0, 3, 6, ...
+func sampleTasks(tasks []utils.Task, every int, count int, seed int64) []utils.Task {
+	sampled := tasks[:0]
+	if every > 1 {
+		for i := 0; i < len(tasks); i += every {
+			sampled = append(sampled, tasks[i])
+		}
+		return sampled
+	}
+	if count >= len(tasks) {
+		return tasks
+	}
+	keep := make([]bool, len(tasks))
+	for _, i := range rand.New(rand.NewSource(seed)).Perm(len(tasks))[:count] {
+		keep[i] = true
+	}
+	for i, task := range tasks {
+		if keep[i] {
+			sampled = append(sampled, task)
+		}
+	}
+	return sampled
+}
+
+// printEstimate prints the theoretical work of processing the tasks of the run (see `utils.EstimateWork`).
+func printEstimate(config Config) {
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	estimate := utils.EstimateWork(taskQueue.Tasks, png.KernelSizes())
+
+	fmt.Printf("Images: %d (unreadable: %d)\n", estimate.Images, estimate.Unreadable)
+	fmt.Printf("Pixels: %d\n", estimate.Pixels)
+	effects := make([]string, 0, len(estimate.PixelOps))
+	for effect := range estimate.PixelOps {
+		effects = append(effects, effect)
+	}
+	sort.Strings(effects)
+	for _, effect := range effects {
+		fmt.Printf("Effect %s: %d pixel ops, %d multiply-adds\n", effect, estimate.PixelOps[effect], estimate.MultiplyAdds[effect])
+	}
+	fmt.Printf("Total: %d pixel ops, %d multiply-adds\n", estimate.TotalPixelOps, estimate.TotalMultiplyAdds)
+}
+
+// checkEffectOrder prints the warnings of `png.AnalyzeEffectChain` for the tasks of the run.
+// Obs: advisory only; the run proceeds with the effects as given.
+func checkEffectOrder(config Config) {
+	if config.Mode == "serve" {
+		return
+	}
+	// tasks are repeated for each data directory; analyzing the first one and those with their own chain is enough
+	dataDirs := strings.Split(config.DataDirs, "+")
+	analyzed := []string{dataDirs[0]}
+	for _, dir := range dataDirs[1:] {
+		if _, ok := config.DirEffects[dir]; ok {
+			analyzed = append(analyzed, dir)
+		}
+	}
+	taskQueue, err := sourceTasks(config, strings.Join(analyzed, "+"))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	for _, task := range taskQueue.Tasks {
+		for _, branch := range task.Branches() {
+			checkEffectChain(branch)
+		}
+	}
+}
+
+// checkEffectChain prints the warnings of `png.AnalyzeEffectChain` for the effects of 'task'.
+func checkEffectChain(task utils.Task) {
+	report := png.AnalyzeEffectChain(task.Effects)
+	for _, warning := range report.Warnings {
+		fmt.Printf("Warning (%s): %s\n", task.InPath, warning)
+	}
+	if report.GrayscaleFirst {
+		fmt.Printf("Warning (%s): grayscale is applied before other effects; they will act on the gray image\n", task.InPath)
+	}
+}
+
+// limitPixels sets the maximum number of pixels of the images loaded (`png.MaxPixels`) to 'config.MaxPixels'
+// if positive, and returns a function restoring the previous limit.
+// Obs: the limit applies to every image loaded in the process while the run lasts (files, archives and HTTP requests).
+func limitPixels(config Config) func() {
+	if config.MaxPixels <= 0 {
+		return func() {}
+	}
+	oldMaxPixels := png.MaxPixels
+	png.MaxPixels = config.MaxPixels
+	return func() { png.MaxPixels = oldMaxPixels }
+}
+
+// pinProcs sets GOMAXPROCS to the number of threads of the run if 'config.PinProcs' is true
+// and returns a function restoring the previous value.
+// Obs: GOMAXPROCS limits the OS threads executing goroutines simultaneously, not the number of goroutines.
+// Therefore, the effective parallelism of a pinned run is 'ThreadCount' even though the pipeline modes
+// spawn 'ThreadCount' workers per phase and each phase 2 worker spawns 'SubThreadCount' sub-threads:
+// all these goroutines share 'ThreadCount' cores, trading oversubscription for reproducible timings.
+// The sequential mode is pinned to one core.
+func pinProcs(config Config) func() {
+	// obs: the bench modes pin each run of the sweep separately
+	if !config.PinProcs || config.Mode == "bench" || config.Mode == "barriers" || config.Mode == "compute" {
+		return func() {}
+	}
+	nProcs := config.ThreadCount
+	if config.Mode == "s" || nProcs < 1 {
+		nProcs = 1
+	}
+	oldProcs := runtime.GOMAXPROCS(nProcs)
+	return func() { runtime.GOMAXPROCS(oldProcs) }
+}
+
+// run executes the scheduler scheme given by the Mode field of 'config' and returns its times.
+// Returns `ErrNoTasks` without running if there are no images to process, or `ErrNothingToResume` if resuming a completed run.
+func run(config Config) (Result, error) {
+	if config.SortTasks && config.Shuffle {
+		return Result{}, errors.New("tasks can't be both sorted and shuffled")
+	}
+	if config.Sample < 0 || config.SampleCount < 0 || (config.Sample > 1 && config.SampleCount > 0) {
+		return Result{}, fmt.Errorf("invalid sample (every %d-th, %d at random): expected either one, not negative", config.Sample, config.SampleCount)
+	}
+	if !validSliceStrategy(config.SliceStrategy) {
+		return Result{}, fmt.Errorf("unknown slice strategy %q: expected one of %v", config.SliceStrategy, sliceStrategies)
+	}
+	if !validQuality(config.Quality) {
+		return Result{}, fmt.Errorf("unknown quality %q: expected one of %s, %s or %s", config.Quality, QualityHigh, QualityBalanced, QualityFast)
+	}
+	// open the checkpoint of the run; start a new one unless resuming
+	// obs: once the options are valid, so a run failing to start doesn't lose the checkpoint of a previous one
+	if config.CheckpointPath != "" {
+		config.checkpoint = utils.NewCheckpoint(config.CheckpointPath)
+		if !config.Resume {
+			if err := config.checkpoint.Reset(); err != nil {
+				return Result{}, fmt.Errorf("resetting checkpoint: %w", err)
+			}
+		}
+		defer config.checkpoint.Close()
+	}
+	tasks, err := checkTasks(config)
+	if err != nil {
+		return Result{}, err
+	}
+	config.tasks = tasks
+	if config.results == nil {
+		config.results = newResultCache(config.ResultCacheSize)
+	}
+
+	// record the events of the run; the remaining ones are written when the run is done
+	if config.EventLog != "" {
+		events, err := newEventLog(config.EventLog)
+		if err != nil {
+			return Result{}, err
+		}
+		config.events = events
+		defer func() {
+			if err := config.events.Close(); err != nil {
+				fmt.Println("Error writing event log:", err)
+			}
+		}()
+	}
+
+	// collect the manifest during the run; written when the run is done
+	if config.ManifestPath != "" {
+		config.manifest = utils.NewManifest()
+		defer func() {
+			if err := config.manifest.Write(config.ManifestPath); err != nil {
+				fmt.Println("Error writing manifest:", err)
+			}
+		}()
+	}
+
+	// sample the heap during the run if requested
+	// obs: the sampler covers the whole mode function; besides the parallel section it only creates the tasks
+	sampler := startMemSampler(config.PeakMem)
+	result, err := runMode(config)
+	result.PeakHeapInuse, result.PeakGoroutines = sampler.Stop()
+	if err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
+
+// taskDone records a completed task in the checkpoint, manifest and batch state of the run, if enabled.
+// @img: processed image
+// @start: time the processing of the task started (i.e., before loading the image)
+// Obs: a task that can't be recorded in the checkpoint is reported; its output is saved, but it is processed again
+// when resuming.
+func (config *Config) taskDone(task *utils.Task, img *png.Image, start time.Time) {
+	if err := config.checkpoint.MarkDone(task.OutPath); err != nil {
+		fmt.Printf("Error recording %s in the checkpoint: %v\n", task.OutPath, err)
+	}
+	config.batch.markDone(task.OutPath)
+	if config.manifest != nil {
+		config.manifest.Add(utils.ManifestEntry{InPath: task.InPath, OutPath: task.OutPath, Effects: task.Effects,
+			Width: img.Bounds.Dx(), Height: img.Bounds.Dy(), TimeElapsed: time.Since(start).Seconds()})
+	}
+}
+
+// saveTask saves 'img' to the output of 'task' (see `saveOutput`) and records the task done (see `taskDone`).
+// If the output can't be saved (eg: a directory of its path is a file; see `png.ErrParentNotDir`), the error is
+// reported and the task recorded as failed in the batch state instead; outputs not saved are never recorded as done,
+// so they are processed again when resuming.
+func (config *Config) saveTask(task *utils.Task, img *png.Image, start time.Time) {
+	if err := config.saveOutput(task, img); err != nil {
+		fmt.Printf("Error saving image %s: %v\n", task.OutPath, err)
+		config.batch.markFailed(task.OutPath, err)
+		return
+	}
+	config.taskDone(task, img, start)
+}
+
+// loadImage loads the image of 'task' and, if the task has a mask, restricts its effects to the mask (see `png.Image.SetMask`).
+func loadImage(task *utils.Task) (*png.Image, error) {
+	return loadImageFrom(task, nil)
+}
+
+// loadImageFrom is as `loadImage`, with the buffers of the image taken from 'pool' (see `png.BufferPool`).
+func loadImageFrom(task *utils.Task, pool *png.BufferPool) (*png.Image, error) {
+	img, err := pool.Load(task.InPath)
+	if err != nil || task.Mask == "" {
+		return img, err
+	}
+	mask, err := png.LoadMask(task.Mask)
+	if err != nil {
+		return nil, fmt.Errorf("loading mask %s: %w", task.Mask, err)
+	}
+	if err := img.SetMask(mask); err != nil {
+		return nil, fmt.Errorf("mask %s: %w", task.Mask, err)
+	}
+	return img, nil
+}
+
+// loadTaskImageFile loads the image of a task of a run with two buffers (see `loadTaskImageFrom`); `loadImageFrom`,
+// replaced by tests to count the images the runs load.
+var loadTaskImageFile = loadImageFrom
+
+// loadTaskImage loads the image of 'task' as `loadImage`. With `InPlace`, images without a mask whose effects can
+// all be applied in place (see `png.Kernel.InPlace`) are loaded with a single buffer (see `png.LoadInPlace`).
+// obs: the chains of all outputs are checked, since they are applied to clones of the same image
+func (config *Config) loadTaskImage(task *utils.Task) (*png.Image, error) {
+	return config.loadTaskImageFrom(task, nil)
+}
+
+// loadTaskImageFrom is as `loadTaskImage`, with the buffers of the image taken from 'pool' (see `png.BufferPool`).
+func (config *Config) loadTaskImageFrom(task *utils.Task, pool *png.BufferPool) (*png.Image, error) {
+	if !config.InPlace || task.Mask != "" {
+		return loadTaskImageFile(task, pool)
+	}
+	for _, branch := range task.Branches() {
+		if !png.InPlaceChain(config.createKernels(branch.Effects)) {
+			return loadTaskImageFile(task, pool)
+		}
+	}
+	return pool.LoadInPlace(task.InPath)
+}
+
+// forEachBranch calls 'process' with each branch of 'task' (see `utils.Task.Branches`) and the image to apply its effects to.
+// The image is loaded once: every branch but the last one gets a clone of 'img' (see `png.Image.Clone`) and the last one 'img' itself.
+func forEachBranch(task *utils.Task, img *png.Image, process func(branch *utils.Task, img *png.Image)) {
+	if len(task.Outputs) == 0 {
+		process(task, img)
+		return
+	}
+	branches := task.Branches()
+	for i := range branches {
+		branchImg := img
+		if i < len(branches)-1 {
+			branchImg = img.Clone()
+		}
+		process(&branches[i], branchImg)
+	}
+}
+
+// saveOutput saves 'img' to the output path of 'task'.
+// With `CopyUnchanged`, if no effect changed the pixels of a PNG source (see `png.Image.Unchanged`), the source
+// file is copied instead, so the output keeps the compression and metadata of the original byte for byte.
+// With `GrayOutput`, gray images are saved with a single channel.
+// With `EmbedProvenance`, the effect chain of 'task' is written to the output as a tEXt chunk (see `png.EffectsKeyword`);
+// unchanged images are then re-encoded too, since a copy of the source would not carry it.
+func (config *Config) saveOutput(task *utils.Task, img *png.Image) error {
+	img.SetGrayOutput(config.GrayOutput)
+	img.SetEightBitOutput(qualityLevels[config.Quality].eightBitOutput)
+	if config.EmbedProvenance {
+		return img.SaveText(task.OutPath, png.EffectsKeyword, png.FormatEffectChain(task.Effects))
+	}
+	if config.CopyUnchanged && img.SourceFormat() == "png" && img.Unchanged() {
+		return utils.CopyFile(task.InPath, task.OutPath)
+	}
+	return img.Save(task.OutPath)
+}
+
+// createKernels returns the kernels of 'effects', with custom kernels normalized if `NormalizeKernels` is set
+// (see `png.NormalizeKernels`) and merged by `png.OptimizeChain` if `OptimizeChain` is set or `Quality` merges them.
+// obs: not with `SaveIntermediates`, which saves the image after each effect of the chain
+// If `Quality` convolves 8 bit channels, the convolutions are set to (see `png.EightBitKernels`), after merging them.
+func (config *Config) createKernels(effects []string) []*png.Kernel {
+	kernels := png.CreateKernels(effects)
+	if config.NormalizeKernels {
+		png.NormalizeKernels(kernels)
+	}
+	if (config.OptimizeChain || qualityLevels[config.Quality].optimizeChain) && !config.SaveIntermediates {
+		kernels = png.OptimizeChain(kernels)
+	}
+	if qualityLevels[config.Quality].eightBitEffects {
+		png.EightBitKernels(kernels)
+	}
+	return kernels
+}
+
+// stepSaver returns a function saving 'img' after each effect next to the output of 'task', or nil if
+// `SaveIntermediates` is off. Step i is the image after the effect i of the chain, named by the output path.
+// eg: step 0 of data/out/small_IMG_2029_Out.png => data/out/small_IMG_2029_Out.step0.png
+// obs: diagnostic only; images that can't be saved are reported and the run goes on.
+func (config *Config) stepSaver(task *utils.Task, img *png.Image) func(step int) {
+	if !config.SaveIntermediates {
+		return nil
+	}
+	ext := filepath.Ext(task.OutPath)
+	base := strings.TrimSuffix(task.OutPath, ext)
+	return func(step int) {
+		stepPath := fmt.Sprintf("%s.step%d%s", base, step, ext)
+		if err := img.Save(stepPath); err != nil {
+			fmt.Printf("Error saving intermediate image %s: %v\n", stepPath, err)
+		}
+	}
+}
+
+// runMode executes the scheduler scheme given by the Mode field of 'config' and returns its times.
+func runMode(config Config) (Result, error) {
+	runMode, ok := runModes[config.Mode]
+	if !ok {
 		panic("Invalid scheduling scheme given.")
 	}
+	return runMode(config)
 }
@@ -0,0 +1,598 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	stdpng "image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	cons "proj3/constants"
+	"proj3/png"
+	"proj3/utils"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestMain runs the tests in a temporary directory, so the results file written by the runs
+// (see `resultsPath`) is not the one of the repository.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "scheduler")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "benchmark"), 0755); err == nil {
+		err = os.Chdir(dir)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testImage returns a 'width' x 'height' opaque image with a different gradient for each 'seed'
+func testImage(width, height, seed int) *image.RGBA64 {
+	pixels := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixels.SetRGBA64(x, y, color.RGBA64{uint16((x*2039 + seed*7919) % 65536), uint16((y*3001 + seed*104729) % 65536),
+				uint16((x*y*97 + seed*31) % 65536), 65535})
+		}
+	}
+	return pixels
+}
+
+// useTestImages writes 'n' generated images to the data directory "small" of a temporary input directory,
+// with an effects file applying 'effects' to each of them, and points the input, output and effects paths
+// to them for the duration of the test. Returns the output directory.
+// eg: n = 2 => small/IMG_0.png and small/IMG_1.png, saved to small_IMG_0_Out.png and small_IMG_1_Out.png
+func useTestImages(t *testing.T, n int, effects []string) string {
+	t.Helper()
+	dir := t.TempDir()
+	inDir, outDir := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	for _, d := range []string{filepath.Join(inDir, "small"), outDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var lines []string
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("IMG_%d", i)
+		img := png.NewImageFromRGBA64(testImage(40, 30, i))
+		if err := img.Save(filepath.Join(inDir, "small", name+".png")); err != nil {
+			t.Fatal(err)
+		}
+		line, _ := json.Marshal(map[string]interface{}{"inPath": name + ".png", "outPath": name + "_Out.png", "effects": effects})
+		lines = append(lines, string(line))
+	}
+	effectsPath := filepath.Join(dir, "effects.txt")
+	if err := os.WriteFile(effectsPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldEffects, oldIn, oldOut := cons.EffectsPathFile, cons.InDir, cons.OutDir
+	t.Cleanup(func() { cons.EffectsPathFile, cons.InDir, cons.OutDir = oldEffects, oldIn, oldOut })
+	cons.EffectsPathFile, cons.InDir, cons.OutDir = effectsPath, inDir, outDir
+	return outDir
+}
+
+func TestPinProcs(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(3))
+
+	tests := []struct {
+		config Config
+		want   int
+	}{
+		{Config{Mode: "parfiles", ThreadCount: 2, PinProcs: true}, 2},
+		{Config{Mode: "pipebspws", ThreadCount: 5, SubThreadCount: 4, PinProcs: true}, 5},
+		{Config{Mode: "s", ThreadCount: 4, PinProcs: true}, 1},
+		{Config{Mode: "parfiles", ThreadCount: 2}, 3},
+		// the sweeps pin each of their runs
+		{Config{Mode: "bench", ThreadCount: 2, PinProcs: true}, 3},
+	}
+	for _, test := range tests {
+		restore := pinProcs(test.config)
+		if got := runtime.GOMAXPROCS(0); got != test.want {
+			t.Errorf("%s with %d threads: GOMAXPROCS is %d, want %d", test.config.Mode, test.config.ThreadCount, got, test.want)
+		}
+		restore()
+		if got := runtime.GOMAXPROCS(0); got != 3 {
+			t.Errorf("%s with %d threads: GOMAXPROCS restored to %d, want 3", test.config.Mode, test.config.ThreadCount, got)
+		}
+	}
+
+	// restored at the end of a run
+	useTestImages(t, 2, []string{"B"})
+	Schedule(Config{DataDirs: "small", Mode: "parfiles", ThreadCount: 2, PinProcs: true})
+	if got := runtime.GOMAXPROCS(0); got != 3 {
+		t.Errorf("GOMAXPROCS is %d after a pinned run, want 3", got)
+	}
+}
+
+func TestNoTasks(t *testing.T) {
+	useTestImages(t, 2, []string{"B"})
+	// an empty effects file, and a data directory with no images
+	empty := filepath.Join(t.TempDir(), "effects.txt")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		effectsPath string
+		dataDirs    string
+	}{
+		{"empty effects file", empty, "small"},
+		{"no images", cons.EffectsPathFile, "missing"},
+	}
+	for _, test := range tests {
+		cons.EffectsPathFile = test.effectsPath
+		for _, mode := range []string{"s", "parfiles", "parslices", "pipebsp"} {
+			config := Config{DataDirs: test.dataDirs, Mode: mode, ThreadCount: 2, SubThreadCount: 2}
+			if _, err := run(config); !errors.Is(err, ErrNoTasks) {
+				t.Errorf("%s, mode %s: got %v, want %v", test.name, mode, err, ErrNoTasks)
+			}
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	const n = 5
+	manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+	for _, mode := range []string{"s", "parfiles", "parslices", "pipebsp", "pipebspws"} {
+		useTestImages(t, n, []string{"B", "G"})
+		if _, err := run(Config{DataDirs: "small", Mode: mode, ThreadCount: 2, ManifestPath: manifestPath}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(manifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []utils.ManifestEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		// one entry per task, in order of completion
+		if len(entries) != n {
+			t.Fatalf("%s: %d entries in the manifest, want %d", mode, len(entries), n)
+		}
+		seen := map[string]bool{}
+		for _, entry := range entries {
+			name := strings.TrimSuffix(filepath.Base(entry.InPath), ".png")
+			if seen[name] || !strings.HasPrefix(name, "IMG_") {
+				t.Errorf("%s: unexpected or repeated input %q", mode, entry.InPath)
+			}
+			seen[name] = true
+			if filepath.Base(entry.OutPath) != "small_"+name+"_Out.png" {
+				t.Errorf("%s: output of %s is %q", mode, name, entry.OutPath)
+			}
+			if !reflect.DeepEqual(entry.Effects, []string{"B", "G"}) || entry.Width != 40 || entry.Height != 30 || entry.TimeElapsed <= 0 {
+				t.Errorf("%s: entry of %s is %+v, want effects [B G], size 40x30 and a time", mode, name, entry)
+			}
+		}
+	}
+}
+
+func TestLoadErrorsAreSkipped(t *testing.T) {
+	for _, mode := range []string{"s", "parfiles", "parslices"} {
+		outDir := useTestImages(t, 3, []string{"B"})
+		// corrupt the second image: the others are processed
+		if err := os.WriteFile(filepath.Join(cons.InDir, "small", "IMG_1.png"), []byte("not a png"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := run(Config{DataDirs: "small", Mode: mode, ThreadCount: 2}); err != nil {
+			t.Fatalf("mode %s: %v", mode, err)
+		}
+		for i, want := range []bool{true, false, true} {
+			_, err := os.Stat(filepath.Join(outDir, fmt.Sprintf("small_IMG_%d_Out.png", i)))
+			if written := err == nil; written != want {
+				t.Errorf("mode %s: output of IMG_%d written: %v, want %v", mode, i, written, want)
+			}
+		}
+	}
+	// a bad effects file is reported
+	useTestImages(t, 1, []string{"B"})
+	if err := os.WriteFile(cons.EffectsPathFile, []byte(`{"inPath": "IMG_0.png"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(Config{DataDirs: "small", Mode: "s"}); err == nil {
+		t.Error("a malformed effects file returned no error")
+	}
+}
+
+func TestMaxPixelsRestored(t *testing.T) {
+	defer func(old int) { png.MaxPixels = old }(png.MaxPixels)
+	png.MaxPixels = 5000
+
+	// images of 40x30 pixels: over the limit of the run, skipped
+	outDir := useTestImages(t, 2, []string{"B"})
+	Schedule(Config{DataDirs: "small", Mode: "s", MaxPixels: 1000})
+	if entries, _ := os.ReadDir(outDir); len(entries) != 0 {
+		t.Errorf("%d images over the limit were written", len(entries))
+	}
+	if png.MaxPixels != 5000 {
+		t.Errorf("the limit is %d after the run, want 5000", png.MaxPixels)
+	}
+	// no limit given: the one of the process applies
+	Schedule(Config{DataDirs: "small", Mode: "s"})
+	if entries, _ := os.ReadDir(outDir); len(entries) != 2 {
+		t.Errorf("%d images written, want 2", len(entries))
+	}
+}
+
+func TestShuffleTasks(t *testing.T) {
+	const n = 20
+	useTestImages(t, n, []string{"G"})
+	order := func(config Config) []string {
+		t.Helper()
+		config.DataDirs = "small"
+		taskQueue, err := createTasks(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var inPaths []string
+		for _, task := range taskQueue.Tasks {
+			inPaths = append(inPaths, filepath.Base(task.InPath))
+		}
+		return inPaths
+	}
+	unshuffled := order(Config{})
+	shuffled := order(Config{Shuffle: true, Seed: 7})
+	// the same seed gives the same order; another seed or no shuffle, another one
+	if again := order(Config{Shuffle: true, Seed: 7}); !reflect.DeepEqual(again, shuffled) {
+		t.Errorf("the same seed gave orders %v and %v", shuffled, again)
+	}
+	if reflect.DeepEqual(shuffled, unshuffled) || reflect.DeepEqual(shuffled, order(Config{Shuffle: true, Seed: 8})) {
+		t.Errorf("shuffled order %v is the order of the effects file or of another seed", shuffled)
+	}
+
+	// every task of the shuffled queue runs exactly once
+	manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+	for _, mode := range []string{"parfiles", "pipebspws"} {
+		if _, err := run(Config{DataDirs: "small", Mode: mode, ThreadCount: 4, Shuffle: true, Seed: 7, ManifestPath: manifestPath}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(manifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []utils.ManifestEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			t.Fatal(err)
+		}
+		runs := map[string]int{}
+		for _, entry := range entries {
+			runs[filepath.Base(entry.InPath)]++
+		}
+		for _, inPath := range unshuffled {
+			if runs[inPath] != 1 {
+				t.Errorf("%s: %s ran %d times", mode, inPath, runs[inPath])
+			}
+		}
+	}
+}
+
+func TestSaveIntermediates(t *testing.T) {
+	// slice the small test images too (see `effectiveSubThreads`)
+	defer func(old int) { cons.MinRowsPerSlice = old }(cons.MinRowsPerSlice)
+	cons.MinRowsPerSlice = 1
+
+	// reference of the first step: the image with the first effect only
+	outDir := useTestImages(t, 1, []string{"B"})
+	if _, err := run(Config{DataDirs: "small", Mode: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	blurred, err := os.ReadFile(filepath.Join(outDir, "small_IMG_0_Out.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{"s", "parfiles", "parslices"} {
+		outDir := useTestImages(t, 1, []string{"B", "G"})
+		if _, err := run(Config{DataDirs: "small", Mode: mode, ThreadCount: 3, SaveIntermediates: true}); err != nil {
+			t.Fatal(err)
+		}
+		// two effects: an image after each, the last one being the output
+		want := []string{"small_IMG_0_Out.png", "small_IMG_0_Out.step0.png", "small_IMG_0_Out.step1.png"}
+		entries, err := os.ReadDir(outDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Name())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: saved %v, want %v", mode, got, want)
+		}
+		read := func(name string) []byte {
+			data, err := os.ReadFile(filepath.Join(outDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return data
+		}
+		if !bytes.Equal(read(want[1]), blurred) {
+			t.Errorf("%s: step 0 is not the image after the blur", mode)
+		}
+		if !bytes.Equal(read(want[2]), read(want[0])) {
+			t.Errorf("%s: step 1 is not the output", mode)
+		}
+	}
+}
+
+func TestCopyUnchanged(t *testing.T) {
+	for _, copyUnchanged := range []bool{true, false} {
+		outDir := useTestImages(t, 2, []string{"G"})
+		// IMG_0: gray, so grayscale changes no pixel; encoded with another compression than the one of `png.Save`
+		gray := image.NewGray(image.Rect(0, 0, 40, 30))
+		for i := range gray.Pix {
+			gray.Pix[i] = uint8(i * 13)
+		}
+		var buf bytes.Buffer
+		encoder := stdpng.Encoder{CompressionLevel: stdpng.BestCompression}
+		if err := encoder.Encode(&buf, gray); err != nil {
+			t.Fatal(err)
+		}
+		source := buf.Bytes()
+		if err := os.WriteFile(filepath.Join(cons.InDir, "small", "IMG_0.png"), source, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := run(Config{DataDirs: "small", Mode: "s", CopyUnchanged: copyUnchanged}); err != nil {
+			t.Fatal(err)
+		}
+		output, err := os.ReadFile(filepath.Join(outDir, "small_IMG_0_Out.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identical := bytes.Equal(output, source); identical != copyUnchanged {
+			t.Errorf("copying unchanged images %v: output identical to the source: %v", copyUnchanged, identical)
+		}
+		// IMG_1 is a color image, changed by grayscale: re-encoded
+		colorSource, _ := os.ReadFile(filepath.Join(cons.InDir, "small", "IMG_1.png"))
+		colorOutput, _ := os.ReadFile(filepath.Join(outDir, "small_IMG_1_Out.png"))
+		if bytes.Equal(colorOutput, colorSource) {
+			t.Errorf("copying unchanged images %v: the changed image was copied", copyUnchanged)
+		}
+	}
+}
+
+func TestContentHashOutputs(t *testing.T) {
+	for _, mode := range []string{"s", "parfiles", "pipebsp"} {
+		outDir := useTestImages(t, 2, []string{"B"})
+		config := Config{DataDirs: "small", Mode: mode, ThreadCount: 2, SubThreadCount: 2, ContentHash: true}
+		if _, err := run(config); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			task := utils.Task{InPath: filepath.Join(cons.InDir, "small", fmt.Sprintf("IMG_%d.png", i)), Effects: []string{"B"}}
+			hash, err := utils.ContentHash(task, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(outDir, fmt.Sprintf("small_IMG_%d_Out.%s.png", i, hash))); err != nil {
+				t.Errorf("mode %s: output of IMG_%d not written with its hash: %v", mode, i, err)
+			}
+		}
+	}
+
+	// the modes process the queue built by the run, instead of building (and hashing) it again
+	config := Config{DataDirs: "small", ContentHash: true, tasks: &utils.TaskQueue{}}
+	if queue, _ := createTasks(config); queue != config.tasks {
+		t.Error("the queue of the run was built again")
+	}
+}
+
+// TestBranchesLoadOnce runs tasks with two outputs in each mode: each image is loaded once
+// and both outputs are saved with their own effects.
+func TestBranchesLoadOnce(t *testing.T) {
+	outDir := useTestImages(t, 3, nil)
+	var lines []string
+	for i := 0; i < 3; i++ {
+		line, _ := json.Marshal(map[string]interface{}{"inPath": fmt.Sprintf("IMG_%d.png", i), "outputs": []map[string]interface{}{
+			{"outPath": fmt.Sprintf("IMG_%d_blur.png", i), "effects": []string{"B"}},
+			{"outPath": fmt.Sprintf("IMG_%d_edges.png", i), "effects": []string{"G", "E"}},
+		}})
+		lines = append(lines, string(line))
+	}
+	if err := os.WriteFile(cons.EffectsPathFile, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old func(*utils.Task, *png.BufferPool) (*png.Image, error)) { loadTaskImageFile = old }(loadTaskImageFile)
+	loads := make(map[string]int)
+	var mu sync.Mutex
+	loadTaskImageFile = func(task *utils.Task, pool *png.BufferPool) (*png.Image, error) {
+		mu.Lock()
+		loads[task.InPath]++
+		mu.Unlock()
+		return loadImageFrom(task, pool)
+	}
+
+	for _, mode := range []string{"s", "parfiles", "parslices", "pipebsp", "pipebspws"} {
+		for path := range loads {
+			delete(loads, path)
+		}
+		if _, err := run(Config{DataDirs: "small", Mode: mode, ThreadCount: 2}); err != nil {
+			t.Fatalf("mode %s: %v", mode, err)
+		}
+		if len(loads) != 3 {
+			t.Errorf("mode %s: %d images loaded, want 3", mode, len(loads))
+		}
+		for path, n := range loads {
+			if n != 1 {
+				t.Errorf("mode %s: %s loaded %d times for its 2 outputs", mode, filepath.Base(path), n)
+			}
+		}
+
+		for i := 0; i < 3; i++ {
+			for suffix, effects := range map[string][]string{"blur": {"B"}, "edges": {"G", "E"}} {
+				want := png.NewImageFromRGBA64(testImage(40, 30, i))
+				want.ApplyEffects(png.CreateKernels(effects))
+				got, err := png.Load(filepath.Join(outDir, fmt.Sprintf("small_IMG_%d_%s.png", i, suffix)))
+				if err != nil {
+					t.Fatalf("mode %s: %v", mode, err)
+				}
+				if !got.Equal(want) {
+					t.Errorf("mode %s: output %s of image %d differs from its effects applied alone", mode, suffix, i)
+				}
+			}
+		}
+	}
+}
+
+func TestOutputCollisions(t *testing.T) {
+	outDir := useTestImages(t, 2, []string{"B"})
+	// both images write to the same output
+	effects := `{"inPath": "IMG_0.png", "outPath": "Out.png", "effects": ["B"]}
+{"inPath": "IMG_1.png", "outPath": "Out.png", "effects": ["S"]}
+`
+	if err := os.WriteFile(cons.EffectsPathFile, []byte(effects), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := run(Config{DataDirs: "small", Mode: "parfiles", ThreadCount: 2})
+	if !errors.Is(err, ErrOutputCollision) || !strings.Contains(err.Error(), "small_Out.png") {
+		t.Fatalf("got %v, want %v naming the output", err, ErrOutputCollision)
+	}
+	// reported before any processing
+	if entries, _ := os.ReadDir(outDir); len(entries) != 0 {
+		t.Errorf("%d outputs written despite the collision", len(entries))
+	}
+}
+
+func TestSortTasks(t *testing.T) {
+	useTestImages(t, 3, []string{"B"})
+	// the effects file lists the images out of order, IMG_1 twice
+	effects := `{"inPath": "IMG_2.png", "outPath": "IMG_2_Out.png", "effects": ["B"]}
+{"inPath": "IMG_1.png", "outPath": "IMG_1_B.png", "effects": ["B"]}
+{"inPath": "IMG_0.png", "outPath": "IMG_0_Out.png", "effects": ["B"]}
+{"inPath": "IMG_1.png", "outPath": "IMG_1_S.png", "effects": ["S"]}
+`
+	if err := os.WriteFile(cons.EffectsPathFile, []byte(effects), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputs := func(config Config) []string {
+		queue, err := createTasks(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, task := range queue.Tasks {
+			names = append(names, filepath.Base(task.OutPath))
+		}
+		return names
+	}
+
+	unsorted := []string{"small_IMG_2_Out.png", "small_IMG_1_B.png", "small_IMG_0_Out.png", "small_IMG_1_S.png"}
+	if got := outputs(Config{DataDirs: "small"}); !reflect.DeepEqual(got, unsorted) {
+		t.Errorf("tasks in order %v, want the order of the effects file %v", got, unsorted)
+	}
+	// tasks of the same input keep their order
+	sorted := []string{"small_IMG_0_Out.png", "small_IMG_1_B.png", "small_IMG_1_S.png", "small_IMG_2_Out.png"}
+	if got := outputs(Config{DataDirs: "small", SortTasks: true}); !reflect.DeepEqual(got, sorted) {
+		t.Errorf("sorted tasks in order %v, want %v", got, sorted)
+	}
+
+	if _, err := run(Config{DataDirs: "small", Mode: "s", SortTasks: true, Shuffle: true}); err == nil {
+		t.Error("a run both sorting and shuffling returned no error")
+	}
+}
+
+func TestEmbedProvenance(t *testing.T) {
+	for _, mode := range []string{"s", "parfiles", "pipebsp"} {
+		for _, embed := range []bool{true, false} {
+			outDir := useTestImages(t, 2, []string{"B", "B", "S"})
+			config := Config{DataDirs: "small", Mode: mode, ThreadCount: 2, SubThreadCount: 2, EmbedProvenance: embed}
+			if _, err := run(config); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				outPath := filepath.Join(outDir, fmt.Sprintf("small_IMG_%d_Out.png", i))
+				text, err := png.LoadText(outPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				chain, ok := text[png.EffectsKeyword]
+				if embed && chain != "B,B,S" || !embed && ok {
+					t.Errorf("%s, embedding %v: output %d records the effects %q (%v), want %q",
+						mode, embed, i, chain, ok, "B,B,S")
+				}
+				// the chunk leaves the pixels as they are
+				img, err := png.Load(outPath)
+				if err != nil {
+					t.Fatalf("%s, embedding %v: the output is not a valid PNG: %v", mode, embed, err)
+				}
+				want := png.NewImageFromRGBA64(testImage(40, 30, i))
+				want.ApplyEffects(png.CreateKernels([]string{"B", "B", "S"}))
+				if !img.Equal(want) {
+					t.Errorf("%s, embedding %v: the pixels of output %d differ from the effects applied", mode, embed, i)
+				}
+			}
+		}
+	}
+}
+
+func TestSampleTasks(t *testing.T) {
+	const n = 10
+	// names of the outputs of the images with indexes 'indexes', sorted as `os.ReadDir` lists them
+	outputsOf := func(indexes []int) []string {
+		var names []string
+		for _, i := range indexes {
+			names = append(names, fmt.Sprintf("small_IMG_%d_Out.png", i))
+		}
+		sort.Strings(names)
+		return names
+	}
+	perm := rand.New(rand.NewSource(7)).Perm(n)[:4]
+
+	for _, test := range []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{"every 3rd", Config{Sample: 3}, outputsOf([]int{0, 3, 6, 9})},
+		{"every 1st", Config{Sample: 1}, outputsOf([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})},
+		{"4 at random", Config{SampleCount: 4, Seed: 7}, outputsOf(perm)},
+		{"more than all", Config{SampleCount: 20, Seed: 7}, outputsOf([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})},
+	} {
+		for _, mode := range []string{"s", "parfiles"} {
+			outDir := useTestImages(t, n, []string{"G"})
+			config := test.config
+			config.DataDirs, config.Mode, config.ThreadCount = "small", mode, 2
+			if _, err := run(config); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.Name())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s in %s: processed %v, want %v", test.name, mode, got, test.want)
+			}
+		}
+	}
+
+	useTestImages(t, n, []string{"G"})
+	for _, config := range []Config{{Sample: -1}, {SampleCount: -1}, {Sample: 2, SampleCount: 3}} {
+		config.DataDirs, config.Mode = "small", "s"
+		if _, err := run(config); err == nil {
+			t.Errorf("sample every %d-th and %d at random: no error", config.Sample, config.SampleCount)
+		}
+	}
+}
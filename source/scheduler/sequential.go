@@ -1,51 +1,51 @@
 package scheduler
 
 import (
-	"proj3/utils"
 	"proj3/png"
+	"proj3/utils"
 	"fmt"
 	"time"
-	"os"
 )
 
 // Process images specified by 'config' and 'effects.txt', sequentially applying effects to each image.
-func RunSequential(config Config) {
+func RunSequential(config Config) (Result, error) {
 	// start timer for total elapsed time
 	startTime := time.Now()
 	
 	// create a queue of tasks given data directories CMD inputs and effects.txt file
-	taskQueue := utils.CreateTasks(config.DataDirs)
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		return Result{}, err
+	}
 
 	// load image each image and apply effects sequentially
 	for i := 0; i < len(taskQueue.Tasks); i++ {
 		// load the image
-		
-		img, err := png.Load(taskQueue.Tasks[i].InPath)
-
-		if err != nil{
-			fmt.Println("Error loading image: ", err)
-			os.Exit(1)
+		taskStart := time.Now()
+		img, err := config.loadTaskImage(&taskQueue.Tasks[i])
+		if err != nil {
+			// skip images that can't be loaded (eg: over `png.MaxPixels`)
+			fmt.Printf("Error loading image %s: %v\n", taskQueue.Tasks[i].InPath, err)
+			continue
 		}
 
-		// apply the effects sequentially
-		kernels := png.CreateKernels(taskQueue.Tasks[i].Effects)
-		for _, kernel := range kernels {
-			img.ApplyEffect(kernel)
-			// invert image buffer for application of next effect (see png.Image struct definition)
-			img.Final = 1 - img.Final
-		}
+		// apply the effects of each output sequentially
+		forEachBranch(&taskQueue.Tasks[i], img, func(task *utils.Task, img *png.Image) {
+			kernels := config.createKernels(task.Effects)
+			config.results.apply(task, img, func() {
+				applyOneThread(img, kernels, config.stepSaver(task, img))
+			})
 
-		// save output and go to next image
-		img.Save(taskQueue.Tasks[i].OutPath)
+			// save output and go to next image
+			config.saveTask(task, img, taskStart)
+		})
 	}
 
 	// compute elapsed time
 	elapsedTime := time.Since(startTime)
 
-	// write result into JSON format 
-	writeStr := fmt.Sprintf("{\"mode\": \"%s\", \"threads\": %d, \"timeElapsed\": %f, \"timeParallel\": %f , \"datadir\": \"%s\"}\n", 
-								config.Mode , 1, elapsedTime.Seconds(), 0.0, config.DataDirs)
-	// write times to results text file
-	utils.WriteToFile(resultsPath, writeStr)
+	// return times + settings to be written to the results file
+	return Result{Mode: config.Mode, Threads: 1, TimeElapsed: elapsedTime.Seconds(),
+		TimeParallel: 0.0, DataDir: config.DataDirs}, nil
 }
 
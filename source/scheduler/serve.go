@@ -0,0 +1,204 @@
+package scheduler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	ws "proj3/WorkStealing"
+	"proj3/png"
+	"strings"
+)
+
+//=====================================================================================================================
+// HTTP server mode: `POST /process?effects=B,S` with a PNG/JPEG body returns the processed image as PNG.
+// - Each request is converted into a task submitted to a work stealing `ws.Pool`, and the handler waits for its
+//   `ws.Future`. At most `config.ThreadCount` tasks are submitted at the same time, so at most `ThreadCount` images
+//   are decoded and processed at the same time irrespective of the number of requests.
+// - A panic while processing an image is recovered by its future and answered with a 500; the server keeps serving.
+// - Requests whose client is gone (`r.Context()`) stop waiting for a slot or for their task.
+// - Obs: each request is a batch of a single task, so the pool runs one worker per batch; the workers of the requests
+//   processed at the same time run in parallel. Each task is a single image, so there is nothing to steal.
+//=====================================================================================================================
+
+// Maximum size of an uploaded image, in bytes
+const maxBodySize = 32 << 20
+
+// Maximum number of pixels (width x height) of an uploaded image if `png.MaxPixels` is not set.
+// A small upload may declare huge dimensions (a decompression bomb), so the server never decodes without a limit.
+// eg: 8192 x 8192 pixels => 2 x 512MB of `RGBA64` buffers
+const defaultServeMaxPixels = 1 << 26
+
+// Default address of the server if none is given
+const defaultAddr = ":8080"
+
+// Each uploaded image is associated to a `serveTask`, processed by a task of the pool.
+// Obs: the image is decoded, processed and encoded by the pool, so only `ThreadCount` decoded images are in memory
+// at the same time; requests waiting for a slot hold only their (compressed) upload.
+type serveTask struct {
+	data 		[]byte				// uploaded image
+	kernels 	[]*png.Kernel		// effects to be applied to the image
+	out 		bytes.Buffer		// processed image, encoded as PNG
+	status 		int					// HTTP status of the response; `http.StatusOK` if 'out' holds the image
+	err 		error				// error of the task if 'status' is not OK
+}
+
+// decodeUpload decodes an uploaded image; `png.LoadReader`, replaced by tests
+var decodeUpload = png.LoadReader
+
+// Decode the image, apply the effects in `kernels` and encode the result.
+func (st *serveTask) process() {
+	img, err := decodeUpload(bytes.NewReader(st.data))
+	if err != nil {
+		st.err = err
+		switch {
+		case errors.Is(err, png.ErrTooLarge):
+			st.status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, png.ErrUnsupportedModel):
+			st.status = http.StatusUnsupportedMediaType
+		default:
+			st.status = http.StatusBadRequest
+		}
+		return
+	}
+	img.ApplyEffects(st.kernels)
+	if err := img.SaveWriter(&st.out, "png"); err != nil {
+		st.status, st.err = http.StatusInternalServerError, errors.New("error encoding image")
+		return
+	}
+	st.status = http.StatusOK
+}
+
+// NewServeHandler returns the handler of the server, which submits the processing of images to 'pool',
+// at most 'nThreads' (at least 1) at the same time.
+func NewServeHandler(pool *ws.Pool, nThreads int) http.Handler {
+	if nThreads < 1 {
+		nThreads = 1
+	}
+	// one slot per image processed at the same time
+	slots := make(chan struct{}, nThreads)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/process", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// parse and validate the effects. eg: "B,S" -> ["B", "S"]
+		var effects []string
+		if effectsStr := r.URL.Query().Get("effects"); effectsStr != "" {
+			effects = strings.Split(effectsStr, ",")
+		}
+		// obs: effects reading files are rejected, so clients can't open the files of the server
+		for _, effect := range effects {
+			if png.ReadsFile(effect) {
+				http.Error(w, fmt.Sprintf("effect %q reads a file; not allowed in the server", effect), http.StatusBadRequest)
+				return
+			}
+			if !png.ValidEffect(effect) {
+				http.Error(w, fmt.Sprintf("invalid effect %q", effect), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// read the body up to the size limit
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "image too large", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "error reading image", http.StatusBadRequest)
+			}
+			return
+		}
+
+		// detect the content type from the data itself; the header sent by clients is not reliable
+		if contentType := http.DetectContentType(body); contentType != "image/png" && contentType != "image/jpeg" {
+			http.Error(w, "only PNG and JPEG images are supported", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := checkPixels(body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// wait for a slot, then submit the image to the pool and wait for it to be processed
+		task := &serveTask{data: body, kernels: png.CreateKernels(effects)}
+		select {
+		case slots <- struct{}{}:
+		case <-r.Context().Done():
+			return
+		}
+		future := pool.Submit(func() (ws.Result, error) {
+			// obs: the slot is released even if the task panics or the client is gone
+			defer func() { <-slots }()
+			task.process()
+			return nil, nil
+		})
+		select {
+		case <-future.Done():
+		case <-r.Context().Done():
+			return
+		}
+		if _, err := future.Wait(); err != nil {
+			var panicErr *ws.PanicError
+			if errors.As(err, &panicErr) {
+				fmt.Printf("Error processing image: %v\n%s", panicErr.Value, panicErr.Stack)
+				http.Error(w, "error processing image", http.StatusInternalServerError)
+			} else {
+				// the pool was shut down before executing the task: its slot was never released
+				<-slots
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			}
+			return
+		}
+		if task.status != http.StatusOK {
+			http.Error(w, task.err.Error(), task.status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(task.out.Bytes())
+	})
+	return mux
+}
+
+// checkPixels returns an error wrapping `png.ErrTooLarge` if the header of the image in 'data' declares more pixels
+// than `png.MaxPixels`, or than `defaultServeMaxPixels` if no limit is set.
+// Obs: images whose header can't be decoded pass; their error is given by `png.LoadReader`.
+func checkPixels(data []byte) error {
+	maxPixels := png.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = defaultServeMaxPixels
+	}
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	if int64(imgConfig.Width)*int64(imgConfig.Height) > int64(maxPixels) {
+		return fmt.Errorf("%w: %dx%d > %d", png.ErrTooLarge, imgConfig.Width, imgConfig.Height, maxPixels)
+	}
+	return nil
+}
+
+// RunServer serves requests at `config.Addr` until the server fails, processing at most `config.ThreadCount` images
+// at the same time.
+func RunServer(config Config) error {
+	nThreads := config.ThreadCount
+	if nThreads < 1 {
+		nThreads = 1
+	}
+	addr := config.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	// obs: the tasks running when the server fails are completed
+	pool := ws.NewPool(1)
+	defer pool.Shutdown(true)
+
+	return http.ListenAndServe(addr, NewServeHandler(pool, nThreads))
+}
@@ -0,0 +1,289 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	stdpng "image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	ws "proj3/WorkStealing"
+	"proj3/png"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a server processing 2 images at a time, closed at the end of the test
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	pool := ws.NewPool(1)
+	server := httptest.NewServer(NewServeHandler(pool, 2))
+	t.Cleanup(func() {
+		server.Close()
+		pool.Shutdown(true)
+	})
+	return server
+}
+
+// encodePNG returns 'img' encoded as PNG
+func encodePNG(t *testing.T, img *png.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := img.SaveWriter(&buf, "png"); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestServeProcess(t *testing.T) {
+	server := newTestServer(t)
+	body := encodePNG(t, png.NewImageFromRGBA64(testImage(40, 30, 1)))
+
+	resp, err := http.Post(server.URL+"/process?effects=B,S", "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status %d: %s", resp.StatusCode, msg)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("content type %q, want image/png", contentType)
+	}
+	got, err := png.LoadReader(resp.Body)
+	if err != nil {
+		t.Fatalf("the response is not an image: %v", err)
+	}
+
+	want, _ := png.LoadReader(bytes.NewReader(body))
+	want.ApplyEffects(png.CreateKernels([]string{"B", "S"}))
+	if !got.Equal(want) {
+		t.Error("the response is not the image with the effects applied")
+	}
+}
+
+// bombPNG returns a 1x1 PNG whose header declares 'width' x 'height' pixels
+func bombPNG(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := stdpng.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// IHDR chunk: length (8:12), type (12:16), width (16:20), height (20:24), ..., CRC of type and data (29:33)
+	binary.BigEndian.PutUint32(data[16:20], width)
+	binary.BigEndian.PutUint32(data[20:24], height)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestServeErrors(t *testing.T) {
+	server := newTestServer(t)
+	valid := encodePNG(t, png.NewImageFromRGBA64(testImage(8, 8, 0)))
+	// a valid lookup table and kernel file, which clients can't use anyway: the server's files are not theirs to read
+	lutPath := filepath.Join(t.TempDir(), "identity.txt")
+	var lut strings.Builder
+	for v := 0; v < 256; v++ {
+		fmt.Fprintln(&lut, v<<8)
+	}
+	if err := os.WriteFile(lutPath, []byte(lut.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	kernelPath := filepath.Join(t.TempDir(), "box.txt")
+	if err := os.WriteFile(kernelPath, []byte("1 1 1\n1 1 1\n1 1 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		body   []byte
+		want   int
+	}{
+		{"invalid effect", http.MethodPost, "?effects=B,NOPE", valid, http.StatusBadRequest},
+		{"not an image", http.MethodPost, "?effects=B", []byte("plain text, not an image"), http.StatusUnsupportedMediaType},
+		{"not a POST", http.MethodGet, "?effects=B", nil, http.StatusMethodNotAllowed},
+		{"too large", http.MethodPost, "?effects=B", make([]byte, maxBodySize+1), http.StatusRequestEntityTooLarge},
+		{"file effect", http.MethodPost, "?effects=B,LUT" + url.QueryEscape(lutPath), valid, http.StatusBadRequest},
+		{"kernel file effect", http.MethodPost, "?effects=KF" + url.QueryEscape(kernelPath), valid, http.StatusBadRequest},
+		// a few bytes declaring 50000 x 50000 pixels; rejected even if no limit is set (see `defaultServeMaxPixels`)
+		{"decompression bomb", http.MethodPost, "?effects=B", bombPNG(t, 50000, 50000), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+"/process"+test.query, bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, resp.StatusCode, test.want)
+		}
+	}
+
+	// a limit set for the run applies instead of the default one
+	defer func(old int) { png.MaxPixels = old }(png.MaxPixels)
+	png.MaxPixels = 8 * 8
+	for _, test := range []struct {
+		name string
+		body []byte
+		want int
+	}{
+		{"at the limit", valid, http.StatusOK},
+		{"over the limit", encodePNG(t, png.NewImageFromRGBA64(testImage(9, 8, 0))), http.StatusRequestEntityTooLarge},
+	} {
+		resp, err := http.Post(server.URL+"/process?effects=B", "application/octet-stream", bytes.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, resp.StatusCode, test.want)
+		}
+	}
+}
+
+// TestServeConcurrentDecodes sends many requests at once to a server processing 2 images at a time:
+// at most 2 uploads are decoded at the same time, however many requests wait.
+func TestServeConcurrentDecodes(t *testing.T) {
+	var inFlight, peak atomic.Int64
+	defer func(old func(io.Reader) (*png.Image, error)) { decodeUpload = old }(decodeUpload)
+	decodeUpload = func(r io.Reader) (*png.Image, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for old := peak.Load(); n > old && !peak.CompareAndSwap(old, n); old = peak.Load() {
+		}
+		// widen the window for overlapping decodes
+		time.Sleep(5 * time.Millisecond)
+		return png.LoadReader(r)
+	}
+
+	server := newTestServer(t)
+	body := encodePNG(t, png.NewImageFromRGBA64(testImage(16, 16, 1)))
+	const numRequests = 16
+	var wg sync.WaitGroup
+	statuses := make([]int, numRequests)
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Post(server.URL+"/process?effects=B", "application/octet-stream", bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("request %d: status %d", i, status)
+		}
+	}
+	if peak.Load() > 2 {
+		t.Errorf("%d uploads decoded at the same time, want at most 2", peak.Load())
+	}
+}
+
+// a panic while processing an image is answered with an error, and the server keeps serving
+func TestServePanic(t *testing.T) {
+	defer func(old func(io.Reader) (*png.Image, error)) { decodeUpload = old }(decodeUpload)
+	var panicked atomic.Bool
+	decodeUpload = func(r io.Reader) (*png.Image, error) {
+		if panicked.CompareAndSwap(false, true) {
+			panic("decoder bug")
+		}
+		return png.LoadReader(r)
+	}
+
+	server := newTestServer(t)
+	body := encodePNG(t, png.NewImageFromRGBA64(testImage(8, 8, 0)))
+	// more requests than slots: the slot of the panicking task is released
+	for i, want := range []int{http.StatusInternalServerError, http.StatusOK, http.StatusOK, http.StatusOK} {
+		resp, err := http.Post(server.URL+"/process?effects=B", "application/octet-stream", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status %d, want %d", i, resp.StatusCode, want)
+		}
+		if strings.Contains(string(msg), "decoder bug") {
+			t.Errorf("request %d: the panic is sent to the client: %s", i, msg)
+		}
+	}
+}
+
+// requests whose client is gone stop waiting, for a slot or for their image
+func TestServeCanceledRequest(t *testing.T) {
+	defer func(old func(io.Reader) (*png.Image, error)) { decodeUpload = old }(decodeUpload)
+	decoding, release := make(chan struct{}, 2), make(chan struct{})
+	decodeUpload = func(r io.Reader) (*png.Image, error) {
+		decoding <- struct{}{}
+		<-release
+		return png.LoadReader(r)
+	}
+
+	pool := ws.NewPool(1)
+	defer pool.Shutdown(true)
+	handler := NewServeHandler(pool, 1)
+	body := encodePNG(t, png.NewImageFromRGBA64(testImage(8, 8, 0)))
+	// serve sends a request with 'ctx' to the handler and returns a channel closed once it returns
+	serve := func(ctx context.Context) <-chan struct{} {
+		req := httptest.NewRequest(http.MethodPost, "/process?effects=B", bytes.NewReader(body)).WithContext(ctx)
+		returned := make(chan struct{})
+		go func() {
+			defer close(returned)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		return returned
+	}
+
+	// the first request holds the only slot while its image is decoded
+	ctx, cancelFirst := context.WithCancel(context.Background())
+	first := serve(ctx)
+	<-decoding
+	// the second one waits for the slot
+	ctx, cancelSecond := context.WithCancel(context.Background())
+	second := serve(ctx)
+	for _, test := range []struct {
+		name     string
+		cancel   func()
+		returned <-chan struct{}
+	}{{"waiting for a slot", cancelSecond, second}, {"waiting for its image", cancelFirst, first}} {
+		test.cancel()
+		select {
+		case <-test.returned:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request %s: the handler did not return once canceled", test.name)
+		}
+	}
+
+	// the canceled image still releases its slot
+	close(release)
+	select {
+	case <-serve(context.Background()):
+	case <-time.After(5 * time.Second):
+		t.Error("a request after the canceled ones did not get a slot")
+	}
+}
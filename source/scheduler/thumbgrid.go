@@ -0,0 +1,120 @@
+package scheduler
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	cons "proj3/constants"
+	"proj3/png"
+	"proj3/utils"
+	"sync"
+	"time"
+)
+
+// Thumbnail grids: each data directory of the run is summarized as a single image with a grid of thumbnails
+// of its images, with their effects applied (eg: for a gallery index). Only the grids are saved, to the output
+// directory and named by the data directory. eg: small => data/out/small_grid.png
+
+// RunThumbGrid processes the images of each data directory with 'config.ThreadCount' goroutines, downscales them
+// to 'config.ThumbSize' (see `png.Image.Thumbnail`) and saves a grid of the thumbnails per directory, in the
+// order of the effects file. Grids are as square as possible. eg: 4 images => 2x2; 5 images => 3x2
+// Obs: the outputs of the images are not saved, so they are not recorded in the checkpoint or manifest.
+func RunThumbGrid(config Config) (Result, error) {
+	// start timer for total elapsed time
+	startTime := time.Now()
+
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		return Result{}, err
+	}
+	size := config.ThumbSize
+	if size < 1 {
+		size = cons.ThumbSize
+	}
+	nThreads := config.ThreadCount
+	if nThreads < 1 {
+		nThreads = 1
+	}
+
+	// start timer for parallel tasks
+	parallelTime := time.Now()
+	dirs, groups := groupByDir(taskQueue.Tasks)
+	for _, dir := range dirs {
+		thumbs := thumbnails(groups[dir], nThreads, size)
+		if len(thumbs) == 0 {
+			continue
+		}
+		grid := png.Grid(thumbs, gridCols(len(thumbs)), size)
+		outPath := cons.OutDir + "/" + filepath.Base(dir) + "_grid.png"
+		// obs: a grid that can't be saved is reported, and the next directories are still processed
+		if err := grid.Save(outPath); err != nil {
+			fmt.Printf("Error saving grid %s: %v\n", outPath, err)
+		}
+	}
+	totalParallelTime := time.Since(parallelTime)
+
+	// compute total elapsed time
+	elapsedTime := time.Since(startTime)
+
+	return Result{Mode: config.Mode, Threads: nThreads, TimeElapsed: elapsedTime.Seconds(),
+		TimeParallel: totalParallelTime.Seconds(), DataDir: config.DataDirs}, nil
+}
+
+// groupByDir groups 'tasks' by the directory of their input image.
+// Returns the directories in the order they first appear and the tasks of each one, in their order.
+func groupByDir(tasks []utils.Task) ([]string, map[string][]utils.Task) {
+	var dirs []string
+	groups := make(map[string][]utils.Task)
+	for _, task := range tasks {
+		dir := filepath.Dir(task.InPath)
+		if _, ok := groups[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		groups[dir] = append(groups[dir], task)
+	}
+	return dirs, groups
+}
+
+// thumbnails applies the effects of 'tasks' with 'nThreads' goroutines, one image each at a time, and returns
+// the thumbnails of the results in the order of the tasks; one for each output of a task (see `utils.Task.Branches`).
+// Images that can't be loaded are skipped.
+func thumbnails(tasks []utils.Task, nThreads int, size int) []*png.Image {
+	indexes := make(chan int, len(tasks))
+	for i := range tasks {
+		indexes <- i
+	}
+	close(indexes)
+
+	// obs: each goroutine writes the thumbnails of its own tasks; no lock needed
+	taskThumbs := make([][]*png.Image, len(tasks))
+	var wg sync.WaitGroup
+	for i := 0; i < nThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				img, err := loadImage(&tasks[i])
+				if err != nil {
+					fmt.Printf("Error loading image %s: %v\n", tasks[i].InPath, err)
+					continue
+				}
+				forEachBranch(&tasks[i], img, func(task *utils.Task, img *png.Image) {
+					applyOneThread(img, png.CreateKernels(task.Effects), nil)
+					taskThumbs[i] = append(taskThumbs[i], img.Thumbnail(size))
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	var thumbs []*png.Image
+	for _, t := range taskThumbs {
+		thumbs = append(thumbs, t...)
+	}
+	return thumbs
+}
+
+// gridCols returns the number of columns of a grid of 'n' images, so that it is as square as possible
+func gridCols(n int) int {
+	return int(math.Ceil(math.Sqrt(float64(n))))
+}
@@ -0,0 +1,62 @@
+package scheduler
+
+import (
+	"os"
+	"path/filepath"
+	cons "proj3/constants"
+	"proj3/png"
+	"testing"
+)
+
+// copyDataDir copies the images of the data directory "small" of the test to the data directory 'dir'
+func copyDataDir(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(cons.InDir, "small"))
+	if err == nil {
+		err = os.Mkdir(filepath.Join(cons.InDir, dir), 0755)
+	}
+	for _, entry := range entries {
+		var data []byte
+		if data, err = os.ReadFile(filepath.Join(cons.InDir, "small", entry.Name())); err == nil {
+			err = os.WriteFile(filepath.Join(cons.InDir, dir, entry.Name()), data, 0644)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestThumbGrid(t *testing.T) {
+	outDir := useTestImages(t, 4, []string{"B"})
+	// a second data directory with the same images, whose grid can't be saved: its path is a directory
+	copyDataDir(t, "big")
+	if err := os.Mkdir(filepath.Join(outDir, "big_grid.png"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a third one processed after the failure
+	copyDataDir(t, "mixture")
+
+	const size = 16
+	config := Config{DataDirs: "small+big+mixture", Mode: "thumbgrid", ThreadCount: 2, ThumbSize: size}
+	if _, err := run(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// 4 images of 40x30 => 2x2 grid of 16x16 cells
+	for _, dir := range []string{"small", "mixture"} {
+		grid, err := png.Load(filepath.Join(outDir, dir+"_grid.png"))
+		if err != nil {
+			t.Fatalf("%s: %v", dir, err)
+		}
+		if width, height := grid.Bounds.Dx(), grid.Bounds.Dy(); width != 2*size || height != 2*size {
+			t.Errorf("%s: grid of %dx%d, want %dx%d", dir, width, height, 2*size, 2*size)
+		}
+	}
+	// only the grids are saved
+	if entries, _ := os.ReadDir(outDir); len(entries) != 3 {
+		t.Errorf("%d entries in the output directory, want the 2 grids and the directory in the way of the third", len(entries))
+	}
+}
@@ -0,0 +1,194 @@
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"proj3/png"
+	"proj3/utils"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Output verification: the images of the run are processed and the PNG each output would be saved as is hashed
+// instead of written, then compared with a manifest of expected hashes (eg: recorded before a refactor).
+// Any difference points to a change in the math of the effects. The manifest is a JSON object mapping the name of
+// each output to the SHA-256 of its bytes. eg: {"small_IMG_2029_Out.png": "3f1a...", ...}
+
+// Mismatch is an output of the run not matching the manifest (see `VerifyAgainstManifest`)
+// @OutPath: name of the output, as in the manifest
+// @Expected: hash in the manifest; empty if the output is not in it
+// @Actual: hash of the output; empty if no task gives the output or it couldn't be processed
+// @Err: error loading the image of the output, if any
+type Mismatch struct {
+	OutPath  string
+	Expected string
+	Actual   string
+	Err      error
+}
+
+// String describes the mismatch in a line, as printed by the verify mode
+func (m Mismatch) String() string {
+	switch {
+	case m.Err != nil:
+		return fmt.Sprintf("%s: %v", m.OutPath, m.Err)
+	case m.Expected == "":
+		return fmt.Sprintf("%s: not in the manifest (hash %s)", m.OutPath, m.Actual)
+	case m.Actual == "":
+		return fmt.Sprintf("%s: no task gives this output (expected hash %s)", m.OutPath, m.Expected)
+	default:
+		return fmt.Sprintf("%s: expected hash %s, got %s", m.OutPath, m.Expected, m.Actual)
+	}
+}
+
+// outputHash is the hash of an output of the run (see `hashOutputs`)
+type outputHash struct {
+	name string
+	hash string
+	err  error
+}
+
+// VerifyAgainstManifest processes 'tasks' in parallel and returns the outputs whose hash differs from the one
+// in 'manifest', sorted by name. Outputs missing in the manifest and outputs of the manifest not given by any
+// task are mismatches too. Nothing is saved. Returns no mismatches if all outputs are as expected.
+func VerifyAgainstManifest(tasks []utils.Task, manifest map[string]string) []Mismatch {
+	var mismatches []Mismatch
+	produced := make(map[string]bool)
+	for _, output := range hashOutputs(tasks) {
+		produced[output.name] = true
+		expected := manifest[output.name]
+		if output.err != nil || output.hash != expected {
+			mismatches = append(mismatches,
+				Mismatch{OutPath: output.name, Expected: expected, Actual: output.hash, Err: output.err})
+		}
+	}
+	for name, expected := range manifest {
+		if !produced[name] {
+			mismatches = append(mismatches, Mismatch{OutPath: name, Expected: expected})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].OutPath < mismatches[j].OutPath })
+	return mismatches
+}
+
+// hashOutputs applies the effects of 'tasks' and returns the hash of each output, in no particular order.
+// The images are processed by GOMAXPROCS goroutines, one image at a time each, as in parfiles (see `ExecuteTask`).
+// Outputs are named by the base of their output path; their hash is the SHA-256 of the PNG `png.Image.Save` writes.
+// obs: kernels are not merged (see `png.OptimizeChain`), so the hashes check the effects as given.
+func hashOutputs(tasks []utils.Task) []outputHash {
+	taskQueue := utils.NewTaskQueue()
+	taskQueue.Tasks = tasks
+	outputs := make(chan outputHash, len(tasks))
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := taskQueue.Dequeue(); task != nil; task = taskQueue.Dequeue() {
+				hashTask(task, outputs)
+			}
+		}()
+	}
+	// close once all images are hashed; outputs are collected meanwhile
+	go func() {
+		wg.Wait()
+		close(outputs)
+	}()
+
+	var hashes []outputHash
+	for output := range outputs {
+		hashes = append(hashes, output)
+	}
+	return hashes
+}
+
+// hashTask sends the hash of each output of 'task' to 'outputs' (see `hashOutputs`)
+func hashTask(task *utils.Task, outputs chan<- outputHash) {
+	img, err := loadImage(task)
+	if err != nil {
+		for _, branch := range task.Branches() {
+			outputs <- outputHash{name: filepath.Base(branch.OutPath),
+				err: fmt.Errorf("loading image %s: %w", task.InPath, err)}
+		}
+		return
+	}
+	forEachBranch(task, img, func(task *utils.Task, img *png.Image) {
+		applyOneThread(img, png.CreateKernels(task.Effects), nil)
+		hash := sha256.New()
+		output := outputHash{name: filepath.Base(task.OutPath)}
+		if err := img.SaveWriter(hash, "png"); err != nil {
+			output.err = fmt.Errorf("encoding %s: %w", task.OutPath, err)
+		} else {
+			output.hash = hex.EncodeToString(hash.Sum(nil))
+		}
+		outputs <- output
+	})
+}
+
+// readHashManifest reads the manifest of expected hashes at 'path'
+func readHashManifest(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest map[string]string
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// printVerification checks the outputs of the run against the manifest of 'config.HashManifest' and prints the
+// mismatches. If the manifest does not exist, it is created with the hashes of the outputs instead, so a later
+// run can be checked against this one.
+func printVerification(config Config) {
+	taskQueue, err := createTasks(config)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	manifest, err := readHashManifest(config.HashManifest)
+	if errors.Is(err, fs.ErrNotExist) {
+		recordHashManifest(config.HashManifest, taskQueue.Tasks)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	mismatches := VerifyAgainstManifest(taskQueue.Tasks, manifest)
+	for _, mismatch := range mismatches {
+		fmt.Println(mismatch)
+	}
+	fmt.Printf("Verified against %s: %d outputs expected, %d mismatches\n", config.HashManifest, len(manifest), len(mismatches))
+}
+
+// recordHashManifest writes the hashes of the outputs of 'tasks' to a new manifest at 'path'.
+// Outputs that can't be processed are reported and left out.
+func recordHashManifest(path string, tasks []utils.Task) {
+	manifest := make(map[string]string)
+	for _, output := range hashOutputs(tasks) {
+		if output.err != nil {
+			fmt.Printf("%s: %v\n", output.name, output.err)
+			continue
+		}
+		manifest[output.name] = output.hash
+	}
+	writeBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, writeBytes, 0644)
+	}
+	if err != nil {
+		fmt.Println("Error writing manifest:", err)
+		return
+	}
+	fmt.Printf("Recorded the hashes of %d outputs in %s\n", len(manifest), path)
+}
@@ -0,0 +1,49 @@
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// the outputs saved by a sequential run match a manifest of their hashes; a tampered manifest reports
+// the changed, missing and extra outputs, sorted by name
+func TestVerifyAgainstManifest(t *testing.T) {
+	outDir := useTestImages(t, 3, []string{"S", "B"})
+	if _, err := run(Config{DataDirs: "small", Mode: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	manifest := make(map[string]string)
+	for _, name := range []string{"small_IMG_0_Out.png", "small_IMG_1_Out.png", "small_IMG_2_Out.png"} {
+		data, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha256.Sum256(data)
+		manifest[name] = hex.EncodeToString(hash[:])
+	}
+	tasks, err := createTasks(Config{DataDirs: "small"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mismatches := VerifyAgainstManifest(tasks.Tasks, manifest); len(mismatches) != 0 {
+		t.Fatalf("correct manifest: got mismatches %v", mismatches)
+	}
+
+	hash0, hash2 := manifest["small_IMG_0_Out.png"], manifest["small_IMG_2_Out.png"]
+	manifest["small_IMG_0_Out.png"] = hash2
+	delete(manifest, "small_IMG_2_Out.png")
+	manifest["small_IMG_9_Out.png"] = hash0
+	want := []Mismatch{
+		{OutPath: "small_IMG_0_Out.png", Expected: hash2, Actual: hash0},
+		{OutPath: "small_IMG_2_Out.png", Actual: hash2},
+		{OutPath: "small_IMG_9_Out.png", Expected: hash0},
+	}
+	if got := VerifyAgainstManifest(tasks.Tasks, manifest); !reflect.DeepEqual(got, want) {
+		t.Errorf("tampered manifest: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"proj3/mysync"
+	"strings"
+)
+
+//=============================================================================
+// Archives of images
+//=============================================================================
+
+// archiveFormat returns the format of the archive at 'archivePath' given by its extension: "zip", "tar.gz", "tar"
+// or "" if not supported.
+func archiveFormat(archivePath string) string {
+	name := strings.ToLower(archivePath)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// IsArchive returns true if 'archivePath' has the extension of a supported archive (.zip, .tar.gz, .tgz or .tar)
+func IsArchive(archivePath string) bool {
+	return archiveFormat(archivePath) != ""
+}
+
+// ArchiveName returns the name of the archive at 'archivePath' without directories and extension.
+// It plays the role of the data directory of the images in the archive. Ex: "data/small.tar.gz" -> "small"
+func ArchiveName(archivePath string) string {
+	name := filepath.Base(archivePath)
+	for _, ext := range []string{".tar.gz", ".tgz", ".zip", ".tar"} {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+// Archive holds the regular files of a .zip, .tar.gz or .tar archive in memory,
+// so images can be read from it without unpacking the archive to disk.
+// @files: contents of each file by its name in the archive
+// @baseNames: name in the archive of each file by its base name. eg: "IMG_2029.png" -> "small/IMG_2029.png"
+type Archive struct {
+	files     map[string][]byte
+	baseNames map[string]string
+}
+
+// ReadArchive reads all regular files of the archive at 'archivePath' into memory.
+// The format is given by the extension (see `IsArchive`).
+func ReadArchive(archivePath string) (*Archive, error) {
+	archive := &Archive{files: make(map[string][]byte), baseNames: make(map[string]string)}
+
+	switch archiveFormat(archivePath) {
+	case "zip":
+		zipReader, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		defer zipReader.Close()
+		for _, file := range zipReader.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			reader, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return nil, fmt.Errorf("reading %s from %s: %w", file.Name, archivePath, err)
+			}
+			archive.add(file.Name, data)
+		}
+
+	case "tar.gz", "tar":
+		file, err := os.Open(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		var reader io.Reader = file
+		if archiveFormat(archivePath) == "tar.gz" {
+			gzipReader, err := gzip.NewReader(file)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", archivePath, err)
+			}
+			defer gzipReader.Close()
+			reader = gzipReader
+		}
+		tarReader := tar.NewReader(reader)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", archivePath, err)
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			data, err := io.ReadAll(tarReader)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s from %s: %w", header.Name, archivePath, err)
+			}
+			archive.add(header.Name, data)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported archive %s: expected .zip, .tar.gz, .tgz or .tar", archivePath)
+	}
+	return archive, nil
+}
+
+// add stores the contents of the file 'name' of the archive
+// obs: if several files share a base name, the first one is found by it
+func (a *Archive) add(name string, data []byte) {
+	a.files[name] = data
+	if _, ok := a.baseNames[path.Base(name)]; !ok {
+		a.baseNames[path.Base(name)] = name
+	}
+}
+
+// Open returns a reader of the file 'name' of the archive.
+// 'name' is looked up by its full name in the archive or, if not found, by its base name,
+// so effects files can refer to images in a folder of the archive. eg: "IMG_2029.png" => "small/IMG_2029.png"
+func (a *Archive) Open(name string) (io.Reader, error) {
+	data, ok := a.files[name]
+	if !ok {
+		fullName, found := a.baseNames[path.Base(name)]
+		if !found {
+			return nil, fmt.Errorf("%s: not found in archive", name)
+		}
+		data = a.files[fullName]
+	}
+	return bytes.NewReader(data), nil
+}
+
+// CreateArchiveTasks creates a queue of tasks with the entries of the effects file, for the images in an archive.
+// Paths are not combined with data directories: 'InPath' is the name of the image in the archive (see `Archive.Open`)
+// and 'OutPath' the name given in the effects file.
+// @archiveName: name of the archive (see `ArchiveName`); acts as the data directory to select per-directory effects.
+// @dirEffects: optional effect chain per data directory (see `CreateTasks`). May be nil.
+// Obs: effects sidecars are not looked up in archives (see `sidecarEffects`).
+func CreateArchiveTasks(archiveName string, dirEffects map[string][]string) (*TaskQueue, error) {
+	tqueue := NewTaskQueue()
+	err := parseEffects(func(task Task) error {
+		if effects, ok := dirEffects[archiveName]; ok {
+			task = overrideEffects(task, effects)
+		}
+		tqueue.Tasks = append(tqueue.Tasks, task)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tqueue, nil
+}
+
+// ArchiveWriter writes files to a new .zip, .tar.gz or .tar archive.
+// @TASLock: test and set lock to synchronize workers adding files in parallel
+type ArchiveWriter struct {
+	mysync.TASLock
+	file       *os.File
+	zipWriter  *zip.Writer
+	gzipWriter *gzip.Writer
+	tarWriter  *tar.Writer
+}
+
+// NewArchiveWriter creates the archive at 'archivePath'. The format is given by the extension (see `IsArchive`).
+func NewArchiveWriter(archivePath string) (*ArchiveWriter, error) {
+	format := archiveFormat(archivePath)
+	if format == "" {
+		return nil, fmt.Errorf("unsupported archive %s: expected .zip, .tar.gz, .tgz or .tar", archivePath)
+	}
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	writer := &ArchiveWriter{TASLock: mysync.NewTasLock(), file: file}
+	switch format {
+	case "zip":
+		writer.zipWriter = zip.NewWriter(file)
+	case "tar.gz":
+		writer.gzipWriter = gzip.NewWriter(file)
+		writer.tarWriter = tar.NewWriter(writer.gzipWriter)
+	case "tar":
+		writer.tarWriter = tar.NewWriter(file)
+	}
+	return writer, nil
+}
+
+// Add writes a file named 'name' with contents 'data' to the archive in thread safe manner
+func (w *ArchiveWriter) Add(name string, data []byte) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.zipWriter != nil {
+		fileWriter, err := w.zipWriter.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = fileWriter.Write(data)
+		return err
+	}
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+	if err := w.tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := w.tarWriter.Write(data)
+	return err
+}
+
+// Close finishes the archive and closes its file
+func (w *ArchiveWriter) Close() error {
+	var err error
+	if w.zipWriter != nil {
+		err = w.zipWriter.Close()
+	} else {
+		err = w.tarWriter.Close()
+		if w.gzipWriter != nil {
+			if gzipErr := w.gzipWriter.Close(); err == nil {
+				err = gzipErr
+			}
+		}
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
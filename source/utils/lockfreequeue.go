@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+//=============================================================================
+// Lock-free task queue
+//=============================================================================
+
+// TaskSource is a queue of tasks shared by workers, each taking the next task with `Dequeue` until it returns nil.
+// Implemented by `TaskQueue` (TAS lock) and `LockFreeQueue` (atomic CAS), so they can be swapped to compare them.
+type TaskSource interface {
+	Dequeue() *Task
+}
+
+// LockFreeQueue is an unbounded multi-producer, multi-consumer FIFO queue of tasks without locks (Michael-Scott queue).
+// Tasks are kept in a linked list of nodes: 'head' points to a dummy node whose successor is the next task to dequeue,
+// and 'tail' to the last node or, while an enqueue is half done, to the one before it. Enqueues and dequeues
+// swing these pointers with CAS, and any goroutine finding 'tail' lagging behind advances it, so none waits for another.
+// Obs: ABA can't happen: nodes are never reused, and the garbage collector does not free a node (nor reuse its address)
+// while any goroutine still holds a pointer to it, so a CAS never succeeds on a node removed and allocated again.
+// This is why no tagged pointers or hazard pointers are needed, as they would be without a garbage collector.
+type LockFreeQueue struct {
+	head unsafe.Pointer // *lfNode; dummy node before the first task
+	tail unsafe.Pointer // *lfNode; last node, or the one before it
+}
+
+// lfNode is a node of the linked list of a `LockFreeQueue`
+type lfNode struct {
+	task Task
+	next unsafe.Pointer // *lfNode; nil for the last node
+}
+
+// NewLockFreeQueue creates an empty LockFreeQueue and returns a pointer to it
+func NewLockFreeQueue() *LockFreeQueue {
+	dummy := unsafe.Pointer(&lfNode{})
+	return &LockFreeQueue{head: dummy, tail: dummy}
+}
+
+// NewLockFreeQueueFrom returns a LockFreeQueue with 'tasks', in order. eg: the tasks of a `TaskQueue`
+func NewLockFreeQueueFrom(tasks []Task) *LockFreeQueue {
+	queue := NewLockFreeQueue()
+	for _, task := range tasks {
+		queue.Enqueue(task)
+	}
+	return queue
+}
+
+// Enqueue adds a new task to the end of the queue in thread safe manner
+func (q *LockFreeQueue) Enqueue(task Task) {
+	node := unsafe.Pointer(&lfNode{task: task})
+	for {
+		tail := atomic.LoadPointer(&q.tail)
+		next := atomic.LoadPointer(&(*lfNode)(tail).next)
+		// 'tail' and 'next' are inconsistent if another enqueue moved the tail meanwhile; try again
+		if tail != atomic.LoadPointer(&q.tail) {
+			continue
+		}
+		if next != nil {
+			// another enqueue linked its node but did not advance the tail yet; help it and try again
+			atomic.CompareAndSwapPointer(&q.tail, tail, next)
+			continue
+		}
+		// link the node after the last one; the enqueue takes effect here
+		if atomic.CompareAndSwapPointer(&(*lfNode)(tail).next, nil, node) {
+			// advance the tail to the node; if it fails, another goroutine already did
+			atomic.CompareAndSwapPointer(&q.tail, tail, node)
+			return
+		}
+	}
+}
+
+// Dequeue removes the first Task of the queue in thread safe manner and return a pointer to it; nil if empty
+func (q *LockFreeQueue) Dequeue() *Task {
+	for {
+		head := atomic.LoadPointer(&q.head)
+		tail := atomic.LoadPointer(&q.tail)
+		next := atomic.LoadPointer(&(*lfNode)(head).next)
+		// 'head', 'tail' and 'next' are inconsistent if another dequeue moved the head meanwhile; try again
+		if head != atomic.LoadPointer(&q.head) {
+			continue
+		}
+		if head == tail {
+			if next == nil {
+				return nil
+			}
+			// the tail lags behind a node being enqueued; advance it so the head does not pass it
+			atomic.CompareAndSwapPointer(&q.tail, tail, next)
+			continue
+		}
+		// obs: the task is read before the CAS; once the head moves, the node may be the dummy of other dequeues.
+		// It is never written after being linked, so reading it here is safe even if the CAS fails.
+		task := (*lfNode)(next).task
+		// the successor becomes the new dummy; the dequeue takes effect here
+		if atomic.CompareAndSwapPointer(&q.head, head, next) {
+			return &task
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Stress test for the `LockFreeQueue`: many producers enqueuing and many consumers dequeuing at the same time,
+// at high contention. Every task must be dequeued exactly once (no duplicates, no losses), and the tasks of each
+// producer in the order it enqueued them.
+// Obs: run with `-race` (see `TestLockFreeQueueStress` and `TestWorkStealing`) to also check for data races.
+
+// QueueStressTest enqueues 'numTasks' tasks to a `LockFreeQueue` from 'numProducers' producers, each its share of
+// the tasks in increasing order, while 'numConsumers' consumers dequeue them until the producers are done and the
+// queue is empty. Returns the number of tasks dequeued more than once, the number never dequeued, and the number of
+// tasks a consumer dequeued before an earlier task of the same producer (FIFO violations).
+func QueueStressTest(numTasks int, numProducers int, numConsumers int) (duplicates int, lost int, outOfOrder int) {
+	queue := NewLockFreeQueue()
+	counts := make([]int32, numTasks)
+	var unordered atomic.Int64
+
+	var producing sync.WaitGroup
+	var done atomic.Bool
+	// producer 'p' enqueues tasks p, p + numProducers, p + 2*numProducers, ...; the id of a task is its InPath
+	for p := 0; p < numProducers; p++ {
+		producing.Add(1)
+		go func(p int) {
+			defer producing.Done()
+			for id := p; id < numTasks; id += numProducers {
+				queue.Enqueue(Task{InPath: strconv.Itoa(id)})
+			}
+		}(p)
+	}
+
+	// consumers: dequeue until the producers are done and the queue is empty
+	var consuming sync.WaitGroup
+	for c := 0; c < numConsumers; c++ {
+		consuming.Add(1)
+		go func() {
+			defer consuming.Done()
+			// last task dequeued of each producer; a FIFO queue gives each consumer those of a producer in order
+			last := make([]int, numProducers)
+			for p := range last {
+				last[p] = -1
+			}
+			for {
+				// obs: the flag is read before dequeuing, so an empty queue after it means all tasks were taken
+				finished := done.Load()
+				task := queue.Dequeue()
+				if task == nil {
+					if finished {
+						return
+					}
+					continue
+				}
+				id, _ := strconv.Atoi(task.InPath)
+				atomic.AddInt32(&counts[id], 1)
+				if p := id % numProducers; id < last[p] {
+					unordered.Add(1)
+				} else {
+					last[p] = id
+				}
+			}
+		}()
+	}
+	producing.Wait()
+	done.Store(true)
+	consuming.Wait()
+
+	// check every task was dequeued exactly once
+	for _, count := range counts {
+		if count > 1 {
+			duplicates++
+		} else if count == 0 {
+			lost++
+		}
+	}
+	return duplicates, lost, int(unordered.Load())
+}
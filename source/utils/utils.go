@@ -2,11 +2,26 @@ package utils
 
 import(
 	"proj3/mysync"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"unicode"
 	cons "proj3/constants"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 type Queue struct {
@@ -21,11 +36,51 @@ type Queue struct {
 // @inPath: path to the input image
 // @outPath: path to the output image
 // @effects: list of effects to be applied to the image
+// @mask: optional path to a black and white image; effects are only applied where it is white (see `png.Image.SetMask`)
+// @outputs: optional; several outputs of the same input image, which is loaded once for all of them.
+// If given, 'outPath' and 'effects' are not used (see `Branches`). Ex:
+// {"inPath": "IMG_2029.png", "outputs": [{"outPath": "IMG_2029_B.png", "effects": ["B"]}, {"outPath": "IMG_2029_S.png", "effects": ["S"]}]}
 // reference: using tags to parse JSON https://pkg.go.dev/encoding/json#Marshal
 type Task struct {
-	InPath  string   `json:"inPath"`
-	OutPath string   `json:"outPath"`
-	Effects []string `json:"effects"`
+	InPath  string   `json:"inPath" yaml:"inPath" toml:"inPath"`
+	OutPath string   `json:"outPath" yaml:"outPath" toml:"outPath"`
+	Effects []string `json:"effects" yaml:"effects" toml:"effects"`
+	Mask    string   `json:"mask,omitempty" yaml:"mask,omitempty" toml:"mask,omitempty"`
+	Outputs []Output `json:"outputs,omitempty" yaml:"outputs,omitempty" toml:"outputs,omitempty"`
+}
+
+// Output is one of the outputs of a `Task` with several outputs: the effects applied to the input image
+// and the path the result is saved to.
+type Output struct {
+	OutPath string   `json:"outPath" yaml:"outPath" toml:"outPath"`
+	Effects []string `json:"effects" yaml:"effects" toml:"effects"`
+}
+
+// Branches returns a task with a single output for each output of 'task', with its input and mask.
+// A task without `Outputs` is its own single branch.
+// Obs: the branches are processed from a single load of the input image (eg: by cloning it; see `png.Image.Clone`).
+func (task Task) Branches() []Task {
+	if len(task.Outputs) == 0 {
+		return []Task{task}
+	}
+	branches := make([]Task, len(task.Outputs))
+	for i, output := range task.Outputs {
+		branches[i] = Task{InPath: task.InPath, OutPath: output.OutPath, Effects: output.Effects, Mask: task.Mask}
+	}
+	return branches
+}
+
+// CountOutputs returns the number of outputs of 'tasks', i.e., the number of images saved by processing them
+func CountOutputs(tasks []Task) int {
+	n := 0
+	for _, task := range tasks {
+		if len(task.Outputs) > 0 {
+			n += len(task.Outputs)
+		} else {
+			n++
+		}
+	}
+	return n
 }
 
 // TaskQueue is a struct containing a list of tasks and a TASLock to synchronize access to them
@@ -68,56 +123,612 @@ func (tq *TaskQueue) Dequeue() *Task {
 	return nil
 }
 
+//=============================================================================
+// Effects file decoders
+//=============================================================================
+
+// taskDecoder decodes one `Task` entry of the effects file at a time.
+// Obs: `json.Decoder` already satisfies this interface; YAML and TOML files are
+// parsed at once and served entry by entry by `listDecoder`.
+type taskDecoder interface {
+	Decode(v interface{}) error
+}
+
+// listDecoder serves a list of already parsed `Task`s one at a time, returning io.EOF at the end.
+type listDecoder struct {
+	tasks []Task
+	next  int
+}
+
+// Decode copies the next parsed `Task` into 'v', which must be a *Task.
+func (d *listDecoder) Decode(v interface{}) error {
+	if d.next >= len(d.tasks) {
+		return io.EOF
+	}
+	task, ok := v.(*Task)
+	if !ok {
+		return fmt.Errorf("listDecoder: cannot decode into %T", v)
+	}
+	*task = d.tasks[d.next]
+	d.next++
+	return nil
+}
+
+// tomlTasks mirrors the layout of a TOML effects file, where each entry is a `[[task]]` table.
+type tomlTasks struct {
+	Task []Task `toml:"task"`
+}
+
+// newTaskDecoder returns a `taskDecoder` for 'r' chosen by the extension of 'path'.
+// .yaml/.yml files hold a list of tasks; .toml files hold `[[task]]` tables;
+// anything else is parsed as JSON lines, as in effects.txt.
+func newTaskDecoder(r io.Reader, path string) (taskDecoder, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var tasks []Task
+		if err := yaml.NewDecoder(r).Decode(&tasks); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return &listDecoder{tasks: tasks}, nil
+
+	case ".toml":
+		var file tomlTasks
+		if _, err := toml.NewDecoder(r).Decode(&file); err != nil {
+			return nil, err
+		}
+		return &listDecoder{tasks: file.Task}, nil
+
+	default:
+		return json.NewDecoder(r), nil
+	}
+}
+
 // Combines data directories from CMD inputs and effects.txt file
 //  to create a queue of tasks and returns a pointer to it.
-func CreateTasks(dataDirs string) *TaskQueue {
-	// open effects.txt file and instantiate JSON decoder to parse it
-	effectsFile, err := os.Open(cons.EffectsPathFile)
-	if err != nil{
-		fmt.Println("Error opening effects.txt file:", err)
-		os.Exit(1)
+// @dirEffects: optional effect chain per data directory; tasks of a directory in the map
+// apply its chain instead of the effects given in effects.txt (see `LoadDirEffects`). May be nil.
+// Images with an effects sidecar apply its chain instead of both (see `sidecarEffects`).
+// Returns an error if the effects file or a sidecar can't be opened or parsed.
+func CreateTasks(dataDirs string, dirEffects map[string][]string) (*TaskQueue, error) {
+	// queue to populate with Task structs
+	tqueue := NewTaskQueue()
+
+	tasks, errs := CreateTasksChan(context.Background(), dataDirs, dirEffects)
+	for task := range tasks {
+		tqueue.Tasks = append(tqueue.Tasks, task)
 	}
-	defer effectsFile.Close()
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return tqueue, nil
+}
+
+// CreateTasksChan is the streaming version of `CreateTasks`: tasks are sent on the returned channel
+// as the effects file is parsed, so consumers can start processing before the whole file is read.
+// The task channel is closed when the file is exhausted, parsing fails or 'ctx' is cancelled;
+// the error channel then yields the parse error or `ctx.Err()`, or is closed empty on success.
+// Obs: YAML and TOML files are parsed at once by their decoders; only JSON lines files are streamed.
+// Obs: no mode of the scheduler consumes the stream yet; `CreateTasks` collects it. The queue of a run is needed
+// whole before processing starts, to skip the images in the checkpoint, sort, shuffle or sample the tasks and
+// divide them among the workers (see `scheduler.createTasks`).
+func CreateTasksChan(ctx context.Context, dataDirs string, dirEffects map[string][]string) (<-chan Task, <-chan error) {
+	tasks := make(chan Task)
+	// obs: buffered so the parser never blocks on reporting its error
+	errs := make(chan error, 1)
 
 	// Split the dataDirs input into individual directories
 	// e.g. "s+b" -> ["s", "b"]
 	dirs := strings.Split(dataDirs, "+")
 
-	// instantiate JSON decoder to parse effects.txt file
-	decoder := json.NewDecoder(effectsFile)
+	go func() {
+		defer close(errs)
+		defer close(tasks)
 
-	// queue to populate with Task structs
-	tqueue := NewTaskQueue()
-	
-	// loop over parse effects.txt entries and create new tasks combining with data directories
-	for {
+		// loop over data directories and send a new task for each one
+		err := parseEffects(func(task Task) error {
+			for _, dir := range dirs {
+				newTask, err := dirTask(dir, task, dirEffects)
+				if err != nil {
+					return err
+				}
+				select {
+				case tasks <- newTask:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return tasks, errs
+}
+
+// parseEffects calls 'handle' with each entry of the effects file, in order.
+// Stops at the first error opening/parsing the file or returned by 'handle' and returns it.
+// Obs: only a clean end of file (io.EOF, possibly wrapped) ends the parsing; a malformed entry, even a truncated
+// last one (io.ErrUnexpectedEOF), is a parse error giving the number of the entry (from 1).
+func parseEffects(handle func(task Task) error) error {
+	// open effects.txt file
+	effectsFile, err := os.Open(cons.EffectsPathFile)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", cons.EffectsPathFile, err)
+	}
+	defer effectsFile.Close()
+
+	// instantiate a decoder for the effects file based on its extension (JSON by default)
+	decoder, err := newTaskDecoder(effectsFile, cons.EffectsPathFile)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", cons.EffectsPathFile, err)
+	}
+
+	// loop over parse effects.txt entries
+	for entry := 1; ; entry++ {
 		var task Task
 		// retrieve next entry from effects.txt file
 		// Obs: the Task struct defines the fields to be parsed from the JSON file
 		if err := decoder.Decode(&task); err != nil {
-			if err.Error() == "EOF" {
-				// end of file reached, stop parsing
-				break
-			} else {
-				fmt.Println("Error decoding effects file:", err)
-				os.Exit(1)
+			if !errors.Is(err, io.EOF) {
+				return fmt.Errorf("decoding entry %d of %s: %w", entry, cons.EffectsPathFile, err)
 			}
+			// end of file reached, stop parsing
+			return nil
+		}
+		if err := handle(task); err != nil {
+			return err
 		}
-		// loop over data directories and create a new task for each one
-		for _, dir := range dirs {
-			// Create a new task with updated paths for each directory
-			newTask := Task{
-						InPath:  cons.InDir + "/" + dir + "/" + task.InPath,
-						OutPath: cons.OutDir + "/" + dir + "_" + task.OutPath,
-						Effects: task.Effects,}
+	}
+}
+
+// Extensions of the images of a data directory processed by `CreateEffectsTasks`
+var imageExts = map[string]bool{".png": true, ".jpg": true, ".jpeg": true}
 
-			// add new task to the queue
+// CreateEffectsTasks creates a queue of tasks applying 'effects' to every image of the data directories, instead of
+// the entries of the effects file (eg: effects given in the command line; see `png.ParseEffectChain`).
+// The images are the PNG and JPEG files of each directory, by name; the output of IMG.png is IMG_Out.png, as in
+// the effects file. Per-directory effects and sidecars override 'effects' as in `CreateTasks`.
+// Returns an error if a data directory can't be read or a sidecar can't be parsed.
+func CreateEffectsTasks(dataDirs string, effects []string, dirEffects map[string][]string) (*TaskQueue, error) {
+	tqueue := NewTaskQueue()
+	for _, dir := range strings.Split(dataDirs, "+") {
+		entries, err := os.ReadDir(cons.InDir + "/" + dir)
+		if err != nil {
+			return nil, fmt.Errorf("listing images of %s: %w", dir, err)
+		}
+		// obs: entries are sorted by name
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if entry.IsDir() || !imageExts[strings.ToLower(ext)] {
+				continue
+			}
+			task := Task{InPath: entry.Name(), OutPath: strings.TrimSuffix(entry.Name(), ext) + "_Out.png", Effects: effects}
+			newTask, err := dirTask(dir, task, dirEffects)
+			if err != nil {
+				return nil, err
+			}
 			tqueue.Tasks = append(tqueue.Tasks, newTask)
 		}
 	}
-	return tqueue
+	return tqueue, nil
+}
+
+// dirTask creates the task of the effects file entry 'task' for the data directory 'dir'
+// Returns an error if the sidecar of the image can't be read or parsed (see `sidecarEffects`).
+func dirTask(dir string, task Task, dirEffects map[string][]string) (Task, error) {
+	// Create a new task with updated paths for the directory
+	newTask := Task{
+				InPath:  cons.InDir + "/" + dir + "/" + task.InPath,
+				OutPath: cons.OutDir + "/" + dir + "_" + task.OutPath,
+				Effects: task.Effects,}
+	// obs: the mask is in the data directory, as the image
+	if task.Mask != "" {
+		newTask.Mask = cons.InDir + "/" + dir + "/" + task.Mask
+	}
+	for _, output := range task.Outputs {
+		newTask.Outputs = append(newTask.Outputs,
+			Output{OutPath: cons.OutDir + "/" + dir + "_" + output.OutPath, Effects: output.Effects})
+	}
+	if effects, ok := dirEffects[dir]; ok {
+		newTask = overrideEffects(newTask, effects)
+	}
+	// obs: the sidecar is the most specific, so it overrides the chain of the directory too
+	effects, ok, err := sidecarEffects(newTask.InPath)
+	if err != nil {
+		return Task{}, err
+	}
+	if ok {
+		newTask = overrideEffects(newTask, effects)
+	}
+	return newTask, nil
+}
+
+// Extension of the effects sidecar of an image: a file next to it, named as the image followed by the extension.
+// eg: data/in/small/IMG_2029.png => data/in/small/IMG_2029.png.effects
+const sidecarExt = ".effects"
+
+// sidecarEffects returns the effect chain in the sidecar of the image at 'inPath' (see `sidecarExt`),
+// or false if it has none. The sidecar holds the effects as in the effects file, i.e., a JSON array,
+// or the plain effect codes separated by commas, spaces or new lines. Ex: ["B", "S"]; B,S
+// An empty sidecar gives an empty chain: the image is saved without effects.
+func sidecarEffects(inPath string) ([]string, bool, error) {
+	path := inPath + sidecarExt
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("reading sidecar %s: %w", path, err)
+	}
+
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "[") {
+		var effects []string
+		if err := json.Unmarshal([]byte(text), &effects); err != nil {
+			return nil, false, fmt.Errorf("parsing sidecar %s: %w", path, err)
+		}
+		return effects, true, nil
+	}
+	effects := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	return effects, true, nil
+}
+
+// overrideEffects returns 'task' with 'effects' as the effect chain of all of its outputs (see `CreateTasks`)
+func overrideEffects(task Task, effects []string) Task {
+	task.Effects = effects
+	outputs := make([]Output, len(task.Outputs))
+	for i, output := range task.Outputs {
+		outputs[i] = Output{OutPath: output.OutPath, Effects: effects}
+	}
+	if len(outputs) > 0 {
+		task.Outputs = outputs
+	}
+	return task
+}
+
+// LoadDirEffects parses the per-directory effect chains in 'path' to be passed to `CreateTasks`.
+// The file holds a JSON object mapping data directories to effect chains. Ex:
+// {"small": ["G"], "big": ["B", "E"]}
+func LoadDirEffects(path string) (map[string][]string, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dirEffects := make(map[string][]string)
+	if err := json.Unmarshal(file, &dirEffects); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return dirEffects, nil
+}
+
+//=============================================================================
+// Content hash of tasks
+//=============================================================================
+
+// number of hex digits of the content hash embedded in output paths (see `HashedPath`)
+const contentHashLen = 12
+
+// ContentHash returns a short hash (truncated SHA-256, in hex) of the contents of the input image of 'task',
+// of its mask if any, and of its effect chain: the same image with the same effects always gets the same hash,
+// while changing the image or the effects changes it. Files are read with 'open' (eg: `Archive.Open`); if nil, from disk.
+func ContentHash(task Task, open func(name string) (io.Reader, error)) (string, error) {
+	if open == nil {
+		open = openFile
+	}
+	hash := sha256.New()
+	for _, name := range []string{task.InPath, task.Mask} {
+		if name == "" {
+			continue
+		}
+		reader, err := open(name)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(hash, reader)
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return "", fmt.Errorf("hashing %s: %w", name, err)
+		}
+	}
+	// obs: quoted, so the boundaries between effects are part of the hash. eg: ["B","G"] != ["BG"]
+	fmt.Fprintf(hash, "%q", task.Effects)
+	return hex.EncodeToString(hash.Sum(nil))[:contentHashLen], nil
 }
 
+// HashedPath inserts 'hash' before the extension of 'path'. eg: "data/out/small_IMG_2029_Out.png" -> "data/out/small_IMG_2029_Out.<hash>.png"
+func HashedPath(path string, hash string) string {
+	ext := filepath.Ext(path)
+	return path[:len(path)-len(ext)] + "." + hash + ext
+}
+
+// AddContentHashes embeds the content hash of each task in its output path (see `ContentHash` and `HashedPath`),
+// so outputs are content addressed: a checkpoint records them by content, and a changed input gets a new output.
+// Each of the `Outputs` of a task gets the hash of its own effects.
+// Tasks whose input can't be read keep their output path; they fail when the image is loaded.
+func AddContentHashes(tasks []Task, open func(name string) (io.Reader, error)) {
+	for i := range tasks {
+		if len(tasks[i].Outputs) > 0 {
+			for j, branch := range tasks[i].Branches() {
+				if hash, err := ContentHash(branch, open); err == nil {
+					tasks[i].Outputs[j].OutPath = HashedPath(branch.OutPath, hash)
+				}
+			}
+			continue
+		}
+		if hash, err := ContentHash(tasks[i], open); err == nil {
+			tasks[i].OutPath = HashedPath(tasks[i].OutPath, hash)
+		}
+	}
+}
+
+// openFile opens the file 'name' for `ContentHash`
+func openFile(name string) (io.Reader, error) {
+	return os.Open(name)
+}
+
+//=============================================================================
+// Output collisions
+//=============================================================================
+
+// Collision is an output path written by more than one task (or output of a task; see `Task.Branches`).
+// Tasks run concurrently, so which of them is kept is up to the scheduling; the others are lost.
+// @InPaths: input images of the tasks writing to 'OutPath', in the order of the tasks
+type Collision struct {
+	OutPath string
+	InPaths []string
+}
+
+// String returns the collision as "<outPath> <- <inPath>, <inPath>, ..."
+func (c Collision) String() string {
+	return c.OutPath + " <- " + strings.Join(c.InPaths, ", ")
+}
+
+// DetectCollisions returns the output paths targeted by more than one of 'tasks', in the order they first appear.
+// Returns nil if all outputs are distinct.
+func DetectCollisions(tasks []Task) []Collision {
+	inPaths := make(map[string][]string)
+	var outPaths []string
+	for _, task := range tasks {
+		for _, branch := range task.Branches() {
+			if _, ok := inPaths[branch.OutPath]; !ok {
+				outPaths = append(outPaths, branch.OutPath)
+			}
+			inPaths[branch.OutPath] = append(inPaths[branch.OutPath], branch.InPath)
+		}
+	}
+	var collisions []Collision
+	for _, outPath := range outPaths {
+		if len(inPaths[outPath]) > 1 {
+			collisions = append(collisions, Collision{OutPath: outPath, InPaths: inPaths[outPath]})
+		}
+	}
+	return collisions
+}
+
+//=============================================================================
+// Checkpoint of completed tasks
+//=============================================================================
+
+// Checkpoint records the output path of each completed `Task` in a file, one per line,
+// so that a batch that dies partway can be resumed without reprocessing completed images.
+// @path: path to the checkpoint file
+// @file: checkpoint file opened in append mode at the first `MarkDone`
+// @Mutex: lock to synchronize concurrent writers
+// Obs: a mutex rather than a `mysync.TASLock`: each `MarkDone` holds the lock while syncing the file to disk, and
+// writers waiting for it sleep instead of spinning for that long.
+// Obs: all methods are no-ops on a nil *Checkpoint, so callers need not check if checkpointing is enabled.
+type Checkpoint struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+// creates a new Checkpoint struct for the file at 'path' and returns a pointer to it
+func NewCheckpoint(path string) *Checkpoint {
+	return &Checkpoint{path: path}
+}
+
+// Load returns the set of output paths recorded in the checkpoint file.
+// If the file does not exist, returns an empty set.
+func (c *Checkpoint) Load() map[string]bool {
+	done := make(map[string]bool)
+	if c == nil {
+		return done
+	}
+	file, err := os.Open(c.path)
+	if err != nil {
+		return done
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// obs: a crash might leave an empty or partial last line; a partial path never matches a task
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			done[line] = true
+		}
+	}
+	return done
+}
+
+// MarkDone appends 'outPath' to the checkpoint file in thread safe manner.
+// The line is synced to disk before returning, so it survives a crash right after.
+func (c *Checkpoint) MarkDone(outPath string) error {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if c.file == nil {
+		file, err := os.OpenFile(c.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		c.file = file
+	}
+	if _, err := c.file.WriteString(outPath + "\n"); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+// Reset removes all records from the checkpoint file
+func (c *Checkpoint) Reset() error {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	err := os.Remove(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Close closes the checkpoint file
+func (c *Checkpoint) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+//=============================================================================
+// Work estimate
+//=============================================================================
+
+// WorkEstimate contains the theoretical work of processing a list of tasks
+// @Images: number of images whose dimensions could be read
+// @Unreadable: number of images whose dimensions could not be read (not counted in the totals)
+// @Pixels: total pixels of all images
+// @PixelOps: pixels processed by each effect, counting each application of the effect
+// @MultiplyAdds: multiply-adds of each effect (pixels x kernel size per convolution)
+// @TotalPixelOps, TotalMultiplyAdds: sums over all effects
+type WorkEstimate struct {
+	Images            int
+	Unreadable        int
+	Pixels            int64
+	PixelOps          map[string]int64
+	MultiplyAdds      map[string]int64
+	TotalPixelOps     int64
+	TotalMultiplyAdds int64
+}
+
+// EstimateWork computes the work of processing 'tasks' without processing them.
+// Only the image headers are decoded to get their dimensions.
+// @kernelSizes: number of elements of the kernel of each effect (see `png.KernelSizes`)
+// Obs: multiply-adds are counted per channel, i.e. for one of r, g, b.
+func EstimateWork(tasks []Task, kernelSizes map[string]int) WorkEstimate {
+	estimate := WorkEstimate{PixelOps: make(map[string]int64), MultiplyAdds: make(map[string]int64)}
+	for _, task := range tasks {
+		width, height, err := imageSize(task.InPath)
+		if err != nil {
+			estimate.Unreadable++
+			continue
+		}
+		pixels := int64(width) * int64(height)
+		estimate.Images++
+		estimate.Pixels += pixels
+
+		// obs: each output applies its own effects to the image
+		for _, branch := range task.Branches() {
+			for _, effect := range branch.Effects {
+				multiplyAdds := pixels * int64(kernelSizes[effect])
+				estimate.PixelOps[effect] += pixels
+				estimate.MultiplyAdds[effect] += multiplyAdds
+				estimate.TotalPixelOps += pixels
+				estimate.TotalMultiplyAdds += multiplyAdds
+			}
+		}
+	}
+	return estimate
+}
+
+// imageSize returns the dimensions of the image at 'path' decoding only its header
+func imageSize(path string) (int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	imgConfig, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	return imgConfig.Width, imgConfig.Height, nil
+}
+
+//=============================================================================
+// Manifest of processed files
+//=============================================================================
+
+// ManifestEntry describes a processed image
+type ManifestEntry struct {
+	InPath      string   `json:"inPath"`
+	OutPath     string   `json:"outPath"`
+	Effects     []string `json:"effects"`
+	Width       int      `json:"width"`			// width of the output image
+	Height      int      `json:"height"`			// height of the output image
+	TimeElapsed float64  `json:"timeElapsed"`	// seconds from loading to saving the image
+}
+
+// Manifest collects a `ManifestEntry` for each processed image, in order of completion.
+// @TASLock: test and set lock to synchronize workers completing images in parallel
+// Obs: all methods are no-ops on a nil *Manifest, so callers need not check if the manifest is enabled.
+type Manifest struct {
+	mysync.TASLock
+	Entries []ManifestEntry
+}
+
+// creates and initialize a new Manifest struct and returns a pointer to it
+func NewManifest() *Manifest {
+	return &Manifest{TASLock: mysync.NewTasLock(), Entries: make([]ManifestEntry, 0)}
+}
+
+// Add appends 'entry' to the manifest in thread safe manner
+func (m *Manifest) Add(entry ManifestEntry) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	m.Entries = append(m.Entries, entry)
+	m.Unlock()
+}
+
+// Write writes the manifest to 'filename' as a JSON array
+func (m *Manifest) Write(filename string) error {
+	if m == nil {
+		return nil
+	}
+	m.Lock()
+	writeBytes, err := json.MarshalIndent(m.Entries, "", "  ")
+	m.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, writeBytes, 0644)
+}
 
 // Writes 'text' to 'filename', appending to a new line. If the file does not exist, it is created.
 func WriteToFile(filename string, text string) {
@@ -137,6 +748,25 @@ func WriteToFile(filename string, text string) {
 	}
 }
 
+// CopyFile copies the contents of the file 'src' to 'dst', creating or truncating it.
+func CopyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 // Prints the current working directory; used for debugging
 func PrintWorkingDirectory(){
 	dir, err := os.Getwd()
@@ -0,0 +1,456 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	cons "proj3/constants"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useEffectsFile writes 'content' to an effects file named 'name' in a temporary directory and points
+// the effects file, input and output directories to it for the duration of the test.
+func useEffectsFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	effectsPath, inDir, outDir := cons.EffectsPathFile, cons.InDir, cons.OutDir
+	t.Cleanup(func() { cons.EffectsPathFile, cons.InDir, cons.OutDir = effectsPath, inDir, outDir })
+	cons.EffectsPathFile, cons.InDir, cons.OutDir = path, dir, dir
+	return dir
+}
+
+func TestCreateTasksFormats(t *testing.T) {
+	files := map[string]string{
+		"effects.txt": `{"inPath": "IMG_1.png", "outPath": "IMG_1_Out.png", "effects": ["G", "E"]}
+{"inPath": "IMG_2.png", "outPath": "IMG_2_Out.png", "effects": ["B"]}
+`,
+		"effects.yaml": `# hand-written effects
+- inPath: IMG_1.png
+  outPath: IMG_1_Out.png
+  effects: [G, E]
+- inPath: IMG_2.png
+  outPath: IMG_2_Out.png
+  effects: [B]
+`,
+		"effects.toml": `[[task]]
+inPath = "IMG_1.png"
+outPath = "IMG_1_Out.png"
+effects = ["G", "E"]
+
+[[task]]
+inPath = "IMG_2.png"
+outPath = "IMG_2_Out.png"
+effects = ["B"]
+`,
+	}
+	parsed := make(map[string][]Task)
+	for name, content := range files {
+		dir := useEffectsFile(t, name, content)
+		queue, err := CreateTasks("small", nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// the paths differ by the temporary directory only
+		for i := range queue.Tasks {
+			queue.Tasks[i].InPath, _ = filepath.Rel(dir, queue.Tasks[i].InPath)
+			queue.Tasks[i].OutPath, _ = filepath.Rel(dir, queue.Tasks[i].OutPath)
+		}
+		parsed[name] = queue.Tasks
+	}
+
+	want := []Task{
+		{InPath: "small/IMG_1.png", OutPath: "small_IMG_1_Out.png", Effects: []string{"G", "E"}},
+		{InPath: "small/IMG_2.png", OutPath: "small_IMG_2_Out.png", Effects: []string{"B"}},
+	}
+	for name, tasks := range parsed {
+		if !reflect.DeepEqual(tasks, want) {
+			t.Errorf("%s: got tasks %+v, want %+v", name, tasks, want)
+		}
+	}
+}
+
+func TestLoadDirEffects(t *testing.T) {
+	dir := useEffectsFile(t, "effects.txt", `{"inPath": "IMG_1.png", "outPath": "IMG_1_Out.png", "effects": ["E"]}
+`)
+	path := filepath.Join(dir, "dir-effects.json")
+	if err := os.WriteFile(path, []byte(`{"small": ["G"], "big": ["B", "S"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dirEffects, err := LoadDirEffects(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := CreateTasks("small+big+mixture", dirEffects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the directories in the map apply their chain; the others the one of effects.txt
+	want := map[string][]string{"small": {"G"}, "big": {"B", "S"}, "mixture": {"E"}}
+	if len(queue.Tasks) != len(want) {
+		t.Fatalf("got %d tasks, want %d", len(queue.Tasks), len(want))
+	}
+	for _, task := range queue.Tasks {
+		dataDir := filepath.Base(filepath.Dir(task.InPath))
+		if !reflect.DeepEqual(task.Effects, want[dataDir]) {
+			t.Errorf("task of %s applies %v, want %v", dataDir, task.Effects, want[dataDir])
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{"small": "G"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDirEffects(path); err == nil {
+		t.Error("a chain that is not a list: no error")
+	}
+	if _, err := LoadDirEffects(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("a missing file: no error")
+	}
+}
+
+// effectsLines returns an effects file of 'n' JSON lines, IMG_1.png to IMG_n.png
+func effectsLines(n int) string {
+	var lines strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&lines, "{\"inPath\": \"IMG_%d.png\", \"outPath\": \"IMG_%d_Out.png\", \"effects\": [\"G\"]}\n", i, i)
+	}
+	return lines.String()
+}
+
+func TestCreateTasksChan(t *testing.T) {
+	useEffectsFile(t, "effects.txt", effectsLines(50))
+	want, err := CreateTasks("small+big", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream yields the tasks of the queue, in the same order
+	tasks, errs := CreateTasksChan(context.Background(), "small+big", nil)
+	var got []Task
+	for task := range tasks {
+		got = append(got, task)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want.Tasks) {
+		t.Errorf("streamed %d tasks differing from the %d of the queue", len(got), len(want.Tasks))
+	}
+
+	// a parse error is sent on the error channel once the tasks before it are streamed
+	useEffectsFile(t, "effects.txt", effectsLines(3)+"{\"inPath\": \"IMG_4.png\", \"outPa")
+	tasks, errs = CreateTasksChan(context.Background(), "small", nil)
+	n := 0
+	for range tasks {
+		n++
+	}
+	if err := <-errs; err == nil || n != 3 {
+		t.Errorf("streamed %d tasks and got error %v, want 3 tasks and a parse error", n, err)
+	}
+}
+
+func TestCreateTasksChanCancel(t *testing.T) {
+	const n = 10000
+	useEffectsFile(t, "effects.txt", effectsLines(n))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tasks, errs := CreateTasksChan(ctx, "small", nil)
+	// cancel after the first task; the parser stops instead of reading the rest of the file
+	<-tasks
+	cancel()
+	received := 1
+	for range tasks {
+		received++
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if received >= n {
+		t.Errorf("received all %d tasks after cancelling", received)
+	}
+}
+
+func TestCheckpointConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.txt")
+	checkpoint := NewCheckpoint(path)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				if err := checkpoint.MarkDone(fmt.Sprintf("out/%d_%d.png", w, i)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	checkpoint.Close()
+
+	done := NewCheckpoint(path).Load()
+	if len(done) != 200 {
+		t.Fatalf("loaded %d outputs, want 200", len(done))
+	}
+	for w := 0; w < 8; w++ {
+		for i := 0; i < 25; i++ {
+			if !done[fmt.Sprintf("out/%d_%d.png", w, i)] {
+				t.Fatalf("output %d_%d is not recorded", w, i)
+			}
+		}
+	}
+}
+
+func TestCheckpointPartialLine(t *testing.T) {
+	// a crash in the middle of a write leaves a partial last line
+	path := filepath.Join(t.TempDir(), "checkpoint.txt")
+	if err := os.WriteFile(path, []byte("out/a.png\nout/b.png\n\nout/c.p"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	done := NewCheckpoint(path).Load()
+	if !reflect.DeepEqual(done, map[string]bool{"out/a.png": true, "out/b.png": true, "out/c.p": true}) {
+		t.Errorf("loaded %v", done)
+	}
+	// missing file: nothing done
+	if done := NewCheckpoint(path + ".missing").Load(); len(done) != 0 {
+		t.Errorf("loaded %v from a missing file", done)
+	}
+}
+
+func TestEstimateWork(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string][2]int{"small.png": {10, 20}, "wide.png": {30, 4}} {
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = png.Encode(file, image.NewGray(image.Rect(0, 0, size[0], size[1])))
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tasks := []Task{
+		{InPath: filepath.Join(dir, "small.png"), Effects: []string{"B", "S"}},
+		{InPath: filepath.Join(dir, "wide.png"), Effects: []string{"G", "B"}},
+		{InPath: filepath.Join(dir, "missing.png"), Effects: []string{"B"}},
+	}
+	// 200 and 120 pixels; 3x3 kernels for the convolutions, none for grayscale
+	got := EstimateWork(tasks, map[string]int{"B": 9, "S": 9, "G": 0})
+	want := WorkEstimate{
+		Images:            2,
+		Unreadable:        1,
+		Pixels:            320,
+		PixelOps:          map[string]int64{"B": 320, "S": 200, "G": 120},
+		MultiplyAdds:      map[string]int64{"B": 320 * 9, "S": 200 * 9, "G": 0},
+		TotalPixelOps:     640,
+		TotalMultiplyAdds: 520 * 9,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestCreateTasksBadEffectsFile(t *testing.T) {
+	files := map[string]string{
+		"effects.txt":  `{"inPath": "IMG_1.png", "outPath": "IMG_1_Out.png", "effects": ["G"]` + "\n",
+		"effects.yaml": "- inPath: [IMG_1.png\n",
+		"effects.toml": "[[task]\ninPath = \"IMG_1.png\"\n",
+	}
+	for name, content := range files {
+		useEffectsFile(t, name, content)
+		if _, err := CreateTasks("small", nil); err == nil {
+			t.Errorf("%s: malformed effects file returned no error", name)
+		}
+	}
+	// missing file
+	useEffectsFile(t, "effects.txt", "")
+	cons.EffectsPathFile += ".missing"
+	if _, err := CreateTasks("small", nil); err == nil {
+		t.Error("missing effects file returned no error")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	img, copied, changed := write("img.png", "pixels"), write("copy.png", "pixels"), write("changed.png", "pixelz")
+	hash := func(inPath string, effects ...string) string {
+		t.Helper()
+		h, err := ContentHash(Task{InPath: inPath, OutPath: "out.png", Effects: effects}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	reference := hash(img, "B", "G")
+	if len(reference) != contentHashLen {
+		t.Errorf("hash %q has %d digits, want %d", reference, len(reference), contentHashLen)
+	}
+	// same content and effects: same hash, whatever the path
+	if hash(img, "B", "G") != reference || hash(copied, "B", "G") != reference {
+		t.Error("the same input and effects gave another hash")
+	}
+	for name, other := range map[string]string{
+		"changed effects":     hash(img, "B", "S"),
+		"effects reordered":   hash(img, "G", "B"),
+		"effects joined":      hash(img, "BG"),
+		"changed input bytes": hash(changed, "B", "G"),
+	} {
+		if other == reference {
+			t.Errorf("%s gave the same hash", name)
+		}
+	}
+	if _, err := ContentHash(Task{InPath: filepath.Join(dir, "missing.png")}, nil); err == nil {
+		t.Error("hashing a missing input returned no error")
+	}
+
+	tasks := []Task{{InPath: img, OutPath: "out/img_Out.png", Effects: []string{"B", "G"}}}
+	AddContentHashes(tasks, nil)
+	if want := "out/img_Out." + reference + ".png"; tasks[0].OutPath != want {
+		t.Errorf("hashed output path %q, want %q", tasks[0].OutPath, want)
+	}
+}
+
+func TestDetectCollisions(t *testing.T) {
+	tasks := []Task{
+		{InPath: "small/IMG_1.png", OutPath: "out/a.png", Effects: []string{"B"}},
+		{InPath: "big/IMG_1.png", OutPath: "out/b.png", Effects: []string{"B"}},
+		{InPath: "small/IMG_2.png", OutPath: "out/a.png", Effects: []string{"G"}},
+		// outputs of the same task collide too
+		{InPath: "small/IMG_3.png", Outputs: []Output{{OutPath: "out/c.png", Effects: []string{"B"}}, {OutPath: "out/c.png", Effects: []string{"S"}}}},
+	}
+	want := []Collision{
+		{OutPath: "out/a.png", InPaths: []string{"small/IMG_1.png", "small/IMG_2.png"}},
+		{OutPath: "out/c.png", InPaths: []string{"small/IMG_3.png", "small/IMG_3.png"}},
+	}
+	if got := DetectCollisions(tasks); !reflect.DeepEqual(got, want) {
+		t.Errorf("got collisions %v, want %v", got, want)
+	}
+	if got := want[0].String(); got != "out/a.png <- small/IMG_1.png, small/IMG_2.png" {
+		t.Errorf("collision printed as %q", got)
+	}
+	if got := DetectCollisions(tasks[:2]); got != nil {
+		t.Errorf("distinct outputs reported as collisions: %v", got)
+	}
+}
+
+func TestSidecarEffects(t *testing.T) {
+	dir := useEffectsFile(t, "effects.txt", `{"inPath": "IMG_1.png", "outPath": "IMG_1_Out.png", "effects": ["G"]}
+{"inPath": "IMG_2.png", "outPath": "IMG_2_Out.png", "effects": ["G"]}
+{"inPath": "IMG_3.png", "outputs": [{"outPath": "IMG_3_a.png", "effects": ["G"]}, {"outPath": "IMG_3_b.png", "effects": ["E"]}]}
+{"inPath": "IMG_4.png", "outPath": "IMG_4_Out.png", "effects": ["G"]}
+`)
+	if err := os.MkdirAll(filepath.Join(dir, "small"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sidecars := map[string]string{
+		"IMG_1.png.effects": `["B", "S"]`,
+		"IMG_2.png.effects": "B, S\nE\n",
+		"IMG_3.png.effects": "",
+	}
+	for name, content := range sidecars {
+		if err := os.WriteFile(filepath.Join(dir, "small", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the sidecar overrides the chain of the directory too
+	queue, err := CreateTasks("small", map[string][]string{"small": {"Sh"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"IMG_1.png": {"B", "S"},
+		"IMG_2.png": {"B", "S", "E"},
+		"IMG_3.png": {},
+		"IMG_4.png": {"Sh"},
+	}
+	if len(queue.Tasks) != len(want) {
+		t.Fatalf("got %d tasks, want %d", len(queue.Tasks), len(want))
+	}
+	for _, task := range queue.Tasks {
+		name := filepath.Base(task.InPath)
+		if len(task.Effects) != len(want[name]) || (len(task.Effects) > 0 && !reflect.DeepEqual(task.Effects, want[name])) {
+			t.Errorf("%s applies %q, want %q", name, task.Effects, want[name])
+		}
+		// all outputs of the image apply the chain of its sidecar
+		for _, output := range task.Outputs {
+			if len(output.Effects) != len(want[name]) {
+				t.Errorf("%s: output %s applies %q, want %q", name, output.OutPath, output.Effects, want[name])
+			}
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "small", "IMG_4.png.effects"), []byte(`["B"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateTasks("small", nil); err == nil {
+		t.Error("a malformed sidecar: no error")
+	}
+}
+
+func TestCreateTasksMalformedEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		entry   string // number of the malformed entry, in the error
+	}{
+		{"middle line", `{"inPath": "IMG_1.png", "outPath": "IMG_1_Out.png", "effects": ["G"]}
+{"inPath": "IMG_2.png", "outPath": IMG_2_Out.png, "effects": ["B"]}
+{"inPath": "IMG_3.png", "outPath": "IMG_3_Out.png", "effects": ["S"]}
+`, "entry 2"},
+		{"truncated last line", `{"inPath": "IMG_1.png", "outPath": "IMG_1_Out.png", "effects": ["G"]}
+{"inPath": "IMG_2.png", "outPa`, "entry 2"},
+	}
+	for _, test := range tests {
+		useEffectsFile(t, "effects.txt", test.content)
+		_, err := CreateTasks("small", nil)
+		if err == nil || !strings.Contains(err.Error(), test.entry) || !strings.Contains(err.Error(), cons.EffectsPathFile) {
+			t.Errorf("%s: got %v, want a parse error of %s of the file", test.name, err, test.entry)
+		}
+		if errors.Is(err, io.EOF) {
+			t.Errorf("%s: the parse error is an end of file: %v", test.name, err)
+		}
+	}
+
+	// a clean end of file, with or without a last newline and blank lines
+	for _, content := range []string{
+		`{"inPath": "IMG_1.png", "outPath": "IMG_1_Out.png", "effects": ["G"]}`,
+		"{\"inPath\": \"IMG_1.png\", \"outPath\": \"IMG_1_Out.png\", \"effects\": [\"G\"]}\n\n\n",
+	} {
+		useEffectsFile(t, "effects.txt", content)
+		if queue, err := CreateTasks("small", nil); err != nil || len(queue.Tasks) != 1 {
+			t.Errorf("parsing %q: %v", content, err)
+		}
+	}
+}
+
+// run with -race to also check the queue for data races
+func TestLockFreeQueueStress(t *testing.T) {
+	numTasks := 200000
+	if testing.Short() {
+		numTasks = 20000
+	}
+	duplicates, lost, outOfOrder := QueueStressTest(numTasks, 4, 8)
+	if duplicates > 0 || lost > 0 || outOfOrder > 0 {
+		t.Errorf("%d tasks: %d dequeued more than once, %d lost, %d out of order", numTasks, duplicates, lost, outOfOrder)
+	}
+}